@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +44,49 @@ type Clients struct {
 	Daisy         daisyCompute.Client
 	OSConfig      osconfigInterface
 	OSConfigZonal osconfigZonalInterface
+	// Compute is used for the calls which the daisy client doesn't support,
+	// such as clearing the deletion protection of instances. It may be nil.
+	Compute *compute.Service
+	// MaxConcurrency limits the number of concurrent delete calls made by each
+	// CleanX function. Zero means no limit.
+	MaxConcurrency int
+	// ListFilter, if set, filters the instances and disks listed by
+	// CleanInstances and CleanDisks on the server side, e.g.
+	// "labels.test-run-id=abcde". The policy still applies to the listed
+	// resources.
+	ListFilter string
+}
+
+// listOptions returns the options of the aggregated list calls for instances
+// and disks.
+func (c Clients) listOptions() []daisyCompute.ListCallOption {
+	if c.ListFilter == "" {
+		return nil
+	}
+	return []daisyCompute.ListCallOption{daisyCompute.Filter(c.ListFilter)}
+}
+
+// semaphore bounds the number of goroutines deleting resources at once. A nil
+// semaphore doesn't block.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
 }
 
 type osconfigInterface interface {
@@ -63,6 +107,10 @@ func NewClients(ctx context.Context, opts ...option.ClientOption) (*Clients, err
 	if err != nil {
 		return nil, err
 	}
+	c.Compute, err = compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
 	c.OSConfig, err = osconfig.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
@@ -125,7 +173,9 @@ func AgePolicy(t time.Time) PolicyFunc {
 		case *compute.Instance:
 			name = r.Name
 			desc = r.Description
-			if r.DeletionProtection {
+			// Instances protected by their owner are kept, but not test
+			// VMs which daisy created with deletion protection.
+			if r.DeletionProtection && !strings.Contains(r.Description, daisyDescription) {
 				return false
 			}
 			labels = r.Labels
@@ -148,7 +198,8 @@ func AgePolicy(t time.Time) PolicyFunc {
 // workflow. Note that daisy does have its own resource deletion hooks, this is
 // used in edge cases where workflow deletion hooks are unreliable. Also
 // contains safeguards such as refusing to delete default networks or resources
-// with a "do-not-delete" label.
+// with a "do-not-delete" label. Instances of the workflow with deletion
+// protection match, CleanInstances clears the protection before deleting them.
 func WorkflowPolicy(id string) PolicyFunc {
 	return func(resource any) bool {
 		var name, desc string
@@ -169,6 +220,36 @@ func WorkflowPolicy(id string) PolicyFunc {
 		case *compute.MachineImage:
 			name = r.Name
 			desc = r.Description
+		case *compute.Firewall:
+			name = r.Name
+			desc = r.Description
+		case *compute.HealthCheck:
+			name = r.Name
+			desc = r.Description
+		case *compute.ResourcePolicy:
+			name = r.Name
+			desc = r.Description
+		case *compute.InstanceGroupManager:
+			name = r.Name
+			desc = r.Description
+		case *compute.InstanceTemplate:
+			name = r.Name
+			desc = r.Description
+		case *compute.Address:
+			name = r.Name
+			desc = r.Description
+			labels = r.Labels
+		case *compute.Router:
+			name = r.Name
+			desc = r.Description
+		case *compute.Route:
+			// Daisy doesn't create routes, so routes created by guest tests
+			// may only be named after the workflow in their description.
+			if strings.Contains(r.Description, fmt.Sprintf("%s %q", daisyDescription, id)) {
+				return !strings.Contains(r.Description, keepLabel)
+			}
+			name = r.Name
+			desc = r.Description
 		case *compute.Disk:
 			desc = r.Description
 			labels = r.Labels
@@ -183,9 +264,6 @@ func WorkflowPolicy(id string) PolicyFunc {
 			name = r.Name
 		case *compute.Instance:
 			desc = r.Description
-			if r.DeletionProtection {
-				return false
-			}
 			labels = r.Labels
 			name = r.Name
 		default:
@@ -198,11 +276,65 @@ func WorkflowPolicy(id string) PolicyFunc {
 	}
 }
 
+// daisyDescription is part of the description daisy gives the resources it
+// creates, unless the workflow sets one.
+const daisyDescription = "created by Daisy in workflow"
+
+// DaisyOrphanPolicy takes a time.Time and returns a PolicyFunc which indicates
+// to delete anything created by any daisy workflow before the given time. It
+// has the same safeguards as AgePolicy.
+func DaisyOrphanPolicy(t time.Time) PolicyFunc {
+	olderThan := AgePolicy(t)
+	return func(resource any) bool {
+		var desc string
+		switch r := resource.(type) {
+		case *compute.Instance:
+			desc = r.Description
+		case *compute.Disk:
+			desc = r.Description
+		case *compute.Network:
+			desc = r.Description
+		case *compute.Snapshot:
+			desc = r.Description
+		case *compute.Image:
+			desc = r.Description
+		case *compute.MachineImage:
+			desc = r.Description
+		default:
+			return false
+		}
+		return strings.Contains(desc, daisyDescription) && olderThan(resource)
+	}
+}
+
+// OrphanReport lists the resources deleted by CleanOrphanedResources, and the
+// errors encountered.
+type OrphanReport struct {
+	Deleted []string
+	Errs    []error
+}
+
+// CleanOrphanedResources deletes the instances, disks and networks created by
+// any daisy workflow longer than olderThan ago, such as those leaked by test
+// runs which were killed before they could clean up. Instances are deleted
+// before disks, and disks before networks. On dry run, the report lists what
+// would have been deleted.
+func CleanOrphanedResources(clients Clients, project string, olderThan time.Duration, dryRun bool) OrphanReport {
+	policy := DaisyOrphanPolicy(time.Now().Add(-olderThan))
+	var report OrphanReport
+	for _, clean := range []func(Clients, string, PolicyFunc, bool) ([]string, []error){CleanInstances, CleanDisks, CleanNetworks} {
+		deleted, errs := clean(clients, project, policy, dryRun)
+		report.Deleted = append(report.Deleted, deleted...)
+		report.Errs = append(report.Errs, errs...)
+	}
+	return report
+}
+
 // CleanInstances deletes all instances indicated, returning a slice of deleted
 // instance partial URLs and a slice of errors encountered. On dry run, returns
 // what would have been deleted.
 func CleanInstances(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
-	instances, err := clients.Daisy.AggregatedListInstances(project)
+	instances, err := clients.Daisy.AggregatedListInstances(project, clients.listOptions()...)
 	if err != nil {
 		return nil, []error{fmt.Errorf("error listing instance in project %q: %v", project, err)}
 	}
@@ -212,6 +344,7 @@ func CleanInstances(clients Clients, project string, delete PolicyFunc, dryRun b
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, i := range instances {
 		if !delete(i) {
 			continue
@@ -220,10 +353,21 @@ func CleanInstances(clients Clients, project string, delete PolicyFunc, dryRun b
 		zone := path.Base(i.Zone)
 		name := path.Base(i.SelfLink)
 		partial := fmt.Sprintf("projects/%s/zones/%s/instances/%s", project, zone, name)
+		protected := i.DeletionProtection
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
+				if protected {
+					if err := clearDeletionProtection(clients.Compute, project, zone, name); err != nil {
+						errsMu.Lock()
+						defer errsMu.Unlock()
+						errs = append(errs, err)
+						return
+					}
+				}
 				if err := clients.Daisy.DeleteInstance(project, zone, name); err != nil {
 					errsMu.Lock()
 					defer errsMu.Unlock()
@@ -237,14 +381,37 @@ func CleanInstances(clients Clients, project string, delete PolicyFunc, dryRun b
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
+// clearDeletionProtection turns off the deletion protection of an instance, so
+// that it can be deleted.
+func clearDeletionProtection(svc *compute.Service, project, zone, name string) error {
+	if svc == nil {
+		return fmt.Errorf("instance %s has deletion protection, which can't be cleared without a compute client", name)
+	}
+	op, err := svc.Instances.SetDeletionProtection(project, zone, name).DeletionProtection(false).Do()
+	if err != nil {
+		return fmt.Errorf("failed to clear deletion protection of instance %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		op, err = svc.ZoneOperations.Wait(project, zone, op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("failed to wait for deletion protection of instance %s to be cleared: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to clear deletion protection of instance %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
 // CleanDisks deletes all disks indicated, returning a slice of deleted partial
 // urls and a slice of encountered errors. On dry run, returns what would have
 // been deleted.
 func CleanDisks(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
-	disks, err := clients.Daisy.AggregatedListDisks(project)
+	disks, err := clients.Daisy.AggregatedListDisks(project, clients.listOptions()...)
 	if err != nil {
 		return nil, []error{fmt.Errorf("error listing disks in project %q: %v", project, err)}
 	}
@@ -254,6 +421,7 @@ func CleanDisks(clients Clients, project string, delete PolicyFunc, dryRun bool)
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, d := range disks {
 		if !delete(d) {
 			continue
@@ -265,6 +433,8 @@ func CleanDisks(clients Clients, project string, delete PolicyFunc, dryRun bool)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.Daisy.DeleteDisk(project, zone, name); err != nil {
 					errsMu.Lock()
@@ -279,6 +449,7 @@ func CleanDisks(clients Clients, project string, delete PolicyFunc, dryRun bool)
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -296,6 +467,7 @@ func CleanImages(clients Clients, project string, delete PolicyFunc, dryRun bool
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, d := range images {
 		if !delete(d) {
 			continue
@@ -306,6 +478,8 @@ func CleanImages(clients Clients, project string, delete PolicyFunc, dryRun bool
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.Daisy.DeleteImage(project, name); err != nil {
 					errsMu.Lock()
@@ -320,6 +494,7 @@ func CleanImages(clients Clients, project string, delete PolicyFunc, dryRun bool
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -337,6 +512,7 @@ func CleanMachineImages(clients Clients, project string, delete PolicyFunc, dryR
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, d := range images {
 		if !delete(d) {
 			continue
@@ -347,6 +523,8 @@ func CleanMachineImages(clients Clients, project string, delete PolicyFunc, dryR
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.Daisy.DeleteMachineImage(project, name); err != nil {
 					errsMu.Lock()
@@ -361,6 +539,7 @@ func CleanMachineImages(clients Clients, project string, delete PolicyFunc, dryR
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -378,6 +557,7 @@ func CleanSnapshots(clients Clients, project string, delete PolicyFunc, dryRun b
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, d := range images {
 		if !delete(d) {
 			continue
@@ -388,6 +568,8 @@ func CleanSnapshots(clients Clients, project string, delete PolicyFunc, dryRun b
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.Daisy.DeleteSnapshot(project, name); err != nil {
 					errsMu.Lock()
@@ -402,14 +584,586 @@ func CleanSnapshots(clients Clients, project string, delete PolicyFunc, dryRun b
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// CleanFirewallRules deletes all firewall rules indicated, whichever network
+// they are part of, returning a slice of deleted partial urls and a slice of
+// encountered errors. On dry run, returns what would have been deleted.
+func CleanFirewallRules(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	firewalls, err := clients.Daisy.ListFirewallRules(project)
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing firewalls in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, f := range firewalls {
+		if !delete(f) {
+			continue
+		}
+
+		name := path.Base(f.SelfLink)
+		partial := fmt.Sprintf("projects/%s/global/firewalls/%s", project, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := clients.Daisy.DeleteFirewallRule(project, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// CleanResourcePolicies deletes all resource policies indicated, such as
+// snapshot schedules, returning a slice of deleted partial urls and a slice of
+// encountered errors. The daisy client doesn't support resource policies, so
+// the compute client must be set. On dry run, returns what would have been
+// deleted.
+func CleanResourcePolicies(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing resource policies in project %q: no compute client", project)}
+	}
+	var policies []*compute.ResourcePolicy
+	err := clients.Compute.ResourcePolicies.AggregatedList(project).Pages(context.Background(), func(l *compute.ResourcePolicyAggregatedList) error {
+		for _, scoped := range l.Items {
+			policies = append(policies, scoped.ResourcePolicies...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing resource policies in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, p := range policies {
+		if !delete(p) {
+			continue
+		}
+
+		region := path.Base(p.Region)
+		name := p.Name
+		partial := fmt.Sprintf("projects/%s/regions/%s/resourcePolicies/%s", project, region, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteResourcePolicy(clients.Compute, project, region, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// deleteResourcePolicy deletes a resource policy and waits for it to be gone.
+func deleteResourcePolicy(svc *compute.Service, project, region, name string) error {
+	op, err := svc.ResourcePolicies.Delete(project, region, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to delete resource policy %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		op, err = svc.RegionOperations.Wait(project, region, op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("failed to wait for resource policy %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete resource policy %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// CleanInstanceGroupManagers deletes all zonal and regional managed instance
+// groups indicated, along with their instances, returning a slice of deleted
+// partial urls and a slice of encountered errors. The daisy client doesn't
+// support instance groups, so the compute client must be set. On dry run,
+// returns what would have been deleted.
+func CleanInstanceGroupManagers(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing instance group managers in project %q: no compute client", project)}
+	}
+	var groups []*compute.InstanceGroupManager
+	err := clients.Compute.InstanceGroupManagers.AggregatedList(project).Pages(context.Background(), func(l *compute.InstanceGroupManagerAggregatedList) error {
+		for _, scoped := range l.Items {
+			groups = append(groups, scoped.InstanceGroupManagers...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing instance group managers in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, g := range groups {
+		if !delete(g) {
+			continue
+		}
+
+		var zone, region string
+		name := g.Name
+		partial := fmt.Sprintf("projects/%s/regions/%s/instanceGroupManagers/%s", project, path.Base(g.Region), name)
+		if g.Zone != "" {
+			zone = path.Base(g.Zone)
+			partial = fmt.Sprintf("projects/%s/zones/%s/instanceGroupManagers/%s", project, zone, name)
+		} else {
+			region = path.Base(g.Region)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteInstanceGroupManager(clients.Compute, project, zone, region, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
+// deleteInstanceGroupManager deletes a zonal managed instance group, or a
+// regional one if zone is empty, and waits for it to be gone. The operation is
+// only done once the instances of the group are deleted.
+func deleteInstanceGroupManager(svc *compute.Service, project, zone, region, name string) error {
+	var op *compute.Operation
+	var err error
+	if zone != "" {
+		op, err = svc.InstanceGroupManagers.Delete(project, zone, name).Do()
+	} else {
+		op, err = svc.RegionInstanceGroupManagers.Delete(project, region, name).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete instance group manager %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		if zone != "" {
+			op, err = svc.ZoneOperations.Wait(project, zone, op.Name).Do()
+		} else {
+			op, err = svc.RegionOperations.Wait(project, region, op.Name).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to wait for instance group manager %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete instance group manager %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// CleanInstanceTemplates deletes all global and regional instance templates
+// indicated, returning a slice of deleted partial urls and a slice of
+// encountered errors. Templates can't be deleted while a managed instance
+// group uses them, so those are cleaned first. The daisy client doesn't
+// support instance templates, so the compute client must be set. On dry run,
+// returns what would have been deleted.
+func CleanInstanceTemplates(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing instance templates in project %q: no compute client", project)}
+	}
+	var templates []*compute.InstanceTemplate
+	err := clients.Compute.InstanceTemplates.AggregatedList(project).Pages(context.Background(), func(l *compute.InstanceTemplateAggregatedList) error {
+		for _, scoped := range l.Items {
+			templates = append(templates, scoped.InstanceTemplates...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing instance templates in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, it := range templates {
+		if !delete(it) {
+			continue
+		}
+
+		var region string
+		name := it.Name
+		partial := fmt.Sprintf("projects/%s/global/instanceTemplates/%s", project, name)
+		if it.Region != "" {
+			region = path.Base(it.Region)
+			partial = fmt.Sprintf("projects/%s/regions/%s/instanceTemplates/%s", project, region, name)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteInstanceTemplate(clients.Compute, project, region, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// deleteInstanceTemplate deletes a regional instance template, or a global one
+// if region is empty, and waits for it to be gone.
+func deleteInstanceTemplate(svc *compute.Service, project, region, name string) error {
+	var op *compute.Operation
+	var err error
+	if region != "" {
+		op, err = svc.RegionInstanceTemplates.Delete(project, region, name).Do()
+	} else {
+		op, err = svc.InstanceTemplates.Delete(project, name).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete instance template %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		if region != "" {
+			op, err = svc.RegionOperations.Wait(project, region, op.Name).Do()
+		} else {
+			op, err = svc.GlobalOperations.Wait(project, op.Name).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to wait for instance template %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete instance template %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// CleanAddresses deletes all regional and global static addresses indicated,
+// external or internal, returning a slice of deleted partial urls and a slice
+// of encountered errors. Addresses can't be deleted while instances use them,
+// so those are cleaned first. The daisy client doesn't support addresses, so
+// the compute client must be set. On dry run, returns what would have been
+// deleted.
+func CleanAddresses(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing addresses in project %q: no compute client", project)}
+	}
+	var addresses []*compute.Address
+	err := clients.Compute.Addresses.AggregatedList(project).Pages(context.Background(), func(l *compute.AddressAggregatedList) error {
+		for _, scoped := range l.Items {
+			addresses = append(addresses, scoped.Addresses...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing addresses in project %q: %v", project, err)}
+	}
+	// The aggregated list only has regional addresses.
+	err = clients.Compute.GlobalAddresses.List(project).Pages(context.Background(), func(l *compute.AddressList) error {
+		addresses = append(addresses, l.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing global addresses in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, a := range addresses {
+		if !delete(a) {
+			continue
+		}
+
+		var region string
+		name := a.Name
+		partial := fmt.Sprintf("projects/%s/global/addresses/%s", project, name)
+		if a.Region != "" {
+			region = path.Base(a.Region)
+			partial = fmt.Sprintf("projects/%s/regions/%s/addresses/%s", project, region, name)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteAddress(clients.Compute, project, region, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// deleteAddress deletes a regional static address, or a global one if region
+// is empty, and waits for it to be gone.
+func deleteAddress(svc *compute.Service, project, region, name string) error {
+	var op *compute.Operation
+	var err error
+	if region != "" {
+		op, err = svc.Addresses.Delete(project, region, name).Do()
+	} else {
+		op, err = svc.GlobalAddresses.Delete(project, name).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete address %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		if region != "" {
+			op, err = svc.RegionOperations.Wait(project, region, op.Name).Do()
+		} else {
+			op, err = svc.GlobalOperations.Wait(project, op.Name).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to wait for address %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete address %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// CleanRouters deletes all cloud routers indicated, along with their Cloud NAT
+// configuration, returning a slice of deleted partial urls and a slice of
+// encountered errors. Networks can't be deleted while routers use them, so
+// routers are cleaned first. The daisy client doesn't support routers, so the
+// compute client must be set. On dry run, returns what would have been
+// deleted.
+func CleanRouters(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing routers in project %q: no compute client", project)}
+	}
+	var routers []*compute.Router
+	err := clients.Compute.Routers.AggregatedList(project).Pages(context.Background(), func(l *compute.RouterAggregatedList) error {
+		for _, scoped := range l.Items {
+			routers = append(routers, scoped.Routers...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing routers in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, r := range routers {
+		if !delete(r) {
+			continue
+		}
+
+		region := path.Base(r.Region)
+		name := r.Name
+		partial := fmt.Sprintf("projects/%s/regions/%s/routers/%s", project, region, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteRouter(clients.Compute, project, region, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// deleteRouter deletes a router and waits for it to be gone.
+func deleteRouter(svc *compute.Service, project, region, name string) error {
+	op, err := svc.Routers.Delete(project, region, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to delete router %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		op, err = svc.RegionOperations.Wait(project, region, op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("failed to wait for router %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete router %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// CleanRoutes deletes all custom routes indicated, and the custom routes of the
+// networks indicated, such as routes to VMs which forward IP packets, returning
+// a slice of deleted partial urls and a slice of encountered errors. Networks
+// can't be deleted while routes use them, so routes are cleaned first. The
+// daisy client doesn't support routes, so the compute client must be set. On
+// dry run, returns what would have been deleted.
+func CleanRoutes(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
+	if clients.Compute == nil {
+		return nil, []error{fmt.Errorf("error listing routes in project %q: no compute client", project)}
+	}
+	var routes []*compute.Route
+	err := clients.Compute.Routes.List(project).Pages(context.Background(), func(l *compute.RouteList) error {
+		routes = append(routes, l.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing routes in project %q: %v", project, err)}
+	}
+	deletedNetworks := make(map[string]bool)
+	err = clients.Compute.Networks.List(project).Pages(context.Background(), func(l *compute.NetworkList) error {
+		for _, n := range l.Items {
+			if delete(n) {
+				deletedNetworks[n.SelfLink] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, []error{fmt.Errorf("error listing networks in project %q: %v", project, err)}
+	}
+
+	var deletedMu sync.Mutex
+	var deleted []string
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
+	for _, r := range routes {
+		// Subnet and peering routes can't be deleted, they are removed along
+		// with their network.
+		if r.NextHopNetwork != "" || r.NextHopPeering != "" {
+			continue
+		}
+		if !delete(r) && !deletedNetworks[r.Network] {
+			continue
+		}
+
+		name := r.Name
+		partial := fmt.Sprintf("projects/%s/global/routes/%s", project, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			if !dryRun {
+				if err := deleteRoute(clients.Compute, project, name); err != nil {
+					errsMu.Lock()
+					defer errsMu.Unlock()
+					errs = append(errs, err)
+					return
+				}
+			}
+			deletedMu.Lock()
+			defer deletedMu.Unlock()
+			deleted = append(deleted, partial)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
+// deleteRoute deletes a route and waits for it to be gone.
+func deleteRoute(svc *compute.Service, project, name string) error {
+	op, err := svc.Routes.Delete(project, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to delete route %s: %v", name, err)
+	}
+	for op.Status != "DONE" {
+		op, err = svc.GlobalOperations.Wait(project, op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("failed to wait for route %s to be deleted: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to delete route %s: %s", name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
 // CleanRegionalBackendServices deletes load balancer backend services in the
 // given region indicated by the policy.
 
-// CleanNetworks deletes all networks indicated, as well as all subnetworks and
-// firewall rules that are part of the network indicated for deleted. Returns a
+// CleanNetworks deletes all networks indicated, as well as all subnetworks,
+// firewall rules, forwarding rules and backend services that are part of the
+// network indicated for deleted, and the regional health checks indicated in
+// the regions of its subnetworks. Returns a
 // slice of deleted partial urls and a slice of encountered errors. On dry run,
 // returns what would have been deleted.
 func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bool) ([]string, []error) {
@@ -430,12 +1184,14 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 
 	regionalForwardingRules := make(map[string][]*compute.ForwardingRule)
 	regionalBackendServices := make(map[string][]*compute.BackendService)
+	healthChecksCleaned := make(map[string]bool)
 
 	var deletedMu sync.Mutex
 	var deleted []string
 	var errsMu sync.Mutex
 	var errs []error
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	for _, n := range networks {
 		if !delete(n) {
 			continue
@@ -452,6 +1208,8 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
+				sem.acquire()
+				defer sem.release()
 				if !dryRun {
 					if err := clients.Daisy.DeleteFirewallRule(project, name); err != nil {
 						errsMu.Lock()
@@ -503,6 +1261,8 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 				wg.Add(1)
 				go func(frName string) {
 					defer wg.Done()
+					sem.acquire()
+					defer sem.release()
 					if !dryRun {
 						if err := clients.Daisy.DeleteForwardingRule(project, region, frName); err != nil {
 							errsMu.Lock()
@@ -538,6 +1298,8 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 				wg.Add(1)
 				go func(bsName string) {
 					defer wg.Done()
+					sem.acquire()
+					defer sem.release()
 					if !dryRun {
 						if err := clients.Daisy.DeleteRegionBackendService(project, region, bsName); err != nil {
 							errsMu.Lock()
@@ -554,9 +1316,47 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 
 			subnetpartial := fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", project, region, sn.Name)
 			wg.Wait()
+
+			// Health checks are not part of a network, they are deleted once
+			// the backend services in the region which may use them are.
+			if !healthChecksCleaned[region] {
+				healthChecksCleaned[region] = true
+				regionHCs, err := clients.Daisy.ListRegionHealthChecks(project, region)
+				if err != nil {
+					errsMu.Lock()
+					errs = append(errs, err)
+					errsMu.Unlock()
+				}
+				for _, hc := range regionHCs {
+					if !delete(hc) {
+						continue
+					}
+					hcpartial := fmt.Sprintf("projects/%s/regions/%s/healthChecks/%s", project, region, hc.Name)
+					wg.Add(1)
+					go func(hcName string) {
+						defer wg.Done()
+						sem.acquire()
+						defer sem.release()
+						if !dryRun {
+							if err := clients.Daisy.DeleteRegionHealthCheck(project, region, hcName); err != nil {
+								errsMu.Lock()
+								defer errsMu.Unlock()
+								errs = append(errs, err)
+								return
+							}
+						}
+						deletedMu.Lock()
+						defer deletedMu.Unlock()
+						deleted = append(deleted, hcpartial)
+					}(hc.Name)
+				}
+				wg.Wait()
+			}
 			wg.Add(1)
 			go func(snName string) {
 				defer wg.Done()
+				sem.acquire()
+				defer sem.release()
 				if !dryRun {
 					if err := clients.Daisy.DeleteSubnetwork(project, region, snName); err != nil {
 						errsMu.Lock()
@@ -574,6 +1374,8 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.Daisy.DeleteNetwork(project, name); err != nil {
 					errsMu.Lock()
@@ -588,6 +1390,7 @@ func CleanNetworks(clients Clients, project string, delete PolicyFunc, dryRun bo
 		}()
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -604,6 +1407,7 @@ func CleanGuestPolicies(ctx context.Context, clients Clients, project string, de
 
 func deleteGuestPolicies(ctx context.Context, clients Clients, gpolicies []*osconfigpb.GuestPolicy, delete PolicyFunc, dryRun bool) ([]string, []error) {
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	var deletedMu sync.Mutex
 	var deleted []string
 	var errsMu sync.Mutex
@@ -616,6 +1420,8 @@ func deleteGuestPolicies(ctx context.Context, clients Clients, gpolicies []*osco
 		wg.Add(1)
 		go func(gp *osconfigpb.GuestPolicy) {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				if err := clients.OSConfig.DeleteGuestPolicy(ctx, &osconfigpb.DeleteGuestPolicyRequest{Name: gp.GetName()}); err != nil {
 					errsMu.Lock()
@@ -630,6 +1436,7 @@ func deleteGuestPolicies(ctx context.Context, clients Clients, gpolicies []*osco
 		}(gp)
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -672,6 +1479,7 @@ func getOSPolicies(ctx context.Context, clients Clients, project string) (ospoli
 
 func deleteOSPolicies(ctx context.Context, clients Clients, ospolicies []*osconfigv1alphapb.OSPolicyAssignment, delete PolicyFunc, dryRun bool) ([]string, []error) {
 	var wg sync.WaitGroup
+	sem := newSemaphore(clients.MaxConcurrency)
 	var deletedMu sync.Mutex
 	var deleted []string
 	var errsMu sync.Mutex
@@ -683,6 +1491,8 @@ func deleteOSPolicies(ctx context.Context, clients Clients, ospolicies []*osconf
 		wg.Add(1)
 		go func(osp *osconfigv1alphapb.OSPolicyAssignment) {
 			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
 			if !dryRun {
 				op, err := clients.OSConfigZonal.DeleteOSPolicyAssignment(ctx, &osconfigv1alphapb.DeleteOSPolicyAssignmentRequest{Name: osp.GetName()})
 				if err != nil {
@@ -699,6 +1509,7 @@ func deleteOSPolicies(ctx context.Context, clients Clients, ospolicies []*osconf
 		}(osp)
 	}
 	wg.Wait()
+	sort.Strings(deleted)
 	return deleted, errs
 }
 
@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"net/http"
 	"path"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,6 +32,7 @@ import (
 	computeDaisy "github.com/GoogleCloudPlatform/compute-daisy/compute"
 	"github.com/googleapis/gax-go/v2"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
 	osconfigv1alphapb "google.golang.org/genproto/googleapis/cloud/osconfig/v1alpha"
 	osconfigpb "google.golang.org/genproto/googleapis/cloud/osconfig/v1beta"
 )
@@ -116,6 +120,12 @@ func TestAgePolicy(t *testing.T) {
 			resource: &compute.Instance{CreationTimestamp: "1970-01-01T00:00:01+00:00", DeletionProtection: true},
 			output:   false,
 		},
+		{
+			name:     "Deletion protection enabled by daisy",
+			time:     time.Now(),
+			resource: &compute.Instance{CreationTimestamp: "1970-01-01T00:00:01+00:00", Description: "created by Daisy in workflow \"asdf\" on behalf of root", DeletionProtection: true},
+			output:   true,
+		},
 		{
 			name:     "Default network",
 			time:     time.Now(),
@@ -206,6 +216,18 @@ func TestWorkflowPolicy(t *testing.T) {
 			resource: &compute.Snapshot{Name: "snapshot-asdf", Description: "created by Daisy in workflow \"asdf\" on behalf of root"},
 			output:   true,
 		},
+		{
+			name:     "Workflow Firewall",
+			wfID:     "asdf",
+			resource: &compute.Firewall{Name: "firewall-asdf", Description: "created by Daisy in workflow \"asdf\" on behalf of root"},
+			output:   true,
+		},
+		{
+			name:     "Workflow Health Check",
+			wfID:     "asdf",
+			resource: &compute.HealthCheck{Name: "hc-asdf"},
+			output:   true,
+		},
 		{
 			name:     "Workflow Instance",
 			wfID:     "asdf",
@@ -222,7 +244,7 @@ func TestWorkflowPolicy(t *testing.T) {
 			name:     "Deletion protection enabled",
 			wfID:     "asdf",
 			resource: &compute.Instance{Name: "instance-asdf", Description: "created by Daisy in workflow \"asdf\" on behalf of root", DeletionProtection: true},
-			output:   false,
+			output:   true,
 		},
 		{
 			name:     "Keep label in description",
@@ -230,6 +252,18 @@ func TestWorkflowPolicy(t *testing.T) {
 			resource: &compute.Instance{Name: "network-asdf", Description: "created by Daisy in workflow \"asdf\" on behalf of root. do-not-delete"},
 			output:   false,
 		},
+		{
+			name:     "Route described with workflow",
+			wfID:     "asdf",
+			resource: &compute.Route{Name: "route", Description: "created by Daisy in workflow \"asdf\" on behalf of root"},
+			output:   true,
+		},
+		{
+			name:     "Route described with other workflow",
+			wfID:     "asdf",
+			resource: &compute.Route{Name: "route", Description: "created by Daisy in workflow \"asdfg\" on behalf of root"},
+			output:   false,
+		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -244,8 +278,9 @@ func TestWorkflowPolicy(t *testing.T) {
 func TestCleanInstances(t *testing.T) {
 	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/aggregated/instances?alt=json&pageToken=&prettyPrint=false", "test-project") {
-			fmt.Fprint(w, `{"Items":{"Instances":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/test-instance", "Zone":"test-zone"}]}}}`)
-		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/zones/test-zone/instances/test-instance?alt=json&prettyPrint=false", "test-project") {
+			// Instances terminated by preemption are still cleaned up.
+			fmt.Fprint(w, `{"Items":{"Instances":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/test-instance", "Zone":"test-zone"}, {"SelfLink": "projects/test-project/zones/test-zone/instances/test-preempted-instance", "Zone":"test-zone", "Status":"TERMINATED"}]}}}`)
+		} else if r.Method == "DELETE" && (r.URL.String() == fmt.Sprintf("/projects/%s/zones/test-zone/instances/test-instance?alt=json&prettyPrint=false", "test-project") || r.URL.String() == fmt.Sprintf("/projects/%s/zones/test-zone/instances/test-preempted-instance?alt=json&prettyPrint=false", "test-project")) {
 			w.WriteHeader(200)
 			w.Write([]byte(`{"status":"DONE"}`))
 		} else if r.Method == "POST" && r.URL.String() == fmt.Sprintf("/projects/%s/zones/test-zone/operations//wait?alt=json&prettyPrint=false", "test-project") {
@@ -272,7 +307,7 @@ func TestCleanInstances(t *testing.T) {
 			clients: Clients{Daisy: daisyFake},
 			project: "test-project",
 			policy:  deleteEverything,
-			output:  []string{"projects/test-project/zones/test-zone/instances/test-instance"},
+			output:  []string{"projects/test-project/zones/test-zone/instances/test-instance", "projects/test-project/zones/test-zone/instances/test-preempted-instance"},
 			dryRun:  true,
 		},
 		{
@@ -280,7 +315,7 @@ func TestCleanInstances(t *testing.T) {
 			clients: Clients{Daisy: daisyFake},
 			project: "test-project",
 			policy:  deleteEverything,
-			output:  []string{"projects/test-project/zones/test-zone/instances/test-instance"},
+			output:  []string{"projects/test-project/zones/test-zone/instances/test-instance", "projects/test-project/zones/test-zone/instances/test-preempted-instance"},
 			dryRun:  false,
 		},
 		{
@@ -588,6 +623,65 @@ func TestCleanSnapshots(t *testing.T) {
 	}
 }
 
+func TestCleanFirewallRules(t *testing.T) {
+	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/global/firewalls?alt=json&pageToken=&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/global/firewalls/test-firewall", "Network": "projects/test-project/global/networks/default"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/firewalls/test-firewall?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "POST" && r.URL.String() == fmt.Sprintf("/projects/%s/global/operations//wait?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else {
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		name    string
+		clients Clients
+		project string
+		policy  PolicyFunc
+		output  []string
+		dryRun  bool
+	}{
+		{
+			name:    "delete everything",
+			clients: Clients{Daisy: daisyFake},
+			project: "test-project",
+			policy:  deleteEverything,
+			output:  []string{"projects/test-project/global/firewalls/test-firewall"},
+		},
+		{
+			name:    "delete everything dry run",
+			clients: Clients{Daisy: daisyFake},
+			project: "test-project",
+			policy:  deleteEverything,
+			output:  []string{"projects/test-project/global/firewalls/test-firewall"},
+			dryRun:  true,
+		},
+		{
+			name:    "delete nothing",
+			clients: Clients{Daisy: daisyFake},
+			project: "test-project",
+			policy:  deleteNothing,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			o, errs := CleanFirewallRules(tc.clients, tc.project, tc.policy, tc.dryRun)
+			for _, e := range errs {
+				t.Errorf("error from CleanFirewallRules: %v", e)
+			}
+			if !slices.Equal(o, tc.output) {
+				t.Errorf("unexpected output from CleanFirewallRules, want %v but got %v", tc.output, o)
+			}
+		})
+	}
+}
+
 func TestCleanNetworks(t *testing.T) {
 	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/global/networks?alt=json&pageToken=&prettyPrint=false", "test-project") {
@@ -600,6 +694,10 @@ func TestCleanNetworks(t *testing.T) {
 			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/regions/testRegion/backendServices/test-backend-service", "Name": "test-backend-service", "Network": "projects/test-project/global/networks/test-network"}]}`)
 		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/backendServices/test-backend-service?alt=json&prettyPrint=false", "test-project") {
 			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/%s/healthChecks?alt=json&pageToken=&prettyPrint=false", "test-project", "test-region") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/regions/test-region/healthChecks/test-health-check", "Name": "test-health-check"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/healthChecks/test-health-check?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
 		} else if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/aggregated/subnetworks?alt=json&pageToken=&prettyPrint=false", "test-project") {
 			fmt.Fprint(w, `{"items":{"regions/test-region":{"subnetworks":[{"Network": "projects/test-project/global/networks/fake-network"}, {"Network": "projects/test-project/global/networks/test-network","SelfLink": "projects/test-project/regions/test-region/subnetworks/test-subnetwork", "Name": "test-subnetwork", "Region": "test-region", "IpCidrRange": "10.1.0.0/48"}, {"Network": "projects/test-project/global/networks/test-network","SelfLink": "projects/test-project/regions/test-region/subnetworks/test-subnetwork-2", "Name": "test-subnetwork-2", "Region": "test-region", "IpCidrRange": "10.128.0.0/48"}]}}}`)
 		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/firewalls/test-firewall?alt=json&prettyPrint=false", "test-project") {
@@ -635,7 +733,7 @@ func TestCleanNetworks(t *testing.T) {
 			clients: Clients{Daisy: daisyFake},
 			project: "test-project",
 			policy:  deleteEverything,
-			output:  []string{"projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network", "projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/regions/test-region/subnetworks/test-subnetwork"},
+			output:  []string{"projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network", "projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/regions/test-region/healthChecks/test-health-check", "projects/test-project/regions/test-region/subnetworks/test-subnetwork"},
 			dryRun:  true,
 		},
 		{
@@ -643,7 +741,7 @@ func TestCleanNetworks(t *testing.T) {
 			clients: Clients{Daisy: daisyFake},
 			project: "test-project",
 			policy:  deleteEverything,
-			output:  []string{"projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network", "projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/regions/test-region/subnetworks/test-subnetwork"},
+			output:  []string{"projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network", "projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/regions/test-region/healthChecks/test-health-check", "projects/test-project/regions/test-region/subnetworks/test-subnetwork"},
 		},
 		{
 			name:    "delete nothing",
@@ -803,3 +901,521 @@ func TestDeleteOSPolicies(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanDisksMaxConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxRunning int
+	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/disks?alt=json&pageToken=&prettyPrint=false" {
+			var disks []string
+			for i := 5; i >= 0; i-- {
+				disks = append(disks, fmt.Sprintf(`{"SelfLink": "projects/test-project/zones/test-zone/disks/test-disk-%d", "Zone":"test-zone"}`, i))
+			}
+			fmt.Fprintf(w, `{"Items":{"Disks":{"disks":[%s]}}}`, strings.Join(disks, ","))
+		} else if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/zones/test-zone/disks/") {
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			w.Write([]byte(`{"status":"DONE"}`))
+		} else if r.Method == "POST" && r.URL.String() == "/projects/test-project/zones/test-zone/operations//wait?alt=json&prettyPrint=false" {
+			w.Write([]byte(`{"status":"DONE"}`))
+		} else {
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, errs := CleanDisks(Clients{Daisy: daisyFake, MaxConcurrency: 2}, "test-project", deleteEverything, false)
+	for _, e := range errs {
+		t.Errorf("error from CleanDisks: %v", e)
+	}
+	if maxRunning > 2 {
+		t.Errorf("CleanDisks made %d concurrent delete calls, want at most 2", maxRunning)
+	}
+	if len(o) != 6 || !sort.StringsAreSorted(o) {
+		t.Errorf("CleanDisks returned %v, want the 6 disks sorted", o)
+	}
+}
+
+func TestDaisyOrphanPolicy(t *testing.T) {
+	old := "1970-01-01T00:00:01+00:00"
+	recent := time.Now().Format(time.RFC3339)
+	daisyDesc := `Instance created by Daisy in workflow "image-test" on behalf of user.`
+	testcases := []struct {
+		name     string
+		resource any
+		output   bool
+	}{
+		{
+			name:     "Old daisy instance",
+			resource: &compute.Instance{Description: daisyDesc, CreationTimestamp: old},
+			output:   true,
+		},
+		{
+			name:     "Recent daisy instance",
+			resource: &compute.Instance{Description: daisyDesc, CreationTimestamp: recent},
+			output:   false,
+		},
+		{
+			name:     "Old instance not created by daisy",
+			resource: &compute.Instance{Description: "my instance", CreationTimestamp: old},
+			output:   false,
+		},
+		{
+			name:     "Old daisy instance with do-not-delete label",
+			resource: &compute.Instance{Description: daisyDesc, CreationTimestamp: old, Labels: map[string]string{keepLabel: ""}},
+			output:   false,
+		},
+		{
+			name:     "Old daisy disk",
+			resource: &compute.Disk{Description: `Disk created by Daisy in workflow "image-test" on behalf of user.`, CreationTimestamp: old},
+			output:   true,
+		},
+		{
+			name:     "Old daisy network",
+			resource: &compute.Network{Description: `Network created by Daisy in workflow "image-test" on behalf of user.`, CreationTimestamp: old},
+			output:   true,
+		},
+		{
+			name:     "Old guest policy",
+			resource: &osconfigpb.GuestPolicy{Description: daisyDesc},
+			output:   false,
+		},
+	}
+	policy := DaisyOrphanPolicy(time.Now().Add(-time.Hour))
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy(tc.resource); got != tc.output {
+				t.Errorf("DaisyOrphanPolicy() = %v, want %v", got, tc.output)
+			}
+		})
+	}
+}
+
+func TestCleanOrphanedResources(t *testing.T) {
+	old := "1970-01-01T00:00:01+00:00"
+	var deleteCalls []string
+	var mu sync.Mutex
+	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/instances?alt=json&pageToken=&prettyPrint=false":
+			fmt.Fprintf(w, `{"Items":{"Instances":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/leaked", "Zone":"test-zone", "Description": "Instance created by Daisy in workflow \"test\" on behalf of user.", "CreationTimestamp": %q}, {"SelfLink": "projects/test-project/zones/test-zone/instances/user-vm", "Zone":"test-zone", "CreationTimestamp": %q}]}}}`, old, old)
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/disks?alt=json&pageToken=&prettyPrint=false":
+			fmt.Fprintf(w, `{"Items":{"Disks":{"disks":[{"SelfLink": "projects/test-project/zones/test-zone/disks/leaked", "Zone":"test-zone", "Description": "Disk created by Daisy in workflow \"test\" on behalf of user.", "CreationTimestamp": %q}]}}}`, old)
+		case r.Method == "DELETE":
+			mu.Lock()
+			deleteCalls = append(deleteCalls, r.URL.Path)
+			mu.Unlock()
+			w.Write([]byte(`{"status":"DONE"}`))
+		case r.Method == "POST":
+			w.Write([]byte(`{"status":"DONE"}`))
+		case r.Method == "GET":
+			// Every other resource list is empty.
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"projects/test-project/zones/test-zone/instances/leaked", "projects/test-project/zones/test-zone/disks/leaked"}
+	for _, dryRun := range []bool{true, false} {
+		deleteCalls = nil
+		report := CleanOrphanedResources(Clients{Daisy: daisyFake}, "test-project", time.Hour, dryRun)
+		for _, e := range report.Errs {
+			t.Errorf("error from CleanOrphanedResources: %v", e)
+		}
+		if len(report.Deleted) != len(want) || report.Deleted[0] != want[0] || report.Deleted[1] != want[1] {
+			t.Errorf("CleanOrphanedResources(dryRun=%v) deleted %v, want %v", dryRun, report.Deleted, want)
+		}
+		if wantCalls := map[bool]int{true: 0, false: 2}[dryRun]; len(deleteCalls) != wantCalls {
+			t.Errorf("CleanOrphanedResources(dryRun=%v) made %d delete calls, want %d", dryRun, len(deleteCalls), wantCalls)
+		}
+	}
+}
+
+func TestCleanInstancesListFilter(t *testing.T) {
+	_, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/instances?alt=json&filter=labels.test-run-id%3Dabcde&pageToken=&prettyPrint=false":
+			fmt.Fprint(w, `{"Items":{"Instances":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/vm-abcde", "Zone":"test-zone", "Name": "vm-abcde"}]}}}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, errs := CleanInstances(Clients{Daisy: daisyFake, ListFilter: "labels.test-run-id=abcde"}, "test-project", WorkflowPolicy("abcde"), true)
+	for _, e := range errs {
+		t.Errorf("error from CleanInstances: %v", e)
+	}
+	if len(deleted) != 1 || deleted[0] != "projects/test-project/zones/test-zone/instances/vm-abcde" {
+		t.Errorf("CleanInstances() deleted %v, want vm-abcde", deleted)
+	}
+}
+
+func TestCleanInstancesDeletionProtection(t *testing.T) {
+	var mu sync.Mutex
+	var cleared, deleted bool
+	srv, daisyFake, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/instances?alt=json&pageToken=&prettyPrint=false":
+			fmt.Fprint(w, `{"Items":{"Instances":{"instances":[{"Name": "test-instance-abcde", "SelfLink": "projects/test-project/zones/test-zone/instances/test-instance-abcde", "Zone":"test-zone", "DeletionProtection": true}]}}}`)
+		case r.Method == "POST" && r.URL.String() == "/projects/test-project/zones/test-zone/instances/test-instance-abcde/setDeletionProtection?alt=json&deletionProtection=false&prettyPrint=false":
+			cleared = true
+			fmt.Fprint(w, `{"name":"op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.String() == "/projects/test-project/zones/test-zone/operations/op/wait?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"name":"op","status":"DONE"}`)
+		case r.Method == "DELETE" && r.URL.String() == "/projects/test-project/zones/test-zone/instances/test-instance-abcde?alt=json&prettyPrint=false":
+			if !cleared {
+				w.WriteHeader(400)
+				fmt.Fprintln(w, "instance has deletion protection")
+				return
+			}
+			deleted = true
+			fmt.Fprint(w, `{"status":"DONE"}`)
+		case r.Method == "POST" && r.URL.String() == "/projects/test-project/zones/test-zone/operations//wait?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if _, errs := CleanInstances(Clients{Daisy: daisyFake}, "test-project", deleteEverything, false); len(errs) != 1 {
+		t.Errorf("CleanInstances() without a compute client returned errors %v, want one error", errs)
+	}
+	if deleted {
+		t.Fatalf("CleanInstances() without a compute client deleted a protected instance")
+	}
+
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, errs := CleanInstances(Clients{Daisy: daisyFake, Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), false)
+	for _, e := range errs {
+		t.Errorf("error from CleanInstances: %v", e)
+	}
+	if !cleared || !deleted || len(out) != 1 {
+		t.Errorf("CleanInstances() cleared protection: %v, deleted: %v, returned %v, want the protected instance cleared and deleted", cleared, deleted, out)
+	}
+}
+
+func TestCleanResourcePolicies(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/aggregated/resourcePolicies":
+			fmt.Fprint(w, `{"items":{"regions/test-region":{"resourcePolicies":[{"name":"schedule-abcde","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"},{"name":"schedule","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"}]}}}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/regions/test-region/resourcePolicies/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/regions/test-region/operations/op/wait":
+			fmt.Fprint(w, `{"name":"op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanResourcePolicies(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanResourcePolicies() without a compute client returned errors %v, want one error", errs)
+	}
+	want := []string{"projects/test-project/regions/test-region/resourcePolicies/schedule-abcde"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanResourcePolicies(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanResourcePolicies: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanResourcePolicies(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	if !slices.Equal(deleted, []string{"schedule-abcde"}) {
+		t.Errorf("deleted resource policies %v, want schedule-abcde", deleted)
+	}
+}
+
+func TestCleanInstanceGroupManagers(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/aggregated/instanceGroupManagers":
+			fmt.Fprint(w, `{"items":{"zones/test-zone":{"instanceGroupManagers":[{"name":"mig-abcde","zone":"https://www.googleapis.com/compute/v1/projects/test-project/zones/test-zone"},{"name":"mig","zone":"https://www.googleapis.com/compute/v1/projects/test-project/zones/test-zone"}]},"regions/test-region":{"instanceGroupManagers":[{"name":"regional-mig-abcde","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"}]}}}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/zones/test-zone/instanceGroupManagers/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"zone-op","status":"RUNNING"}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/regions/test-region/instanceGroupManagers/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"region-op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/zones/test-zone/operations/zone-op/wait":
+			fmt.Fprint(w, `{"name":"zone-op","status":"DONE"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/regions/test-region/operations/region-op/wait":
+			fmt.Fprint(w, `{"name":"region-op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanInstanceGroupManagers(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanInstanceGroupManagers() without a compute client returned errors %v, want one error", errs)
+	}
+	want := []string{"projects/test-project/regions/test-region/instanceGroupManagers/regional-mig-abcde", "projects/test-project/zones/test-zone/instanceGroupManagers/mig-abcde"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanInstanceGroupManagers(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanInstanceGroupManagers: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanInstanceGroupManagers(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	sort.Strings(deleted)
+	if !slices.Equal(deleted, []string{"mig-abcde", "regional-mig-abcde"}) {
+		t.Errorf("deleted instance group managers %v, want mig-abcde and regional-mig-abcde", deleted)
+	}
+}
+
+func TestCleanInstanceTemplates(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/aggregated/instanceTemplates":
+			fmt.Fprint(w, `{"items":{"global":{"instanceTemplates":[{"name":"template-abcde"},{"name":"template"}]},"regions/test-region":{"instanceTemplates":[{"name":"regional-template-abcde","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"}]}}}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/global/instanceTemplates/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"global-op","status":"RUNNING"}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/regions/test-region/instanceTemplates/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"region-op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/global/operations/global-op/wait":
+			fmt.Fprint(w, `{"name":"global-op","status":"DONE"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/regions/test-region/operations/region-op/wait":
+			fmt.Fprint(w, `{"name":"region-op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanInstanceTemplates(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanInstanceTemplates() without a compute client returned errors %v, want one error", errs)
+	}
+	want := []string{"projects/test-project/global/instanceTemplates/template-abcde", "projects/test-project/regions/test-region/instanceTemplates/regional-template-abcde"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanInstanceTemplates(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanInstanceTemplates: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanInstanceTemplates(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	sort.Strings(deleted)
+	if !slices.Equal(deleted, []string{"regional-template-abcde", "template-abcde"}) {
+		t.Errorf("deleted instance templates %v, want template-abcde and regional-template-abcde", deleted)
+	}
+}
+
+func TestCleanAddresses(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/aggregated/addresses":
+			fmt.Fprint(w, `{"items":{"regions/test-region":{"addresses":[{"name":"external-abcde","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"},{"name":"address","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"}]}}}`)
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/global/addresses":
+			fmt.Fprint(w, `{"items":[{"name":"global-abcde"},{"name":"kept-abcde","labels":{"do-not-delete":"true"}}]}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/regions/test-region/addresses/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"region-op","status":"RUNNING"}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/global/addresses/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"global-op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/regions/test-region/operations/region-op/wait":
+			fmt.Fprint(w, `{"name":"region-op","status":"DONE"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/global/operations/global-op/wait":
+			fmt.Fprint(w, `{"name":"global-op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanAddresses(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanAddresses() without a compute client returned errors %v, want one error", errs)
+	}
+	want := []string{"projects/test-project/global/addresses/global-abcde", "projects/test-project/regions/test-region/addresses/external-abcde"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanAddresses(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanAddresses: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanAddresses(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	sort.Strings(deleted)
+	if !slices.Equal(deleted, []string{"external-abcde", "global-abcde"}) {
+		t.Errorf("deleted addresses %v, want external-abcde and global-abcde", deleted)
+	}
+}
+
+func TestCleanRouters(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/aggregated/routers":
+			fmt.Fprint(w, `{"items":{"regions/test-region":{"routers":[{"name":"nat-abcde","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"},{"name":"router","region":"https://www.googleapis.com/compute/v1/projects/test-project/regions/test-region"}]}}}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/regions/test-region/routers/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/regions/test-region/operations/op/wait":
+			fmt.Fprint(w, `{"name":"op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanRouters(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanRouters() without a compute client returned errors %v, want one error", errs)
+	}
+	want := []string{"projects/test-project/regions/test-region/routers/nat-abcde"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanRouters(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanRouters: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanRouters(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	if !slices.Equal(deleted, []string{"nat-abcde"}) {
+		t.Errorf("deleted routers %v, want nat-abcde", deleted)
+	}
+}
+
+func TestCleanRoutes(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv, _, err := computeDaisy.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/global/routes":
+			fmt.Fprint(w, `{"items":[{"name":"forward-abcde","description":"created by Daisy in workflow \"abcde\""},{"name":"default-route-1234"},{"name":"to-router","network":"https://www.googleapis.com/compute/v1/projects/test-project/global/networks/network-abcde"},{"name":"subnet-route","network":"https://www.googleapis.com/compute/v1/projects/test-project/global/networks/network-abcde","nextHopNetwork":"https://www.googleapis.com/compute/v1/projects/test-project/global/networks/network-abcde"},{"name":"described","description":"created by Daisy in workflow \"abcde\" on behalf of root"},{"name":"other-workflow","description":"created by Daisy in workflow \"fghij\""}]}`)
+		case r.Method == "GET" && r.URL.Path == "/projects/test-project/global/networks":
+			fmt.Fprint(w, `{"items":[{"name":"network-abcde","selfLink":"https://www.googleapis.com/compute/v1/projects/test-project/global/networks/network-abcde"},{"name":"default","selfLink":"https://www.googleapis.com/compute/v1/projects/test-project/global/networks/default"}]}`)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/projects/test-project/global/routes/"):
+			deleted = append(deleted, path.Base(r.URL.Path))
+			fmt.Fprint(w, `{"name":"op","status":"RUNNING"}`)
+		case r.Method == "POST" && r.URL.Path == "/projects/test-project/global/operations/op/wait":
+			fmt.Fprint(w, `{"name":"op","status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	computeFake, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := CleanRoutes(Clients{}, "test-project", deleteEverything, true); len(errs) != 1 {
+		t.Errorf("CleanRoutes() without a compute client returned errors %v, want one error", errs)
+	}
+	// Routes without the workflow ID suffix match by their network or their
+	// description.
+	want := []string{"projects/test-project/global/routes/described", "projects/test-project/global/routes/forward-abcde", "projects/test-project/global/routes/to-router"}
+	for _, dryRun := range []bool{true, false} {
+		out, errs := CleanRoutes(Clients{Compute: computeFake}, "test-project", WorkflowPolicy("abcde"), dryRun)
+		for _, e := range errs {
+			t.Errorf("error from CleanRoutes: %v", e)
+		}
+		if !slices.Equal(out, want) {
+			t.Errorf("CleanRoutes(dryRun: %v) = %v, want %v", dryRun, out, want)
+		}
+	}
+	sort.Strings(deleted)
+	if want := []string{"described", "forward-abcde", "to-router"}; !slices.Equal(deleted, want) {
+		t.Errorf("deleted routes %v, want %v", deleted, want)
+	}
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
@@ -32,8 +33,11 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/boottime"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/cvm"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/disk"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/dns"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/gpu"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/guestagent"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/hostnamevalidation"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/hotattach"
@@ -43,16 +47,21 @@ import (
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/loadbalancer"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/mdsmtls"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/metadata"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/modules"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/nestedvirt"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/network"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/networkperf"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/ntp"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/oslogin"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/packagevalidation"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/reposvalidation"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/security"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/shapevalidation"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/sql"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/ssh"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/storageperf"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/suspendresume"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/windowsactivation"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/windowscontainers"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/test_suites/winrm"
 	"github.com/GoogleCloudPlatform/compute-daisy/compute"
@@ -64,14 +73,17 @@ var (
 	project                 = flag.String("project", "", "project to use for test runner")
 	testProjects            = flag.String("test_projects", "", "comma separated list of projects to be used for tests. defaults to the test runner project")
 	zone                    = flag.String("zone", "us-central1-a", "zone to be used for tests")
+	fallbackZones           = flag.String("fallback_zones", "", "comma separated list of zones to run a test in, in order, when the zone is out of capacity for its VMs")
 	printwf                 = flag.Bool("print", false, "print out the parsed test workflows and exit")
 	validate                = flag.Bool("validate", false, "validate all the test workflows and exit")
 	outPath                 = flag.String("out_path", "junit.xml", "junit xml path")
+	jsonOutPath             = flag.String("json_out_path", "", "path to write a JSON summary of the results to, disabled if empty")
 	gcsPath                 = flag.String("gcs_path", "", "GCS Path for Daisy working directory")
 	writeLocalArtifacts     = flag.String("write_local_artifacts", "", "Local path to download test artifacts from gcs.")
 	localPath               = flag.String("local_path", "", "path where test output files are stored, can be modified for local testing")
 	images                  = flag.String("images", "", "comma separated list of images to test")
 	timeout                 = flag.String("timeout", "45m", "timeout for the test suite")
+	suiteTimeouts           = flag.String("suite_timeouts", "", "comma separated list of suite=timeout pairs overriding -timeout for the given suites, e.g. networkperf=20m,storageperf=2h")
 	computeEndpointOverride = flag.String("compute_endpoint_override", "", "compute client endpoint override")
 	parallelCount           = flag.Int("parallel_count", 5, "TestParallelCount")
 	parallelStagger         = flag.String("parallel_stagger", "60s", "parseable time.Duration to stagger each parallel test")
@@ -80,7 +92,12 @@ var (
 	machineType             = flag.String("machine_type", "", "deprecated, use -x86_shape and/or -arm64_shape instead")
 	x86Shape                = flag.String("x86_shape", "n1-standard-1", "default x86(-32 and -64) vm shape for tests not requiring a specific shape")
 	arm64Shape              = flag.String("arm64_shape", "t2a-standard-1", "default arm64 vm shape for tests not requiring a specific shape")
+	machineTypes            = flag.String("machine_types", "", "comma separated list of machine types to run each test suite on, in one workflow per machine type. Machine types not matching the architecture of an image are skipped. Overrides -x86_shape and -arm64_shape")
+	excludeFile             = flag.String("exclude_file", "", "path to a JSON list of {suite, test, image, reason} entries excluding tests from running on images matching the image glob. An entry without a test skips the whole suite")
 	setExitStatus           = flag.Bool("set_exit_status", true, "Exit with non-zero exit code if test suites are failing")
+	nodeGroup               = flag.String("node_group", "", "name of a pre-existing sole-tenant node group that tests requiring dedicated hardware can schedule VMs on")
+	cleanupDryRun           = flag.Bool("cleanup_dry_run", false, "only log the resources left behind by test workflows instead of deleting them")
+	resultsWebhook          = flag.String("results_webhook", "", "HTTP endpoint to post the json results of each test workflow to once it finishes")
 )
 
 var (
@@ -157,6 +174,24 @@ func main() {
 		*arm64Shape = *machineType
 	}
 
+	timeouts, err := imagetest.ParseSuiteTimeouts(*suiteTimeouts)
+	if err != nil {
+		log.Fatal("-suite_timeouts flag not valid:", err)
+	}
+	for suite, timeout := range timeouts {
+		log.Printf("using timeout %s for suite %s", timeout, suite)
+	}
+
+	var excludes []imagetest.ExcludeEntry
+	if *excludeFile != "" {
+		var err error
+		excludes, err = imagetest.LoadExcludeFile(*excludeFile)
+		if err != nil {
+			log.Fatal("-exclude_file flag not valid:", err)
+		}
+		log.Printf("using %d entries of -exclude_file %s", len(excludes), *excludeFile)
+	}
+
 	// Setup tests.
 	testPackages := []struct {
 		name      string
@@ -254,11 +289,42 @@ func main() {
 			windowscontainers.Name,
 			windowscontainers.TestSetup,
 		},
+		{
+			windowsactivation.Name,
+			windowsactivation.TestSetup,
+		},
+		{
+			modules.Name,
+			modules.TestSetup,
+		},
+		{
+			boottime.Name,
+			boottime.TestSetup,
+		},
+		{
+			reposvalidation.Name,
+			reposvalidation.TestSetup,
+		},
+		{
+			ntp.Name,
+			ntp.TestSetup,
+		},
+		{
+			dns.Name,
+			dns.TestSetup,
+		},
+		{
+			gpu.Name,
+			gpu.TestSetup,
+		},
+		{
+			nestedvirt.Name,
+			nestedvirt.TestSetup,
+		},
 	}
 
 	ctx := context.Background()
 	var computeclient compute.Client
-	var err error
 	if *computeEndpointOverride != "" {
 		log.Printf("Using compute endpoint %q", *computeEndpointOverride)
 		computeclient, err = compute.NewClient(ctx, option.WithEndpoint(*computeEndpointOverride))
@@ -277,6 +343,10 @@ func main() {
 		if excludeRegex != nil && excludeRegex.MatchString(testPackage.name) {
 			continue
 		}
+		suiteTimeout := *timeout
+		if t, ok := timeouts[testPackage.name]; ok {
+			suiteTimeout = t
+		}
 		for _, image := range strings.Split(*images, ",") {
 			if !strings.Contains(image, "/") {
 				// Find the project of the image.
@@ -311,14 +381,34 @@ func main() {
 				}
 			}
 
-			log.Printf("Add test workflow for test %s on image %s", testPackage.name, image)
-			test, err := imagetest.NewTestWorkflow(computeclient, *computeEndpointOverride, testPackage.name, image, *timeout, *project, *zone, *x86Shape, *arm64Shape)
-			if err != nil {
-				log.Fatalf("Failed to create test workflow: %v", err)
+			var tests []*imagetest.TestWorkflow
+			if *machineTypes != "" {
+				log.Printf("Add test workflows for test %s on image %s with machine types %s and timeout %s", testPackage.name, image, *machineTypes, suiteTimeout)
+				tests, err = imagetest.NewTestWorkflowMatrix(computeclient, *computeEndpointOverride, testPackage.name, image, suiteTimeout, *project, *zone, strings.Split(*machineTypes, ","), *nodeGroup)
+				if err != nil {
+					log.Fatalf("Failed to create test workflows: %v", err)
+				}
+			} else {
+				log.Printf("Add test workflow for test %s on image %s with timeout %s", testPackage.name, image, suiteTimeout)
+				test, err := imagetest.NewTestWorkflow(computeclient, *computeEndpointOverride, testPackage.name, image, suiteTimeout, *project, *zone, *x86Shape, *arm64Shape, *nodeGroup)
+				if err != nil {
+					log.Fatalf("Failed to create test workflow: %v", err)
+				}
+				tests = append(tests, test)
 			}
-			testWorkflows = append(testWorkflows, test)
-			if err := testPackage.setupFunc(test); err != nil {
-				log.Fatalf("%s.TestSetup for %s failed: %v", testPackage.name, image, err)
+			for _, test := range tests {
+				testWorkflows = append(testWorkflows, test)
+				test.SetCleanupDryRun(*cleanupDryRun)
+				test.ApplyExcludes(excludes)
+				if *resultsWebhook != "" {
+					test.SetResultsCallback(imagetest.ResultsWebhook(*resultsWebhook), 0)
+				}
+				if *fallbackZones != "" {
+					test.SetFallbackZones(strings.Split(*fallbackZones, ","), testPackage.setupFunc)
+				}
+				if err := testPackage.setupFunc(test); err != nil {
+					log.Fatalf("%s.TestSetup for %s on %s failed: %v", testPackage.name, image, test.MachineType.Name, err)
+				}
 			}
 		}
 	}
@@ -389,6 +479,16 @@ func main() {
 	outFile.Write([]byte{'\n'})
 	fmt.Printf("%s\n", bytes)
 
+	if *jsonOutPath != "" {
+		summary, err := json.MarshalIndent(imagetest.Summarize(testWorkflows), "", "\t")
+		if err != nil {
+			log.Fatalf("failed to marshal results summary: %v", err)
+		}
+		if err := os.WriteFile(*jsonOutPath, append(summary, '\n'), 0644); err != nil {
+			log.Fatalf("failed to write results summary: %v", err)
+		}
+	}
+
 	if *setExitStatus && (suites.Errors != 0 || suites.Failures != 0) {
 		log.Fatalf("test suite has error or failure")
 	}
@@ -26,7 +26,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -48,6 +50,25 @@ func checkFirstBootSpecialGA(ctx context.Context) bool {
 	return false
 }
 
+// countBoot increments the number of times the VM booted, which is kept in a
+// file next to the work directories, and returns it.
+func countBoot(workDirPath string) (int, error) {
+	countFile := filepath.Join(workDirPath, "cit_boot_count")
+	count := 0
+	if b, err := os.ReadFile(countFile); err == nil {
+		if count, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return 0, fmt.Errorf("malformed boot count in %s: %v", countFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	count++
+	if err := os.WriteFile(countFile, []byte(strconv.Itoa(count)), 0644); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func main() {
 	ctx := context.Background()
 
@@ -62,12 +83,35 @@ func main() {
 	ctx, cancel := context.WithTimeout(ctx, d)
 	defer cancel()
 
+	// VMs which measure their boot time get the time of this signal, so it is
+	// sent before anything else.
+	if _, err := utils.GetMetadata(ctx, "instance", "attributes", "_cit_signal_boot"); err == nil {
+		if err := utils.PutMetadata(ctx, path.Join("instance", "guest-attributes", utils.GuestAttributeTestNamespace, utils.BootedGAKey), ""); err != nil {
+			log.Printf("failed to signal boot: %v", err)
+		}
+	}
+
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		log.Fatalf("failed to create cloud storage client: %v", err)
 	}
 
 	log.Printf("FINISHED-BOOTING")
+
+	workDirPath := "/etc/"
+	if runtime.GOOS == "windows" {
+		workDirPath = "C:\\"
+	}
+
+	// VMs which verify their reboots publish how many times they booted.
+	if _, err := utils.GetMetadata(ctx, "instance", "attributes", "_cit_count_boots"); err == nil {
+		count, err := countBoot(workDirPath)
+		if err != nil {
+			log.Printf("failed to count boot: %v", err)
+		} else if err := utils.PutMetadata(ctx, path.Join("instance", "guest-attributes", utils.GuestAttributeTestNamespace, utils.BootCountGAKey), strconv.Itoa(count)); err != nil {
+			log.Printf("failed to publish boot count %d: %v", count, err)
+		}
+	}
 	firstBootSpecialAttribute := checkFirstBootSpecialGA(ctx)
 	// firstBootSpecialGA should be true if we need to match a different guest attribute than the usual guest attribute
 	defer func(ctx context.Context, firstBootSpecialGA bool) {
@@ -118,15 +162,16 @@ func main() {
 		testArguments = append(testArguments, "-test.run", testRun)
 	}
 
+	testSkip, err := utils.GetMetadata(ctx, "instance", "attributes", "_test_skip")
+	if err == nil && testSkip != "" {
+		testArguments = append(testArguments, "-test.skip", testSkip)
+	}
+
 	testPackage, err := utils.GetMetadata(ctx, "instance", "attributes", "_test_package_name")
 	if err != nil {
 		log.Fatalf("failed to get metadata _test_package_name: %v", err)
 	}
 
-	workDirPath := "/etc/"
-	if runtime.GOOS == "windows" {
-		workDirPath = "C:\\"
-	}
 	workDir, err := os.MkdirTemp(workDirPath, "image_test")
 	if err != nil {
 		log.Fatalf("failed to create work dir: %v", err)
@@ -136,12 +181,19 @@ func main() {
 	if err = utils.DownloadGCSObjectToFile(ctx, client, testPackageURL, workDir+testPackage); err != nil {
 		log.Fatalf("failed to download object: %v", err)
 	}
+
+	if scriptURL, err := utils.GetMetadata(ctx, "instance", "attributes", "_cit_startup_script_url"); err == nil && scriptURL != "" {
+		if err := runStartupScript(ctx, client, scriptURL, workDir); err != nil {
+			log.Printf("startup script %s failed: %v", scriptURL, err)
+		}
+	}
 	client.Close()
 
 	log.Printf("sleep 30s to allow environment to stabilize")
 	time.Sleep(30 * time.Second)
 
 	out, err := executeCmd(workDir+testPackage, workDir, testArguments)
+	testsFailed := err != nil
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			log.Printf("test package exited with error: %v stderr: %q", ee, ee.Stderr)
@@ -160,6 +212,58 @@ func main() {
 	if err = uploadGCSObject(ctx, client, resultsURL, bytes.NewReader(out)); err != nil {
 		log.Fatalf("failed to upload test result: %v", err)
 	}
+
+	// The guest agent and system logs are only collected from VMs which asked
+	// for them, and only when their tests failed.
+	if !testsFailed {
+		return
+	}
+	for _, l := range []struct {
+		name    string
+		urlKey  string
+		collect func(string) ([]byte, error)
+	}{
+		{"guest agent", "_test_agent_log_url", utils.GetAgentLog},
+		{"system", "_test_system_log_url", utils.GetSystemLog},
+	} {
+		logURL, err := utils.GetMetadata(ctx, "instance", "attributes", l.urlKey)
+		if err != nil || logURL == "" {
+			continue
+		}
+		out, err := l.collect(runtime.GOOS)
+		if err != nil {
+			log.Printf("failed to get %s log: %v", l.name, err)
+		}
+		if len(out) > 0 {
+			if err := uploadGCSObject(ctx, client, logURL, bytes.NewReader(out)); err != nil {
+				log.Printf("failed to upload %s log: %v", l.name, err)
+			}
+		}
+	}
+}
+
+// runStartupScript downloads the startup script of the test VM to the work
+// directory and runs it, logging its output.
+func runStartupScript(ctx context.Context, client *storage.Client, scriptURL, workDir string) error {
+	script := workDir + path.Base(scriptURL)
+	if err := utils.DownloadGCSObjectToFile(ctx, client, scriptURL, script); err != nil {
+		return err
+	}
+	if err := os.Chmod(script, 0755); err != nil {
+		return err
+	}
+	cmd, args := script, []string{}
+	if runtime.GOOS == "windows" {
+		if strings.HasSuffix(script, ".ps1") {
+			cmd, args = "powershell.exe", []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", script}
+		} else {
+			cmd, args = "cmd.exe", []string{"/c", script}
+		}
+	}
+	log.Printf("running startup script %s", scriptURL)
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	log.Printf("startup script output:\n%s\n", out)
+	return err
 }
 
 func executeCmd(cmd, dir string, arg []string) ([]byte, error) {
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ExcludeEntry excludes a test of a suite from running on the images matching
+// a glob pattern, e.g. to quarantine a test which is flaky on some images.
+type ExcludeEntry struct {
+	Suite string `json:"suite"`
+	// Test is the name of a top level test of the suite. If empty, the whole
+	// suite is skipped.
+	Test string `json:"test,omitempty"`
+	// Image is a glob pattern, as accepted by path.Match, matched against the
+	// image name, family and the last element of the image URL.
+	Image  string `json:"image"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// LoadExcludeFile reads a JSON list of ExcludeEntry from a file.
+func LoadExcludeFile(filename string) ([]ExcludeEntry, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclude file: %v", err)
+	}
+	var entries []ExcludeEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse exclude file %s: %v", filename, err)
+	}
+	for _, e := range entries {
+		if e.Suite == "" || e.Image == "" {
+			return nil, fmt.Errorf("exclude entry %+v in %s must have a suite and an image", e, filename)
+		}
+		if strings.Contains(e.Test, "/") {
+			return nil, fmt.Errorf("exclude entry %+v in %s must name a top level test", e, filename)
+		}
+		if _, err := path.Match(e.Image, ""); err != nil {
+			return nil, fmt.Errorf("exclude entry %+v in %s has an invalid image pattern: %v", e, filename, err)
+		}
+	}
+	return entries, nil
+}
+
+// ApplyExcludes skips the tests of the workflow which are excluded on its
+// image. An entry without a test skips the whole workflow, other tests are
+// skipped in the guest and reported as skipped with the reason of the entry.
+func (t *TestWorkflow) ApplyExcludes(entries []ExcludeEntry) {
+	images := []string{path.Base(t.ImageURL), t.Image.Name, t.Image.Family}
+	for _, e := range entries {
+		if e.Suite != t.Name || !matchesAny(e.Image, images) {
+			continue
+		}
+		reason := e.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("excluded on images matching %s", e.Image)
+		}
+		if e.Test == "" {
+			t.Skip(reason)
+			continue
+		}
+		if t.excludedTests == nil {
+			t.excludedTests = make(map[string]string)
+		}
+		t.excludedTests[e.Test] = reason
+	}
+}
+
+func matchesAny(pattern string, names []string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// testSkipPattern returns the -test.skip pattern of the tests excluded from
+// running in the guest, or an empty string if no test is excluded.
+func (t *TestWorkflow) testSkipPattern() string {
+	if len(t.excludedTests) == 0 {
+		return ""
+	}
+	var tests []string
+	for test := range t.excludedTests {
+		tests = append(tests, regexp.QuoteMeta(test))
+	}
+	sort.Strings(tests)
+	return fmt.Sprintf("^(%s)$", strings.Join(tests, "|"))
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestLoadExcludeFile(t *testing.T) {
+	testcases := []struct {
+		name    string
+		content string
+		wantErr bool
+		want    int
+	}{
+		{name: "valid", content: `[{"suite": "ssh", "test": "TestSSHKey", "image": "debian-*", "reason": "flaky"}, {"suite": "network", "image": "rhel-9*"}]`, want: 2},
+		{name: "empty", content: `[]`, want: 0},
+		{name: "not json", content: `suite: ssh`, wantErr: true},
+		{name: "missing image", content: `[{"suite": "ssh", "test": "TestSSHKey"}]`, wantErr: true},
+		{name: "subtest", content: `[{"suite": "ssh", "test": "TestSSHKey/sub", "image": "*"}]`, wantErr: true},
+		{name: "bad glob", content: `[{"suite": "ssh", "image": "debian-["}]`, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "exclude.json")
+			if err := os.WriteFile(filename, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := LoadExcludeFile(filename)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("LoadExcludeFile() err = %v, want error: %v", err, tc.wantErr)
+			}
+			if len(entries) != tc.want {
+				t.Errorf("LoadExcludeFile() returned %d entries, want %d", len(entries), tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyExcludes(t *testing.T) {
+	entries := []ExcludeEntry{
+		{Suite: "ssh", Test: "TestSSHKey", Image: "debian-1[12]*", Reason: "flaky"},
+		{Suite: "ssh", Test: "TestHostKey", Image: "debian-12"},
+		{Suite: "ssh", Test: "TestOther", Image: "rhel-*"},
+		{Suite: "network", Image: "debian-*", Reason: "broken"},
+	}
+	twf := NewTestWorkflowForUnitTest("ssh", "projects/debian-cloud/global/images/family/debian-12", "30m")
+	twf.Image = &compute.Image{Name: "debian-12-bookworm-v20240515", Family: "debian-12"}
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	twf.ApplyExcludes(entries)
+	if twf.skipped {
+		t.Errorf("workflow skipped by the exclude entries of single tests")
+	}
+	if want := "^(TestHostKey|TestSSHKey)$"; twf.testSkipPattern() != want {
+		t.Errorf("testSkipPattern() = %q, want %q", twf.testSkipPattern(), want)
+	}
+	if reason := twf.excludedTests["TestSSHKey"]; reason != "flaky" {
+		t.Errorf("TestSSHKey excluded with reason %q, want flaky", reason)
+	}
+
+	network := NewTestWorkflowForUnitTest("network", "projects/debian-cloud/global/images/debian-11-bullseye-v20240515", "30m")
+	network.ApplyExcludes(entries)
+	if !network.skipped || network.SkippedMessage() != "broken" {
+		t.Errorf("network workflow skipped %v with message %q, want skipped with message broken", network.skipped, network.SkippedMessage())
+	}
+	if network.testSkipPattern() != "" {
+		t.Errorf("unexpected test skip pattern %q for a skipped workflow", network.testSkipPattern())
+	}
+}
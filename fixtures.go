@@ -15,14 +15,30 @@
 package imagetest
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"maps"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 	daisy "github.com/GoogleCloudPlatform/compute-daisy"
 	"github.com/google/uuid"
+	"github.com/jstemmer/go-junit-report/v2/junit"
 	computeBeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 )
@@ -45,6 +61,9 @@ const (
 	// DefaultMTU is the default MTU set for a network.
 	DefaultMTU = 1460
 
+	// MinMTU is the minimum MTU settable for a network.
+	MinMTU = 1300
+
 	// JumboFramesMTU is the maximum MTU settable for a network.
 	JumboFramesMTU = 8896
 
@@ -59,6 +78,8 @@ type TestVM struct {
 	// The underlying instance running the test. Exactly one of these must be non-nil.
 	instance     *daisy.Instance
 	instancebeta *daisy.InstanceBeta
+	// Number of times Reboot was called for the VM.
+	reboots int
 }
 
 // AddUser add user public key to metadata ssh-keys.
@@ -76,12 +97,50 @@ func (t *TestVM) AddUser(user, publicKey string) {
 	t.AddMetadata("ssh-keys", keyline)
 }
 
+// AddUserWithExpiry adds a user public key to metadata ssh-keys which the
+// guest agent should only honor until expireOn.
+func (t *TestVM) AddUserWithExpiry(user, publicKey string, expireOn time.Time) error {
+	key, err := utils.SSHKeyWithExpiry(publicKey, user, expireOn)
+	if err != nil {
+		return err
+	}
+	t.AddUser(user, key)
+	return nil
+}
+
+// CollectAgentLogsOnFailure uploads the guest agent log and the system log of
+// the VM next to its test results if any of its tests fail. Their paths are
+// added to the failures of the workflow.
+func (t *TestVM) CollectAgentLogsOnFailure() {
+	t.AddMetadata("_test_agent_log_url", fmt.Sprintf("${OUTSPATH}/%s-guest-agent.log", t.name))
+	t.AddMetadata("_test_system_log_url", fmt.Sprintf("${OUTSPATH}/%s-system.log", t.name))
+}
+
 // Skip marks a test workflow to be skipped.
 func (t *TestWorkflow) Skip(message string) {
 	t.skipped = true
 	t.skippedMessage = message
 }
 
+// SkipImage marks the test workflow to be skipped with the given reason if the
+// regular expression matches the URL, name or family of the image. Suites call
+// it at the start of their setup, so no VM is created for images the suite
+// doesn't support. It returns whether the workflow is skipped.
+func (t *TestWorkflow) SkipImage(pattern, reason string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid image pattern %q: %v", pattern, err)
+	}
+	if t.skipped {
+		return true, nil
+	}
+	if re.MatchString(t.ImageURL) || re.MatchString(t.Image.Name) || re.MatchString(t.Image.Family) {
+		log.Printf("Skipping test %s on image %s: %s", t.Name, t.ImageURL, reason)
+		t.Skip(reason)
+	}
+	return t.skipped, nil
+}
+
 // SkippedMessage returns the skip reason message for the workflow.
 func (t *TestWorkflow) SkippedMessage() string {
 	return t.skippedMessage
@@ -93,6 +152,76 @@ func (t *TestWorkflow) LockProject() {
 	t.lockProject = true
 }
 
+// AddProjectMetadata sets a project metadata key while the workflow runs, for
+// tests of how the guest handles project metadata such as project ssh keys.
+// The key replaces any value the project has, which is restored once the
+// workflow is done, so it locks the project, see LockProject. Project ssh keys
+// are added to the ssh-keys of the project instead, and removed once the
+// workflow is done.
+func (t *TestWorkflow) AddProjectMetadata(key, value string) {
+	if t.projectMetadata == nil {
+		t.projectMetadata = make(map[string]string)
+	}
+	t.projectMetadata[key] = value
+	t.LockProject()
+}
+
+// SetCleanupDryRun sets whether the resources left behind by the workflow are
+// only logged instead of deleted when cleaning up after it. Resources match if
+// their name ends with the workflow ID, as for a normal cleanup.
+func (t *TestWorkflow) SetCleanupDryRun(dryRun bool) {
+	t.cleanupDryRun = dryRun
+}
+
+// SetResourceLabels adds labels to the VMs and disks created by the workflow,
+// along with the test-run-id and test-suite labels identifying the run. Keys
+// and values are lowercased, and characters not allowed in labels are
+// replaced with dashes. Networks don't support labels, so they are still
+// identified by their name. It applies to the resources created after it is
+// called.
+func (t *TestWorkflow) SetResourceLabels(labels map[string]string) {
+	if t.resourceLabels == nil {
+		t.resourceLabels = make(map[string]string)
+	}
+	for k, v := range labels {
+		t.resourceLabels[normalizeLabel(k)] = normalizeLabel(v)
+	}
+}
+
+// SetResultsCallback registers a function to be called with the results of the
+// workflow once it has finished and been cleaned up. The callback is called
+// for failed and skipped workflows too, and is abandoned after timeout. A
+// timeout of zero uses the default of 30 seconds.
+func (t *TestWorkflow) SetResultsCallback(callback ResultsCallback, timeout time.Duration) {
+	t.resultsCallback = callback
+	t.resultsCallbackTimeout = timeout
+}
+
+// ResultsWebhook returns a ResultsCallback which posts the results as json to
+// the given HTTP endpoint.
+func ResultsWebhook(url string) ResultsCallback {
+	return func(ctx context.Context, suite junit.Testsuite) error {
+		body, err := json.Marshal(suite)
+		if err != nil {
+			return fmt.Errorf("failed to marshal results: %v", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create results webhook request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to post results to %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("results webhook %s returned status %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
 // WaitForVMQuota appends a list of quotas to the wait for vm quota step. Quotas with a blank region will be populated with the region corresponding to the workflow zone.
 func (t *TestWorkflow) WaitForVMQuota(qa *daisy.QuotaAvailable) error {
 	return t.waitForQuotaStep(qa, waitForVMQuotaStepName)
@@ -172,6 +301,149 @@ func (t *TestWorkflow) CreateTestVM(name string) (*TestVM, error) {
 	return &TestVM{name: vmname, testWorkflow: t, instance: i}, nil
 }
 
+// CreateTestVMFromImage adds the necessary steps to create a VM with the
+// specified name booting from one of the images of a workflow created with
+// NewMultiImageTestWorkflow. The VM uses the default machine type for the
+// architecture of the image.
+func (t *TestWorkflow) CreateTestVMFromImage(name, image string) (*TestVM, error) {
+	if image == t.ImageURL {
+		return t.CreateTestVM(name)
+	}
+	var ti *testImage
+	for _, extra := range t.extraImages {
+		if extra.url == image {
+			ti = extra
+		}
+	}
+	if ti == nil {
+		return nil, fmt.Errorf("image %s is not an image of test %s", image, t.Name)
+	}
+	vm, err := t.CreateTestVM(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, stepName := range t.getCreateStepNames(createDisksStepName) {
+		for _, disk := range *t.wf.Steps[stepName].CreateDisks {
+			if disk.Name == vm.name {
+				disk.SourceImage = image
+			}
+		}
+	}
+	vm.instance.MachineType = ti.machineType.Name
+	if arch := guestArch(ti.image); arch != guestArch(t.Image) {
+		vm.instance.StartupScript = "wrapper-" + arch
+		vm.instance.Metadata["_test_package_url"] = "${SOURCESPATH}/testpackage-" + arch
+	}
+	return vm, nil
+}
+
+// CreateTestVMFromSnapshot adds the necessary steps to create a VM with the
+// specified name whose boot disk is restored from a snapshot. The snapshot may
+// be one created earlier in the workflow with CreateSnapshot, referenced by
+// name, or the URL of an existing snapshot.
+func (t *TestWorkflow) CreateTestVMFromSnapshot(name, snapshotURL string) (*TestVM, error) {
+	parts := strings.Split(name, ".")
+	vmname := strings.ReplaceAll(parts[0], "_", "-")
+
+	bootDisk := &compute.Disk{Name: vmname}
+	createDiskStep, err := t.appendCreateDiskFromSnapshotStep(bootDisk, snapshotURL)
+	if err != nil {
+		return nil, err
+	}
+
+	daisyInst := &daisy.Instance{}
+	// The VM can't be part of the create-vms step, which the snapshot depends
+	// on. Its own step is named like the steps of parallel VM creation, so
+	// fixtures which look up the create-vms steps find it.
+	createVMStep, i, err := t.appendCreateVMStepNamed(createVMsStepName+"-"+vmname, []*compute.Disk{bootDisk}, daisyInst)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.wf.AddDependency(createVMStep, createDiskStep); err != nil {
+		return nil, err
+	}
+
+	waitStep, err := t.addWaitStep(vmname, vmname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.wf.AddDependency(waitStep, createVMStep); err != nil {
+		return nil, err
+	}
+
+	if createSubnetworkStep, ok := t.wf.Steps[createSubnetworkStepName]; ok {
+		if err := t.wf.AddDependency(createVMStep, createSubnetworkStep); err != nil {
+			return nil, err
+		}
+	}
+
+	if createNetworkStep, ok := t.wf.Steps[createNetworkStepName]; ok {
+		if err := t.wf.AddDependency(createVMStep, createNetworkStep); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TestVM{name: vmname, testWorkflow: t, instance: i}, nil
+}
+
+// CreateTestVMWithAccelerators adds the necessary steps to create a VM with
+// the specified name and accelerators attached to the workflow. The machine
+// type of the workflow must support the accelerators, use
+// CreateTestVMMultipleDisks with GuestAccelerators and a MachineType set on
+// the instance for other shapes.
+func (t *TestWorkflow) CreateTestVMWithAccelerators(name string, accels []*compute.AcceleratorConfig) (*TestVM, error) {
+	if len(accels) == 0 {
+		return nil, fmt.Errorf("failed to create VM %s with no accelerators", name)
+	}
+	if err := validateAccelerators(t.MachineType.Name, accels); err != nil {
+		return nil, fmt.Errorf("failed to create VM %s: %v", name, err)
+	}
+	parts := strings.Split(name, ".")
+	vmname := strings.ReplaceAll(parts[0], "_", "-")
+
+	bootDisk := &compute.Disk{Name: vmname}
+	createDisksStep, err := t.appendCreateDisksStep(bootDisk)
+	if err != nil {
+		return nil, err
+	}
+
+	daisyInst := &daisy.Instance{}
+	// createDisksStep doesn't depend on any other steps.
+	createVMStep, i, err := t.appendCreateVMStep([]*compute.Disk{bootDisk}, daisyInst, accels...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.wf.AddDependency(createVMStep, createDisksStep); err != nil {
+		return nil, err
+	}
+
+	waitStep, err := t.addWaitStep(vmname, vmname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.wf.AddDependency(waitStep, createVMStep); err != nil {
+		return nil, err
+	}
+
+	if createSubnetworkStep, ok := t.wf.Steps[createSubnetworkStepName]; ok {
+		if err := t.wf.AddDependency(createVMStep, createSubnetworkStep); err != nil {
+			return nil, err
+		}
+	}
+
+	if createNetworkStep, ok := t.wf.Steps[createNetworkStepName]; ok {
+		if err := t.wf.AddDependency(createVMStep, createNetworkStep); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TestVM{name: vmname, testWorkflow: t, instance: i}, nil
+}
+
 // CreateTestVMBeta adds the necessary steps to create a VM with the specified
 // name from the compute beta API to the workflow.
 func (t *TestWorkflow) CreateTestVMBeta(name string) (*TestVM, error) {
@@ -238,7 +510,7 @@ func (t *TestWorkflow) CreateTestVMMultipleDisks(disks []*compute.Disk, instance
 		if i == 0 {
 			createDisksStep, err = t.appendCreateDisksStep(disk)
 		} else {
-			createDisksStep, err = t.appendCreateMountDisksStep(disk)
+			createDisksStep, err = t.appendCreateMountDisksStep(vmname, disk)
 		}
 
 		if err != nil {
@@ -314,7 +586,7 @@ func (t *TestWorkflow) CreateTestVMFromInstanceBeta(i *daisy.InstanceBeta, disks
 		if i == 0 {
 			createDisksStep, err = t.appendCreateDisksStep(disk)
 		} else {
-			createDisksStep, err = t.appendCreateMountDisksStep(disk)
+			createDisksStep, err = t.appendCreateMountDisksStep(vmname, disk)
 		}
 
 		if err != nil {
@@ -447,6 +719,51 @@ func (t *TestVM) SetWindowsStartupScript(script string) {
 	t.AddMetadata("windows-startup-script-ps1", script)
 }
 
+// getMetadata returns the value of a metadata key set for the VM at creation.
+func (t *TestVM) getMetadata(key string) (string, bool) {
+	var metadata map[string]string
+	if t.instance != nil {
+		metadata = t.instance.Metadata
+	} else if t.instancebeta != nil {
+		metadata = t.instancebeta.Metadata
+	}
+	value, ok := metadata[key]
+	return value, ok
+}
+
+// AddStartupScript sets the startup script of the VM, in the
+// `windows-startup-script-ps1` metadata key on Windows images and in the
+// `startup-script` key otherwise. The startup script runs along with the test
+// wrapper, which is run from the `startup-script-url` keys, so it may not have
+// finished when the tests start; use AddStartupScriptURL for provisioning
+// which the tests need.
+func (t *TestVM) AddStartupScript(script string) error {
+	key := "startup-script"
+	if utils.HasFeature(t.testWorkflow.Image, "WINDOWS") {
+		key = "windows-startup-script-ps1"
+	}
+	if _, ok := t.getMetadata(key); ok {
+		return fmt.Errorf("failed to add startup script to VM %s: metadata key %s is already set", t.name, key)
+	}
+	t.AddMetadata(key, script)
+	return nil
+}
+
+// AddStartupScriptURL makes the test wrapper download the script at the given
+// gs:// URL and run it before the test binary. The tests are run even if the
+// script fails. Scripts ending in .ps1 are run with PowerShell on Windows,
+// with cmd otherwise, and are executed directly on other systems.
+func (t *TestVM) AddStartupScriptURL(url string) error {
+	if _, _, err := utils.ParseGCSPath(url); err != nil {
+		return fmt.Errorf("failed to add startup script to VM %s: %v", t.name, err)
+	}
+	if _, ok := t.getMetadata("_cit_startup_script_url"); ok {
+		return fmt.Errorf("failed to add startup script to VM %s: it already has a startup script URL", t.name)
+	}
+	t.AddMetadata("_cit_startup_script_url", url)
+	return nil
+}
+
 // SetNetworkPerformanceTier sets the performance tier of the VM.
 // The tier must be one of "DEFAULT" or "TIER_1"
 func (t *TestVM) SetNetworkPerformanceTier(tier string) error {
@@ -472,6 +789,11 @@ func (t *TestVM) SetNetworkPerformanceTier(tier string) error {
 // Reboot stops the VM, waits for it to shutdown, then starts it again. Your
 // test package must handle being run twice.
 func (t *TestVM) Reboot() error {
+	for _, disk := range t.createdDisks() {
+		if _, ok := t.testWorkflow.diskKeys[disk.Name]; ok {
+			return fmt.Errorf("failed to reboot VM %s: daisy can't start VMs with disks encrypted with customer-supplied keys", t.name)
+		}
+	}
 	// TODO: better solution than a shared counter for name collisions.
 	t.testWorkflow.counter++
 	stepSuffix := fmt.Sprintf("%s-%d", t.name, t.testWorkflow.counter)
@@ -516,9 +838,166 @@ func (t *TestVM) Reboot() error {
 	if err := t.testWorkflow.wf.AddDependency(waitStartedStep, startInstancesStep); err != nil {
 		return err
 	}
+	t.reboots++
+	return nil
+}
+
+// RebootExpectCount reboots the VM n times like Reboot, and verifies after
+// each reboot that the VM booted exactly once more, which the test wrapper
+// publishes in a guest attribute. A spurious or missing reboot fails the
+// workflow. Reboots done with Reboot before are counted as well.
+func (t *TestVM) RebootExpectCount(n int) error {
+	if n < 1 {
+		return fmt.Errorf("failed to reboot VM %s: reboot count %d must be positive", t.name, n)
+	}
+	t.AddMetadata("_cit_count_boots", "true")
+	for i := 0; i < n; i++ {
+		if err := t.Reboot(); err != nil {
+			return err
+		}
+		lastStep, err := t.testWorkflow.getLastStepForVM(t.name)
+		if err != nil {
+			return fmt.Errorf("failed resolve last step")
+		}
+		t.testWorkflow.counter++
+		stepSuffix := fmt.Sprintf("%s-%d", t.name, t.testWorkflow.counter)
+		verifyStep, err := t.testWorkflow.addWaitSignalStep("boot-count-"+stepSuffix, t.name, utils.GuestAttributeTestNamespace, utils.BootCountGAKey, "")
+		if err != nil {
+			return err
+		}
+		signal := (*verifyStep.WaitForInstancesSignal)[0]
+		// Only the boot count can end the step, with an error if it is not
+		// the expected one.
+		signal.SerialOutput = nil
+		signal.GuestAttribute.SuccessValue = fmt.Sprint(t.reboots + 1)
+		if err := t.testWorkflow.wf.AddDependency(verifyStep, lastStep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MeasureBootTime measures the time from the end of the step creating the VM
+// to the test wrapper starting on its first boot, which it signals with a
+// guest attribute. The time is reported as the boot_time metric of the VM in
+// the results summary of the workflow. VMs created in the same step are
+// created in parallel, so the time includes the creation of the other VMs of
+// the step if it takes longer.
+func (t *TestVM) MeasureBootTime() error {
+	createStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+	waitStep, err := t.testWorkflow.addWaitGuestAttributeStep("booted-"+t.name, t.name, utils.BootedGAKey)
+	if err != nil {
+		return err
+	}
+	(*waitStep.WaitForInstancesSignal)[0].Interval = "1s"
+	// Boots can take as long as the tests of the VM.
+	if testWaitStep, ok := t.testWorkflow.wf.Steps["wait-"+t.name]; ok {
+		waitStep.Timeout = testWaitStep.Timeout
+	}
+	if err := t.testWorkflow.wf.AddDependency(waitStep, createStep); err != nil {
+		return err
+	}
+	t.AddMetadata("_cit_signal_boot", "true")
+	t.testWorkflow.bootTimeVMs = append(t.testWorkflow.bootTimeVMs, t.name)
 	return nil
 }
 
+// WaitForGuestAttribute waits for the VM to set the guest attribute with the
+// given namespace and key, or to print the success match of the test results
+// to the serial console, after the previous steps of the VM. This lets tests
+// with several phases signal the end of each phase.
+func (t *TestVM) WaitForGuestAttribute(namespace, key string) error {
+	if namespace == "" || key == "" {
+		return fmt.Errorf("failed to wait for guest attribute on VM %s: namespace and key must not be empty", t.name)
+	}
+	// TODO: better solution than a shared counter for name collisions.
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", t.name, t.testWorkflow.counter)
+
+	lastStep, err := t.testWorkflow.getLastStepForVM(t.name)
+	if err != nil {
+		return fmt.Errorf("failed resolve last step")
+	}
+
+	waitStep, err := t.testWorkflow.addWaitSignalStep("guest-attribute-"+stepSuffix, t.name, namespace, key, "")
+	if err != nil {
+		return err
+	}
+
+	return t.testWorkflow.wf.AddDependency(waitStep, lastStep)
+}
+
+// SetMetadataDuringRun sets the metadata key of the running VM to the value,
+// after the previous steps of the VM, keeping its other metadata. Follow it
+// with WaitForGuestAttribute to wait until the guest has processed the change.
+func (t *TestVM) SetMetadataDuringRun(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("failed to set metadata on VM %s: key must not be empty", t.name)
+	}
+	// TODO: better solution than a shared counter for name collisions.
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", t.name, t.testWorkflow.counter)
+
+	lastStep, err := t.testWorkflow.getLastStepForVM(t.name)
+	if err != nil {
+		return fmt.Errorf("failed resolve last step")
+	}
+
+	updateStep, err := t.testWorkflow.wf.NewStep("update-metadata-" + stepSuffix)
+	if err != nil {
+		return err
+	}
+	updateStep.UpdateInstancesMetadata = &daisy.UpdateInstancesMetadata{
+		{Instance: t.name, Metadata: map[string]string{key: value}},
+	}
+
+	return t.testWorkflow.wf.AddDependency(updateStep, lastStep)
+}
+
+// SetMetadataOnSignal sets the metadata key of the running VM to the value
+// once the guest sets the guest attribute signalKey in the test namespace,
+// keeping its other metadata. Unlike SetMetadataDuringRun, the change happens
+// while the tests of the VM run, so a test can signal it is ready and then
+// check how the guest handles the change. The guest must always signal, even
+// when its test is skipped or fails first, or the workflow waits until the
+// tests of the VM time out. utils.SignalWorkflow signals when the test ends.
+func (t *TestVM) SetMetadataOnSignal(signalKey, key, value string) error {
+	if signalKey == "" || key == "" {
+		return fmt.Errorf("failed to set metadata on VM %s: signal key and key must not be empty", t.name)
+	}
+	createStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+	// TODO: better solution than a shared counter for name collisions.
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", t.name, t.testWorkflow.counter)
+
+	waitStep, err := t.testWorkflow.addWaitGuestAttributeStep("signal-"+stepSuffix, t.name, signalKey)
+	if err != nil {
+		return err
+	}
+	// The signal can come as late as the end of the tests of the VM.
+	if testWaitStep, ok := t.testWorkflow.wf.Steps["wait-"+t.name]; ok {
+		waitStep.Timeout = testWaitStep.Timeout
+	}
+	if err := t.testWorkflow.wf.AddDependency(waitStep, createStep); err != nil {
+		return err
+	}
+
+	updateStep, err := t.testWorkflow.wf.NewStep("update-metadata-" + stepSuffix)
+	if err != nil {
+		return err
+	}
+	updateStep.UpdateInstancesMetadata = &daisy.UpdateInstancesMetadata{
+		{Instance: t.name, Metadata: map[string]string{key: value}},
+	}
+	return t.testWorkflow.wf.AddDependency(updateStep, waitStep)
+}
+
 // Resume waits for the vm to be SUSPENDED, then resumes it. It does not handle suspension.
 func (t *TestVM) Resume() error {
 	// TODO: better solution than a shared counter for name collisions.
@@ -538,7 +1017,10 @@ func (t *TestVM) Resume() error {
 		{Name: t.name, Status: []string{"SUSPENDED"}},
 	}
 
-	createStep := t.testWorkflow.wf.Steps[createVMsStepName]
+	createStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
 
 	if err := t.testWorkflow.wf.AddDependency(waitSuspended, createStep); err != nil {
 		return err
@@ -583,29 +1065,283 @@ func (t *TestVM) ResizeDiskAndReboot(diskSize int) error {
 	return t.Reboot()
 }
 
-// ForceMachineType sets the machine type for the test VM. This will override
-// the machine_type flag in the CIT wrapper, and should only be used when a
-// test absolutely requires a specific machine shape.
-func (t *TestVM) ForceMachineType(machinetype string) {
-	if t.instance != nil {
-		t.instance.MachineType = machinetype
-	} else if t.instancebeta != nil {
-		t.instancebeta.MachineType = machinetype
+// ResizeDisk resizes a disk attached to the VM while the VM is running. The
+// resize happens once the VM is created, and the VM's test results are only
+// collected after the resize, so the test can wait for the guest to see the
+// larger disk. The new size must be larger than the size the disk was created
+// with.
+func (t *TestVM) ResizeDisk(diskName string, newSizeGb int64) error {
+	vmname, err := t.testWorkflow.getVMForDisk(diskName)
+	if err != nil {
+		return err
 	}
-}
-
-// ForceZone sets the zone for the test vm. This will override the zone option
-// from the CIT wrapper and and should only be used when a test requires a specific
-// zone.
-func (t *TestVM) ForceZone(z string) {
-	if t.instance != nil {
-		t.instance.Zone = z
-	} else if t.instancebeta != nil {
-		t.instancebeta.Zone = z
+	if vmname != t.name {
+		return fmt.Errorf("disk %s is attached to vm %s, not %s", diskName, vmname, t.name)
+	}
+	if sizeGb, ok := t.testWorkflow.getDiskSizeGb(diskName); ok && newSizeGb <= sizeGb {
+		return fmt.Errorf("new size %dGB of disk %s must be larger than its current size %dGB", newSizeGb, diskName, sizeGb)
+	}
+	createVMStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+	waitStep, ok := t.testWorkflow.wf.Steps["wait-"+t.name]
+	if !ok {
+		return fmt.Errorf("could not find wait step for vm %s", t.name)
 	}
-}
 
-// EnableSecureBoot make the current test VMs in workflow with secure boot.
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", diskName, t.testWorkflow.counter)
+	diskResizeStep, err := t.testWorkflow.addDiskResizeStep(stepSuffix, diskName, int(newSizeGb))
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(diskResizeStep, createVMStep); err != nil {
+		return err
+	}
+	return t.testWorkflow.wf.AddDependency(waitStep, diskResizeStep)
+}
+
+// AttachDisk creates the disk and attaches it to the VM while the VM is
+// running. The test running on the VM must set the guest attribute
+// utils.HotplugAttachedGAKeyPrefix + disk.Name once the disk has appeared, and
+// the workflow waits for it before any DetachDisk.
+func (t *TestVM) AttachDisk(disk *compute.Disk) error {
+	if disk == nil || disk.Name == "" {
+		return fmt.Errorf("failed to attach disk with empty parameters")
+	}
+	if _, ok := t.testWorkflow.hotplugDisks[disk.Name]; ok {
+		return fmt.Errorf("disk %s is already attached in workflow", disk.Name)
+	}
+	createDisksStep, err := t.testWorkflow.appendCreateMountDisksStep(t.name, disk)
+	if err != nil {
+		return err
+	}
+	createVMStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", disk.Name, t.testWorkflow.counter)
+	attachDiskStep, err := t.testWorkflow.addAttachDiskStep(stepSuffix, t.name, disk.Name)
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(attachDiskStep, createVMStep, createDisksStep); err != nil {
+		return err
+	}
+	waitAttachedStep, err := t.testWorkflow.addWaitGuestAttributeStep("attached-"+stepSuffix, t.name, utils.HotplugAttachedGAKeyPrefix+disk.Name)
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(waitAttachedStep, attachDiskStep); err != nil {
+		return err
+	}
+
+	if t.testWorkflow.hotplugDisks == nil {
+		t.testWorkflow.hotplugDisks = make(map[string]*hotplugDisk)
+	}
+	t.testWorkflow.hotplugDisks[disk.Name] = &hotplugDisk{vmname: t.name, attachedStep: waitAttachedStep}
+	return nil
+}
+
+// DetachDisk detaches a disk attached with AttachDisk from the running VM once
+// the guest has seen it. The test running on the VM must set the guest
+// attribute utils.HotplugDetachedGAKeyPrefix + diskName once the disk is gone.
+func (t *TestVM) DetachDisk(diskName string) error {
+	disk, ok := t.testWorkflow.hotplugDisks[diskName]
+	if !ok || disk.vmname != t.name {
+		return fmt.Errorf("disk %s was not attached to vm %s with AttachDisk", diskName, t.name)
+	}
+	if disk.detached {
+		return fmt.Errorf("disk %s is already detached from vm %s", diskName, t.name)
+	}
+
+	t.testWorkflow.counter++
+	stepSuffix := fmt.Sprintf("%s-%d", diskName, t.testWorkflow.counter)
+	detachDiskStep, err := t.testWorkflow.addDetachDiskStep(stepSuffix, t.name, diskName)
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(detachDiskStep, disk.attachedStep); err != nil {
+		return err
+	}
+	waitDetachedStep, err := t.testWorkflow.addWaitGuestAttributeStep("detached-"+stepSuffix, t.name, utils.HotplugDetachedGAKeyPrefix+diskName)
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(waitDetachedStep, detachDiskStep); err != nil {
+		return err
+	}
+	disk.detached = true
+	return nil
+}
+
+// CreateSnapshot adds a step which snapshots the given disk of the VM once the
+// VM has finished its test run. The snapshot is deleted when the workflow is
+// cleaned up.
+func (t *TestVM) CreateSnapshot(disk *compute.Disk, snapshotName string) (*daisy.Snapshot, error) {
+	_, snapshot, err := t.testWorkflow.appendCreateSnapshotStep(disk, snapshotName)
+	return snapshot, err
+}
+
+// SetBootExpectations sets the serial console output which signals that the
+// tests on the VM finished, and output such as a kernel panic message which
+// fails the workflow as soon as it appears. An empty successMatch keeps the
+// default marker printed by the test wrapper, and an empty failureMatch adds
+// no failure match. The guest attribute signal written by the wrapper is
+// still waited for, so a custom successMatch should not be printed before
+// the tests finish. The failure match applies to every wait step of the VM
+// which watches the serial console, including those after reboots.
+func (t *TestVM) SetBootExpectations(successMatch, failureMatch string) error {
+	waitStep, ok := t.testWorkflow.wf.Steps["wait-"+t.name]
+	if !ok {
+		return fmt.Errorf("could not find wait step for VM %s", t.name)
+	}
+	if successMatch != "" {
+		for _, signal := range *waitStep.WaitForInstancesSignal {
+			if signal.Name == t.name && signal.SerialOutput != nil {
+				signal.SerialOutput.SuccessMatch = successMatch
+			}
+		}
+	}
+	if failureMatch == "" {
+		return nil
+	}
+	for _, step := range t.testWorkflow.wf.Steps {
+		if step.WaitForInstancesSignal == nil {
+			continue
+		}
+		for _, signal := range *step.WaitForInstancesSignal {
+			if signal.Name == t.name && signal.SerialOutput != nil && !slices.Contains(signal.SerialOutput.FailureMatch, failureMatch) {
+				signal.SerialOutput.FailureMatch = append(signal.SerialOutput.FailureMatch, failureMatch)
+			}
+		}
+	}
+	return nil
+}
+
+// SetWaitTimeout sets how long the workflow waits for the tests on the VM to
+// finish, overriding the workflow default timeout for this VM only. The
+// timeout of the tests run in the guest is set to the same duration.
+func (t *TestVM) SetWaitTimeout(d string) error {
+	if _, err := time.ParseDuration(d); err != nil {
+		return fmt.Errorf("invalid wait timeout %q for VM %s: %v", d, t.name, err)
+	}
+	waitStep, ok := t.testWorkflow.wf.Steps["wait-"+t.name]
+	if !ok {
+		return fmt.Errorf("could not find wait step for VM %s", t.name)
+	}
+	waitStep.Timeout = d
+	t.AddMetadata("_cit_timeout", d)
+	return nil
+}
+
+// DependsOn makes the VM wait for the other VM to be ready before being
+// created, e.g. for a client VM which needs a server VM to be running. The
+// step creating the VM depends on the wait step of the other VM. VMs created
+// in the same step can't depend on one another, so the workflow must use
+// SetParallelVMCreation. Dependency cycles are rejected.
+func (t *TestVM) DependsOn(other *TestVM) error {
+	if other == nil || other.testWorkflow != t.testWorkflow {
+		return fmt.Errorf("VM %s can only depend on a VM of the same workflow", t.name)
+	}
+	if other.name == t.name {
+		return fmt.Errorf("VM %s can't depend on itself", t.name)
+	}
+	wf := t.testWorkflow.wf
+	createStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+	waitStep, ok := wf.Steps["wait-"+other.name]
+	if !ok {
+		return fmt.Errorf("could not find wait step for VM %s", other.name)
+	}
+	var createStepName string
+	for name, step := range wf.Steps {
+		if step == createStep {
+			createStepName = name
+		}
+	}
+	deps := slices.Clone(wf.Dependencies[createStepName])
+	if err := wf.AddDependency(createStep, waitStep); err != nil {
+		return err
+	}
+	if cycle := t.testWorkflow.findDependencyCycle(); cycle != nil {
+		wf.Dependencies[createStepName] = deps
+		return fmt.Errorf("VM %s can't depend on VM %s, it would create the dependency cycle %s", t.name, other.name, strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// ForceMachineType sets the machine type for the test VM. This will override
+// the machine_type flag in the CIT wrapper, and should only be used when a
+// test absolutely requires a specific machine shape.
+func (t *TestVM) ForceMachineType(machinetype string) {
+	if t.instance != nil {
+		t.instance.MachineType = machinetype
+	} else if t.instancebeta != nil {
+		t.instancebeta.MachineType = machinetype
+	}
+}
+
+// EnableNestedVirtualization exposes the virtualization extensions of the CPU
+// to the test vm, so that it can run KVM. The machine type of the vm, or of the
+// workflow if the vm doesn't force one, must support nested virtualization.
+func (t *TestVM) EnableNestedVirtualization() error {
+	var machineType string
+	if t.instance != nil {
+		machineType = t.instance.MachineType
+	} else if t.instancebeta != nil {
+		machineType = t.instancebeta.MachineType
+	}
+	if machineType == "" && t.testWorkflow.MachineType != nil {
+		machineType = t.testWorkflow.MachineType.Name
+	}
+	if !SupportsNestedVirtualization(machineType) {
+		return fmt.Errorf("failed to enable nested virtualization on VM %s: machine type %q doesn't support it, use one of the machine families %v", t.name, machineType, nestedVirtualizationFamilies)
+	}
+	if t.instance != nil {
+		if t.instance.AdvancedMachineFeatures == nil {
+			t.instance.AdvancedMachineFeatures = &compute.AdvancedMachineFeatures{}
+		}
+		t.instance.AdvancedMachineFeatures.EnableNestedVirtualization = true
+	} else if t.instancebeta != nil {
+		if t.instancebeta.AdvancedMachineFeatures == nil {
+			t.instancebeta.AdvancedMachineFeatures = &computeBeta.AdvancedMachineFeatures{}
+		}
+		t.instancebeta.AdvancedMachineFeatures.EnableNestedVirtualization = true
+	}
+	return nil
+}
+
+// SetCustomMachineType sets a custom machine type with the given number of
+// vCPUs and memory in MB for the test vm. An empty family uses the n1 custom
+// machine types, which have no family prefix. This will override the machine
+// type like ForceMachineType.
+func (t *TestVM) SetCustomMachineType(family string, cpus int, memMB int) error {
+	machineType, err := customMachineType(family, cpus, memMB)
+	if err != nil {
+		return fmt.Errorf("failed to set custom machine type on VM %s: %v", t.name, err)
+	}
+	t.ForceMachineType(machineType)
+	return nil
+}
+
+// ForceZone sets the zone for the test vm. This will override the zone option
+// from the CIT wrapper and and should only be used when a test requires a specific
+// zone.
+func (t *TestVM) ForceZone(z string) {
+	if t.instance != nil {
+		t.instance.Zone = z
+	} else if t.instancebeta != nil {
+		t.instancebeta.Zone = z
+	}
+}
+
+// EnableSecureBoot make the current test VMs in workflow with secure boot.
 func (t *TestVM) EnableSecureBoot() {
 	if t.instance != nil {
 		if t.instance.ShieldedInstanceConfig == nil {
@@ -620,6 +1356,33 @@ func (t *TestVM) EnableSecureBoot() {
 	}
 }
 
+// SetShieldedIntegrityPolicy sets the secure boot, vTPM and integrity
+// monitoring options of the instance. All three options are sent to the API,
+// so options which are false are disabled rather than left to the defaults.
+// Secure boot requires the image to have the UEFI_COMPATIBLE guest OS feature.
+func (t *TestVM) SetShieldedIntegrityPolicy(secureBoot, vtpm, integrityMonitoring bool) error {
+	if secureBoot && !utils.HasFeature(t.testWorkflow.Image, "UEFI_COMPATIBLE") {
+		return fmt.Errorf("cannot enable secure boot on VM %s: image %s does not have the UEFI_COMPATIBLE guest OS feature", t.name, t.testWorkflow.Image.Name)
+	}
+	forceSendFields := []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"}
+	if t.instance != nil {
+		t.instance.ShieldedInstanceConfig = &compute.ShieldedInstanceConfig{
+			EnableSecureBoot:          secureBoot,
+			EnableVtpm:                vtpm,
+			EnableIntegrityMonitoring: integrityMonitoring,
+			ForceSendFields:           forceSendFields,
+		}
+	} else if t.instancebeta != nil {
+		t.instancebeta.ShieldedInstanceConfig = &computeBeta.ShieldedInstanceConfig{
+			EnableSecureBoot:          secureBoot,
+			EnableVtpm:                vtpm,
+			EnableIntegrityMonitoring: integrityMonitoring,
+			ForceSendFields:           forceSendFields,
+		}
+	}
+	return nil
+}
+
 // EnableConfidentialInstance enabled CVM features for the instance.
 func (t *TestVM) EnableConfidentialInstance() {
 	if t.instance != nil {
@@ -643,40 +1406,462 @@ func (t *TestVM) EnableConfidentialInstance() {
 	}
 }
 
-// SetMinCPUPlatform sets the minimum CPU platform of the instance.
-func (t *TestVM) SetMinCPUPlatform(minCPUPlatform string) {
+// AddLocalSSD attaches a local SSD with the given interface, NVME or SCSI, to
+// the instance. Local SSDs are deleted with the instance, and their contents
+// don't persist across a stop and start of the VM. The number of local SSDs is
+// checked against the limit of the machine type currently set on the VM, so
+// ForceMachineType must be called first if it is used.
+func (t *TestVM) AddLocalSSD(iface string) error {
+	machineType := t.testWorkflow.MachineType.Name
+	if t.instance != nil && t.instance.MachineType != "" {
+		machineType = t.instance.MachineType
+	} else if t.instancebeta != nil && t.instancebeta.MachineType != "" {
+		machineType = t.instancebeta.MachineType
+	}
+	count := t.localSSDCount() + 1
+	if err := validateLocalSSDs(machineType, iface, count); err != nil {
+		return fmt.Errorf("failed to add local SSD to VM %s: %v", t.name, err)
+	}
+
+	deviceName := fmt.Sprintf("local-ssd-%d", count-1)
+	if t.instance != nil {
+		t.instance.Disks = append(t.instance.Disks, &compute.AttachedDisk{
+			AutoDelete:       true,
+			DeviceName:       deviceName,
+			InitializeParams: &compute.AttachedDiskInitializeParams{DiskType: "local-ssd"},
+			Interface:        iface,
+			Type:             "SCRATCH",
+		})
+	} else if t.instancebeta != nil {
+		t.instancebeta.Disks = append(t.instancebeta.Disks, &computeBeta.AttachedDisk{
+			AutoDelete:       true,
+			DeviceName:       deviceName,
+			InitializeParams: &computeBeta.AttachedDiskInitializeParams{DiskType: "local-ssd"},
+			Interface:        iface,
+			Type:             "SCRATCH",
+		})
+	}
+	return nil
+}
+
+// SetDiskInterface attaches the boot disk and mount disks of the VM with the
+// given interface, NVME or SCSI, instead of the default interface of the
+// machine type. The interface is checked against the machine type currently
+// set on the VM, so ForceMachineType must be called first if it is used.
+func (t *TestVM) SetDiskInterface(iface string) error {
+	machineType := t.testWorkflow.MachineType.Name
+	if t.instance != nil && t.instance.MachineType != "" {
+		machineType = t.instance.MachineType
+	} else if t.instancebeta != nil && t.instancebeta.MachineType != "" {
+		machineType = t.instancebeta.MachineType
+	}
+	if err := validateDiskInterface(machineType, iface); err != nil {
+		return fmt.Errorf("failed to set disk interface of VM %s: %v", t.name, err)
+	}
+	if t.instance != nil {
+		for _, d := range t.instance.Disks {
+			if d.Type != "SCRATCH" {
+				d.Interface = iface
+			}
+		}
+	} else if t.instancebeta != nil {
+		for _, d := range t.instancebeta.Disks {
+			if d.Type != "SCRATCH" {
+				d.Interface = iface
+			}
+		}
+	}
+	return nil
+}
+
+// kmsKeyRgx matches the resource name of a Cloud KMS key.
+var kmsKeyRgx = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+(/cryptoKeyVersions/[^/]+)?$`)
+
+// SetDiskEncryptionKey encrypts the boot disk and mount disks created for the
+// VM with the given Cloud KMS key, in the format
+// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+// The Compute Engine service agent of the project needs permission to
+// encrypt and decrypt with the key.
+func (t *TestVM) SetDiskEncryptionKey(kmsKeyName string) error {
+	if !kmsKeyRgx.MatchString(kmsKeyName) {
+		return fmt.Errorf("failed to set disk encryption key of VM %s: %q is not a KMS key name", t.name, kmsKeyName)
+	}
+	for _, disk := range t.createdDisks() {
+		disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: kmsKeyName}
+	}
+	return nil
+}
+
+// SetDiskCustomerEncryptionKey encrypts the boot disk and mount disks created
+// for the VM with a customer-supplied encryption key: a base64 encoded
+// 256-bit AES key, or if rsaWrapped is set, such a key wrapped with the
+// Google public RSA certificate. The key is only added to the workflow when it
+// runs, so it is not printed with the workflow. Daisy can't supply the key
+// when starting a VM, so VMs with such disks can't be rebooted with Reboot.
+func (t *TestVM) SetDiskCustomerEncryptionKey(key string, rsaWrapped bool) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("failed to set disk encryption key of VM %s: key is not base64 encoded", t.name)
+	}
+	encryptionKey := &compute.CustomerEncryptionKey{RawKey: key}
+	wantLen := 32
+	if rsaWrapped {
+		encryptionKey = &compute.CustomerEncryptionKey{RsaEncryptedKey: key}
+		wantLen = 256
+	}
+	if len(decoded) != wantLen {
+		// The key itself is not part of the error, which may be logged.
+		return fmt.Errorf("failed to set disk encryption key of VM %s: key is %d bytes long, want %d", t.name, len(decoded), wantLen)
+	}
+	if t.testWorkflow.diskKeys == nil {
+		t.testWorkflow.diskKeys = make(map[string]*compute.CustomerEncryptionKey)
+	}
+	for _, disk := range t.createdDisks() {
+		t.testWorkflow.diskKeys[disk.Name] = encryptionKey
+	}
+	return nil
+}
+
+// createdDisks returns the disks attached to the VM at creation which the
+// workflow creates.
+func (t *TestVM) createdDisks() []*daisy.Disk {
+	var sources []string
+	if t.instance != nil {
+		for _, d := range t.instance.Disks {
+			sources = append(sources, d.Source)
+		}
+	} else if t.instancebeta != nil {
+		for _, d := range t.instancebeta.Disks {
+			sources = append(sources, d.Source)
+		}
+	}
+	var disks []*daisy.Disk
+	for _, step := range t.testWorkflow.wf.Steps {
+		if step.CreateDisks == nil {
+			continue
+		}
+		for _, disk := range *step.CreateDisks {
+			if slices.Contains(sources, disk.Name) {
+				disks = append(disks, disk)
+			}
+		}
+	}
+	return disks
+}
+
+// SetBootDiskAutoDelete sets whether the boot disk is deleted along with the
+// VM, which it is by default. A boot disk kept after its VM is deleted, e.g.
+// to attach it to another VM, is still deleted when the workflow is cleaned up.
+func (t *TestVM) SetBootDiskAutoDelete(autoDelete bool) {
+	if t.instance != nil && len(t.instance.Disks) > 0 {
+		t.instance.Disks[0].AutoDelete = autoDelete
+	} else if t.instancebeta != nil && len(t.instancebeta.Disks) > 0 {
+		t.instancebeta.Disks[0].AutoDelete = autoDelete
+	}
+}
+
+// SetDeletionProtection sets whether the VM is protected from deletion. The
+// protection is cleared when the workflow is cleaned up, so that the VM can be
+// deleted.
+func (t *TestVM) SetDeletionProtection(protect bool) {
+	if t.instance != nil {
+		t.instance.DeletionProtection = protect
+	} else if t.instancebeta != nil {
+		t.instancebeta.DeletionProtection = protect
+	}
+}
+
+// localSSDCount returns the number of local SSDs attached to the instance.
+func (t *TestVM) localSSDCount() int {
+	var count int
+	if t.instance != nil {
+		for _, d := range t.instance.Disks {
+			if d.Type == "SCRATCH" {
+				count++
+			}
+		}
+	} else if t.instancebeta != nil {
+		for _, d := range t.instancebeta.Disks {
+			if d.Type == "SCRATCH" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// EnableConfidentialCompute enables the given confidential instance type, one
+// of SEV, SEV_SNP or TDX, on the instance. SEV_SNP and TDX are only available
+// in the beta API, so a VM created from the GA API is converted to a beta
+// instance. The machine type currently set on the VM must support the
+// confidential instance type, so ForceMachineType must be called first if it
+// is used.
+func (t *TestVM) EnableConfidentialCompute(confidentialInstanceType string) error {
+	machineType := t.testWorkflow.MachineType.Name
+	if t.instance != nil && t.instance.MachineType != "" {
+		machineType = t.instance.MachineType
+	} else if t.instancebeta != nil && t.instancebeta.MachineType != "" {
+		machineType = t.instancebeta.MachineType
+	}
+	if err := validateConfidentialInstanceType(machineType, confidentialInstanceType); err != nil {
+		return fmt.Errorf("failed to enable confidential compute on VM %s: %v", t.name, err)
+	}
+
+	if t.instance != nil && confidentialInstanceType != "SEV" {
+		beta, err := t.testWorkflow.convertInstanceToBeta(t.instance)
+		if err != nil {
+			return err
+		}
+		t.instance = nil
+		t.instancebeta = beta
+	}
+
+	if t.instance != nil {
+		// The GA API only supports SEV, which is enabled by default.
+		t.instance.ConfidentialInstanceConfig = &compute.ConfidentialInstanceConfig{EnableConfidentialCompute: true}
+		if t.instance.Scheduling == nil {
+			t.instance.Scheduling = &compute.Scheduling{}
+		}
+		t.instance.Scheduling.OnHostMaintenance = "TERMINATE"
+	} else if t.instancebeta != nil {
+		t.instancebeta.ConfidentialInstanceConfig = &computeBeta.ConfidentialInstanceConfig{
+			ConfidentialInstanceType:  confidentialInstanceType,
+			EnableConfidentialCompute: true,
+		}
+		if t.instancebeta.Scheduling == nil {
+			t.instancebeta.Scheduling = &computeBeta.Scheduling{}
+		}
+		t.instancebeta.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+	return nil
+}
+
+// SetSpot makes the instance a Spot VM, which is stopped or deleted according
+// to terminationAction, STOP or DELETE, when it is preempted. Spot VMs can't
+// be restarted automatically or live migrated.
+func (t *TestVM) SetSpot(terminationAction string) error {
+	if terminationAction != "STOP" && terminationAction != "DELETE" {
+		return fmt.Errorf("failed to make VM %s a spot VM: termination action must be STOP or DELETE, got %q", t.name, terminationAction)
+	}
+	automaticRestart := false
+	if t.instance != nil {
+		if t.instance.Scheduling == nil {
+			t.instance.Scheduling = &compute.Scheduling{}
+		}
+		t.instance.Scheduling.ProvisioningModel = "SPOT"
+		t.instance.Scheduling.Preemptible = true
+		t.instance.Scheduling.InstanceTerminationAction = terminationAction
+		t.instance.Scheduling.AutomaticRestart = &automaticRestart
+		t.instance.Scheduling.OnHostMaintenance = "TERMINATE"
+	} else if t.instancebeta != nil {
+		if t.instancebeta.Scheduling == nil {
+			t.instancebeta.Scheduling = &computeBeta.Scheduling{}
+		}
+		t.instancebeta.Scheduling.ProvisioningModel = "SPOT"
+		t.instancebeta.Scheduling.Preemptible = true
+		t.instancebeta.Scheduling.InstanceTerminationAction = terminationAction
+		t.instancebeta.Scheduling.AutomaticRestart = &automaticRestart
+		t.instancebeta.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+	return nil
+}
+
+// SetOnHostMaintenance sets whether the instance is live migrated, MIGRATE, or
+// stopped, TERMINATE, during host maintenance events. VMs with accelerators,
+// confidential computing or spot provisioning can't be live migrated, and
+// already terminate on host maintenance.
+func (t *TestVM) SetOnHostMaintenance(policy string) error {
+	if policy != "MIGRATE" && policy != "TERMINATE" {
+		return fmt.Errorf("failed to set host maintenance policy on VM %s: policy must be MIGRATE or TERMINATE, got %q", t.name, policy)
+	}
+	if policy == "MIGRATE" {
+		var accelerated, confidential, spot bool
+		if t.instance != nil {
+			accelerated = len(t.instance.GuestAccelerators) > 0
+			confidential = t.instance.ConfidentialInstanceConfig != nil && t.instance.ConfidentialInstanceConfig.EnableConfidentialCompute
+			spot = t.instance.Scheduling != nil && t.instance.Scheduling.Preemptible
+		} else if t.instancebeta != nil {
+			accelerated = len(t.instancebeta.GuestAccelerators) > 0
+			confidential = t.instancebeta.ConfidentialInstanceConfig != nil && t.instancebeta.ConfidentialInstanceConfig.EnableConfidentialCompute
+			spot = t.instancebeta.Scheduling != nil && t.instancebeta.Scheduling.Preemptible
+		}
+		switch {
+		case accelerated:
+			return fmt.Errorf("failed to set host maintenance policy on VM %s: VMs with accelerators can't be live migrated", t.name)
+		case confidential:
+			return fmt.Errorf("failed to set host maintenance policy on VM %s: confidential VMs can't be live migrated", t.name)
+		case spot:
+			return fmt.Errorf("failed to set host maintenance policy on VM %s: spot VMs can't be live migrated", t.name)
+		}
+	}
+	if t.instance != nil {
+		if t.instance.Scheduling == nil {
+			t.instance.Scheduling = &compute.Scheduling{}
+		}
+		t.instance.Scheduling.OnHostMaintenance = policy
+	} else if t.instancebeta != nil {
+		if t.instancebeta.Scheduling == nil {
+			t.instancebeta.Scheduling = &computeBeta.Scheduling{}
+		}
+		t.instancebeta.Scheduling.OnHostMaintenance = policy
+	}
+	return nil
+}
+
+// SetAutomaticRestart sets whether the instance is restarted after it is
+// stopped by a host event, which it is by default. Spot and preemptible VMs
+// can't be restarted automatically.
+func (t *TestVM) SetAutomaticRestart(restart bool) error {
+	if restart {
+		if (t.instance != nil && t.instance.Scheduling != nil && t.instance.Scheduling.Preemptible) ||
+			(t.instancebeta != nil && t.instancebeta.Scheduling != nil && t.instancebeta.Scheduling.Preemptible) {
+			return fmt.Errorf("failed to enable automatic restart on VM %s: preemptible VMs can't be restarted automatically", t.name)
+		}
+	}
+	if t.instance != nil {
+		if t.instance.Scheduling == nil {
+			t.instance.Scheduling = &compute.Scheduling{}
+		}
+		t.instance.Scheduling.AutomaticRestart = &restart
+	} else if t.instancebeta != nil {
+		if t.instancebeta.Scheduling == nil {
+			t.instancebeta.Scheduling = &computeBeta.Scheduling{}
+		}
+		t.instancebeta.Scheduling.AutomaticRestart = &restart
+	}
+	return nil
+}
+
+// SetNodeAffinity schedules the instance on sole-tenant nodes matching the
+// node affinities. Each affinity must have an operator of IN or NOT_IN.
+func (t *TestVM) SetNodeAffinity(affinities []*compute.SchedulingNodeAffinity) error {
+	if len(affinities) == 0 {
+		return fmt.Errorf("failed to set node affinity on VM %s: no node affinities", t.name)
+	}
+	for _, a := range affinities {
+		if a == nil || (a.Operator != "IN" && a.Operator != "NOT_IN") {
+			return fmt.Errorf("failed to set node affinity on VM %s: operator must be IN or NOT_IN, got %+v", t.name, a)
+		}
+	}
+	if t.instance != nil {
+		if t.instance.Scheduling == nil {
+			t.instance.Scheduling = &compute.Scheduling{}
+		}
+		t.instance.Scheduling.NodeAffinities = affinities
+	} else if t.instancebeta != nil {
+		if t.instancebeta.Scheduling == nil {
+			t.instancebeta.Scheduling = &computeBeta.Scheduling{}
+		}
+		t.instancebeta.Scheduling.NodeAffinities = nil
+		for _, a := range affinities {
+			t.instancebeta.Scheduling.NodeAffinities = append(t.instancebeta.Scheduling.NodeAffinities, &computeBeta.SchedulingNodeAffinity{Key: a.Key, Operator: a.Operator, Values: a.Values})
+		}
+	}
+	return nil
+}
+
+// SetReservationAffinity sets which reservations the instance consumes. The
+// consume reservation type must be ANY_RESERVATION, SPECIFIC_RESERVATION or
+// NO_RESERVATION, and a specific reservation must be named by the key and
+// values of the affinity. A nil affinity restores the default.
+func (t *TestVM) SetReservationAffinity(affinity *compute.ReservationAffinity) error {
+	if affinity != nil {
+		switch affinity.ConsumeReservationType {
+		case "ANY_RESERVATION", "NO_RESERVATION":
+		case "SPECIFIC_RESERVATION":
+			if affinity.Key == "" || len(affinity.Values) == 0 {
+				return fmt.Errorf("failed to set reservation affinity on VM %s: a specific reservation needs a key and values", t.name)
+			}
+		default:
+			return fmt.Errorf("failed to set reservation affinity on VM %s: consume reservation type must be ANY_RESERVATION, SPECIFIC_RESERVATION or NO_RESERVATION, got %q", t.name, affinity.ConsumeReservationType)
+		}
+	}
+	if t.instance != nil {
+		t.instance.ReservationAffinity = affinity
+	} else if t.instancebeta != nil {
+		t.instancebeta.ReservationAffinity = nil
+		if affinity != nil {
+			t.instancebeta.ReservationAffinity = &computeBeta.ReservationAffinity{ConsumeReservationType: affinity.ConsumeReservationType, Key: affinity.Key, Values: affinity.Values}
+		}
+	}
+	return nil
+}
+
+// NodeGroupAffinity returns a node affinity which schedules VMs on the node
+// group of the workflow, or an error if the workflow has no node group.
+func (t *TestWorkflow) NodeGroupAffinity() (*compute.SchedulingNodeAffinity, error) {
+	if t.NodeGroup == "" {
+		return nil, fmt.Errorf("test workflow %s has no node group", t.Name)
+	}
+	return &compute.SchedulingNodeAffinity{
+		Key:      "compute.googleapis.com/node-group-name",
+		Operator: "IN",
+		Values:   []string{t.NodeGroup},
+	}, nil
+}
+
+// SetMinCPUPlatform sets the minimum CPU platform of the instance, e.g.
+// "Intel Ice Lake", which must be available for its machine type.
+func (t *TestVM) SetMinCPUPlatform(minCPUPlatform string) error {
+	if minCPUPlatform == "" {
+		return fmt.Errorf("minimum CPU platform of VM %s must not be empty", t.name)
+	}
 	if t.instance != nil {
 		t.instance.MinCpuPlatform = minCPUPlatform
 	} else if t.instancebeta != nil {
 		t.instancebeta.MinCpuPlatform = minCPUPlatform
 	}
+	return nil
 }
 
 // UseGVNIC sets the type of vNIC to be used to GVNIC
 func (t *TestVM) UseGVNIC() {
+	t.setNicType("GVNIC")
+}
+
+// UseVirtioNet sets the type of vNIC to be used to VIRTIO_NET, rather than
+// leaving it to the default of the machine type. Machine types which only
+// support gVNIC can't use it, see SupportsVirtioNet.
+func (t *TestVM) UseVirtioNet() {
+	t.setNicType("VIRTIO_NET")
+}
+
+// setNicType sets the vNIC type of the primary network interface.
+func (t *TestVM) setNicType(nicType string) {
 	if t.instance != nil {
 		if t.instance.NetworkInterfaces == nil {
 			t.instance.NetworkInterfaces = []*compute.NetworkInterface{
 				{
-					NicType: "GVNIC",
+					NicType: nicType,
 				},
 			}
 		} else {
-			t.instance.NetworkInterfaces[0].NicType = "GVNIC"
+			t.instance.NetworkInterfaces[0].NicType = nicType
 		}
 	} else if t.instancebeta != nil {
 		if t.instancebeta.NetworkInterfaces == nil {
 			t.instancebeta.NetworkInterfaces = []*computeBeta.NetworkInterface{
 				{
-					NicType: "GVNIC",
+					NicType: nicType,
 				},
 			}
 		} else {
-			t.instancebeta.NetworkInterfaces[0].NicType = "GVNIC"
+			t.instancebeta.NetworkInterfaces[0].NicType = nicType
 		}
 	}
 }
 
+// EnableIPForwarding allows the test VM to send and receive packets with
+// source or destination addresses other than its own, as NAT and router VMs
+// do.
+func (t *TestVM) EnableIPForwarding() {
+	if t.instance != nil {
+		t.instance.CanIpForward = true
+	} else if t.instancebeta != nil {
+		t.instancebeta.CanIpForward = true
+	}
+}
+
 // AddCustomNetwork add current test VMs in workflow using provided network and
 // subnetwork. If subnetwork is empty, not using subnetwork, in this case
 // network has to be in auto mode VPC.
@@ -728,6 +1913,119 @@ func (t *TestVM) AddCustomNetwork(network *Network, subnetwork *Subnetwork) erro
 	return nil
 }
 
+// AddNetworkInterface adds a network interface on the given network and
+// subnetwork to the test VM. The network and subnetwork are created by the
+// workflow if they don't exist yet, with an automatically assigned IP range
+// for the subnetwork, or the ranges set with SetSubnetCIDR. If subnet is empty, the network is created in auto mode.
+// The VM keeps its default network interface as the first interface, and the
+// number of interfaces is capped by the limit of the machine type.
+func (t *TestVM) AddNetworkInterface(network, subnet string) error {
+	machineType := ""
+	var nics []string
+	if t.instance != nil {
+		machineType = t.instance.MachineType
+		for _, nic := range t.instance.NetworkInterfaces {
+			nics = append(nics, nic.Network)
+		}
+	} else if t.instancebeta != nil {
+		machineType = t.instancebeta.MachineType
+		for _, nic := range t.instancebeta.NetworkInterfaces {
+			nics = append(nics, nic.Network)
+		}
+	}
+	if len(nics) == 0 {
+		// The default interface is created by daisy if none is set.
+		nics = append(nics, "default")
+	}
+	if limit := maxNetworkInterfaces(machineType, t.testWorkflow.MachineType); len(nics)+1 > limit {
+		return fmt.Errorf("failed to add network interface to VM %s: machine type supports at most %d network interfaces", t.name, limit)
+	}
+	if slices.Contains(nics, network) {
+		return fmt.Errorf("failed to add network interface to VM %s: VM already has an interface on network %s", t.name, network)
+	}
+
+	createVMStep, err := t.testWorkflow.getCreateStepForVM(t.name)
+	if err != nil {
+		return err
+	}
+	n, err := t.testWorkflow.getOrCreateNetwork(network, subnet == "")
+	if err != nil {
+		return err
+	}
+	if err := t.testWorkflow.wf.AddDependency(createVMStep, t.testWorkflow.wf.Steps[createNetworkStepName]); err != nil {
+		return err
+	}
+	var sn *Subnetwork
+	if subnet != "" {
+		if sn, err = n.getOrCreateSubnetwork(subnet); err != nil {
+			return err
+		}
+		if err := t.testWorkflow.wf.AddDependency(createVMStep, t.testWorkflow.wf.Steps[createSubnetworkStepName]); err != nil {
+			return err
+		}
+	}
+
+	if t.instance != nil && len(t.instance.NetworkInterfaces) == 0 {
+		t.instance.NetworkInterfaces = []*compute.NetworkInterface{{}}
+	} else if t.instancebeta != nil && len(t.instancebeta.NetworkInterfaces) == 0 {
+		t.instancebeta.NetworkInterfaces = []*computeBeta.NetworkInterface{{}}
+	}
+	return t.AddCustomNetwork(n, sn)
+}
+
+// SetStackType sets the stack type of the first network interface of the test
+// VM to IPV4_ONLY, IPV4_IPV6 or IPV6_ONLY. The interface must be on a
+// subnetwork created by the workflow, which is given an external IPv6 range
+// for stack types with IPv6.
+func (t *TestVM) SetStackType(stackType string) error {
+	if stackType != "IPV4_ONLY" && stackType != "IPV4_IPV6" && stackType != "IPV6_ONLY" {
+		return fmt.Errorf("failed to set stack type on VM %s: stack type must be IPV4_ONLY, IPV4_IPV6 or IPV6_ONLY, got %q", t.name, stackType)
+	}
+	var subnetName string
+	if t.instance != nil && len(t.instance.NetworkInterfaces) > 0 {
+		subnetName = t.instance.NetworkInterfaces[0].Subnetwork
+	} else if t.instancebeta != nil && len(t.instancebeta.NetworkInterfaces) > 0 {
+		subnetName = t.instancebeta.NetworkInterfaces[0].Subnetwork
+	}
+	subnet := t.testWorkflow.getSubnetwork(subnetName)
+	if subnet == nil {
+		return fmt.Errorf("failed to set stack type on VM %s: the first network interface must be on a subnetwork created by the workflow, use AddCustomNetwork first", t.name)
+	}
+	if stackType != "IPV4_ONLY" {
+		// Subnetworks shared with other VMs keep IPv6 enabled.
+		subnet.StackType = stackType
+		subnet.Ipv6AccessType = "EXTERNAL"
+	}
+
+	if t.instance != nil {
+		nic := t.instance.NetworkInterfaces[0]
+		nic.StackType = stackType
+		nic.Ipv6AccessType = ""
+		nic.Ipv6AccessConfigs = nil
+		if stackType != "IPV4_ONLY" {
+			nic.Ipv6AccessType = "EXTERNAL"
+			nic.Ipv6AccessConfigs = []*compute.AccessConfig{{Name: "external-ipv6", Type: "DIRECT_IPV6"}}
+		}
+		if stackType == "IPV6_ONLY" {
+			// An empty list stops daisy from adding the default IPv4 access config.
+			nic.AccessConfigs = []*compute.AccessConfig{}
+		}
+	} else if t.instancebeta != nil {
+		nic := t.instancebeta.NetworkInterfaces[0]
+		nic.StackType = stackType
+		nic.Ipv6AccessType = ""
+		nic.Ipv6AccessConfigs = nil
+		if stackType != "IPV4_ONLY" {
+			nic.Ipv6AccessType = "EXTERNAL"
+			nic.Ipv6AccessConfigs = []*computeBeta.AccessConfig{{Name: "external-ipv6", Type: "DIRECT_IPV6"}}
+		}
+		if stackType == "IPV6_ONLY" {
+			nic.AccessConfigs = []*computeBeta.AccessConfig{}
+		}
+	}
+	return nil
+}
+
 // AddAliasIPRanges add alias ip range to current test VMs.
 func (t *TestVM) AddAliasIPRanges(aliasIPRange, rangeName string) error {
 	// TODO: If we haven't set any NetworkInterface struct, does it make sense to support adding alias IPs?
@@ -796,14 +2094,17 @@ type Subnetwork struct {
 // CreateNetwork creates custom network. Using AddCustomNetwork method provided by
 // TestVM to config network on vm
 func (t *TestWorkflow) CreateNetwork(networkName string, autoCreateSubnetworks bool) (*Network, error) {
-	createNetworkStep, network, err := t.appendCreateNetworkStep(networkName, DefaultMTU, autoCreateSubnetworks)
+	mtu := DefaultMTU
+	if t.networkMTU != 0 {
+		mtu = t.networkMTU
+	}
+	createNetworkStep, network, err := t.appendCreateNetworkStep(networkName, mtu, autoCreateSubnetworks)
 	if err != nil {
 		return nil, err
 	}
 
-	createVMsStep, ok := t.wf.Steps[createVMsStepName]
-	if ok {
-		if err := t.wf.AddDependency(createVMsStep, createNetworkStep); err != nil {
+	for _, name := range t.getCreateStepNames(createVMsStepName) {
+		if err := t.wf.AddDependency(t.wf.Steps[name], createNetworkStep); err != nil {
 			return nil, err
 		}
 	}
@@ -811,11 +2112,50 @@ func (t *TestWorkflow) CreateNetwork(networkName string, autoCreateSubnetworks b
 	return &Network{networkName, t, network}, nil
 }
 
-// SetMTU sets the MTU of the network. The MTU must be between 1460 and 8896, inclusively.
-func (n *Network) SetMTU(mtu int) {
-	if mtu >= DefaultMTU && mtu <= JumboFramesMTU {
-		n.network.Mtu = int64(mtu)
+// getOrCreateNetwork returns the network with the given name created by the
+// workflow, creating it if it doesn't exist.
+func (t *TestWorkflow) getOrCreateNetwork(networkName string, autoCreateSubnetworks bool) (*Network, error) {
+	if step, ok := t.wf.Steps[createNetworkStepName]; ok {
+		for _, n := range *step.CreateNetworks {
+			if n.Name == networkName {
+				return &Network{networkName, t, n}, nil
+			}
+		}
+	}
+	return t.CreateNetwork(networkName, autoCreateSubnetworks)
+}
+
+// SetMTU sets the MTU of the network. The MTU must be between 1300 and 8896, inclusively.
+func (n *Network) SetMTU(mtu int) error {
+	if err := validateMTU(mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of network %s: %v", n.name, err)
+	}
+	n.network.Mtu = int64(mtu)
+	return nil
+}
+
+// SetNetworkMTU sets the MTU of the networks created by the workflow, instead
+// of DefaultMTU, including the networks already created. The MTU must be
+// between 1300 and 8896, inclusively. Networks can still be given their own
+// MTU with SetMTU.
+func (t *TestWorkflow) SetNetworkMTU(mtu int) error {
+	if err := validateMTU(mtu); err != nil {
+		return err
+	}
+	t.networkMTU = mtu
+	if step, ok := t.wf.Steps[createNetworkStepName]; ok {
+		for _, n := range *step.CreateNetworks {
+			n.Mtu = int64(mtu)
+		}
 	}
+	return nil
+}
+
+func validateMTU(mtu int) error {
+	if mtu < MinMTU || mtu > JumboFramesMTU {
+		return fmt.Errorf("MTU %d is not between %d and %d", mtu, MinMTU, JumboFramesMTU)
+	}
+	return nil
 }
 
 // CreateSubnetwork creates custom subnetwork. Using AddCustomNetwork method
@@ -836,6 +2176,111 @@ func (n *Network) CreateSubnetwork(name string, ipRange string) (*Subnetwork, er
 	return &Subnetwork{name, n.testWorkflow, subnetwork, n}, nil
 }
 
+// getSubnetwork returns the subnetwork with the given name created by the
+// workflow, or nil if there is none.
+func (t *TestWorkflow) getSubnetwork(name string) *daisy.Subnetwork {
+	step, ok := t.wf.Steps[createSubnetworkStepName]
+	if !ok || name == "" {
+		return nil
+	}
+	for _, sn := range *step.CreateSubnetworks {
+		if sn.Name == name {
+			return sn
+		}
+	}
+	return nil
+}
+
+// getOrCreateSubnetwork returns the subnetwork of the network with the given
+// name created by the workflow, creating it with the next free IP range in
+// 192.168.0.0/16 if it doesn't exist.
+func (n *Network) getOrCreateSubnetwork(name string) (*Subnetwork, error) {
+	var count int
+	if step, ok := n.testWorkflow.wf.Steps[createSubnetworkStepName]; ok {
+		for _, sn := range *step.CreateSubnetworks {
+			if sn.Name == name {
+				if sn.Network != n.name {
+					return nil, fmt.Errorf("subnetwork %s belongs to network %s, not %s", name, sn.Network, n.name)
+				}
+				return &Subnetwork{name, n.testWorkflow, sn, n}, nil
+			}
+		}
+		count = len(*step.CreateSubnetworks)
+	}
+	if n.testWorkflow.subnetCIDR != "" {
+		return n.createSubnetworkWithCIDR(name)
+	}
+	if count > 255 {
+		return nil, fmt.Errorf("no free IP range for subnetwork %s", name)
+	}
+	return n.CreateSubnetwork(name, fmt.Sprintf("192.168.%d.0/24", count))
+}
+
+// createSubnetworkWithCIDR creates a subnetwork with the IP ranges set with
+// SetSubnetCIDR. They can only be used by one subnetwork of the network.
+func (n *Network) createSubnetworkWithCIDR(name string) (*Subnetwork, error) {
+	t := n.testWorkflow
+	if step, ok := t.wf.Steps[createSubnetworkStepName]; ok {
+		for _, sn := range *step.CreateSubnetworks {
+			if sn.Network == n.name && sn.IpCidrRange == t.subnetCIDR {
+				return nil, fmt.Errorf("failed to create subnetwork %s: subnetwork %s of network %s already uses IP range %s", name, sn.Name, n.name, t.subnetCIDR)
+			}
+		}
+	}
+	sn, err := n.CreateSubnetwork(name, t.subnetCIDR)
+	if err != nil {
+		return nil, err
+	}
+	var rangeNames []string
+	for rangeName := range t.subnetSecondaryRanges {
+		rangeNames = append(rangeNames, rangeName)
+	}
+	sort.Strings(rangeNames)
+	for _, rangeName := range rangeNames {
+		sn.AddSecondaryRange(rangeName, t.subnetSecondaryRanges[rangeName])
+	}
+	return sn, nil
+}
+
+// SetSubnetCIDR sets the primary IP range and the secondary IP ranges, by
+// range name, of the subnetworks the workflow creates for the network
+// interfaces of VMs, instead of the next free /24 in 192.168.0.0/16. The
+// ranges must be valid CIDRs which don't overlap. As the ranges of the
+// subnetworks of a network can't overlap either, only one such subnetwork can
+// be created per network.
+func (t *TestWorkflow) SetSubnetCIDR(primary string, secondaryRanges map[string]string) error {
+	_, primaryNet, err := net.ParseCIDR(primary)
+	if err != nil {
+		return fmt.Errorf("invalid primary IP range: %v", err)
+	}
+	type ipRange struct {
+		name  string
+		ipNet *net.IPNet
+	}
+	ranges := []ipRange{{"primary", primaryNet}}
+	for rangeName, cidr := range secondaryRanges {
+		if rangeName == "" {
+			return fmt.Errorf("secondary IP range %s has an empty name", cidr)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid secondary IP range %s: %v", rangeName, err)
+		}
+		ranges = append(ranges, ipRange{rangeName, ipNet})
+	}
+	sort.Slice(ranges[1:], func(i, j int) bool { return ranges[i+1].name < ranges[j+1].name })
+	for i, a := range ranges {
+		for _, b := range ranges[i+1:] {
+			if a.ipNet.Contains(b.ipNet.IP) || b.ipNet.Contains(a.ipNet.IP) {
+				return fmt.Errorf("IP range %s (%s) overlaps IP range %s (%s)", a.name, a.ipNet, b.name, b.ipNet)
+			}
+		}
+	}
+	t.subnetCIDR = primary
+	t.subnetSecondaryRanges = maps.Clone(secondaryRanges)
+	return nil
+}
+
 // SetRegion sets the subnetwork region
 func (s *Subnetwork) SetRegion(region string) {
 	s.subnetwork.Region = region
@@ -895,6 +2340,48 @@ func (t *TestWorkflow) appendCreateFirewallStep(firewallName, networkName, proto
 	return createFirewallStep, firewall, nil
 }
 
+// resourcePolicyRgx matches the partial URL of a resource policy, capturing
+// its region.
+var resourcePolicyRgx = regexp.MustCompile(`^(?:https://www\.googleapis\.com/compute/v1/)?projects/[^/]+/regions/([^/]+)/resourcePolicies/[^/]+$`)
+
+// AttachResourcePolicy attaches a resource policy, such as a snapshot
+// schedule, to a disk created by the workflow. The policy is given by its
+// partial URL, and must be in the region of the disk. Policies whose names end
+// with the workflow ID, like the names of workflow resources, are deleted
+// when the workflow is cleaned up.
+func (t *TestWorkflow) AttachResourcePolicy(disk, policyURL string) error {
+	m := resourcePolicyRgx.FindStringSubmatch(policyURL)
+	if m == nil {
+		return fmt.Errorf("invalid resource policy %q, must be projects/<project>/regions/<region>/resourcePolicies/<name>", policyURL)
+	}
+	var d *daisy.Disk
+	for _, step := range t.wf.Steps {
+		if step.CreateDisks == nil {
+			continue
+		}
+		for _, created := range *step.CreateDisks {
+			if created.Name == disk {
+				d = created
+			}
+		}
+	}
+	if d == nil {
+		return fmt.Errorf("failed to attach resource policy to disk %s: disk is not created by the workflow", disk)
+	}
+	zone := t.Zone.Name
+	if d.Zone != "" {
+		zone = path.Base(d.Zone)
+	}
+	if i := strings.LastIndex(zone, "-"); i != -1 && zone[:i] != m[1] {
+		return fmt.Errorf("failed to attach resource policy %s to disk %s: policy is in region %s, disk is in zone %s", policyURL, disk, m[1], zone)
+	}
+	if !slices.Contains(d.ResourcePolicies, policyURL) {
+		d.ResourcePolicies = append(d.ResourcePolicies, policyURL)
+	}
+	t.resourcePolicies = append(t.resourcePolicies, policyURL)
+	return nil
+}
+
 // AddSSHKey generate ssh key pair and return public key.
 func (t *TestWorkflow) AddSSHKey(user string) (string, error) {
 	keyFileName := os.TempDir() + "/id_rsa_" + uuid.New().String()
@@ -920,6 +2407,62 @@ func (t *TestWorkflow) AddSSHKey(user string) (string, error) {
 	return string(publicKey), nil
 }
 
+// AddFirewallRule opens ports on the network of the test VMs, which is the
+// first network created by the workflow, or the default network of the
+// project if it creates none, so networks need to be created first. The rule
+// allows the protocol, one of tcp, udp or icmp, on the given ports or port
+// ranges such as "5201" or "8000-8080", from the source ranges, or from
+// DefaultSourceRange if nil. ICMP rules take no ports. The default rules for
+// SSH and RDP are unaffected, and the rule is deleted when the workflow is
+// cleaned up.
+func (t *TestWorkflow) AddFirewallRule(name, protocol string, ports, sourceRanges []string) error {
+	if err := validateFirewallRule(protocol, ports, sourceRanges); err != nil {
+		return fmt.Errorf("invalid firewall rule %s: %v", name, err)
+	}
+	network := "default"
+	if step, ok := t.wf.Steps[createNetworkStepName]; ok && len(*step.CreateNetworks) > 0 {
+		network = (*step.CreateNetworks)[0].Name
+	}
+	n := &Network{name: network, testWorkflow: t}
+	if err := n.CreateFirewallRule(name, protocol, ports, sourceRanges); err != nil {
+		return err
+	}
+	t.firewallRules = append(t.firewallRules, name)
+	return nil
+}
+
+func validateFirewallRule(protocol string, ports, sourceRanges []string) error {
+	switch protocol {
+	case "tcp", "udp":
+	case "icmp":
+		if len(ports) > 0 {
+			return fmt.Errorf("icmp rules can't have ports")
+		}
+	default:
+		return fmt.Errorf("protocol %q is not one of tcp, udp or icmp", protocol)
+	}
+	for _, p := range ports {
+		first, last, isRange := strings.Cut(p, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 1 || from > 65535 {
+			return fmt.Errorf("port %q is not a port number or range of port numbers", p)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || to < from || to > 65535 {
+			return fmt.Errorf("port %q is not a port number or range of port numbers", p)
+		}
+	}
+	for _, r := range sourceRanges {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return fmt.Errorf("source range %q is not a CIDR range", r)
+		}
+	}
+	return nil
+}
+
 // CreateFirewallRule create firewall rule.
 func (n *Network) CreateFirewallRule(firewallName, protocol string, ports, ranges []string) error {
 	createFirewallStep, _, err := n.testWorkflow.appendCreateFirewallStep(firewallName, n.name, protocol, ports, ranges)
@@ -933,9 +2476,8 @@ func (n *Network) CreateFirewallRule(firewallName, protocol string, ports, range
 			return err
 		}
 	}
-	createVMsStep, ok := n.testWorkflow.wf.Steps[createVMsStepName]
-	if ok {
-		if err := n.testWorkflow.wf.AddDependency(createVMsStep, createFirewallStep); err != nil {
+	for _, name := range n.testWorkflow.getCreateStepNames(createVMsStepName) {
+		if err := n.testWorkflow.wf.AddDependency(n.testWorkflow.wf.Steps[name], createFirewallStep); err != nil {
 			return err
 		}
 	}
@@ -15,8 +15,15 @@
 package imagetest
 
 import (
+	"context"
+	"encoding/base64"
+	"maps"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 	daisy "github.com/GoogleCloudPlatform/compute-daisy"
@@ -131,6 +138,67 @@ func TestResume(t *testing.T) {
 	}
 }
 
+// TestCreateTestVMFromSnapshot tests that a VM restored from a snapshot in the
+// workflow is created only after the snapshot has been taken.
+func TestCreateTestVMFromSnapshot(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.Image.Architecture = "ARM64"
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if _, err := tvm.CreateSnapshot(&compute.Disk{Name: "vm"}, "snap"); err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	restored, err := twf.CreateTestVMFromSnapshot("restored", "snap")
+	if err != nil {
+		t.Fatalf("failed to create test vm from snapshot: %v", err)
+	}
+	if restored.instance == nil || len(restored.instance.Disks) != 1 || restored.instance.Disks[0].Source != "restored" {
+		t.Errorf("restored vm has unexpected instance %+v", restored.instance)
+	}
+	diskStep, ok := twf.wf.Steps["create-disk-from-snapshot-restored"]
+	if !ok {
+		t.Fatal("create-disk-from-snapshot-restored step missing")
+	}
+	disk := (*diskStep.CreateDisks)[0]
+	if disk.SourceSnapshot != "snap" || disk.SourceImage != "" {
+		t.Errorf("restored disk has source snapshot %q and source image %q, want snapshot %q", disk.SourceSnapshot, disk.SourceImage, "snap")
+	}
+	if disk.Architecture != "ARM64" {
+		t.Errorf("restored disk has architecture %q, want ARM64", disk.Architecture)
+	}
+	wantDeps := map[string]string{
+		"create-disk-from-snapshot-restored": "create-snapshot-snap",
+		"create-vms-restored":                "create-disk-from-snapshot-restored",
+		"wait-restored":                      "create-vms-restored",
+	}
+	for step, dep := range wantDeps {
+		if deps := twf.wf.Dependencies[step]; !slices.Contains(deps, dep) {
+			t.Errorf("%s has deps %v, want a dependency on %s", step, deps, dep)
+		}
+	}
+	if deps := twf.wf.Dependencies[createVMsStepName]; slices.Contains(deps, "create-disk-from-snapshot-restored") {
+		t.Errorf("%s has deps %v, must not depend on the restored disk", createVMsStepName, deps)
+	}
+	if names := twf.getCreateStepNames(createVMsStepName); !slices.Contains(names, "create-vms-restored") {
+		t.Errorf("getCreateStepNames(%s) = %v, want it to include the step of the restored vm", createVMsStepName, names)
+	}
+	if step, err := twf.getCreateStepForVM("restored"); err != nil || step != twf.wf.Steps["create-vms-restored"] {
+		t.Errorf("getCreateStepForVM(restored) = %v, %v, want the create-vms-restored step", step, err)
+	}
+}
+
+func TestCreateTestVMFromSnapshotUnknownSnapshot(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.CreateTestVMFromSnapshot("restored", "snap"); err == nil {
+		t.Error("created vm from a snapshot not in the workflow")
+	}
+	if _, err := twf.CreateTestVMFromSnapshot("restored", "projects/project/global/snapshots/snap"); err != nil {
+		t.Errorf("failed to create vm from existing snapshot: %v", err)
+	}
+}
+
 func TestCreateVMFromInstanceBeta(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	disks := []*compute.Disk{{Name: "vm"}, {Name: "mountdisk", Type: PdSsd, SizeGb: 100}}
@@ -483,6 +551,122 @@ func TestResizeDiskAndReboot(t *testing.T) {
 	}
 }
 
+// TestResizeDisk tests that an online disk resize happens after the VM is
+// created and before its test results are collected and any reboot.
+func TestResizeDisk(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "data", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.ResizeDisk("data", 20); err != nil {
+		t.Fatalf("failed to resize disk: %v", err)
+	}
+	step, ok := twf.wf.Steps["resize-disk-data-1"]
+	if !ok {
+		t.Fatal("resize-disk-data-1 step missing")
+	}
+	if resize := (*step.ResizeDisks)[0]; resize.Name != "data" || resize.DisksResizeRequest.SizeGb != 20 {
+		t.Errorf("resize step resizes disk %s to %dGB, want data to 20GB", resize.Name, resize.DisksResizeRequest.SizeGb)
+	}
+	if deps := twf.wf.Dependencies["resize-disk-data-1"]; !slices.Contains(deps, createVMsStepName) {
+		t.Errorf("resize step has deps %v, want a dependency on %s", deps, createVMsStepName)
+	}
+	if deps := twf.wf.Dependencies["wait-vm"]; !slices.Contains(deps, "resize-disk-data-1") {
+		t.Errorf("wait-vm has deps %v, want a dependency on resize-disk-data-1", deps)
+	}
+	if err := tvm.Reboot(); err != nil {
+		t.Fatalf("failed to reboot: %v", err)
+	}
+	if deps := twf.wf.Dependencies["stop-vm-2"]; !slices.Contains(deps, "wait-vm") {
+		t.Errorf("stop-vm-2 has deps %v, want a dependency on wait-vm", deps)
+	}
+}
+
+func TestResizeDiskInvalid(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "data", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	other, err := twf.CreateTestVM("other")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.ResizeDisk("data", 5); err == nil {
+		t.Error("resized disk to a smaller size")
+	}
+	if err := tvm.ResizeDisk("data", 10); err == nil {
+		t.Error("resized disk to the same size")
+	}
+	if err := tvm.ResizeDisk("missing", 20); err == nil {
+		t.Error("resized disk which does not exist")
+	}
+	if err := other.ResizeDisk("data", 20); err == nil {
+		t.Error("resized disk attached to a different vm")
+	}
+}
+
+// TestAttachDetachDisk tests that a hotplugged disk is attached after the VM
+// is created and detached once the guest has signaled that it appeared.
+func TestAttachDetachDisk(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.DetachDisk("data"); err == nil {
+		t.Error("detached disk which was not attached")
+	}
+	if err := tvm.AttachDisk(&compute.Disk{Name: "data", SizeGb: 10}); err != nil {
+		t.Fatalf("failed to attach disk: %v", err)
+	}
+	if err := tvm.AttachDisk(&compute.Disk{Name: "data", SizeGb: 10}); err == nil {
+		t.Error("attached the same disk twice")
+	}
+	if err := tvm.DetachDisk("data"); err != nil {
+		t.Fatalf("failed to detach disk: %v", err)
+	}
+	if err := tvm.DetachDisk("data"); err == nil {
+		t.Error("detached the same disk twice")
+	}
+	attachStep, ok := twf.wf.Steps["attach-disk-data-1"]
+	if !ok {
+		t.Fatal("attach-disk-data-1 step missing")
+	}
+	if attach := (*attachStep.AttachDisks)[0]; attach.Instance != "vm" || attach.Source != "data" || !attach.AutoDelete {
+		t.Errorf("attach step attaches %+v, want disk data attached to vm with auto delete", attach)
+	}
+	waitAttached := (*twf.wf.Steps["wait-attached-data-1"].WaitForInstancesSignal)[0]
+	if key := waitAttached.GuestAttribute.KeyName; key != utils.HotplugAttachedGAKeyPrefix+"data" {
+		t.Errorf("attached wait step waits on guest attribute %q, want %q", key, utils.HotplugAttachedGAKeyPrefix+"data")
+	}
+	waitDetached := (*twf.wf.Steps["wait-detached-data-2"].WaitForInstancesSignal)[0]
+	if key := waitDetached.GuestAttribute.KeyName; key != utils.HotplugDetachedGAKeyPrefix+"data" {
+		t.Errorf("detached wait step waits on guest attribute %q, want %q", key, utils.HotplugDetachedGAKeyPrefix+"data")
+	}
+	wantDeps := [][2]string{
+		{"attach-disk-data-1", createVMsStepName},
+		{"attach-disk-data-1", createDisksStepName},
+		{"wait-attached-data-1", "attach-disk-data-1"},
+		{"detach-disk-data-2", "wait-attached-data-1"},
+		{"wait-detached-data-2", "detach-disk-data-2"},
+	}
+	for _, dep := range wantDeps {
+		if deps := twf.wf.Dependencies[dep[0]]; !slices.Contains(deps, dep[1]) {
+			t.Errorf("%s has deps %v, want a dependency on %s", dep[0], deps, dep[1])
+		}
+	}
+	// The hotplug steps must not change the wait step for the test results.
+	lastStep, err := twf.getLastStepForVM("vm")
+	if err != nil {
+		t.Fatalf("failed to get last step for vm: %v", err)
+	}
+	if twf.wf.Steps["wait-vm"] != lastStep {
+		t.Error("last step for vm is not wait-vm")
+	}
+}
+
 // TestEnableSecureBoot tests that *TestVM.EnableSecureBoot succeeds and
 // populates the ShieldedInstanceConfig struct.
 func TestEnableSecureBoot(t *testing.T) {
@@ -593,6 +777,55 @@ func TestUseGVNIC(t *testing.T) {
 	}
 }
 
+// TestUseVirtioNet tests that *TestVM.UseVirtioNet populates the Network
+// Interface with a NIC type of VIRTIO_NET, also when one is already set.
+func TestUseVirtioNet(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	tvm.UseVirtioNet()
+	if len(tvm.instance.NetworkInterfaces) != 1 || tvm.instance.NetworkInterfaces[0].NicType != "VIRTIO_NET" {
+		t.Errorf("VM Network Interfaces are %v, want one with NIC type VIRTIO_NET", tvm.instance.NetworkInterfaces)
+	}
+	tvm.UseGVNIC()
+	tvm.UseVirtioNet()
+	if len(tvm.instance.NetworkInterfaces) != 1 || tvm.instance.NetworkInterfaces[0].NicType != "VIRTIO_NET" {
+		t.Errorf("VM Network Interfaces are %v, want one with NIC type VIRTIO_NET", tvm.instance.NetworkInterfaces)
+	}
+	tvmb, err := twf.CreateTestVMBeta("vmbeta")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	tvmb.UseVirtioNet()
+	if len(tvmb.instancebeta.NetworkInterfaces) != 1 || tvmb.instancebeta.NetworkInterfaces[0].NicType != "VIRTIO_NET" {
+		t.Errorf("VM Network Interfaces are %v, want one with NIC type VIRTIO_NET", tvmb.instancebeta.NetworkInterfaces)
+	}
+}
+
+// TestEnableIPForwarding tests that *TestVM.EnableIPForwarding sets
+// CanIpForward on the instance.
+func TestEnableIPForwarding(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	tvm.EnableIPForwarding()
+	if !tvm.instance.CanIpForward {
+		t.Errorf("VM CanIpForward not set")
+	}
+	tvmb, err := twf.CreateTestVMBeta("vmbeta")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	tvmb.EnableIPForwarding()
+	if !tvmb.instancebeta.CanIpForward {
+		t.Errorf("beta VM CanIpForward not set")
+	}
+}
+
 // TestAddAliasIPRanges tests that *TestVM.AddAliasIPRanges succeeds and that
 // it fails if *TestVM.AddCustomNetwork hasn't been called first.
 func TestAddAliasIPRanges(t *testing.T) {
@@ -725,6 +958,69 @@ func TestSetRegion(t *testing.T) {
 	}
 }
 
+// TestRebootWithCustomMTU tests that a VM on a network with a custom MTU is
+// created after the network, and that its final test results come from the
+// boot after the reboot.
+func TestRebootWithCustomMTU(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	network, err := twf.CreateNetwork("network", false)
+	if err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if err := network.SetMTU(JumboFramesMTU); err != nil {
+		t.Fatalf("failed to set MTU: %v", err)
+	}
+	subnetwork, err := network.CreateSubnetwork("subnetwork", "10.128.0.0/20")
+	if err != nil {
+		t.Fatalf("failed to create subnetwork: %v", err)
+	}
+	inst := &daisy.Instance{}
+	inst.Metadata = map[string]string{ShouldRebootDuringTest: "true"}
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}}, inst)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddCustomNetwork(network, subnetwork); err != nil {
+		t.Fatalf("failed to add custom network: %v", err)
+	}
+	if err := tvm.Reboot(); err != nil {
+		t.Fatalf("failed to reboot: %v", err)
+	}
+	if network.network.Mtu != JumboFramesMTU {
+		t.Errorf("network has MTU %d, want %d", network.network.Mtu, JumboFramesMTU)
+	}
+	// The first boot waits on the first boot guest attribute, the test results
+	// are only collected once the VM has started again.
+	firstWait := twf.wf.Steps["wait-vm"].WaitForInstancesSignal
+	if key := (*firstWait)[0].GuestAttribute.KeyName; key != utils.FirstBootGAKey {
+		t.Errorf("first boot wait step waits on guest attribute %q, want %q", key, utils.FirstBootGAKey)
+	}
+	wantDeps := [][2]string{
+		{createVMsStepName, createNetworkStepName},
+		{createVMsStepName, createSubnetworkStepName},
+		{"wait-vm", createVMsStepName},
+		{"stop-vm-1", "wait-vm"},
+		{"wait-stopped-stopped-vm-1", "stop-vm-1"},
+		{"start-vm-1", "wait-stopped-stopped-vm-1"},
+		{"wait-started-vm-1", "start-vm-1"},
+	}
+	for _, dep := range wantDeps {
+		if deps := twf.wf.Dependencies[dep[0]]; !slices.Contains(deps, dep[1]) {
+			t.Errorf("%s has deps %v, want a dependency on %s", dep[0], deps, dep[1])
+		}
+	}
+	lastStep, err := twf.getLastStepForVM("vm")
+	if err != nil {
+		t.Fatalf("failed to get last step for vm: %v", err)
+	}
+	if twf.wf.Steps["wait-started-vm-1"] != lastStep {
+		t.Error("last step for vm is not wait-started-vm-1")
+	}
+	if key := (*lastStep.WaitForInstancesSignal)[0].GuestAttribute.KeyName; key != utils.GuestAttributeTestKey {
+		t.Errorf("final wait step waits on guest attribute %q, want %q", key, utils.GuestAttributeTestKey)
+	}
+}
+
 // TestCreateNetworkDependenciesReverse tests that the create-vms step depends
 // on the create-networks step if they are created in order.
 func TestCreateNetworkDependencies(t *testing.T) {
@@ -825,43 +1121,1354 @@ func TestAddUser(t *testing.T) {
 	}
 }
 
-func TestForceMachineType(t *testing.T) {
+func TestAddUserWithExpiry(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	tvm, err := twf.CreateTestVM("vm")
 	if err != nil {
-		t.Errorf("failed to create test vm: %v", err)
+		t.Fatalf("failed to create test vm: %v", err)
 	}
-	if tvm.instance.MachineType != "" {
-		t.Errorf("machine type already set: %v", tvm.instance.MachineType)
+	tvm.AddUser("user", "ssh-rsa NOEXPIRY")
+	expireOn := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := tvm.AddUserWithExpiry("user", "ssh-rsa EXPIRY user@host\n", expireOn); err != nil {
+		t.Fatalf("failed to add user with expiry: %v", err)
 	}
-	tvm.ForceMachineType("t2a-standard-1")
-	if tvm.instance.MachineType != "t2a-standard-1" {
-		t.Errorf("could not set test machine type, got %q, want t2a-standard-1", tvm.instance.MachineType)
+	want := "user:ssh-rsa NOEXPIRY\n" + `user:ssh-rsa EXPIRY google-ssh {"userName":"user","expireOn":"2024-01-02T15:04:05Z"}`
+	if got := tvm.instance.Metadata["ssh-keys"]; got != want {
+		t.Errorf("ssh-keys metadata is %q, want %q", got, want)
 	}
 }
 
-func TestForceZone(t *testing.T) {
+func TestCollectAgentLogsOnFailure(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	tvm, err := twf.CreateTestVM("vm")
 	if err != nil {
-		t.Errorf("failed to create test vm: %v", err)
+		t.Fatalf("failed to create test vm: %v", err)
 	}
-	if tvm.instance.Zone != "" {
-		t.Errorf("machine zone already set: %v", tvm.instance.Zone)
+	other, err := twf.CreateTestVM("other")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
 	}
-	tvm.ForceZone("us-east1-a")
-	if tvm.instance.Zone != "us-east1-a" {
-		t.Errorf("could not set test zone, got %q, want us-east1-a", tvm.instance.Zone)
+	tvm.CollectAgentLogsOnFailure()
+	if got, want := tvm.instance.Metadata["_test_agent_log_url"], "${OUTSPATH}/vm-guest-agent.log"; got != want {
+		t.Errorf("agent log url is %q, want %q", got, want)
 	}
-	tvmb, err := twf.CreateTestVMBeta("vmbeta")
+	if got, want := tvm.instance.Metadata["_test_system_log_url"], "${OUTSPATH}/vm-system.log"; got != want {
+		t.Errorf("system log url is %q, want %q", got, want)
+	}
+	if _, ok := other.instance.Metadata["_test_agent_log_url"]; ok {
+		t.Error("agent log url set on vm which did not enable agent log collection")
+	}
+	twf.GCSPath = "gs://bucket/run/name/image"
+	want := []string{"gs://bucket/run/name/image/outs/vm-guest-agent.log", "gs://bucket/run/name/image/outs/vm-system.log"}
+	if got := twf.failureLogPaths(); !slices.Equal(got, want) {
+		t.Errorf("failureLogPaths() = %v, want %v", got, want)
+	}
+	localPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(localPath, "name_tests.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	suite := parseResult(testResult{testWorkflow: twf, workflowSuccess: true, results: []string{testFail}}, localPath)
+	var failures int
+	for _, tc := range suite.Testcases {
+		if tc.Failure == nil {
+			continue
+		}
+		failures++
+		if !strings.Contains(tc.Failure.Data, want[0]) || !strings.Contains(tc.Failure.Data, want[1]) {
+			t.Errorf("failure of %s is %q, want it to contain the log paths %v", tc.Name, tc.Failure.Data, want)
+		}
+	}
+	if failures == 0 {
+		t.Error("no failed test case in the parsed results")
+	}
+}
+
+func TestCreateTestVMWithAccelerators(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n1-standard-4"
+	tvm, err := twf.CreateTestVMWithAccelerators("gpu", []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-tesla-t4", AcceleratorCount: 1}})
 	if err != nil {
-		t.Errorf("failed to create test vm: %v", err)
+		t.Fatalf("failed to create test vm with accelerators: %v", err)
 	}
-	if tvmb.instancebeta.Zone != "" {
-		t.Errorf("machine zone already set: %v", tvmb.instancebeta.Zone)
+	if tvm.instance.MachineType != "n1-standard-4" || len(tvm.instance.GuestAccelerators) != 1 {
+		t.Errorf("vm has machine type %q and accelerators %v, want n1-standard-4 with one accelerator", tvm.instance.MachineType, tvm.instance.GuestAccelerators)
 	}
-	tvmb.ForceZone("us-east1-a")
-	if tvmb.instancebeta.Zone != "us-east1-a" {
-		t.Errorf("could not set test zone, got %q, want us-east1-a", tvm.instance.Zone)
+	if deps := twf.wf.Dependencies["wait-gpu"]; !slices.Contains(deps, createVMsStepName) {
+		t.Errorf("wait-gpu has deps %v, want a dependency on %s", deps, createVMsStepName)
+	}
+	if _, err := twf.CreateTestVMWithAccelerators("l4", []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-l4", AcceleratorCount: 1}}); err == nil {
+		t.Error("created vm with an accelerator unsupported by the machine type")
+	}
+	if disks := *twf.wf.Steps[createDisksStepName].CreateDisks; len(disks) != 1 {
+		t.Errorf("create-disks has %d disks, want only the disk of the created vm", len(disks))
+	}
+}
+
+func TestAddLocalSSD(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n2-standard-2"
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddLocalSSD("NVME"); err != nil {
+		t.Fatalf("failed to add local ssd: %v", err)
+	}
+	if err := tvm.AddLocalSSD("SCSI"); err != nil {
+		t.Fatalf("failed to add local ssd: %v", err)
+	}
+	if len(tvm.instance.Disks) != 3 {
+		t.Fatalf("vm has %d disks, want the boot disk and two local ssds", len(tvm.instance.Disks))
+	}
+	for i, want := range []string{"NVME", "SCSI"} {
+		d := tvm.instance.Disks[i+1]
+		if d.Type != "SCRATCH" || d.InitializeParams == nil || d.InitializeParams.DiskType != "local-ssd" || d.Interface != want || !d.AutoDelete {
+			t.Errorf("local ssd %d is %+v, want a SCRATCH local-ssd disk with interface %s", i, d, want)
+		}
+	}
+	if disks := *twf.wf.Steps[createDisksStepName].CreateDisks; len(disks) != 1 {
+		t.Errorf("create-disks has %d disks, want only the boot disk", len(disks))
+	}
+}
+
+func TestAddLocalSSDInvalid(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n2-standard-2"
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddLocalSSD("IDE"); err == nil {
+		t.Error("added local ssd with an invalid interface")
+	}
+	tvm.ForceMachineType("e2-standard-2")
+	if err := tvm.AddLocalSSD("NVME"); err == nil {
+		t.Error("added local ssd to a machine type without local ssd support")
+	}
+	tvm.ForceMachineType("c2-standard-4")
+	for i := 0; i < 8; i++ {
+		if err := tvm.AddLocalSSD("NVME"); err != nil {
+			t.Fatalf("failed to add local ssd %d: %v", i, err)
+		}
+	}
+	if err := tvm.AddLocalSSD("NVME"); err == nil {
+		t.Error("added more local ssds than the machine type supports")
+	}
+}
+
+func TestSetShieldedIntegrityPolicy(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.Image.GuestOsFeatures = []*compute.GuestOsFeature{{Type: "UEFI_COMPATIBLE"}}
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if tvm.instance.ShieldedInstanceConfig != nil {
+		t.Fatalf("vm has shielded instance config %+v by default", tvm.instance.ShieldedInstanceConfig)
+	}
+	if err := tvm.SetShieldedIntegrityPolicy(true, false, true); err != nil {
+		t.Fatalf("failed to set shielded integrity policy: %v", err)
+	}
+	cfg := tvm.instance.ShieldedInstanceConfig
+	if !cfg.EnableSecureBoot || cfg.EnableVtpm || !cfg.EnableIntegrityMonitoring {
+		t.Errorf("vm has shielded instance config %+v, want secure boot and integrity monitoring without vtpm", cfg)
+	}
+	if !slices.Contains(cfg.ForceSendFields, "EnableVtpm") {
+		t.Errorf("disabled vtpm is not sent to the API, force send fields are %v", cfg.ForceSendFields)
+	}
+}
+
+func TestSetShieldedIntegrityPolicyNotUEFI(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetShieldedIntegrityPolicy(true, true, true); err == nil {
+		t.Error("enabled secure boot on an image without UEFI_COMPATIBLE")
+	}
+	if err := tvm.SetShieldedIntegrityPolicy(false, true, true); err != nil {
+		t.Errorf("failed to set shielded integrity policy without secure boot: %v", err)
+	}
+}
+
+func TestEnableConfidentialCompute(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n2d-standard-2"
+	sev, err := twf.CreateTestVM("sev")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := sev.EnableConfidentialCompute("SEV"); err != nil {
+		t.Fatalf("failed to enable SEV: %v", err)
+	}
+	if sev.instance == nil || !sev.instance.ConfidentialInstanceConfig.EnableConfidentialCompute || sev.instance.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("SEV vm is not a confidential GA instance that terminates on host maintenance")
+	}
+
+	snp, err := twf.CreateTestVM("snp")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	snp.AddMetadata("key", "value")
+	if err := snp.EnableConfidentialCompute("SEV_SNP"); err != nil {
+		t.Fatalf("failed to enable SEV_SNP: %v", err)
+	}
+	if snp.instance != nil || snp.instancebeta == nil {
+		t.Fatal("SEV_SNP vm was not converted to a beta instance")
+	}
+	if cfg := snp.instancebeta.ConfidentialInstanceConfig; cfg.ConfidentialInstanceType != "SEV_SNP" || !cfg.EnableConfidentialCompute {
+		t.Errorf("SEV_SNP vm has confidential config %+v", cfg)
+	}
+	if snp.instancebeta.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("SEV_SNP vm has on host maintenance %q, want TERMINATE", snp.instancebeta.Scheduling.OnHostMaintenance)
+	}
+	if snp.instancebeta.Name != "snp" || snp.instancebeta.Metadata["key"] != "value" || len(snp.instancebeta.Disks) != 1 {
+		t.Errorf("SEV_SNP vm lost its configuration when converted to a beta instance: %+v", snp.instancebeta)
+	}
+	step := twf.wf.Steps[createVMsStepName]
+	if len(step.CreateInstances.Instances) != 1 || len(step.CreateInstances.InstancesBeta) != 1 || step.CreateInstances.InstancesBeta[0] != snp.instancebeta {
+		t.Errorf("create-vms step has %d GA and %d beta instances, want one of each", len(step.CreateInstances.Instances), len(step.CreateInstances.InstancesBeta))
+	}
+}
+
+func TestEnableConfidentialComputeInvalid(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n2d-standard-2"
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.EnableConfidentialCompute("SGX"); err == nil {
+		t.Error("enabled an unknown confidential instance type")
+	}
+	if err := tvm.EnableConfidentialCompute("TDX"); err == nil {
+		t.Error("enabled TDX on an AMD machine type")
+	}
+	if tvm.instance == nil || tvm.instance.ConfidentialInstanceConfig != nil {
+		t.Error("vm was modified by a failed call")
+	}
+}
+
+func TestSetSpot(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetSpot("STOP"); err != nil {
+		t.Fatalf("failed to make vm a spot vm: %v", err)
+	}
+	s := tvm.instance.Scheduling
+	if s.ProvisioningModel != "SPOT" || !s.Preemptible || s.InstanceTerminationAction != "STOP" {
+		t.Errorf("vm has scheduling %+v, want a preemptible SPOT vm which stops on termination", s)
+	}
+	if s.AutomaticRestart == nil || *s.AutomaticRestart {
+		t.Error("spot vm restarts automatically")
+	}
+	if err := tvm.SetSpot("SUSPEND"); err == nil {
+		t.Error("made vm a spot vm with an invalid termination action")
+	}
+}
+
+func TestSetNodeAffinity(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if _, err := twf.NodeGroupAffinity(); err == nil {
+		t.Error("got a node group affinity for a workflow without a node group")
+	}
+	twf.NodeGroup = "nodes"
+	affinity, err := twf.NodeGroupAffinity()
+	if err != nil {
+		t.Fatalf("failed to get node group affinity: %v", err)
+	}
+	if err := tvm.SetNodeAffinity([]*compute.SchedulingNodeAffinity{affinity}); err != nil {
+		t.Fatalf("failed to set node affinity: %v", err)
+	}
+	got := tvm.instance.Scheduling.NodeAffinities
+	if len(got) != 1 || got[0].Key != "compute.googleapis.com/node-group-name" || got[0].Operator != "IN" || !slices.Equal(got[0].Values, []string{"nodes"}) {
+		t.Errorf("vm has node affinities %v, want the node group affinity", got)
+	}
+	if err := tvm.SetNodeAffinity(nil); err == nil {
+		t.Error("set empty node affinities")
+	}
+	if err := tvm.SetNodeAffinity([]*compute.SchedulingNodeAffinity{{Key: "key", Operator: "EQUALS"}}); err == nil {
+		t.Error("set node affinity with an invalid operator")
+	}
+}
+
+func TestAddNetworkInterface(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.GuestCpus = 4
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddNetworkInterface("net1", "subnet1"); err != nil {
+		t.Fatalf("failed to add network interface: %v", err)
+	}
+	if err := tvm.AddNetworkInterface("net2", ""); err != nil {
+		t.Fatalf("failed to add network interface: %v", err)
+	}
+	nics := tvm.instance.NetworkInterfaces
+	if len(nics) != 3 {
+		t.Fatalf("vm has %d network interfaces, want 3", len(nics))
+	}
+	if nics[0].Network != "" || nics[0].Subnetwork != "" {
+		t.Errorf("first network interface is %+v, want the default interface", nics[0])
+	}
+	if nics[1].Network != "net1" || nics[1].Subnetwork != "subnet1" || nics[2].Network != "net2" || nics[2].Subnetwork != "" {
+		t.Errorf("vm has network interfaces %+v and %+v, want net1/subnet1 and net2", nics[1], nics[2])
+	}
+	if networks := *twf.wf.Steps[createNetworkStepName].CreateNetworks; len(networks) != 2 || *networks[0].AutoCreateSubnetworks || !*networks[1].AutoCreateSubnetworks {
+		t.Errorf("workflow does not create custom network net1 and auto network net2")
+	}
+	if subnets := *twf.wf.Steps[createSubnetworkStepName].CreateSubnetworks; len(subnets) != 1 || subnets[0].IpCidrRange == "" {
+		t.Errorf("workflow does not create subnetwork subnet1 with an IP range")
+	}
+	for _, dep := range []string{createNetworkStepName, createSubnetworkStepName} {
+		if !slices.Contains(twf.wf.Dependencies[createVMsStepName], dep) {
+			t.Errorf("%s does not depend on %s", createVMsStepName, dep)
+		}
+	}
+
+	// A second VM reuses the networks created for the first.
+	tvm2, err := twf.CreateTestVM("vm2")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm2.AddNetworkInterface("net1", "subnet1"); err != nil {
+		t.Fatalf("failed to add network interface: %v", err)
+	}
+	if networks := *twf.wf.Steps[createNetworkStepName].CreateNetworks; len(networks) != 2 {
+		t.Errorf("workflow creates %d networks, want 2", len(networks))
+	}
+}
+
+func TestAddNetworkInterfaceInvalid(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.GuestCpus = 1
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddNetworkInterface("net1", "subnet1"); err != nil {
+		t.Fatalf("failed to add network interface: %v", err)
+	}
+	if err := tvm.AddNetworkInterface("net2", "subnet2"); err == nil {
+		t.Error("added more network interfaces than the machine type supports")
+	}
+	tvm.ForceMachineType("n2-standard-8")
+	if err := tvm.AddNetworkInterface("net1", "subnet1"); err == nil {
+		t.Error("added two network interfaces on the same network")
+	}
+	if err := tvm.AddNetworkInterface("net3", "subnet1"); err == nil {
+		t.Error("added network interface with a subnetwork of another network")
+	}
+}
+
+func TestSetStackType(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetStackType("IPV4_IPV6"); err == nil {
+		t.Error("set stack type on a vm on the default network")
+	}
+	network, err := twf.CreateNetwork("net", false)
+	if err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	subnet, err := network.CreateSubnetwork("subnet", "10.0.0.0/24")
+	if err != nil {
+		t.Fatalf("failed to create subnetwork: %v", err)
+	}
+	if err := tvm.AddCustomNetwork(network, subnet); err != nil {
+		t.Fatalf("failed to add custom network: %v", err)
+	}
+	if err := tvm.SetStackType("IPV4_IPV6"); err != nil {
+		t.Fatalf("failed to set stack type: %v", err)
+	}
+	if subnet.subnetwork.StackType != "IPV4_IPV6" || subnet.subnetwork.Ipv6AccessType != "EXTERNAL" {
+		t.Errorf("subnetwork has stack type %q and ipv6 access type %q, want IPV4_IPV6 and EXTERNAL", subnet.subnetwork.StackType, subnet.subnetwork.Ipv6AccessType)
+	}
+	nic := tvm.instance.NetworkInterfaces[0]
+	if nic.StackType != "IPV4_IPV6" || len(nic.Ipv6AccessConfigs) != 1 || nic.Ipv6AccessConfigs[0].Type != "DIRECT_IPV6" || len(nic.AccessConfigs) != 1 {
+		t.Errorf("network interface is %+v, want a dual stack interface with ipv4 and ipv6 access configs", nic)
+	}
+	if err := tvm.SetStackType("IPV6_ONLY"); err != nil {
+		t.Fatalf("failed to set stack type: %v", err)
+	}
+	if nic.AccessConfigs == nil || len(nic.AccessConfigs) != 0 {
+		t.Errorf("ipv6 only interface has access configs %v, want an empty list", nic.AccessConfigs)
+	}
+	if err := tvm.SetStackType("IPV5"); err == nil {
+		t.Error("set invalid stack type")
+	}
+}
+
+func TestSetBootExpectations(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.Reboot(); err != nil {
+		t.Fatalf("failed to reboot vm: %v", err)
+	}
+	if err := tvm.SetBootExpectations("CUSTOM-DONE", "Kernel panic"); err != nil {
+		t.Fatalf("failed to set boot expectations: %v", err)
+	}
+	signal := (*twf.wf.Steps["wait-vm"].WaitForInstancesSignal)[0]
+	if signal.SerialOutput.SuccessMatch != "CUSTOM-DONE" || !slices.Equal(signal.SerialOutput.FailureMatch, []string{"Kernel panic"}) {
+		t.Errorf("wait-vm has serial output %+v, want success match CUSTOM-DONE and failure match Kernel panic", signal.SerialOutput)
+	}
+	if signal.GuestAttribute == nil || signal.GuestAttribute.KeyName != utils.GuestAttributeTestKey {
+		t.Errorf("wait-vm no longer waits for the test guest attribute")
+	}
+	started := (*twf.wf.Steps["wait-started-vm-1"].WaitForInstancesSignal)[0]
+	if started.SerialOutput == nil || !slices.Equal(started.SerialOutput.FailureMatch, []string{"Kernel panic"}) {
+		t.Errorf("wait-started-vm-1 has serial output %+v, want failure match Kernel panic", started.SerialOutput)
+	}
+
+	vm2, err := twf.CreateTestVM("vm2")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := vm2.SetBootExpectations("", ""); err != nil {
+		t.Fatalf("failed to set boot expectations: %v", err)
+	}
+	signal = (*twf.wf.Steps["wait-vm2"].WaitForInstancesSignal)[0]
+	if signal.SerialOutput.SuccessMatch != successMatch || len(signal.SerialOutput.FailureMatch) != 0 {
+		t.Errorf("wait-vm2 has serial output %+v, want the defaults", signal.SerialOutput)
+	}
+}
+
+func TestSetWaitTimeout(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if timeout := twf.wf.Steps["wait-vm"].Timeout; timeout != "" {
+		t.Errorf("wait-vm has timeout %q by default, want the workflow default", timeout)
+	}
+	if err := tvm.SetWaitTimeout("2h"); err != nil {
+		t.Fatalf("failed to set wait timeout: %v", err)
+	}
+	if timeout := twf.wf.Steps["wait-vm"].Timeout; timeout != "2h" {
+		t.Errorf("wait-vm has timeout %q, want 2h", timeout)
+	}
+	if timeout := tvm.instance.Metadata["_cit_timeout"]; timeout != "2h" {
+		t.Errorf("vm has test timeout %q, want 2h", timeout)
+	}
+	if err := tvm.SetWaitTimeout("two hours"); err == nil {
+		t.Error("set an invalid wait timeout")
+	}
+}
+
+func TestForceMachineType(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Errorf("failed to create test vm: %v", err)
+	}
+	if tvm.instance.MachineType != "" {
+		t.Errorf("machine type already set: %v", tvm.instance.MachineType)
+	}
+	tvm.ForceMachineType("t2a-standard-1")
+	if tvm.instance.MachineType != "t2a-standard-1" {
+		t.Errorf("could not set test machine type, got %q, want t2a-standard-1", tvm.instance.MachineType)
+	}
+}
+
+func TestEnableNestedVirtualization(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "e2-standard-2"
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.EnableNestedVirtualization(); err == nil {
+		t.Error("enabled nested virtualization on an unsupported machine type")
+	}
+	tvm.ForceMachineType("n2-standard-2")
+	if err := tvm.EnableNestedVirtualization(); err != nil {
+		t.Fatalf("failed to enable nested virtualization: %v", err)
+	}
+	if f := tvm.instance.AdvancedMachineFeatures; f == nil || !f.EnableNestedVirtualization {
+		t.Errorf("vm has advanced machine features %+v, want nested virtualization enabled", f)
+	}
+	twf.MachineType.Name = "n1-standard-1"
+	tvmb, err := twf.CreateTestVMBeta("vmbeta")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvmb.EnableNestedVirtualization(); err != nil {
+		t.Fatalf("failed to enable nested virtualization on beta vm: %v", err)
+	}
+	if f := tvmb.instancebeta.AdvancedMachineFeatures; f == nil || !f.EnableNestedVirtualization {
+		t.Errorf("beta vm has advanced machine features %+v, want nested virtualization enabled", f)
+	}
+}
+
+func TestSetCustomMachineType(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetCustomMachineType("n2", 8, 16384); err != nil {
+		t.Fatalf("failed to set custom machine type: %v", err)
+	}
+	if tvm.instance.MachineType != "n2-custom-8-16384" {
+		t.Errorf("vm has machine type %q, want n2-custom-8-16384", tvm.instance.MachineType)
+	}
+	if err := tvm.SetCustomMachineType("n2", 3, 4096); err == nil {
+		t.Error("set custom machine type with an odd number of vcpus")
+	}
+	if tvm.instance.MachineType != "n2-custom-8-16384" {
+		t.Errorf("failed call changed the machine type to %q", tvm.instance.MachineType)
+	}
+}
+
+func TestForceZone(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Errorf("failed to create test vm: %v", err)
+	}
+	if tvm.instance.Zone != "" {
+		t.Errorf("machine zone already set: %v", tvm.instance.Zone)
+	}
+	tvm.ForceZone("us-east1-a")
+	if tvm.instance.Zone != "us-east1-a" {
+		t.Errorf("could not set test zone, got %q, want us-east1-a", tvm.instance.Zone)
+	}
+	tvmb, err := twf.CreateTestVMBeta("vmbeta")
+	if err != nil {
+		t.Errorf("failed to create test vm: %v", err)
+	}
+	if tvmb.instancebeta.Zone != "" {
+		t.Errorf("machine zone already set: %v", tvmb.instancebeta.Zone)
+	}
+	tvmb.ForceZone("us-east1-a")
+	if tvmb.instancebeta.Zone != "us-east1-a" {
+		t.Errorf("could not set test zone, got %q, want us-east1-a", tvm.instance.Zone)
+	}
+}
+
+func TestSkipImage(t *testing.T) {
+	testcases := []struct {
+		name    string
+		pattern string
+		skipped bool
+	}{
+		{name: "substring of name", pattern: "debian-12", skipped: true},
+		{name: "family", pattern: "^debian-12$", skipped: true},
+		{name: "regex", pattern: "sles-15|debian-1[12]", skipped: true},
+		{name: "no match", pattern: "ubuntu", skipped: false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			twf := NewTestWorkflowForUnitTest("name", "projects/debian-cloud/global/images/family/debian-12", "30m")
+			twf.Image = &compute.Image{Name: "debian-12-bookworm-v20240515", Family: "debian-12"}
+			skipped, err := twf.SkipImage(tc.pattern, "not supported")
+			if err != nil {
+				t.Fatalf("SkipImage(%q) failed: %v", tc.pattern, err)
+			}
+			if skipped != tc.skipped || twf.skipped != tc.skipped {
+				t.Errorf("SkipImage(%q) = %v, workflow skipped %v, want %v", tc.pattern, skipped, twf.skipped, tc.skipped)
+			}
+			if tc.skipped && twf.SkippedMessage() != "not supported" {
+				t.Errorf("unexpected skipped message %q, want %q", twf.SkippedMessage(), "not supported")
+			}
+		})
+	}
+
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.SkipImage("(", "invalid"); err == nil {
+		t.Errorf("SkipImage with an invalid pattern succeeded")
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.SetParallelVMCreation(true)
+	server, err := twf.CreateTestVM("server")
+	if err != nil {
+		t.Fatalf("failed to create server vm: %v", err)
+	}
+	client, err := twf.CreateTestVM("client")
+	if err != nil {
+		t.Fatalf("failed to create client vm: %v", err)
+	}
+	if err := client.DependsOn(server); err != nil {
+		t.Fatalf("client.DependsOn(server) failed: %v", err)
+	}
+	if deps := twf.wf.Dependencies["create-vms-client"]; !slices.Contains(deps, "wait-server") {
+		t.Errorf("create-vms-client depends on %v, want wait-server", deps)
+	}
+	before := slices.Clone(twf.wf.Dependencies["create-vms-server"])
+	if err := server.DependsOn(client); err == nil {
+		t.Errorf("server.DependsOn(client) succeeded despite the dependency cycle")
+	}
+	if deps := twf.wf.Dependencies["create-vms-server"]; !slices.Equal(deps, before) {
+		t.Errorf("create-vms-server depends on %v after the rejected dependency, want %v", deps, before)
+	}
+	if err := server.DependsOn(server); err == nil {
+		t.Errorf("server.DependsOn(server) succeeded")
+	}
+
+	shared := NewTestWorkflowForUnitTest("name", "image", "30m")
+	vm1, err := shared.CreateTestVM("vm1")
+	if err != nil {
+		t.Fatalf("failed to create vm1: %v", err)
+	}
+	vm2, err := shared.CreateTestVM("vm2")
+	if err != nil {
+		t.Fatalf("failed to create vm2: %v", err)
+	}
+	if err := vm2.DependsOn(vm1); err == nil {
+		t.Errorf("DependsOn succeeded for VMs created in the same step")
+	}
+}
+
+// TestDependsOnWithQuota tests that waiting for quota doesn't make the quota
+// steps depend on VMs whose creation they gate.
+func TestDependsOnWithQuota(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.SetParallelVMCreation(true)
+	server, err := twf.CreateTestVM("server")
+	if err != nil {
+		t.Fatalf("failed to create server vm: %v", err)
+	}
+	client, err := twf.CreateTestVM("client")
+	if err != nil {
+		t.Fatalf("failed to create client vm: %v", err)
+	}
+	if err := client.DependsOn(server); err != nil {
+		t.Fatalf("client.DependsOn(server) failed: %v", err)
+	}
+	if _, err := server.CreateSnapshot(&compute.Disk{Name: "server"}, "snap"); err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	if _, err := twf.CreateTestVMFromSnapshot("restored", "snap"); err != nil {
+		t.Fatalf("failed to create test vm from snapshot: %v", err)
+	}
+	if err := twf.WaitForVMQuota(&daisy.QuotaAvailable{Metric: "CPUS", Units: 6}); err != nil {
+		t.Fatalf("WaitForVMQuota failed: %v", err)
+	}
+	if err := twf.WaitForDisksQuota(&daisy.QuotaAvailable{Metric: "SSD_TOTAL_GB", Units: 30}); err != nil {
+		t.Fatalf("WaitForDisksQuota failed: %v", err)
+	}
+	if err := finalizeWorkflows(context.Background(), []*TestWorkflow{twf}, "us-central1-a", "gs://bucket", "/tmp"); err != nil {
+		t.Fatalf("finalizeWorkflows() failed: %v", err)
+	}
+	if cycle := twf.findDependencyCycle(); cycle != nil {
+		t.Fatalf("workflow has the dependency cycle %v", cycle)
+	}
+	for _, name := range []string{"create-vms-server", "create-vms-client", "create-vms-restored"} {
+		if deps := twf.wf.Dependencies[name]; !slices.Contains(deps, waitForVMQuotaStepName) {
+			t.Errorf("%s depends on %v, want %s", name, deps, waitForVMQuotaStepName)
+		}
+	}
+	if deps := twf.wf.Dependencies["create-vms-client"]; !slices.Contains(deps, "wait-server") {
+		t.Errorf("create-vms-client depends on %v, want wait-server", deps)
+	}
+	if deps := twf.wf.Dependencies[waitForVMQuotaStepName]; slices.Contains(deps, "wait-server") {
+		t.Errorf("%s depends on %v, must not wait for server", waitForVMQuotaStepName, deps)
+	}
+}
+
+func TestSetNetworkMTU(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	before, err := twf.CreateNetwork("before", false)
+	if err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if before.network.Mtu != DefaultMTU {
+		t.Errorf("network has MTU %d, want the default %d", before.network.Mtu, DefaultMTU)
+	}
+	for _, mtu := range []int{MinMTU - 1, JumboFramesMTU + 1} {
+		if err := twf.SetNetworkMTU(mtu); err == nil {
+			t.Errorf("SetNetworkMTU(%d) succeeded", mtu)
+		}
+		if err := before.SetMTU(mtu); err == nil {
+			t.Errorf("SetMTU(%d) succeeded", mtu)
+		}
+	}
+	if err := twf.SetNetworkMTU(JumboFramesMTU); err != nil {
+		t.Fatalf("SetNetworkMTU(%d) failed: %v", JumboFramesMTU, err)
+	}
+	after, err := twf.CreateNetwork("after", false)
+	if err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	for _, n := range []*Network{before, after} {
+		if n.network.Mtu != JumboFramesMTU {
+			t.Errorf("network %s has MTU %d, want %d", n.name, n.network.Mtu, JumboFramesMTU)
+		}
+	}
+	if err := after.SetMTU(MinMTU); err != nil || after.network.Mtu != MinMTU {
+		t.Errorf("SetMTU(%d) = %v, network has MTU %d", MinMTU, err, after.network.Mtu)
+	}
+}
+
+func TestSetSubnetCIDR(t *testing.T) {
+	invalid := []struct {
+		name      string
+		primary   string
+		secondary map[string]string
+	}{
+		{name: "invalid primary", primary: "10.0.0.0"},
+		{name: "invalid secondary", primary: "10.0.0.0/24", secondary: map[string]string{"pods": "10.1.0.0/33"}},
+		{name: "unnamed secondary", primary: "10.0.0.0/24", secondary: map[string]string{"": "10.1.0.0/16"}},
+		{name: "secondary in primary", primary: "10.0.0.0/16", secondary: map[string]string{"pods": "10.0.8.0/24"}},
+		{name: "primary in secondary", primary: "10.0.8.0/24", secondary: map[string]string{"pods": "10.0.0.0/16"}},
+		{name: "overlapping secondaries", primary: "10.0.0.0/24", secondary: map[string]string{"pods": "10.4.0.0/14", "services": "10.5.0.0/20"}},
+	}
+	for _, tc := range invalid {
+		twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+		if err := twf.SetSubnetCIDR(tc.primary, tc.secondary); err == nil {
+			t.Errorf("%s: SetSubnetCIDR(%s, %v) succeeded", tc.name, tc.primary, tc.secondary)
+		}
+	}
+
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if err := twf.SetSubnetCIDR("10.0.0.0/24", map[string]string{"services": "10.8.0.0/20", "pods": "10.4.0.0/14"}); err != nil {
+		t.Fatalf("SetSubnetCIDR failed: %v", err)
+	}
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddNetworkInterface("net1", "subnet1"); err != nil {
+		t.Fatalf("failed to add network interface: %v", err)
+	}
+	sn := twf.getSubnetwork("subnet1")
+	if sn == nil || sn.IpCidrRange != "10.0.0.0/24" {
+		t.Fatalf("subnet1 is %v, want a subnetwork with IP range 10.0.0.0/24", sn)
+	}
+	var got []string
+	for _, r := range sn.SecondaryIpRanges {
+		got = append(got, r.RangeName+"="+r.IpCidrRange)
+	}
+	if want := []string{"pods=10.4.0.0/14", "services=10.8.0.0/20"}; !slices.Equal(got, want) {
+		t.Errorf("subnet1 has secondary ranges %v, want %v", got, want)
+	}
+	tvm2, err := twf.CreateTestVM("vm2")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm2.AddNetworkInterface("net1", "subnet2"); err == nil {
+		t.Errorf("created a second subnetwork of net1 with an overlapping IP range")
+	}
+	if err := tvm2.AddNetworkInterface("net2", "subnet3"); err != nil {
+		t.Errorf("failed to add a subnetwork with the same IP range on another network: %v", err)
+	}
+}
+
+func TestAddFirewallRule(t *testing.T) {
+	invalid := []struct {
+		name         string
+		protocol     string
+		ports        []string
+		sourceRanges []string
+	}{
+		{name: "unknown protocol", protocol: "sctp", ports: []string{"5201"}},
+		{name: "icmp with ports", protocol: "icmp", ports: []string{"5201"}},
+		{name: "port zero", protocol: "tcp", ports: []string{"0"}},
+		{name: "port too large", protocol: "tcp", ports: []string{"65536"}},
+		{name: "not a port", protocol: "udp", ports: []string{"iperf"}},
+		{name: "reversed range", protocol: "tcp", ports: []string{"8080-8000"}},
+		{name: "invalid source range", protocol: "tcp", ports: []string{"22"}, sourceRanges: []string{"10.0.0.0"}},
+	}
+	for _, tc := range invalid {
+		twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+		if err := twf.AddFirewallRule("rule", tc.protocol, tc.ports, tc.sourceRanges); err == nil {
+			t.Errorf("%s: AddFirewallRule(%s, %v, %v) succeeded", tc.name, tc.protocol, tc.ports, tc.sourceRanges)
+		}
+	}
+
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := twf.AddFirewallRule("iperf", "tcp", []string{"5201", "8000-8080"}, nil); err != nil {
+		t.Fatalf("AddFirewallRule failed: %v", err)
+	}
+	if _, err := twf.CreateNetwork("net1", true); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if err := twf.AddFirewallRule("ping", "icmp", nil, []string{"192.168.0.0/16"}); err != nil {
+		t.Fatalf("AddFirewallRule failed: %v", err)
+	}
+	step, ok := twf.wf.Steps[createFirewallStepName]
+	if !ok {
+		t.Fatalf("workflow has no %s step", createFirewallStepName)
+	}
+	rules := *step.CreateFirewallRules
+	if len(rules) != 2 {
+		t.Fatalf("workflow creates %d firewall rules, want 2", len(rules))
+	}
+	if rules[0].Network != "default" || !slices.Equal(rules[0].SourceRanges, []string{DefaultSourceRange}) {
+		t.Errorf("iperf rule is on network %s from %v, want default from %s", rules[0].Network, rules[0].SourceRanges, DefaultSourceRange)
+	}
+	if rules[1].Network != "net1" {
+		t.Errorf("ping rule is on network %s, want net1", rules[1].Network)
+	}
+	if !slices.Contains(twf.wf.Dependencies[createVMsStepName], createFirewallStepName) {
+		t.Errorf("%s step does not depend on %s step", createVMsStepName, createFirewallStepName)
+	}
+	if !slices.Equal(twf.firewallRules, []string{"iperf", "ping"}) {
+		t.Errorf("workflow tracks firewall rules %v, want [iperf ping]", twf.firewallRules)
+	}
+}
+
+func TestWaitForGuestAttribute(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.WaitForGuestAttribute("", "phase1"); err == nil {
+		t.Errorf("waited for a guest attribute without a namespace")
+	}
+	if err := tvm.WaitForGuestAttribute("testing", ""); err == nil {
+		t.Errorf("waited for a guest attribute without a key")
+	}
+	if err := tvm.WaitForGuestAttribute("testing", "phase1"); err != nil {
+		t.Fatalf("failed to wait for guest attribute: %v", err)
+	}
+	if err := tvm.WaitForGuestAttribute("progress", "phase2"); err != nil {
+		t.Fatalf("failed to wait for guest attribute: %v", err)
+	}
+	lastStep, err := twf.getLastStepForVM("vm")
+	if err != nil {
+		t.Fatalf("failed to get last step for vm: %v", err)
+	}
+	if step, ok := twf.wf.Steps["wait-guest-attribute-vm-2"]; !ok || step != lastStep {
+		t.Fatalf("last step of vm is not wait-guest-attribute-vm-2")
+	}
+	if deps := twf.wf.Dependencies["wait-guest-attribute-vm-2"]; !slices.Equal(deps, []string{"wait-guest-attribute-vm-1"}) {
+		t.Errorf("wait-guest-attribute-vm-2 depends on %v, want [wait-guest-attribute-vm-1]", deps)
+	}
+	signal := (*lastStep.WaitForInstancesSignal)[0]
+	if signal.Name != "vm" || signal.GuestAttribute.Namespace != "progress" || signal.GuestAttribute.KeyName != "phase2" {
+		t.Errorf("wait step waits for guest attribute %s/%s of %s, want progress/phase2 of vm", signal.GuestAttribute.Namespace, signal.GuestAttribute.KeyName, signal.Name)
+	}
+	if signal.SerialOutput == nil || signal.SerialOutput.SuccessMatch != successMatch {
+		t.Errorf("wait step does not match the test results on the serial console")
+	}
+}
+
+func TestMeasureBootTime(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.MeasureBootTime(); err != nil {
+		t.Fatalf("MeasureBootTime() failed: %v", err)
+	}
+	step, ok := twf.wf.Steps["wait-booted-vm"]
+	if !ok {
+		t.Fatal("wait-booted-vm step missing")
+	}
+	signal := (*step.WaitForInstancesSignal)[0]
+	if signal.Name != "vm" || signal.GuestAttribute.KeyName != utils.BootedGAKey || signal.Interval != "1s" {
+		t.Errorf("wait step waits for guest attribute %s of %s every %s, want %s of vm every 1s", signal.GuestAttribute.KeyName, signal.Name, signal.Interval, utils.BootedGAKey)
+	}
+	if step.Timeout != twf.wf.Steps["wait-vm"].Timeout {
+		t.Errorf("wait step has timeout %q, want the timeout %q of the tests", step.Timeout, twf.wf.Steps["wait-vm"].Timeout)
+	}
+	if deps := twf.wf.Dependencies["wait-booted-vm"]; !slices.Equal(deps, []string{createVMsStepName}) {
+		t.Errorf("wait-booted-vm depends on %v, want [%s]", deps, createVMsStepName)
+	}
+	if tvm.instance.Metadata["_cit_signal_boot"] == "" {
+		t.Errorf("VM does not signal its boot")
+	}
+	if !slices.Equal(twf.bootTimeVMs, []string{"vm"}) {
+		t.Errorf("workflow measures the boot time of %v, want [vm]", twf.bootTimeVMs)
+	}
+	if err := tvm.MeasureBootTime(); err == nil {
+		t.Errorf("second MeasureBootTime() succeeded")
+	}
+}
+
+func TestRebootExpectCount(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.RebootExpectCount(0); err == nil {
+		t.Errorf("RebootExpectCount(0) succeeded")
+	}
+	if err := tvm.Reboot(); err != nil {
+		t.Fatalf("failed to reboot: %v", err)
+	}
+	if err := tvm.RebootExpectCount(2); err != nil {
+		t.Fatalf("RebootExpectCount(2) failed: %v", err)
+	}
+	if tvm.instance.Metadata["_cit_count_boots"] == "" {
+		t.Errorf("VM does not count its boots")
+	}
+	for step, want := range map[string]string{"wait-boot-count-vm-3": "3", "wait-boot-count-vm-5": "4"} {
+		s, ok := twf.wf.Steps[step]
+		if !ok {
+			t.Errorf("%s step missing", step)
+			continue
+		}
+		signal := (*s.WaitForInstancesSignal)[0]
+		if signal.GuestAttribute.KeyName != utils.BootCountGAKey || signal.GuestAttribute.SuccessValue != want || signal.SerialOutput != nil {
+			t.Errorf("%s step waits for guest attribute %s with value %q, want %s with value %q and no serial output", step, signal.GuestAttribute.KeyName, signal.GuestAttribute.SuccessValue, utils.BootCountGAKey, want)
+		}
+	}
+	if deps := twf.wf.Dependencies["wait-boot-count-vm-3"]; !slices.Equal(deps, []string{"wait-started-vm-2"}) {
+		t.Errorf("wait-boot-count-vm-3 depends on %v, want [wait-started-vm-2]", deps)
+	}
+	if deps := twf.wf.Dependencies["stop-vm-4"]; !slices.Equal(deps, []string{"wait-boot-count-vm-3"}) {
+		t.Errorf("stop-vm-4 depends on %v, want [wait-boot-count-vm-3]", deps)
+	}
+	lastStep, err := twf.getLastStepForVM("vm")
+	if err != nil {
+		t.Fatalf("failed to get last step for vm: %v", err)
+	}
+	if lastStep != twf.wf.Steps["wait-boot-count-vm-5"] {
+		t.Errorf("last step of vm is not wait-boot-count-vm-5")
+	}
+}
+
+func TestAddStartupScript(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddStartupScript("echo hello"); err != nil {
+		t.Fatalf("AddStartupScript failed: %v", err)
+	}
+	if got := tvm.instance.Metadata["startup-script"]; got != "echo hello" {
+		t.Errorf("startup-script is %q, want %q", got, "echo hello")
+	}
+	if err := tvm.AddStartupScript("echo again"); err == nil {
+		t.Errorf("AddStartupScript replaced the startup script")
+	}
+	if err := tvm.AddStartupScriptURL("https://example.com/setup.sh"); err == nil {
+		t.Errorf("AddStartupScriptURL accepted a URL which is not in GCS")
+	}
+	if err := tvm.AddStartupScriptURL("gs://bucket/setup.sh"); err != nil {
+		t.Fatalf("AddStartupScriptURL failed: %v", err)
+	}
+	if got := tvm.instance.Metadata["_cit_startup_script_url"]; got != "gs://bucket/setup.sh" {
+		t.Errorf("_cit_startup_script_url is %q, want gs://bucket/setup.sh", got)
+	}
+	if err := tvm.AddStartupScriptURL("gs://bucket/other.sh"); err == nil {
+		t.Errorf("AddStartupScriptURL replaced the startup script URL")
+	}
+	if _, ok := tvm.instance.Metadata["startup-script-url"]; ok {
+		t.Errorf("startup-script-url of the test wrapper was set")
+	}
+
+	twf.Image.GuestOsFeatures = []*compute.GuestOsFeature{{Type: "WINDOWS"}}
+	winvm, err := twf.CreateTestVM("winvm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := winvm.AddStartupScript("Write-Host hello"); err != nil {
+		t.Fatalf("AddStartupScript failed: %v", err)
+	}
+	if got := winvm.instance.Metadata["windows-startup-script-ps1"]; got != "Write-Host hello" {
+		t.Errorf("windows-startup-script-ps1 is %q, want %q", got, "Write-Host hello")
+	}
+}
+
+func TestSetMetadataOnSignal(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetMetadataOnSignal("", "ssh-keys", "user:key"); err == nil {
+		t.Errorf("set metadata without a signal key")
+	}
+	if err := tvm.SetMetadataOnSignal("ready", "ssh-keys", "user:key"); err != nil {
+		t.Fatalf("SetMetadataOnSignal failed: %v", err)
+	}
+	wait, ok := twf.wf.Steps["wait-signal-vm-1"]
+	if !ok {
+		t.Fatalf("wait-signal-vm-1 step missing")
+	}
+	if ga := (*wait.WaitForInstancesSignal)[0].GuestAttribute; ga.Namespace != utils.GuestAttributeTestNamespace || ga.KeyName != "ready" {
+		t.Errorf("wait-signal-vm-1 waits for guest attribute %s/%s, want %s/ready", ga.Namespace, ga.KeyName, utils.GuestAttributeTestNamespace)
+	}
+	if wait.Timeout != twf.wf.Steps["wait-vm"].Timeout {
+		t.Errorf("wait-signal-vm-1 has timeout %q, want the timeout of wait-vm %q", wait.Timeout, twf.wf.Steps["wait-vm"].Timeout)
+	}
+	if deps := twf.wf.Dependencies["wait-signal-vm-1"]; !slices.Equal(deps, []string{createVMsStepName}) {
+		t.Errorf("wait-signal-vm-1 depends on %v, want [%s]", deps, createVMsStepName)
+	}
+	step, ok := twf.wf.Steps["update-metadata-vm-1"]
+	if !ok {
+		t.Fatalf("update-metadata-vm-1 step missing")
+	}
+	if deps := twf.wf.Dependencies["update-metadata-vm-1"]; !slices.Equal(deps, []string{"wait-signal-vm-1"}) {
+		t.Errorf("update-metadata-vm-1 depends on %v, want [wait-signal-vm-1]", deps)
+	}
+	update := (*step.UpdateInstancesMetadata)[0]
+	if update.Instance != "vm" || !maps.Equal(update.Metadata, map[string]string{"ssh-keys": "user:key"}) {
+		t.Errorf("update-metadata-vm-1 sets metadata %v of %s, want ssh-keys=user:key of vm", update.Metadata, update.Instance)
+	}
+}
+
+func TestSetMetadataDuringRun(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetMetadataDuringRun("", "TRUE"); err == nil {
+		t.Errorf("set metadata without a key")
+	}
+	if err := tvm.SetMetadataDuringRun("enable-oslogin", "TRUE"); err != nil {
+		t.Fatalf("SetMetadataDuringRun failed: %v", err)
+	}
+	step, ok := twf.wf.Steps["update-metadata-vm-1"]
+	if !ok {
+		t.Fatalf("update-metadata-vm-1 step missing")
+	}
+	if deps := twf.wf.Dependencies["update-metadata-vm-1"]; !slices.Equal(deps, []string{"wait-vm"}) {
+		t.Errorf("update-metadata-vm-1 depends on %v, want [wait-vm]", deps)
+	}
+	update := (*step.UpdateInstancesMetadata)[0]
+	if update.Instance != "vm" || !maps.Equal(update.Metadata, map[string]string{"enable-oslogin": "TRUE"}) {
+		t.Errorf("update-metadata-vm-1 sets metadata %v of %s, want enable-oslogin=TRUE of vm", update.Metadata, update.Instance)
+	}
+	if err := tvm.WaitForGuestAttribute("testing", "oslogin-enabled"); err != nil {
+		t.Fatalf("failed to wait for guest attribute: %v", err)
+	}
+	if deps := twf.wf.Dependencies["wait-guest-attribute-vm-2"]; !slices.Equal(deps, []string{"update-metadata-vm-1"}) {
+		t.Errorf("wait-guest-attribute-vm-2 depends on %v, want [update-metadata-vm-1]", deps)
+	}
+}
+
+func TestSetDiskInterface(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.MachineType.Name = "n2-standard-2"
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "mount", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.AddLocalSSD("SCSI"); err != nil {
+		t.Fatalf("failed to add local ssd: %v", err)
+	}
+	for _, d := range tvm.instance.Disks {
+		if d.Interface != "" && d.Type != "SCRATCH" {
+			t.Errorf("disk %s has interface %s by default", d.Source, d.Interface)
+		}
+	}
+	if err := tvm.SetDiskInterface("IDE"); err == nil {
+		t.Errorf("set an invalid disk interface")
+	}
+	if err := tvm.SetDiskInterface("NVME"); err != nil {
+		t.Fatalf("SetDiskInterface failed: %v", err)
+	}
+	for _, d := range tvm.instance.Disks {
+		want := "NVME"
+		if d.Type == "SCRATCH" {
+			want = "SCSI"
+		}
+		if d.Interface != want {
+			t.Errorf("disk %s%s has interface %s, want %s", d.Source, d.DeviceName, d.Interface, want)
+		}
+	}
+	tvm.ForceMachineType("c3-standard-4")
+	if err := tvm.SetDiskInterface("SCSI"); err == nil {
+		t.Errorf("set the SCSI disk interface on a machine type which only supports NVME")
+	}
+	if err := tvm.SetDiskInterface("NVME"); err != nil {
+		t.Errorf("SetDiskInterface failed: %v", err)
+	}
+}
+
+func TestSetDiskEncryptionKey(t *testing.T) {
+	key := "projects/p/locations/us-central1/keyRings/ring/cryptoKeys/key"
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "mount", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if _, err := twf.CreateTestVM("other"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetDiskEncryptionKey("projects/p/keyRings/ring"); err == nil {
+		t.Errorf("set an invalid disk encryption key")
+	}
+	if err := tvm.SetDiskEncryptionKey(key); err != nil {
+		t.Fatalf("SetDiskEncryptionKey failed: %v", err)
+	}
+	for _, disk := range *twf.wf.Steps[createDisksStepName].CreateDisks {
+		want := key
+		if disk.Name == "other" {
+			want = ""
+		}
+		var got string
+		if disk.DiskEncryptionKey != nil {
+			got = disk.DiskEncryptionKey.KmsKeyName
+		}
+		if got != want {
+			t.Errorf("disk %s is encrypted with %q, want %q", disk.Name, got, want)
+		}
+	}
+	if keys := twf.diskEncryptionKeys(); !slices.Equal(keys, []string{key}) {
+		t.Errorf("diskEncryptionKeys() = %v, want [%s]", keys, key)
+	}
+}
+
+func TestSetDiskCustomerEncryptionKey(t *testing.T) {
+	rawKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	rsaKey := base64.StdEncoding.EncodeToString(make([]byte, 256))
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "mount", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	other, err := twf.CreateTestVM("other")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	for _, tc := range []struct {
+		key        string
+		rsaWrapped bool
+	}{
+		{"not base64!", false},
+		{base64.StdEncoding.EncodeToString(make([]byte, 16)), false},
+		{rawKey, true},
+		{rsaKey, false},
+	} {
+		if err := tvm.SetDiskCustomerEncryptionKey(tc.key, tc.rsaWrapped); err == nil {
+			t.Errorf("SetDiskCustomerEncryptionKey(%q, %v) succeeded", tc.key, tc.rsaWrapped)
+		} else if strings.Contains(err.Error(), tc.key) {
+			t.Errorf("SetDiskCustomerEncryptionKey error contains the key: %v", err)
+		}
+	}
+	if err := other.SetDiskCustomerEncryptionKey(rsaKey, true); err != nil {
+		t.Fatalf("SetDiskCustomerEncryptionKey failed: %v", err)
+	}
+	if err := tvm.SetDiskCustomerEncryptionKey(rawKey, false); err != nil {
+		t.Fatalf("SetDiskCustomerEncryptionKey failed: %v", err)
+	}
+	if err := tvm.Reboot(); err == nil {
+		t.Errorf("rebooted a VM with customer-supplied encryption keys")
+	}
+	for _, disk := range *twf.wf.Steps[createDisksStepName].CreateDisks {
+		if disk.DiskEncryptionKey != nil {
+			t.Errorf("disk %s has an encryption key before the workflow runs", disk.Name)
+		}
+	}
+
+	twf.applyDiskKeys()
+	for _, disk := range *twf.wf.Steps[createDisksStepName].CreateDisks {
+		want := &compute.CustomerEncryptionKey{RawKey: rawKey}
+		if disk.Name == "other" {
+			want = &compute.CustomerEncryptionKey{RsaEncryptedKey: rsaKey}
+		}
+		if disk.DiskEncryptionKey == nil || disk.DiskEncryptionKey.RawKey != want.RawKey || disk.DiskEncryptionKey.RsaEncryptedKey != want.RsaEncryptedKey {
+			t.Errorf("disk %s has encryption key %+v, want %+v", disk.Name, disk.DiskEncryptionKey, want)
+		}
+	}
+	for _, d := range tvm.instance.Disks {
+		if d.DiskEncryptionKey == nil || d.DiskEncryptionKey.RawKey != rawKey {
+			t.Errorf("attached disk %s of vm has encryption key %+v, want the raw key", d.Source, d.DiskEncryptionKey)
+		}
+	}
+}
+
+func TestSetBootDiskAutoDelete(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "mount", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if !tvm.instance.Disks[0].AutoDelete {
+		t.Errorf("boot disk is not deleted with the VM by default")
+	}
+	tvm.SetBootDiskAutoDelete(false)
+	if tvm.instance.Disks[0].AutoDelete {
+		t.Errorf("boot disk is deleted with the VM after SetBootDiskAutoDelete(false)")
+	}
+	if !tvm.instance.Disks[1].AutoDelete {
+		t.Errorf("mount disk is not deleted with the VM after SetBootDiskAutoDelete(false)")
+	}
+	tvm.SetBootDiskAutoDelete(true)
+	if !tvm.instance.Disks[0].AutoDelete {
+		t.Errorf("boot disk is not deleted with the VM after SetBootDiskAutoDelete(true)")
+	}
+}
+
+func TestSetMinCPUPlatform(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetMinCPUPlatform(""); err == nil {
+		t.Errorf("SetMinCPUPlatform(\"\") succeeded")
+	}
+	if err := tvm.SetMinCPUPlatform("Intel Ice Lake"); err != nil {
+		t.Fatalf("SetMinCPUPlatform(\"Intel Ice Lake\") failed: %v", err)
+	}
+	if tvm.instance.MinCpuPlatform != "Intel Ice Lake" {
+		t.Errorf("minimum CPU platform is %q, want Intel Ice Lake", tvm.instance.MinCpuPlatform)
+	}
+}
+
+func TestSetDeletionProtection(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if twf.deletionProtected() {
+		t.Errorf("workflow is deletion protected by default")
+	}
+	tvm.SetDeletionProtection(true)
+	if !tvm.instance.DeletionProtection || !twf.deletionProtected() {
+		t.Errorf("VM is not deletion protected after SetDeletionProtection(true)")
+	}
+	tvm.SetDeletionProtection(false)
+	if tvm.instance.DeletionProtection || twf.deletionProtected() {
+		t.Errorf("VM is deletion protected after SetDeletionProtection(false)")
+	}
+}
+
+func TestSetReservationAffinity(t *testing.T) {
+	tests := []struct {
+		name     string
+		affinity *compute.ReservationAffinity
+		wantErr  bool
+	}{
+		{"default", nil, false},
+		{"any", &compute.ReservationAffinity{ConsumeReservationType: "ANY_RESERVATION"}, false},
+		{"none", &compute.ReservationAffinity{ConsumeReservationType: "NO_RESERVATION"}, false},
+		{"specific", &compute.ReservationAffinity{ConsumeReservationType: "SPECIFIC_RESERVATION", Key: "compute.googleapis.com/reservation-name", Values: []string{"res"}}, false},
+		{"specific without values", &compute.ReservationAffinity{ConsumeReservationType: "SPECIFIC_RESERVATION", Key: "compute.googleapis.com/reservation-name"}, true},
+		{"invalid type", &compute.ReservationAffinity{ConsumeReservationType: "SOME_RESERVATION"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+			tvm, err := twf.CreateTestVM("vm")
+			if err != nil {
+				t.Fatalf("failed to create test vm: %v", err)
+			}
+			err = tvm.SetReservationAffinity(tc.affinity)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("SetReservationAffinity(%+v) err = %v, want error: %v", tc.affinity, err, tc.wantErr)
+			}
+			if !tc.wantErr && tvm.instance.ReservationAffinity != tc.affinity {
+				t.Errorf("reservation affinity is %+v, want %+v", tvm.instance.ReservationAffinity, tc.affinity)
+			}
+		})
+	}
+}
+
+func TestAttachResourcePolicy(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.Zone.Name = "us-central1-a"
+	if _, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm"}, {Name: "mount", SizeGb: 10}, {Name: "other", SizeGb: 10, Zone: "us-east1-b"}}, nil); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	policy := "projects/p/regions/us-central1/resourcePolicies/schedule"
+	for _, tc := range []struct {
+		disk, policy string
+	}{
+		{"missing", policy},
+		{"mount", "projects/p/zones/us-central1-a/resourcePolicies/schedule"},
+		{"other", policy},
+	} {
+		if err := twf.AttachResourcePolicy(tc.disk, tc.policy); err == nil {
+			t.Errorf("AttachResourcePolicy(%q, %q) succeeded", tc.disk, tc.policy)
+		}
+	}
+	if err := twf.AttachResourcePolicy("mount", policy); err != nil {
+		t.Fatalf("AttachResourcePolicy(mount, %s) failed: %v", policy, err)
+	}
+	for _, d := range *twf.wf.Steps[createDisksStepName].CreateDisks {
+		want := d.Name == "mount"
+		if got := slices.Contains(d.ResourcePolicies, policy); got != want {
+			t.Errorf("disk %s has resource policies %v, want policy attached: %v", d.Name, d.ResourcePolicies, want)
+		}
+	}
+	if !slices.Equal(twf.resourcePolicies, []string{policy}) {
+		t.Errorf("workflow tracks resource policies %v, want %v", twf.resourcePolicies, []string{policy})
+	}
+}
+
+func TestSetOnHostMaintenance(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.SetOnHostMaintenance("RESTART"); err == nil {
+		t.Errorf("SetOnHostMaintenance(RESTART) succeeded")
+	}
+	for _, policy := range []string{"TERMINATE", "MIGRATE"} {
+		if err := tvm.SetOnHostMaintenance(policy); err != nil {
+			t.Fatalf("SetOnHostMaintenance(%s) failed: %v", policy, err)
+		}
+		if got := tvm.instance.Scheduling.OnHostMaintenance; got != policy {
+			t.Errorf("host maintenance policy is %q, want %q", got, policy)
+		}
+	}
+
+	tvm.EnableConfidentialInstance()
+	if err := tvm.SetOnHostMaintenance("MIGRATE"); err == nil {
+		t.Errorf("SetOnHostMaintenance(MIGRATE) succeeded on a confidential VM")
+	}
+	if err := tvm.SetOnHostMaintenance("TERMINATE"); err != nil {
+		t.Errorf("SetOnHostMaintenance(TERMINATE) failed on a confidential VM: %v", err)
+	}
+
+	twf.MachineType.Name = "n1-standard-4"
+	gpuvm, err := twf.CreateTestVMWithAccelerators("gpu", []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-tesla-t4", AcceleratorCount: 1}})
+	if err != nil {
+		t.Fatalf("failed to create test vm with accelerators: %v", err)
+	}
+	if err := gpuvm.SetOnHostMaintenance("MIGRATE"); err == nil {
+		t.Errorf("SetOnHostMaintenance(MIGRATE) succeeded on a VM with accelerators")
+	}
+}
+
+func TestSetAutomaticRestart(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	for _, restart := range []bool{false, true} {
+		if err := tvm.SetAutomaticRestart(restart); err != nil {
+			t.Fatalf("SetAutomaticRestart(%v) failed: %v", restart, err)
+		}
+		if got := tvm.instance.Scheduling.AutomaticRestart; got == nil || *got != restart {
+			t.Errorf("automatic restart is %v, want %v", got, restart)
+		}
+	}
+
+	if err := tvm.SetSpot("STOP"); err != nil {
+		t.Fatalf("SetSpot(STOP) failed: %v", err)
+	}
+	if err := tvm.SetAutomaticRestart(true); err == nil {
+		t.Errorf("SetAutomaticRestart(true) succeeded on a spot VM")
+	}
+	if err := tvm.SetAutomaticRestart(false); err != nil {
+		t.Errorf("SetAutomaticRestart(false) failed on a spot VM: %v", err)
 	}
 }
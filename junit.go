@@ -30,9 +30,10 @@ func convertToTestSuite(results []string, classname string) junit.Testsuite {
 		if err != nil {
 			continue
 		}
-		ts.Testcases = append(ts.Testcases, tcs...)
 		for _, tc := range tcs {
+			// Tests of each image are told apart by the classname.
 			tc.Classname = classname
+			ts.Testcases = append(ts.Testcases, tc)
 
 			ts.Tests++
 			if tc.Skipped != nil {
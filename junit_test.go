@@ -47,6 +47,14 @@ PASS
 === RUN   TestUpdateGroupConf
 --- PASS: TestUpdateGroupConf (0.00s)
 FAIL
+`
+	testSkip = `
+=== RUN   TestWindowsOnly
+    main_test.go:12: Test only run on Windows.
+--- SKIP: TestWindowsOnly (0.00s)
+=== RUN   TestUpdateNSSwitchConfig
+--- PASS: TestUpdateNSSwitchConfig (0.00s)
+PASS
 `
 )
 
@@ -71,6 +79,10 @@ func TestConvertToTestSuite(t *testing.T) {
 			[]string{testPass, testFail},
 			junit.Testsuite{Tests: 9, Failures: 1},
 		},
+		{
+			[]string{testSkip},
+			junit.Testsuite{Tests: 2, Skipped: 1},
+		},
 	}
 	for idx, tt := range tests {
 		ts := convertToTestSuite(tt.results, "")
@@ -99,6 +111,20 @@ func TestConvertToTestSuite(t *testing.T) {
 	}
 }
 
+func TestConvertToTestSuiteClassname(t *testing.T) {
+	ts := convertToTestSuite([]string{testPass, testSkip}, "suite-image")
+	for _, tc := range ts.Testcases {
+		if tc.Classname != "suite-image" {
+			t.Errorf("test case %s has classname %q, want %q", tc.Name, tc.Classname, "suite-image")
+		}
+	}
+	for _, tc := range ts.Testcases {
+		if tc.Name == "TestWindowsOnly" && tc.Skipped == nil {
+			t.Errorf("skipped test case %s is not marked skipped", tc.Name)
+		}
+	}
+}
+
 func TestConvertToTestCase(t *testing.T) {
 	tests := []struct {
 		result string
@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetest
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+	daisy "github.com/GoogleCloudPlatform/compute-daisy"
+	"github.com/jstemmer/go-junit-report/v2/junit"
+)
+
+// SummarySchemaVersion is the version of the ResultsSummary schema. It is
+// bumped whenever a field is removed or changes meaning.
+const SummarySchemaVersion = 1
+
+// Statuses of a test workflow in a ResultsSummary.
+const (
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// ResultsSummary is a machine readable summary of the results of all test
+// workflows of a run.
+type ResultsSummary struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Workflows     []WorkflowSummary `json:"workflows"`
+}
+
+// WorkflowSummary is the result of running the test suite of one test
+// workflow against one image.
+type WorkflowSummary struct {
+	Suite string `json:"suite"`
+	Image string `json:"image"`
+	// WorkflowID is the daisy workflow ID, which is part of the names of the
+	// resources created by the workflow.
+	WorkflowID string `json:"workflowID"`
+	Project    string `json:"project"`
+	// Zone is the zone the workflow ran in, which is one of its fallback
+	// zones if the zone of the run was out of capacity.
+	Zone string `json:"zone"`
+	// MachineType is the machine type of the workflow, if it is one of
+	// several running the suite on different machine types.
+	MachineType string `json:"machineType,omitempty"`
+	// MachineTypes are the machine types of the test VMs, by VM name.
+	MachineTypes    map[string]string `json:"machineTypes,omitempty"`
+	Status          string            `json:"status"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	Tests           int               `json:"tests"`
+	Failures        int               `json:"failures"`
+	Skipped         int               `json:"skipped"`
+	// SkippedMessage is the reason the workflow was skipped, if it was.
+	SkippedMessage string `json:"skippedMessage,omitempty"`
+	// SerialLogsPath is the GCS path of the serial port output of the test
+	// VMs, if any were created.
+	SerialLogsPath string `json:"serialLogsPath,omitempty"`
+	// Metrics are the measurements reported by the tests with
+	// utils.ReportMetric, such as network throughputs.
+	Metrics []Metric `json:"metrics,omitempty"`
+}
+
+// Metric is a measurement reported by a test, or made by the workflow for a
+// VM.
+type Metric struct {
+	Test  string  `json:"test,omitempty"`
+	VM    string  `json:"vm,omitempty"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// metricRgx matches the log lines of utils.ReportMetric in the output of the
+// tests.
+var metricRgx = regexp.MustCompile(regexp.QuoteMeta(utils.MetricLogPrefix) + ` (\S+) (\S+)=(\S+) (\S+)`)
+
+// parseMetrics returns the metrics reported in the outputs of the tests.
+func parseMetrics(results []string) []Metric {
+	var metrics []Metric
+	for _, r := range results {
+		for _, m := range metricRgx.FindAllStringSubmatch(r, -1) {
+			value, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				continue
+			}
+			metrics = append(metrics, Metric{Test: m[1], Name: m[2], Value: value, Unit: m[4]})
+		}
+	}
+	return metrics
+}
+
+// newWorkflowSummary summarizes the result of a test workflow and the test
+// suite parsed from it.
+func newWorkflowSummary(res testResult, suite junit.Testsuite) WorkflowSummary {
+	t := res.testWorkflow
+	s := WorkflowSummary{
+		Suite:           t.Name,
+		Image:           t.ImageURL,
+		WorkflowID:      t.wf.ID(),
+		Project:         t.wf.Project,
+		Zone:            t.wf.Zone,
+		MachineType:     t.matrixMachineType,
+		MachineTypes:    t.machineTypes(),
+		DurationSeconds: res.duration.Seconds(),
+		Tests:           suite.Tests,
+		Failures:        suite.Failures + suite.Errors,
+		Skipped:         suite.Skipped,
+		SerialLogsPath:  t.serialLogsPath(),
+		Metrics:         parseMetrics(res.results),
+	}
+	if res.workflowSuccess {
+		s.Metrics = append(s.Metrics, t.bootTimeMetrics()...)
+	}
+	switch {
+	case res.skipped:
+		s.Status = StatusSkipped
+		s.SkippedMessage = t.SkippedMessage()
+	case !res.workflowSuccess, s.Failures > 0:
+		s.Status = StatusFailed
+	default:
+		s.Status = StatusPassed
+	}
+	return s
+}
+
+// machineTypes returns the machine types of the VMs created by the workflow,
+// by VM name.
+func (t *TestWorkflow) machineTypes() map[string]string {
+	machineTypes := make(map[string]string)
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range step.CreateInstances.Instances {
+			if vm.MachineType != "" {
+				machineTypes[vm.Name] = path.Base(vm.MachineType)
+			}
+		}
+		for _, vm := range step.CreateInstances.InstancesBeta {
+			if vm.MachineType != "" {
+				machineTypes[vm.Name] = path.Base(vm.MachineType)
+			}
+		}
+	}
+	if len(machineTypes) == 0 {
+		return nil
+	}
+	return machineTypes
+}
+
+// bootTimeMetrics returns the boot_time metrics of the VMs measured with
+// MeasureBootTime, which are only valid if the workflow succeeded.
+func (t *TestWorkflow) bootTimeMetrics() []Metric {
+	createSteps := make(map[string]string)
+	for _, vm := range t.bootTimeVMs {
+		step, err := t.getCreateStepForVM(vm)
+		if err != nil {
+			continue
+		}
+		for name, s := range t.wf.Steps {
+			if s == step {
+				createSteps[vm] = name
+			}
+		}
+	}
+	return bootTimes(t.wf.GetStepTimeRecords(), createSteps)
+}
+
+// bootTimes returns the time from the end of the step creating each VM, by VM
+// name, to the end of the step waiting for it to boot.
+func bootTimes(records []daisy.TimeRecord, createSteps map[string]string) []Metric {
+	ends := make(map[string]time.Time)
+	for _, r := range records {
+		ends[r.Name] = r.EndTime
+	}
+	var vms []string
+	for vm := range createSteps {
+		vms = append(vms, vm)
+	}
+	sort.Strings(vms)
+	var metrics []Metric
+	for _, vm := range vms {
+		created, ok := ends[createSteps[vm]]
+		if !ok {
+			continue
+		}
+		booted, ok := ends["wait-booted-"+vm]
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, Metric{VM: vm, Name: "boot_time", Value: booted.Sub(created).Seconds(), Unit: "s"})
+	}
+	return metrics
+}
+
+// Summarize returns the summary of the results of the test workflows, which
+// must have been run with RunTests.
+func Summarize(testWorkflows []*TestWorkflow) ResultsSummary {
+	summary := ResultsSummary{SchemaVersion: SummarySchemaVersion}
+	for _, t := range testWorkflows {
+		if t.summary != nil {
+			summary.Workflows = append(summary.Workflows, *t.summary)
+		}
+	}
+	sort.Slice(summary.Workflows, func(i, j int) bool {
+		if summary.Workflows[i].Suite != summary.Workflows[j].Suite {
+			return summary.Workflows[i].Suite < summary.Workflows[j].Suite
+		}
+		if summary.Workflows[i].Image != summary.Workflows[j].Image {
+			return summary.Workflows[i].Image < summary.Workflows[j].Image
+		}
+		return summary.Workflows[i].MachineType < summary.Workflows[j].MachineType
+	})
+	return summary
+}
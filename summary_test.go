@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagetest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	daisy "github.com/GoogleCloudPlatform/compute-daisy"
+	"github.com/jstemmer/go-junit-report/v2/junit"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestNewWorkflowSummary(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("suite", "projects/p/global/images/image", "30m")
+	twf.wf.Project = "project"
+	twf.wf.Zone = "us-central1-a"
+	step, _, err := twf.appendCreateVMStep([]*compute.Disk{{Name: "vm"}}, nil)
+	if err != nil {
+		t.Fatalf("failed to append create vm step: %v", err)
+	}
+	step.CreateInstances.Instances[0].MachineType = "projects/project/zones/us-central1-a/machineTypes/n2-standard-2"
+	step.CreateInstances.Instances[0].Metadata["daisy-logs-path"] = "gs://bucket/daisy/logs"
+
+	res := testResult{testWorkflow: twf, workflowSuccess: true, duration: 90 * time.Second}
+	s := newWorkflowSummary(res, junit.Testsuite{Tests: 3, Skipped: 1})
+	if s.Suite != "suite" || s.Image != "projects/p/global/images/image" || s.Project != "project" || s.Zone != "us-central1-a" {
+		t.Errorf("summary has suite %q, image %q, project %q and zone %q, want suite, projects/p/global/images/image, project and us-central1-a", s.Suite, s.Image, s.Project, s.Zone)
+	}
+	if s.WorkflowID != twf.wf.ID() {
+		t.Errorf("summary has workflow ID %q, want %q", s.WorkflowID, twf.wf.ID())
+	}
+	if s.MachineTypes["vm"] != "n2-standard-2" {
+		t.Errorf("summary has machine types %v, want vm: n2-standard-2", s.MachineTypes)
+	}
+	if s.Status != StatusPassed || s.DurationSeconds != 90 || s.Tests != 3 || s.Skipped != 1 {
+		t.Errorf("summary has status %q, duration %v, %d tests and %d skipped, want passed, 90, 3 and 1", s.Status, s.DurationSeconds, s.Tests, s.Skipped)
+	}
+	if s.SerialLogsPath != "gs://bucket/daisy/logs" {
+		t.Errorf("summary has serial logs path %q, want gs://bucket/daisy/logs", s.SerialLogsPath)
+	}
+
+	tests := []struct {
+		name  string
+		res   testResult
+		suite junit.Testsuite
+		want  string
+	}{
+		{name: "skipped", res: testResult{testWorkflow: twf, skipped: true}, want: StatusSkipped},
+		{name: "workflow failed", res: testResult{testWorkflow: twf, err: errors.New("failed")}, want: StatusFailed},
+		{name: "test failed", res: testResult{testWorkflow: twf, workflowSuccess: true}, suite: junit.Testsuite{Tests: 1, Failures: 1}, want: StatusFailed},
+	}
+	for _, tc := range tests {
+		if got := newWorkflowSummary(tc.res, tc.suite).Status; got != tc.want {
+			t.Errorf("%s: status = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	b := NewTestWorkflowForUnitTest("b", "image", "30m")
+	b.summary = &WorkflowSummary{Suite: "b", Image: "image"}
+	a2 := NewTestWorkflowForUnitTest("a", "image2", "30m")
+	a2.summary = &WorkflowSummary{Suite: "a", Image: "image2"}
+	a1 := NewTestWorkflowForUnitTest("a", "image1", "30m")
+	a1.summary = &WorkflowSummary{Suite: "a", Image: "image1"}
+	notRun := NewTestWorkflowForUnitTest("c", "image", "30m")
+
+	summary := Summarize([]*TestWorkflow{b, a2, notRun, a1})
+	if summary.SchemaVersion != SummarySchemaVersion {
+		t.Errorf("schema version = %d, want %d", summary.SchemaVersion, SummarySchemaVersion)
+	}
+	var got []string
+	for _, w := range summary.Workflows {
+		got = append(got, w.Suite+"/"+w.Image)
+	}
+	want := []string{"a/image1", "a/image2", "b/image"}
+	if !slices.Equal(got, want) {
+		t.Errorf("summarized workflows %v, want %v", got, want)
+	}
+}
+
+func TestParseMetrics(t *testing.T) {
+	results := []string{
+		"=== RUN   TestNetworkPerformance\n    performance_test.go:72: cit-metric TestNetworkPerformance throughput=9.41 Gbits/s\n--- PASS: TestNetworkPerformance (0.00s)\nPASS\n",
+		"=== RUN   TestGVNICExists\n--- PASS: TestGVNICExists (0.00s)\nPASS\n",
+		"    x_test.go:1: cit-metric TestX/sub iops=1200 ops/s\n    x_test.go:2: cit-metric TestX bad=NaN? s\n",
+	}
+	want := []Metric{
+		{Test: "TestNetworkPerformance", Name: "throughput", Value: 9.41, Unit: "Gbits/s"},
+		{Test: "TestX/sub", Name: "iops", Value: 1200, Unit: "ops/s"},
+	}
+	if got := parseMetrics(results); !slices.Equal(got, want) {
+		t.Errorf("parseMetrics() = %v, want %v", got, want)
+	}
+	if got := parseMetrics(nil); got != nil {
+		t.Errorf("parseMetrics(nil) = %v, want nil", got)
+	}
+}
+
+func TestBootTimes(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []daisy.TimeRecord{
+		{Name: "create-vms", StartTime: start, EndTime: start.Add(30 * time.Second)},
+		{Name: "wait-booted-b", StartTime: start.Add(30 * time.Second), EndTime: start.Add(75 * time.Second)},
+		{Name: "wait-booted-a", StartTime: start.Add(30 * time.Second), EndTime: start.Add(60 * time.Second)},
+	}
+	createSteps := map[string]string{"a": "create-vms", "b": "create-vms", "c": "create-vms"}
+	want := []Metric{
+		{VM: "a", Name: "boot_time", Value: 30, Unit: "s"},
+		{VM: "b", Name: "boot_time", Value: 45, Unit: "s"},
+	}
+	if got := bootTimes(records, createSteps); !slices.Equal(got, want) {
+		t.Errorf("bootTimes() = %v, want %v", got, want)
+	}
+}
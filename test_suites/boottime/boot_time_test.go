@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boottime
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// bootPhaseRgx matches the duration of a boot phase in the output of
+// systemd-analyze time, such as "1min 2.345s (userspace)".
+var bootPhaseRgx = regexp.MustCompile(`((?:\d+(?:\.\d+)?(?:h|min|s|ms|us) ?)+) \((\w+)\)`)
+
+// parseSystemdDuration parses a duration printed by systemd, such as
+// "1min 2.345s" or "890ms".
+func parseSystemdDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	for _, f := range strings.Fields(s) {
+		// Go durations don't take "min".
+		part, err := time.ParseDuration(strings.Replace(f, "min", "m", 1))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %v", s, err)
+		}
+		d += part
+	}
+	return d, nil
+}
+
+// systemdBootTimes returns the duration of each boot phase, such as kernel
+// and userspace, reported by systemd-analyze time. It fails until the boot
+// has finished.
+func systemdBootTimes(ctx context.Context) (map[string]time.Duration, error) {
+	out, err := exec.CommandContext(ctx, "systemd-analyze", "time").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("systemd-analyze time failed: %s %v", out, err)
+	}
+	phases := make(map[string]time.Duration)
+	for _, m := range bootPhaseRgx.FindAllStringSubmatch(string(out), -1) {
+		d, err := parseSystemdDuration(m[1])
+		if err != nil {
+			return nil, err
+		}
+		phases[m[2]] = d
+	}
+	if len(phases) == 0 {
+		return nil, fmt.Errorf("no boot phases in systemd-analyze output %q", out)
+	}
+	return phases, nil
+}
+
+// windowsBootTime returns the boot duration of the last boot event of the
+// diagnostics performance log, which Windows writes a few minutes after boot.
+func windowsBootTime() (time.Duration, error) {
+	out, err := utils.RunPowershellCmd(`$e = Get-WinEvent -FilterHashtable @{LogName='Microsoft-Windows-Diagnostics-Performance/Operational'; Id=100} -MaxEvents 1 -ErrorAction Stop; (([xml]$e.ToXml()).Event.EventData.Data | Where-Object Name -eq 'BootTime').'#text'`)
+	if err != nil {
+		return 0, fmt.Errorf("could not get boot event: %s %s %v", out.Stdout, out.Stderr, err)
+	}
+	ms, err := strconv.Atoi(strings.TrimSpace(out.Stdout))
+	if err != nil {
+		return 0, fmt.Errorf("invalid boot time %q: %v", out.Stdout, err)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// reportBootTime reports the duration of a boot phase as a metric and as a
+// guest attribute.
+func reportBootTime(ctx context.Context, t *testing.T, phase string, d time.Duration) {
+	t.Helper()
+	utils.ReportMetric(t, phase, d.Seconds(), "s")
+	if err := utils.PutGuestAttribute(ctx, utils.GuestAttributeTestNamespace, "boot-time-"+phase, fmt.Sprint(d.Seconds())); err != nil {
+		t.Errorf("could not publish %s boot time: %v", phase, err)
+	}
+}
+
+func TestBootTime(t *testing.T) {
+	ctx := utils.Context(t)
+	if utils.IsWindows() {
+		var d time.Duration
+		err := utils.RetryUntil(ctx, 10*time.Minute, 30*time.Second, func() error {
+			var err error
+			d, err = windowsBootTime()
+			return err
+		})
+		if err != nil {
+			t.Skipf("Windows did not report the boot time: %v", err)
+		}
+		reportBootTime(ctx, t, "total", d)
+		return
+	}
+
+	if !utils.CheckLinuxCmdExists("systemd-analyze") {
+		t.Skip("systemd-analyze is not available, the image may not use systemd")
+	}
+	var phases map[string]time.Duration
+	// systemd-analyze fails while the boot is still running.
+	err := utils.RetryUntil(ctx, 5*time.Minute, 10*time.Second, func() error {
+		var err error
+		phases, err = systemdBootTimes(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total time.Duration
+	for phase, d := range phases {
+		reportBootTime(ctx, t, phase, d)
+		total += d
+	}
+	reportBootTime(ctx, t, "total", total)
+}
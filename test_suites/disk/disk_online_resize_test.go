@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+const onlineResizeMountPoint = "/mnt/onlineresize"
+
+// TestOnlineDiskResize validates that the guest sees a data disk resized while
+// the VM is running, and that a filesystem on it can be grown without a reboot.
+func TestOnlineDiskResize(t *testing.T) {
+	// TODO: test online disk resizing on windows
+	utils.LinuxOnly(t)
+	for _, cmd := range []string{"growpart", "resize2fs", "mkfs.ext4", "sfdisk"} {
+		if !utils.CheckLinuxCmdExists(cmd) {
+			t.Skipf("%s is not available on the image", cmd)
+		}
+	}
+	device := "/dev/disk/by-id/google-" + onlineResizeDiskName
+	partition := device + "-part1"
+
+	if err := waitForBlockDeviceSize(device, onlineResizeDiskSize, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a filesystem on a partition of the initial disk size, so there is
+	// room to grow it regardless of when the resize happened.
+	sfdisk := exec.Command("sfdisk", device)
+	sfdisk.Stdin = strings.NewReader(fmt.Sprintf(",%dGiB\n", onlineResizeInitialSize))
+	if out, err := sfdisk.CombinedOutput(); err != nil {
+		t.Fatalf("failed to partition %s: %v, output: %s", device, err, out)
+	}
+	if out, err := exec.Command("udevadm", "settle").CombinedOutput(); err != nil {
+		t.Fatalf("udevadm settle failed: %v, output: %s", err, out)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-F", partition).CombinedOutput(); err != nil {
+		t.Fatalf("failed to create filesystem on %s: %v, output: %s", partition, err, out)
+	}
+	if err := os.MkdirAll(onlineResizeMountPoint, 0755); err != nil {
+		t.Fatalf("failed to create mount point: %v", err)
+	}
+	if out, err := exec.Command("mount", partition, onlineResizeMountPoint).CombinedOutput(); err != nil {
+		t.Fatalf("failed to mount %s: %v, output: %s", partition, err, out)
+	}
+	defer exec.Command("umount", onlineResizeMountPoint).Run()
+
+	if err := growFilesystem(device, partition); err != nil {
+		t.Fatal(err)
+	}
+	size, err := getFilesystemSize(onlineResizeMountPoint)
+	if err != nil {
+		t.Fatalf("could not get filesystem size: %v", err)
+	}
+	// Filesystem overhead means the size is a bit lower than the disk size.
+	if minSize := int64(onlineResizeDiskSize * gb * 0.9); size < minSize {
+		t.Fatalf("filesystem size of %d gb did not grow to %d gb", size/gb, onlineResizeDiskSize)
+	}
+}
+
+// waitForBlockDeviceSize waits until the block device is at least the
+// expected size.
+func waitForBlockDeviceSize(device string, expectedGb int64, timeout time.Duration) error {
+	var size int64
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(5 * time.Second) {
+		out, err := exec.Command("blockdev", "--getsize64", device).Output()
+		if err != nil {
+			return fmt.Errorf("could not get size of %s: %v", device, err)
+		}
+		size, err = strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("could not parse size of %s from %q: %v", device, out, err)
+		}
+		if size >= expectedGb*gb {
+			return nil
+		}
+	}
+	return fmt.Errorf("block device %s is %d gb after %s, want %d gb", device, size/gb, timeout, expectedGb)
+}
+
+// growFilesystem grows the first partition of the device to fill the device
+// and then grows the ext4 filesystem on it to fill the partition.
+func growFilesystem(device, partition string) error {
+	out, err := exec.Command("growpart", device, "1").CombinedOutput()
+	// growpart exits 1 when the partition already fills the device.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && bytes.Contains(out, []byte("NOCHANGE"))) {
+		return fmt.Errorf("growpart %s failed: %v, output: %s", device, err, out)
+	}
+	if out, err := exec.Command("resize2fs", partition).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs %s failed: %v, output: %s", partition, err, out)
+	}
+	return nil
+}
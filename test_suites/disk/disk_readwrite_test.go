@@ -17,7 +17,6 @@ package disk
 import (
 	"fmt"
 	"os"
-	"runtime"
 	"strings"
 	"testing"
 
@@ -25,7 +24,7 @@ import (
 )
 
 func TestDiskReadWrite(t *testing.T) {
-	if runtime.GOOS == "linux" {
+	if utils.IsLinux() {
 		testDiskReadWriteLinux(t)
 	} else {
 		testDiskReadWriteWindows(t)
@@ -67,7 +67,12 @@ func getDiskSize(image string) (int64, error) {
 	if strings.Contains(image, "cos") {
 		diskPath = "/mnt/stateful_partition"
 	}
+	return getFilesystemSize(diskPath)
+}
 
+// getFilesystemSize returns the size in bytes of the filesystem mounted at the
+// given path.
+func getFilesystemSize(diskPath string) (int64, error) {
 	fstatOut, err := exec.Command("df", "-B1", "--output=size", diskPath).CombinedOutput()
 	if err != nil {
 		return 0, fmt.Errorf("df command failed with error %v", err)
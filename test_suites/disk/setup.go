@@ -46,6 +46,11 @@ var (
 
 const (
 	resizeDiskSize = 200
+	// The data disk of the online resize VM is created with
+	// onlineResizeInitialSize and resized to onlineResizeDiskSize while running.
+	onlineResizeInitialSize = 10
+	onlineResizeDiskSize    = 20
+	onlineResizeDiskName    = "onlineresizedata"
 )
 
 // TestSetup sets up the test workflow.
@@ -63,6 +68,17 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		}
 	}
 	vm.RunTests("TestDiskReadWrite|TestDiskResize")
+	// TODO: test online disk resizing on windows
+	if !utils.HasFeature(t.Image, "WINDOWS") {
+		onlineResizeVM, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "onlineresize"}, {Name: onlineResizeDiskName, Type: imagetest.PdBalanced, SizeGb: onlineResizeInitialSize}}, nil)
+		if err != nil {
+			return err
+		}
+		if err := onlineResizeVM.ResizeDisk(onlineResizeDiskName, onlineResizeDiskSize); err != nil {
+			return err
+		}
+		onlineResizeVM.RunTests("TestOnlineDiskResize")
+	}
 	// Block device naming is an interaction between OS and hardware alone on windows, there is no guest-environment equivalent of udev rules for us to test.
 	if !utils.HasFeature(t.Image, "WINDOWS") && utils.HasFeature(t.Image, "GVNIC") {
 		for _, tc := range blockdevNamingCases {
@@ -0,0 +1,206 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+const (
+	metadataServerName = "metadata.google.internal"
+	metadataServerIP   = "169.254.169.254"
+	// publicName is a name outside of the VPC, which the metadata server
+	// forwards to public DNS.
+	publicName = "www.google.com"
+	// resolvedResolvConf lists the upstream servers of systemd-resolved,
+	// when /etc/resolv.conf points at its stub resolver.
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// zonalDNSImages are the images whose search domains follow the zonal DNS
+// format rather than the hostname of the metadata server.
+var zonalDNSImages = []string{"almalinux-9", "centos-stream-9", "rhel-9", "rocky-linux-9"}
+
+// resolvConf is the configuration of the resolver in resolv.conf.
+type resolvConf struct {
+	nameservers []string
+	search      []string
+}
+
+// parseResolvConf parses the nameserver, search and domain lines of a
+// resolv.conf file.
+func parseResolvConf(b []byte) resolvConf {
+	var conf resolvConf
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.nameservers = append(conf.nameservers, fields[1])
+		case "search", "domain":
+			conf.search = append(conf.search, fields[1:]...)
+		}
+	}
+	return conf
+}
+
+// isStubResolver reports whether the nameservers are only the local stub
+// resolver of systemd-resolved.
+func isStubResolver(nameservers []string) bool {
+	if len(nameservers) == 0 {
+		return false
+	}
+	for _, ns := range nameservers {
+		if ns != "127.0.0.53" && ns != "127.0.0.54" {
+			return false
+		}
+	}
+	return true
+}
+
+// readResolvConf returns the resolver configuration of the guest, following
+// the systemd-resolved stub resolver to its upstream configuration.
+func readResolvConf() (resolvConf, error) {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return resolvConf{}, fmt.Errorf("could not read /etc/resolv.conf: %v", err)
+	}
+	conf := parseResolvConf(b)
+	if !isStubResolver(conf.nameservers) {
+		return conf, nil
+	}
+	b, err = os.ReadFile(resolvedResolvConf)
+	if err != nil {
+		return resolvConf{}, fmt.Errorf("/etc/resolv.conf points at the systemd-resolved stub resolver, but could not read %s: %v", resolvedResolvConf, err)
+	}
+	return parseResolvConf(b), nil
+}
+
+// windowsDNSServers returns the IPv4 DNS servers of the network interfaces.
+func windowsDNSServers() ([]string, error) {
+	out, err := utils.RunPowershellCmd("Get-DnsClientServerAddress -AddressFamily IPv4 | Select-Object -ExpandProperty ServerAddresses")
+	if err != nil {
+		return nil, fmt.Errorf("could not get DNS servers: %s %s %v", out.Stdout, out.Stderr, err)
+	}
+	return strings.Fields(out.Stdout), nil
+}
+
+// lookup resolves a name, retrying while the network comes up after boot.
+func lookup(ctx context.Context, name string) ([]string, error) {
+	var addrs []string
+	err := utils.Retry(ctx, 5, 2*time.Second, func() error {
+		var err error
+		addrs, err = net.DefaultResolver.LookupHost(ctx, name)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %v", name, err)
+	}
+	return addrs, nil
+}
+
+func TestDNSResolution(t *testing.T) {
+	ctx := utils.Context(t)
+	addrs, err := lookup(ctx, metadataServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr == metadataServerIP {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("%s resolved to %v, want %s", metadataServerName, addrs, metadataServerIP)
+	}
+
+	addrs, err = lookup(ctx, publicName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) == 0 {
+		t.Errorf("%s resolved to no addresses", publicName)
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	var servers []string
+	if utils.IsWindows() {
+		var err error
+		servers, err = windowsDNSServers()
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		conf, err := readResolvConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = conf.nameservers
+	}
+	for _, s := range servers {
+		if s == metadataServerIP {
+			return
+		}
+	}
+	t.Fatalf("DNS servers are %v, want %s", servers, metadataServerIP)
+}
+
+func TestDNSSearchDomain(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	image, err := utils.GetMetadata(ctx, "instance", "image")
+	if err != nil {
+		t.Fatalf("couldn't get image from metadata: %v", err)
+	}
+	for _, i := range zonalDNSImages {
+		if strings.Contains(image, i) {
+			t.Skipf("Search domains follow zonal DNS on %s", i)
+		}
+	}
+	hostname, err := utils.GetMetadata(ctx, "instance", "hostname")
+	if err != nil {
+		t.Fatalf("couldn't get hostname from metadata: %v", err)
+	}
+	_, domain, ok := strings.Cut(strings.TrimSpace(hostname), ".")
+	if !ok {
+		t.Fatalf("metadata hostname %q has no domain", hostname)
+	}
+	conf, err := readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range conf.search {
+		if strings.TrimSuffix(s, ".") == domain {
+			return
+		}
+	}
+	t.Fatalf("search domains are %v, want %s", conf.search, domain)
+}
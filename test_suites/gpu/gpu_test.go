@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gpu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+const (
+	linuxInstallerURL   = "https://raw.githubusercontent.com/GoogleCloudPlatform/compute-gpu-installation/main/linux/install_gpu_driver.py"
+	windowsInstallerURL = "https://raw.githubusercontent.com/GoogleCloudPlatform/compute-gpu-installation/main/windows/install_gpu_driver.ps1"
+	// cosNvidiaDir is where cos-extensions installs the driver on
+	// Container-Optimized OS.
+	cosNvidiaDir = "/var/lib/nvidia"
+	// driverVersionGAKey is the guest attribute the detected driver version
+	// is published as.
+	driverVersionGAKey = "gpu-driver-version"
+)
+
+// kernelModuleVersionRgx matches the version of the loaded NVIDIA kernel
+// module in /proc/driver/nvidia/version.
+var kernelModuleVersionRgx = regexp.MustCompile(`Kernel Module\s+([0-9.]+)`)
+
+// gpu is a GPU reported by nvidia-smi.
+type gpu struct {
+	name          string
+	driverVersion string
+}
+
+// download saves the content of url to a file in dir.
+func download(ctx context.Context, url, dir string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download %s: %s", url, resp.Status)
+	}
+	file := filepath.Join(dir, filepath.Base(url))
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return "", fmt.Errorf("could not write %s: %v", file, err)
+	}
+	return file, nil
+}
+
+// isCOS reports whether the guest is Container-Optimized OS.
+func isCOS() bool {
+	b, err := os.ReadFile("/etc/os-release")
+	return err == nil && strings.Contains(string(b), "ID=cos")
+}
+
+// installDriver installs the GPU driver with the installer of the OS and
+// returns the path of nvidia-smi.
+func installDriver(ctx context.Context, t *testing.T) (string, error) {
+	switch {
+	case utils.IsWindows():
+		script, err := download(ctx, windowsInstallerURL, t.TempDir())
+		if err != nil {
+			return "", err
+		}
+		if out, err := utils.RunPowershellCmd("& '" + script + "'"); err != nil {
+			return "", fmt.Errorf("driver install failed: %s %s %v", out.Stdout, out.Stderr, err)
+		}
+		return `C:\Program Files\NVIDIA Corporation\NVSMI\nvidia-smi.exe`, nil
+	case isCOS():
+		if out, err := exec.CommandContext(ctx, "cos-extensions", "install", "gpu").CombinedOutput(); err != nil {
+			return "", fmt.Errorf("cos-extensions install gpu failed: %s %v", out, err)
+		}
+		// The stateful partition is mounted noexec.
+		for _, args := range [][]string{{"--bind", cosNvidiaDir, cosNvidiaDir}, {"-o", "remount,exec", cosNvidiaDir}} {
+			if out, err := exec.CommandContext(ctx, "mount", args...).CombinedOutput(); err != nil {
+				return "", fmt.Errorf("mount %s failed: %s %v", strings.Join(args, " "), out, err)
+			}
+		}
+		return filepath.Join(cosNvidiaDir, "bin", "nvidia-smi"), nil
+	default:
+		script, err := download(ctx, linuxInstallerURL, t.TempDir())
+		if err != nil {
+			return "", err
+		}
+		if out, err := exec.CommandContext(ctx, "python3", script).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("driver install failed: %s %v", out, err)
+		}
+		return "nvidia-smi", nil
+	}
+}
+
+// queryGPUs returns the GPUs nvidia-smi detects.
+func queryGPUs(ctx context.Context, nvidiaSMI string) ([]gpu, error) {
+	out, err := exec.CommandContext(ctx, nvidiaSMI, "--query-gpu=name,driver_version", "--format=csv,noheader").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %s %v", out, err)
+	}
+	var gpus []gpu
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, version, ok := strings.Cut(line, ",")
+		if !ok {
+			continue
+		}
+		gpus = append(gpus, gpu{name: strings.TrimSpace(name), driverVersion: strings.TrimSpace(version)})
+	}
+	return gpus, nil
+}
+
+// kernelModuleVersion returns the version of the loaded NVIDIA kernel module.
+func kernelModuleVersion() (string, error) {
+	b, err := os.ReadFile("/proc/driver/nvidia/version")
+	if err != nil {
+		return "", fmt.Errorf("could not read the NVIDIA kernel module version: %v", err)
+	}
+	m := kernelModuleVersionRgx.FindStringSubmatch(string(b))
+	if m == nil {
+		return "", fmt.Errorf("no version in /proc/driver/nvidia/version: %q", b)
+	}
+	return m[1], nil
+}
+
+func TestGPUDriver(t *testing.T) {
+	ctx := utils.Context(t)
+	count, err := utils.GetMetadata(ctx, "instance", "attributes", expectedGPUCountKey)
+	if err != nil {
+		t.Fatalf("could not get GPU count from metadata: %v", err)
+	}
+	wantCount, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		t.Fatalf("invalid GPU count %q: %v", count, err)
+	}
+
+	nvidiaSMI, err := installDriver(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpus, err := queryGPUs(ctx, nvidiaSMI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gpus) != wantCount {
+		t.Fatalf("nvidia-smi reports %d GPUs %v, want %d", len(gpus), gpus, wantCount)
+	}
+	version := gpus[0].driverVersion
+	for _, g := range gpus {
+		if g.driverVersion != version {
+			t.Errorf("GPU %s has driver version %s, want %s like the other GPUs", g.name, g.driverVersion, version)
+		}
+	}
+	// A driver whose user space and kernel module versions differ fails to
+	// run CUDA applications.
+	if !utils.IsWindows() {
+		moduleVersion, err := kernelModuleVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moduleVersion != version {
+			t.Errorf("nvidia-smi reports driver version %s, but the kernel module version is %s", version, moduleVersion)
+		}
+	}
+	t.Logf("GPU driver version %s", version)
+	if err := utils.PutGuestAttribute(ctx, utils.GuestAttributeTestNamespace, driverVersionGAKey, version); err != nil {
+		t.Errorf("could not publish driver version: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gpu is a CIT suite for testing that the NVIDIA driver installs and
+// detects the GPUs of accelerator-optimized VMs.
+package gpu
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+	daisy "github.com/GoogleCloudPlatform/compute-daisy"
+	"google.golang.org/api/compute/v1"
+)
+
+// Name is the name of the test package. It must match the directory name.
+var Name = "gpu"
+
+const (
+	gpuMachineType = "n1-standard-4"
+	gpuType        = "nvidia-tesla-t4"
+	gpuCount       = 1
+	// expectedGPUCountKey is the metadata key holding the number of GPUs
+	// attached to the VM.
+	expectedGPUCountKey = "expected-gpu-count"
+	// The driver install builds kernel modules, which needs a bigger boot
+	// disk and more time than the other suites.
+	bootDiskSizeGB = 50
+	gpuWaitTimeout = "60m"
+)
+
+// supportedLinuxImageRe matches the Linux images the GPU driver installers
+// support.
+var supportedLinuxImageRe = regexp.MustCompile(`debian|ubuntu|rhel|rocky-linux|centos|cos`)
+
+// TestSetup sets up the test workflow.
+func TestSetup(t *imagetest.TestWorkflow) error {
+	if t.Image.Architecture == "ARM64" {
+		t.Skip("GPUs are not supported on ARM64 images.")
+		return nil
+	}
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		if utils.IsWindowsClient(t.Image.Name) || utils.Is32BitWindows(t.Image.Name) {
+			t.Skip("The GPU driver installer only supports 64 bit Windows Server.")
+			return nil
+		}
+	} else if !supportedLinuxImageRe.MatchString(t.Image.Name) {
+		t.Skip("The GPU driver installer doesn't support this image.")
+		return nil
+	}
+
+	inst := &daisy.Instance{}
+	inst.MachineType = gpuMachineType
+	inst.GuestAccelerators = []*compute.AcceleratorConfig{{AcceleratorType: gpuType, AcceleratorCount: gpuCount}}
+	vm, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "gpu", Type: imagetest.PdBalanced, SizeGb: bootDiskSizeGB}}, inst)
+	if err != nil {
+		return err
+	}
+	if err := vm.SetWaitTimeout(gpuWaitTimeout); err != nil {
+		return err
+	}
+	vm.AddMetadata(expectedGPUCountKey, fmt.Sprintf("%d", gpuCount))
+	vm.AddMetadata("enable-guest-attributes", "TRUE")
+	vm.RunTests("TestGPUDriver")
+	return nil
+}
@@ -33,6 +33,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		return err
 	}
 	telemetrydisabledvm.AddMetadata("disable-guest-telemetry", "true")
+	telemetrydisabledvm.CollectAgentLogsOnFailure()
 	telemetrydisabledvm.RunTests("TestTelemetryDisabled")
 
 	telemetryenabledinst := &daisy.Instance{}
@@ -43,6 +44,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		return err
 	}
 	telemetryenabledvm.AddMetadata("disable-guest-telemetry", "false")
+	telemetryenabledvm.CollectAgentLogsOnFailure()
 	telemetryenabledvm.RunTests("TestTelemetryEnabled")
 
 	snapshotinst := &daisy.Instance{}
@@ -52,6 +54,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	if err != nil {
 		return err
 	}
+	snapshotvm.CollectAgentLogsOnFailure()
 	snapshotvm.RunTests("TestSnapshotScripts")
 
 	if utils.HasFeature(t.Image, "WINDOWS") {
@@ -61,6 +64,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		if err != nil {
 			return err
 		}
+		windowsaccountVM.CollectAgentLogsOnFailure()
 		windowsaccountVM.RunTests("TestWindowsPasswordReset")
 	}
 	return nil
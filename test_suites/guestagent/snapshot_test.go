@@ -16,7 +16,6 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
-	"os/exec"
 	"strings"
 	"testing"
 	"time"
@@ -55,7 +54,7 @@ func snapshotTestPrep(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = exec.Command("systemctl", "restart", "google-guest-agent").Run()
+		err = utils.RestartAgent(utils.Context(t))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -23,14 +23,7 @@ import (
 
 func restartAgent(t *testing.T) {
 	t.Helper()
-	var cmd *exec.Cmd
-	if utils.IsWindows() {
-		cmd = exec.CommandContext(utils.Context(t), "powershell.exe", "-NonInteractive", "Restart-Service", "GCEAgent")
-	} else {
-		cmd = exec.CommandContext(utils.Context(t), "systemctl", "restart", "google-guest-agent")
-	}
-	err := cmd.Run()
-	if err != nil {
+	if err := utils.RestartAgent(utils.Context(t)); err != nil {
 		t.Fatalf("could not restart agent: %v", err)
 	}
 }
@@ -21,7 +21,6 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"runtime"
 	"strings"
 	"testing"
 
@@ -70,7 +69,7 @@ func TestHostname(t *testing.T) {
 	// 'hostname' in metadata is fully qualified domain name.
 	shortname := strings.Split(metadataHostname, ".")[0]
 
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		if err = testHostnameWindows(shortname); err != nil {
 			t.Fatalf("windows hostname error: %v", err)
 		}
@@ -189,22 +188,7 @@ func TestHostKeysGeneratedOnce(t *testing.T) {
 		hashes = append(hashes, sshKeyHash{file, hash})
 	}
 
-	image, err := utils.GetMetadata(utils.Context(t), "instance", "image")
-	if err != nil {
-		t.Fatalf("Couldn't get image from metadata")
-	}
-
-	var restart string
-	switch {
-	case strings.Contains(image, "rhel-6"), strings.Contains(image, "centos-6"):
-		restart = "initctl"
-	default:
-		restart = "systemctl"
-	}
-
-	cmd := exec.Command(restart, "restart", "google-guest-agent")
-	err = cmd.Run()
-	if err != nil {
+	if err := utils.RestartAgent(utils.Context(t)); err != nil {
 		t.Errorf("Failed to restart guest agent: %v", err)
 	}
 
@@ -280,14 +264,26 @@ func TestHostsFile(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't read /etc/hosts")
 	}
-	ip, err := utils.GetMetadata(ctx, "instance", "network-interfaces", "0", "ip")
+	instance, err := utils.GetMetadataJSON(ctx, "instance")
 	if err != nil {
-		t.Fatalf("Couldn't get ip from metadata")
+		t.Fatalf("Couldn't get instance metadata: %v", err)
 	}
-	hostname, err := utils.GetMetadata(ctx, "instance", "hostname")
-	if err != nil {
+	hostname, ok := instance["hostname"].(string)
+	if !ok {
 		t.Fatalf("Couldn't get hostname from metadata")
 	}
+	nics, ok := instance["network-interfaces"].([]any)
+	if !ok || len(nics) == 0 {
+		t.Fatalf("Couldn't get network interfaces from metadata")
+	}
+	nic, ok := nics[0].(map[string]any)
+	if !ok {
+		t.Fatalf("Couldn't get ip from metadata")
+	}
+	ip, ok := nic["ip"].(string)
+	if !ok {
+		t.Fatalf("Couldn't get ip from metadata")
+	}
 	targetLineHost := fmt.Sprintf("%s %s %s  %s\n", ip, hostname, strings.Split(hostname, ".")[0], gcomment)
 	targetLineMetadata := fmt.Sprintf("%s %s  %s\n", "169.254.169.254", "metadata.google.internal", gcomment)
 	if !strings.Contains(string(b), targetLineHost) {
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hotattach
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// windowsDisk is the state of a disk as reported by Get-Disk.
+type windowsDisk struct {
+	Number            int
+	IsOffline         bool
+	OperationalStatus string
+}
+
+func getWindowsDisk(friendlyName string) (*windowsDisk, error) {
+	out, err := utils.RunPowershellCmd(fmt.Sprintf(`Get-Disk -FriendlyName "%s" -ErrorAction Stop | Select-Object Number,IsOffline,OperationalStatus | ConvertTo-Json`, friendlyName))
+	if err != nil {
+		return nil, fmt.Errorf("Get-Disk failed: %s %s %v", out.Stdout, out.Stderr, err)
+	}
+	var disk windowsDisk
+	if err := json.Unmarshal([]byte(out.Stdout), &disk); err != nil {
+		return nil, fmt.Errorf("could not parse Get-Disk output %q: %v", out.Stdout, err)
+	}
+	return &disk, nil
+}
+
+// TestWindowsDiskOnline tests that a disk attached by the workflow while the
+// VM is running is brought online by the SAN policy of the image, and that a
+// partition created on it gets a drive letter.
+func TestWindowsDiskOnline(t *testing.T) {
+	utils.WindowsOnly(t)
+	ctx := utils.Context(t)
+	diskName, err := utils.GetMetadata(ctx, "instance", "attributes", "sanpolicy-disk-name")
+	if err != nil {
+		t.Fatalf("couldn't get disk name from metadata: %v", err)
+	}
+
+	var disk *windowsDisk
+	for {
+		if disk, err = getWindowsDisk(diskName); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("disk %s did not appear: %v", diskName, err)
+		case <-time.After(5 * time.Second):
+		}
+	}
+	if err := utils.PutGuestAttribute(ctx, utils.GuestAttributeTestNamespace, utils.HotplugAttachedGAKeyPrefix+diskName, ""); err != nil {
+		t.Fatalf("failed to signal disk %s is attached: %v", diskName, err)
+	}
+
+	// The disk is brought online shortly after it appears.
+	for i := 0; disk.IsOffline && i < 12; i++ {
+		time.Sleep(5 * time.Second)
+		if disk, err = getWindowsDisk(diskName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if disk.IsOffline {
+		policy, _ := utils.RunPowershellCmd(`(Get-StorageSetting).NewDiskPolicy`)
+		t.Fatalf("disk %d is offline with operational status %s, SAN policy is %s", disk.Number, disk.OperationalStatus, strings.TrimSpace(policy.Stdout))
+	}
+
+	out, err := utils.RunPowershellCmd(fmt.Sprintf(`Initialize-Disk -PartitionStyle GPT -Number %d -PassThru | New-Partition -AssignDriveLetter -UseMaximumSize | Format-Volume -FileSystem NTFS -Confirm:$false`, disk.Number))
+	if err != nil {
+		t.Fatalf("failed to partition disk %d: %s %s %v", disk.Number, out.Stdout, out.Stderr, err)
+	}
+	out, err = utils.RunPowershellCmd(fmt.Sprintf(`(Get-Partition -DiskNumber %d | Where-Object Type -eq Basic).DriveLetter`, disk.Number))
+	if err != nil {
+		t.Fatalf("Get-Partition failed for disk %d: %s %s %v", disk.Number, out.Stdout, out.Stderr, err)
+	}
+	if strings.Trim(out.Stdout, " \r\n\x00") == "" {
+		t.Errorf("partition on disk %d (status %s) has no drive letter", disk.Number, disk.OperationalStatus)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -173,7 +172,7 @@ func TestFileHotAttach(t *testing.T) {
 	fileContents := "cold Attach"
 	fileContentsBytes := []byte(fileContents)
 	var fileFullPath string
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		diskNum, err := getWindowsDiskNumber(ctx)
 		if err != nil {
 			diskNum = 1
@@ -207,7 +206,7 @@ func TestFileHotAttach(t *testing.T) {
 		t.Fatalf("possible race condition, file operation not completed: error %v", err)
 	}
 	// run unmount steps if linux
-	if runtime.GOOS != "windows" {
+	if !utils.IsWindows() {
 		if err = unmountLinuxDisk(ctx); err != nil {
 			t.Fatalf("unmount failed on linux: %v", err)
 		}
@@ -237,7 +236,7 @@ func TestFileHotAttach(t *testing.T) {
 	}
 
 	// mount again, then read from the file
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		t.Log("windows disk was successfully reattached")
 	} else {
 		if err := mountLinuxDiskToPath(ctx, linuxMountPath, true); err != nil {
@@ -269,7 +268,7 @@ func TestMount(t *testing.T) {
 	fileContents := "cold Attach"
 	fileContentsBytes := []byte(fileContents)
 	var fileFullPath string
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		diskNum, err := getWindowsDiskNumber(ctx)
 		if err != nil {
 			diskNum = 1
@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hotattach
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// TestHotplugDisk tests that the udev rules of the guest environment create
+// and remove the device link of a disk which is attached and detached by the
+// workflow while the VM is running.
+func TestHotplugDisk(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	diskName, err := utils.GetMetadata(ctx, "instance", "attributes", "hotplug-disk-name")
+	if err != nil {
+		t.Fatalf("couldn't get hotplug disk name from metadata: %v", err)
+	}
+	device := "/dev/disk/by-id/google-" + diskName
+
+	if err := waitForDevice(ctx, device, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.PutGuestAttribute(ctx, utils.GuestAttributeTestNamespace, utils.HotplugAttachedGAKeyPrefix+diskName, ""); err != nil {
+		t.Fatalf("failed to signal disk %s is attached: %v", diskName, err)
+	}
+	if err := waitForDevice(ctx, device, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.PutGuestAttribute(ctx, utils.GuestAttributeTestNamespace, utils.HotplugDetachedGAKeyPrefix+diskName, ""); err != nil {
+		t.Fatalf("failed to signal disk %s is detached: %v", diskName, err)
+	}
+}
+
+// waitForDevice waits until the device exists, or until it's gone if exists
+// is false.
+func waitForDevice(ctx context.Context, device string, exists bool) error {
+	for {
+		_, err := os.Stat(device)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat %s: %v", device, err)
+		}
+		if (err == nil) == exists {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s to exist: %v, got %v", device, exists, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
@@ -33,6 +33,8 @@ const (
 	linuxMountPath          = "/mnt/disks/hotattach"
 	mkfsCmd                 = "mkfs.ext4"
 	windowsMountDriveLetter = "F"
+	hotplugDiskName         = "hotplugdata"
+	sanPolicyDiskName       = "sanpolicydata"
 )
 
 // TestSetup sets up the test workflow.
@@ -47,6 +49,34 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	hotattach.AddMetadata("hotattach-disk-name", "hotattachmount")
 	hotattach.RunTests("TestFileHotAttach")
 
+	// TODO: test hotplug device naming on windows
+	if !utils.HasFeature(t.Image, "WINDOWS") {
+		hotplug, err := t.CreateTestVM("hotplug")
+		if err != nil {
+			return err
+		}
+		if err := hotplug.AttachDisk(&compute.Disk{Name: hotplugDiskName, Type: imagetest.PdBalanced, SizeGb: 10}); err != nil {
+			return err
+		}
+		if err := hotplug.DetachDisk(hotplugDiskName); err != nil {
+			return err
+		}
+		hotplug.AddMetadata("hotplug-disk-name", hotplugDiskName)
+		hotplug.AddMetadata("enable-guest-attributes", "TRUE")
+		hotplug.RunTests("TestHotplugDisk")
+	} else {
+		sanPolicy, err := t.CreateTestVM("sanpolicy")
+		if err != nil {
+			return err
+		}
+		if err := sanPolicy.AttachDisk(&compute.Disk{Name: sanPolicyDiskName, Type: imagetest.PdBalanced, SizeGb: 10}); err != nil {
+			return err
+		}
+		sanPolicy.AddMetadata("sanpolicy-disk-name", sanPolicyDiskName)
+		sanPolicy.AddMetadata("enable-guest-attributes", "TRUE")
+		sanPolicy.RunTests("TestWindowsDiskOnline")
+	}
+
 	if t.Image.Architecture != "ARM64" && utils.HasFeature(t.Image, "GVNIC") {
 		lssdMountInst := &daisy.Instance{}
 		lssdMountInst.Zone = "us-east4-b"
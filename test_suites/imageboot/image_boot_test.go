@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -315,3 +316,35 @@ func TestBootTime(t *testing.T) {
 		}
 	}
 }
+
+// cpuPlatforms are the CPU platforms of each vendor, from oldest to newest.
+var cpuPlatforms = [][]string{
+	{"Intel Sandy Bridge", "Intel Ivy Bridge", "Intel Haswell", "Intel Broadwell", "Intel Skylake", "Intel Cascade Lake", "Intel Ice Lake", "Intel Sapphire Rapids", "Intel Emerald Rapids", "Intel Granite Rapids"},
+	{"AMD Rome", "AMD Milan", "AMD Genoa", "AMD Turin"},
+}
+
+func TestMinCPUPlatform(t *testing.T) {
+	ctx := utils.Context(t)
+	want, err := utils.GetMetadata(ctx, "instance", "attributes", minCPUPlatformKey)
+	if err != nil {
+		t.Fatalf("couldn't get minimum CPU platform from metadata: %v", err)
+	}
+	got, err := utils.GetMetadata(ctx, "instance", "cpu-platform")
+	if err != nil {
+		t.Fatalf("couldn't get CPU platform from metadata: %v", err)
+	}
+	if got == want {
+		return
+	}
+	for _, platforms := range cpuPlatforms {
+		wantIndex := slices.Index(platforms, want)
+		if wantIndex == -1 {
+			continue
+		}
+		if gotIndex := slices.Index(platforms, got); gotIndex < wantIndex {
+			t.Fatalf("CPU platform is %q, want %q or newer", got, want)
+		}
+		return
+	}
+	t.Fatalf("CPU platform is %q, want %q which is not a known CPU platform", got, want)
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageboot
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// TestSerialPorts checks that serial ports 2 to 4 are usable, which are
+// /dev/ttyS1 to /dev/ttyS3 in the guest.
+func TestSerialPorts(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	for port := 2; port <= 4; port++ {
+		dev := fmt.Sprintf("/dev/ttyS%d", port-1)
+		marker := fmt.Sprintf("cit-serial-port-%d-%d", port, time.Now().UnixNano())
+		// Don't wait for a carrier on the port.
+		f, err := os.OpenFile(dev, os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			t.Errorf("could not open %s: %v", dev, err)
+			continue
+		}
+		_, err = f.WriteString(marker + "\n")
+		f.Close()
+		if err != nil {
+			t.Errorf("could not write to %s: %v", dev, err)
+			continue
+		}
+		err = utils.RetryUntil(ctx, time.Minute, 5*time.Second, func() error {
+			out, err := utils.ReadSerialOutput(ctx, port)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(out, marker) {
+				return fmt.Errorf("%q not in the output of serial port %d", marker, port)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("serial port %d doesn't have the output written to %s: %v", port, dev, err)
+		}
+	}
+}
@@ -28,6 +28,16 @@ import (
 // Name is the name of the test package. It must match the directory name.
 var Name = "imageboot"
 
+// The minimum CPU platform of the cpuplatform VM, and the metadata key it is
+// passed to the guest in.
+const (
+	minCPUPlatform    = "Intel Ice Lake"
+	minCPUPlatformKey = "cit-min-cpu-platform"
+)
+
+// computeReadOnlyScope lets the serialports VM read its own serial port output.
+const computeReadOnlyScope = "https://www.googleapis.com/auth/compute.readonly"
+
 var sbUnsupported = []*regexp.Regexp{
 	// Permanent exceptions
 	regexp.MustCompile("debian-1[01].*arm64"),
@@ -45,7 +55,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	if err != nil {
 		return err
 	}
-	if err := vm.Reboot(); err != nil {
+	if err := vm.RebootExpectCount(1); err != nil {
 		return err
 	}
 	vm.RunTests("TestGuestBoot|TestGuestReboot$")
@@ -63,6 +73,29 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	vm3.AddMetadata("start-time", strconv.Itoa(time.Now().Second()))
 	vm3.RunTests("TestStartTime|TestBootTime")
 
+	if t.Image.Architecture != "ARM64" {
+		vm5, err := t.CreateTestVM("cpuplatform")
+		if err != nil {
+			return err
+		}
+		vm5.ForceMachineType("n2-standard-2")
+		if err := vm5.SetMinCPUPlatform(minCPUPlatform); err != nil {
+			return err
+		}
+		vm5.AddMetadata(minCPUPlatformKey, minCPUPlatform)
+		vm5.RunTests("TestMinCPUPlatform")
+	}
+
+	if !utils.HasFeature(t.Image, "WINDOWS") {
+		vm6, err := t.CreateTestVM("serialports")
+		if err != nil {
+			return err
+		}
+		vm6.AddMetadata("serial-port-enable", "TRUE")
+		vm6.AddScope(computeReadOnlyScope)
+		vm6.RunTests("TestSerialPorts")
+	}
+
 	for _, r := range sbUnsupported {
 		if r.MatchString(t.Image.Name) {
 			return nil
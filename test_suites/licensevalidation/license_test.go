@@ -76,25 +76,37 @@ func TestLicenses(t *testing.T) {
 	}
 	actualLicenses := strings.Split(alicenses, ",")
 
-	sort.Strings(expectedLicenseCodes)
-	sort.Strings(actualLicenseCodes)
-	if len(expectedLicenseCodes) != len(actualLicenseCodes) {
-		t.Errorf("wrong number of license codes, got %d want %d", len(actualLicenseCodes), len(expectedLicenseCodes))
+	if missing, unexpected := diffLists(expectedLicenseCodes, actualLicenseCodes); len(missing) > 0 || len(unexpected) > 0 {
+		t.Errorf("license codes in metadata do not match the image: missing %v, unexpected %v", missing, unexpected)
 	}
-	for i := range expectedLicenseCodes {
-		if expectedLicenseCodes[i] != actualLicenseCodes[i] {
-			t.Errorf("unexpected license code at pos %d, got %s want %s", i, actualLicenseCodes[i], expectedLicenseCodes[i])
-		}
+	if missing, unexpected := diffLists(expectedLicenses, actualLicenses); len(missing) > 0 || len(unexpected) > 0 {
+		t.Errorf("licenses of the image do not match the required licenses: missing %v, unexpected %v", missing, unexpected)
 	}
+}
 
-	sort.Strings(expectedLicenses)
-	sort.Strings(actualLicenses)
-	if len(expectedLicenses) != len(actualLicenses) {
-		t.Errorf("wrong number of licenses, got %d want %d", len(actualLicenses), len(expectedLicenses))
+// diffLists returns the sorted items of want which are not in got, and of got
+// which are not in want, ignoring empty items.
+func diffLists(want, got []string) (missing, unexpected []string) {
+	count := make(map[string]int)
+	for _, w := range want {
+		if w != "" {
+			count[w]++
+		}
 	}
-	for i := range expectedLicenses {
-		if expectedLicenses[i] != actualLicenses[i] {
-			t.Errorf("unexpected license at pos %d, got %s want %s", i, actualLicenses[i], expectedLicenses[i])
+	for _, g := range got {
+		if g != "" {
+			count[g]--
+		}
+	}
+	for item, c := range count {
+		for ; c > 0; c-- {
+			missing = append(missing, item)
+		}
+		for ; c < 0; c++ {
+			unexpected = append(unexpected, item)
 		}
 	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	return missing, unexpected
 }
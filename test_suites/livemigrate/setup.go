@@ -29,11 +29,13 @@ var Name = "livemigrate"
 func TestSetup(t *imagetest.TestWorkflow) error {
 	lm := &daisy.Instance{}
 	lm.Scopes = append(lm.Scopes, "https://www.googleapis.com/auth/cloud-platform")
-	lm.Scheduling = &compute.Scheduling{OnHostMaintenance: "MIGRATE"}
 	lmvm, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "livemigrate"}}, lm)
 	if err != nil {
 		return err
 	}
+	if err := lmvm.SetOnHostMaintenance("MIGRATE"); err != nil {
+		return err
+	}
 	lmvm.RunTests("TestLiveMigrate")
 	return nil
 }
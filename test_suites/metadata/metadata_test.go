@@ -15,17 +15,29 @@
 package metadata
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 )
 
 const metadataURLIPPrefix = "http://169.254.169.254/computeMetadata/v1/instance/"
 
+const (
+	// concurrentFetches is the number of metadata requests made at once by
+	// TestMetadataConcurrentFetch.
+	concurrentFetches = 100
+	// concurrentFetchTimeout bounds each of those requests.
+	concurrentFetchTimeout = 10 * time.Second
+)
+
 type Token struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
@@ -77,6 +89,41 @@ func TestGetMetaDataUsingIP(t *testing.T) {
 	}
 }
 
+// TestMetadataConcurrentFetch checks that many concurrent metadata requests
+// all succeed before their deadline.
+func TestMetadataConcurrentFetch(t *testing.T) {
+	ctx := utils.Context(t)
+	var wg sync.WaitGroup
+	latencies := make([]time.Duration, concurrentFetches)
+	errs := make([]error, concurrentFetches)
+	for i := 0; i < concurrentFetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reqCtx, cancel := context.WithTimeout(ctx, concurrentFetchTimeout)
+			defer cancel()
+			start := time.Now()
+			_, errs[i] = utils.GetMetadata(reqCtx, "instance", "id")
+			latencies[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	utils.ReportMetric(t, "metadata-p99-latency", p99.Seconds(), "s")
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			t.Logf("metadata request failed: %v", err)
+		}
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d concurrent metadata requests failed, p99 latency %v", failed, concurrentFetches, p99)
+	}
+}
+
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
@@ -167,7 +167,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	}
 
 	// Run the tests after setup is complete.
-	vm.RunTests("TestTokenFetch|TestMetaDataResponseHeaders|TestGetMetaDataUsingIP")
+	vm.RunTests("TestTokenFetch|TestMetaDataResponseHeaders|TestGetMetaDataUsingIP|TestMetadataConcurrentFetch")
 	vm2.RunTests("TestShutdownScripts")
 	vm3.RunTests("TestShutdownScriptsFailed")
 	vm4.RunTests("TestShutdownURLScripts")
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// nicModules are the drivers of the NIC types set in setup.
+var nicModules = map[string]string{
+	"GVNIC":      "gve",
+	"VIRTIO_NET": "virtio_net",
+}
+
+// loadedModules returns the names of the modules in /proc/modules and the
+// modules built into the running kernel.
+func loadedModules(ctx context.Context) (map[string]bool, error) {
+	modules := make(map[string]bool)
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return nil, fmt.Errorf("could not open /proc/modules: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name, _, _ := strings.Cut(scanner.Text(), " "); name != "" {
+			modules[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read /proc/modules: %v", err)
+	}
+
+	release, err := exec.CommandContext(ctx, "uname", "-r").Output()
+	if err != nil {
+		return nil, fmt.Errorf("uname -r failed: %v", err)
+	}
+	// Each line of modules.builtin is the path of a module built into the
+	// kernel, such as kernel/drivers/net/virtio_net.ko.
+	builtin, err := os.ReadFile(path.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read built in modules: %v", err)
+	}
+	for _, line := range strings.Fields(string(builtin)) {
+		name := strings.TrimSuffix(path.Base(line), ".ko")
+		modules[strings.ReplaceAll(name, "-", "_")] = true
+	}
+	return modules, nil
+}
+
+// hasNVMe reports whether the VM has an NVMe controller.
+func hasNVMe() bool {
+	entries, err := os.ReadDir("/sys/class/nvme")
+	return err == nil && len(entries) > 0
+}
+
+func TestKernelModules(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	arch, err := utils.GetArchitecture(ctx)
+	if err != nil {
+		t.Fatalf("could not get architecture: %v", err)
+	}
+	nicType, err := utils.GetMetadata(ctx, "instance", "attributes", nicTypeKey)
+	if err != nil {
+		t.Fatalf("could not get NIC type from metadata: %v", err)
+	}
+	nicType = strings.TrimSpace(nicType)
+	nicModule, ok := nicModules[nicType]
+	if !ok {
+		t.Fatalf("unknown NIC type %q", nicType)
+	}
+	want := []string{nicModule}
+	// ARM64 shapes only have NVMe disks, on X86_64 it depends on the shape.
+	if arch == "ARM64" || hasNVMe() {
+		want = append(want, "nvme")
+	} else {
+		want = append(want, "virtio_scsi")
+	}
+
+	modules, err := loadedModules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range want {
+		if !modules[m] {
+			t.Errorf("module %s is not loaded or built in on %s with NIC type %s", m, arch, nicType)
+		}
+	}
+}
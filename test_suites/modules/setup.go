@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package modules is a CIT suite for testing that Linux images load the
+// kernel modules of the virtual hardware of the shape they run on.
+package modules
+
+import (
+	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// Name is the name of the test package. It must match the directory name.
+var Name = "modules"
+
+// nicTypeKey is the metadata key holding the NIC type of the primary network
+// interface, which the metadata server doesn't report.
+const nicTypeKey = "nic-type"
+
+// TestSetup sets up the test workflow.
+func TestSetup(t *imagetest.TestWorkflow) error {
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		t.Skip("Kernel modules are only tested on Linux images.")
+		return nil
+	}
+	virtioNet := imagetest.SupportsVirtioNet(t.MachineType.Name)
+	hasGVNIC := utils.HasFeature(t.Image, "GVNIC")
+	if !virtioNet && !hasGVNIC {
+		t.Skip("The machine type only supports gVNIC, which the image doesn't support.")
+		return nil
+	}
+	if virtioNet {
+		virtio, err := t.CreateTestVM("virtionet")
+		if err != nil {
+			return err
+		}
+		virtio.UseVirtioNet()
+		virtio.AddMetadata(nicTypeKey, "VIRTIO_NET")
+		virtio.RunTests("TestKernelModules")
+	}
+
+	if hasGVNIC {
+		gvnic, err := t.CreateTestVM("gvnic")
+		if err != nil {
+			return err
+		}
+		gvnic.UseGVNIC()
+		gvnic.AddMetadata(nicTypeKey, "GVNIC")
+		gvnic.RunTests("TestKernelModules")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nestedvirt
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// virtualizationModules maps the CPU flags of the virtualization extensions
+// to their KVM module.
+var virtualizationModules = map[string]string{
+	"vmx": "kvm_intel",
+	"svm": "kvm_amd",
+}
+
+// cpuFlags returns the flags of the first CPU in /proc/cpuinfo.
+func cpuFlags() (map[string]bool, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, fmt.Errorf("could not open /proc/cpuinfo: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != "flags" {
+			continue
+		}
+		flags := make(map[string]bool)
+		for _, flag := range strings.Fields(value) {
+			flags[flag] = true
+		}
+		return flags, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read /proc/cpuinfo: %v", err)
+	}
+	return nil, fmt.Errorf("no CPU flags in /proc/cpuinfo")
+}
+
+func TestNestedVirtualization(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	flags, err := cpuFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var module string
+	for flag, m := range virtualizationModules {
+		if flags[flag] {
+			module = m
+			break
+		}
+	}
+	if module == "" {
+		t.Fatal("the CPU has neither the vmx nor the svm flag")
+	}
+	if out, err := exec.CommandContext(ctx, "modprobe", module).CombinedOutput(); err != nil {
+		t.Fatalf("modprobe %s failed: %s %v", module, out, err)
+	}
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		t.Fatalf("%s is loaded but /dev/kvm is not available: %v", module, err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nestedvirt is a CIT suite for testing that Linux images can run KVM
+// on VMs with nested virtualization enabled.
+package nestedvirt
+
+import (
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// Name is the name of the test package. It must match the directory name.
+var Name = "nestedvirt"
+
+// TestSetup sets up the test workflow.
+func TestSetup(t *imagetest.TestWorkflow) error {
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		t.Skip("Nested virtualization is only tested on Linux images.")
+		return nil
+	}
+	if t.Image.Architecture == "ARM64" {
+		t.Skip("Nested virtualization is not supported on ARM64.")
+		return nil
+	}
+	if strings.Contains(t.Image.Name, "cos") {
+		t.Skip("Container-Optimized OS doesn't ship the KVM modules.")
+		return nil
+	}
+	if t.MachineType == nil || !imagetest.SupportsNestedVirtualization(t.MachineType.Name) {
+		t.Skip("The machine type doesn't support nested virtualization.")
+		return nil
+	}
+	vm, err := t.CreateTestVM("nestedvirt")
+	if err != nil {
+		return err
+	}
+	if err := vm.EnableNestedVirtualization(); err != nil {
+		return err
+	}
+	vm.RunTests("TestNestedVirtualization")
+	return nil
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -105,8 +106,7 @@ func TestAliasAgentRestart(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	cmd := exec.Command("systemctl", "restart", "google-guest-agent")
-	err = cmd.Run()
+	err = utils.RestartAgent(utils.Context(t))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,17 +122,32 @@ func TestAliasAgentRestart(t *testing.T) {
 	}
 }
 
+// verifyIPExist checks that the guest agent added a local route for each
+// alias IP range of the primary interface in metadata.
 func verifyIPExist(ctx context.Context, routes []string) error {
-	expected, err := utils.GetMetadata(ctx, "instance", "network-interfaces", "0", "ip-aliases", "0")
+	aliases, err := utils.GetMetadataJSON(ctx, "instance", "network-interfaces", "0", "ip-aliases")
 	if err != nil {
-		return fmt.Errorf("couldn't get first alias IP from metadata: %v", err)
+		return fmt.Errorf("couldn't get alias IPs from metadata: %v", err)
 	}
+	if len(aliases) == 0 {
+		return fmt.Errorf("no alias IPs in metadata")
+	}
+	configured := make(map[string]bool)
 	for _, route := range routes {
-		if route == expected {
-			return nil
+		configured[route] = true
+	}
+	var missing []string
+	for _, alias := range aliases {
+		expected := fmt.Sprint(alias)
+		if !configured[expected] {
+			missing = append(missing, expected)
 		}
 	}
-	return fmt.Errorf("alias ip %s is not exist after reboot", expected)
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("alias ips %v are not configured, routes are %v", missing, routes)
+	}
+	return nil
 }
 
 func compare(a, b []string) bool {
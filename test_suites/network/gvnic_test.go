@@ -18,7 +18,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"runtime"
 	"strings"
 	"testing"
 
@@ -64,7 +63,7 @@ func TestGVNIC(t *testing.T) {
 		t.Fatalf("couldn't find primary NIC: %v", err)
 	}
 	var errMsg error
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		errMsg = CheckGVNICPresentWindows(iface.Name)
 	} else {
 		errMsg = CheckGVNICPresent(iface.Name)
@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+const (
+	// forwardTunnel is the IPIP tunnel between the client and the router of
+	// the IP forwarding test.
+	forwardTunnel  = "citfwd"
+	forwardTimeout = 5 * time.Minute
+	// forwardGracePeriod is how long the target keeps echoing after its first
+	// echo, in case the echo was lost and the client retries.
+	forwardGracePeriod = 30 * time.Second
+)
+
+// runIP runs an ip command.
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %s %v", strings.Join(args, " "), out, err)
+	}
+	return nil
+}
+
+// setSysctl sets a sysctl and checks that the kernel kept the value.
+func setSysctl(name, value string) error {
+	p := "/proc/sys/" + strings.ReplaceAll(name, ".", "/")
+	if err := os.WriteFile(p, []byte(value), 0644); err != nil {
+		return fmt.Errorf("could not set %s: %v", name, err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", name, err)
+	}
+	if got := strings.TrimSpace(string(b)); got != value {
+		return fmt.Errorf("%s is %s after setting it to %s", name, got, value)
+	}
+	return nil
+}
+
+// addForwardTunnel adds the IPIP tunnel between the client and the router.
+// Packets received on the tunnel are answered on the primary interface, so
+// reverse path filtering must be off on both.
+func addForwardTunnel(ctx context.Context, local, remote string) error {
+	if err := runIP("tunnel", "add", forwardTunnel, "mode", "ipip", "local", local, "remote", remote); err != nil {
+		return err
+	}
+	if err := runIP("link", "set", forwardTunnel, "up"); err != nil {
+		return err
+	}
+	iface, err := utils.GetInterface(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't find primary NIC: %v", err)
+	}
+	for _, dev := range []string{"all", iface.Name, forwardTunnel} {
+		if err := setSysctl("net.ipv4.conf."+dev+".rp_filter", "0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestIPForwarding(t *testing.T) {
+	utils.LinuxOnly(t)
+	if err := setSysctl("net.ipv4.ip_forward", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addForwardTunnel(utils.Context(t), forwardRouterConfig.ip, forwardClientConfig.ip); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardedTraffic(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	if err := addForwardTunnel(ctx, forwardClientConfig.ip, forwardRouterConfig.ip); err != nil {
+		t.Fatal(err)
+	}
+	// Send the packets to the target through the router.
+	if err := runIP("route", "add", forwardTargetConfig.ip+"/32", "dev", forwardTunnel); err != nil {
+		t.Fatal(err)
+	}
+	target := net.JoinHostPort(forwardTargetConfig.ip, fmt.Sprintf("%d", forwardPort))
+	// The router and the target may not be ready yet.
+	err := utils.RetryUntil(ctx, forwardTimeout, 10*time.Second, func() error {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		msg := []byte(forwardClientConfig.name)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(msg))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("no echo from %s: %v", target, err)
+		}
+		if string(buf[:n]) != string(msg) {
+			return fmt.Errorf("echo from %s is %q, want %q", target, buf[:n], msg)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not reach %s through router %s: %v", target, forwardRouterConfig.ip, err)
+	}
+}
+
+func TestForwardedTrafficTarget(t *testing.T) {
+	utils.LinuxOnly(t)
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", forwardPort))
+	if err != nil {
+		t.Fatalf("could not listen on udp port %d: %v", forwardPort, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(forwardTimeout))
+	buf := make([]byte, 1024)
+	echoed := false
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && echoed {
+			return
+		}
+		if err != nil {
+			t.Fatalf("received no packet from %s: %v", forwardClientConfig.ip, err)
+		}
+		// A packet from the router would mean it rewrote the source address
+		// rather than forwarding the packet.
+		src := addr.(*net.UDPAddr).IP.String()
+		if src != forwardClientConfig.ip {
+			t.Errorf("received a packet from %s, want %s", src, forwardClientConfig.ip)
+			continue
+		}
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			t.Fatalf("could not echo to %s: %v", addr, err)
+		}
+		if !echoed {
+			echoed = true
+			conn.SetReadDeadline(time.Now().Add(forwardGracePeriod))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// TestIPv6Address tests that the primary interface of a dual stack VM is
+// configured with the IPv6 address from metadata.
+func TestIPv6Address(t *testing.T) {
+	ctx := utils.Context(t)
+	ipv6s, err := utils.GetMetadata(ctx, "instance", "network-interfaces", "0", "ipv6s")
+	if err != nil {
+		t.Fatalf("could not get ipv6 addresses from metadata: %v", err)
+	}
+	var expected []net.IP
+	for _, addr := range strings.Fields(ipv6s) {
+		ip := net.ParseIP(strings.Split(addr, "/")[0])
+		if ip == nil {
+			t.Fatalf("could not parse ipv6 address %q from metadata", addr)
+		}
+		expected = append(expected, ip)
+	}
+	if len(expected) == 0 {
+		t.Fatal("metadata has no ipv6 address for interface 0")
+	}
+	iface, err := utils.GetInterface(ctx, 0)
+	if err != nil {
+		t.Fatalf("could not get interface 0: %v", err)
+	}
+
+	// The address is configured by DHCPv6, which can finish after the test
+	// starts.
+	var addrs []net.Addr
+	for start := time.Now(); time.Since(start) < 2*time.Minute; time.Sleep(5 * time.Second) {
+		addrs, err = iface.Addrs()
+		if err != nil {
+			t.Fatalf("could not get addrs from interface 0: %v", err)
+		}
+		if hasIP(addrs, expected) {
+			return
+		}
+	}
+	t.Errorf("interface 0 has addresses %v, want one of %v", addrs, expected)
+}
+
+// hasIP returns true if any of the addresses is one of the IPs.
+func hasIP(addrs []net.Addr, ips []net.IP) bool {
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, ip := range ips {
+			if ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
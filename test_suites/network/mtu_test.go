@@ -31,22 +31,62 @@ func TestDefaultMTU(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't find primary NIC: %v", err)
 	}
-	if utils.IsWindows() {
-		sysprepInstalled, err := utils.RunPowershellCmd(`googet installed google-compute-engine-sysprep.noarch | Select-Object -Index 1`)
-		if err != nil {
-			t.Fatalf("could not check installed sysprep version: %v", err)
-		}
-		// YYYYMMDD
-		sysprepVerRe := regexp.MustCompile("[0-9]{8}")
-		sysprepVer, err := strconv.Atoi(sysprepVerRe.FindString(sysprepInstalled.Stdout))
-		if err != nil {
-			t.Fatalf("could not determine value of sysprep version: %v", err)
-		}
-		if sysprepVer <= 20240104 {
-			t.Skipf("version %d of gcesysprep is too old to set interface mtu correctly", sysprepVer)
-		}
-	}
+	skipOldSysprep(t)
 	if iface.MTU != gceMTU {
 		t.Fatalf("expected MTU %d on interface %s, got MTU %d", gceMTU, iface.Name, iface.MTU)
 	}
 }
+
+// TestMTUMatchesMetadata checks that the MTU of the network, as reported by
+// the metadata server, is applied to the primary NIC.
+func TestMTUMatchesMetadata(t *testing.T) {
+	checkMTUMatchesMetadata(t)
+}
+
+// TestMTUAfterReboot checks that the MTU of the network is applied to the
+// primary NIC. It runs on a VM which is rebooted, so the result is from the
+// second boot.
+func TestMTUAfterReboot(t *testing.T) {
+	checkMTUMatchesMetadata(t)
+}
+
+func checkMTUMatchesMetadata(t *testing.T) {
+	t.Helper()
+	ctx := utils.Context(t)
+	mtuStr, err := utils.GetMetadata(ctx, "instance", "network-interfaces", "0", "mtu")
+	if err != nil {
+		t.Fatalf("couldn't get network MTU from metadata: %v", err)
+	}
+	wantMTU, err := strconv.Atoi(mtuStr)
+	if err != nil {
+		t.Fatalf("metadata MTU %q is not a number: %v", mtuStr, err)
+	}
+	skipOldSysprep(t)
+	mtu, err := utils.InterfaceMTU(ctx, 0)
+	if err != nil {
+		t.Fatalf("couldn't get MTU of primary NIC: %v", err)
+	}
+	if mtu != wantMTU {
+		t.Fatalf("expected MTU %d from metadata on primary NIC, got MTU %d", wantMTU, mtu)
+	}
+}
+
+func skipOldSysprep(t *testing.T) {
+	t.Helper()
+	if !utils.IsWindows() {
+		return
+	}
+	sysprepInstalled, err := utils.RunPowershellCmd(`googet installed google-compute-engine-sysprep.noarch | Select-Object -Index 1`)
+	if err != nil {
+		t.Fatalf("could not check installed sysprep version: %v", err)
+	}
+	// YYYYMMDD
+	sysprepVerRe := regexp.MustCompile("[0-9]{8}")
+	sysprepVer, err := strconv.Atoi(sysprepVerRe.FindString(sysprepInstalled.Stdout))
+	if err != nil {
+		t.Fatalf("could not determine value of sysprep version: %v", err)
+	}
+	if sysprepVer <= 20240104 {
+		t.Skipf("version %d of gcesysprep is too old to set interface mtu correctly", sysprepVer)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// nicChannels are the channel counts of a NIC reported by ethtool -l.
+type nicChannels struct {
+	rx, tx, combined int
+}
+
+// queues returns the number of receive and transmit queues of the channels.
+// Drivers either report separate RX and TX channels, like gve, or combined
+// channels, like virtio_net.
+func (c nicChannels) queues() (rx, tx int) {
+	return c.rx + c.combined, c.tx + c.combined
+}
+
+// parseEthtoolChannels parses the pre-set maximums and the current settings
+// from the output of ethtool -l.
+func parseEthtoolChannels(out string) (maximum, current nicChannels, err error) {
+	var section *nicChannels
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Pre-set maximums"):
+			section = &maximum
+			continue
+		case strings.HasPrefix(line, "Current hardware settings"):
+			section = &current
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || section == nil {
+			continue
+		}
+		var field *int
+		switch name {
+		case "RX":
+			field = &section.rx
+		case "TX":
+			field = &section.tx
+		case "Combined":
+			field = &section.combined
+		default:
+			continue
+		}
+		// Unsupported channel types are reported as "n/a".
+		value = strings.TrimSpace(value)
+		if value == "n/a" {
+			continue
+		}
+		if *field, err = strconv.Atoi(value); err != nil {
+			return nicChannels{}, nicChannels{}, fmt.Errorf("invalid %s channel count %q: %v", name, value, err)
+		}
+	}
+	if section != &current {
+		return nicChannels{}, nicChannels{}, fmt.Errorf("no current hardware settings in ethtool output %q", out)
+	}
+	return maximum, current, nil
+}
+
+func TestNICQueues(t *testing.T) {
+	utils.LinuxOnly(t)
+	if !utils.CheckLinuxCmdExists("ethtool") {
+		t.Skip("ethtool is not installed")
+	}
+	ctx := utils.Context(t)
+	nicType, err := utils.GetMetadata(ctx, "instance", "attributes", nicTypeKey)
+	if err != nil {
+		t.Fatalf("could not get NIC type from metadata: %v", err)
+	}
+	cpuCount, err := utils.GetMetadata(ctx, "instance", "attributes", expectedCPUsKey)
+	if err != nil {
+		t.Fatalf("could not get vCPU count from metadata: %v", err)
+	}
+	cpus, err := strconv.Atoi(strings.TrimSpace(cpuCount))
+	if err != nil {
+		t.Fatalf("invalid vCPU count %q: %v", cpuCount, err)
+	}
+	iface, err := utils.GetInterface(ctx, 0)
+	if err != nil {
+		t.Fatalf("couldn't find primary NIC: %v", err)
+	}
+	out, err := exec.CommandContext(ctx, "ethtool", "-l", iface.Name).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "Operation not supported") {
+			t.Skipf("%s NIC %s doesn't report its channels", nicType, iface.Name)
+		}
+		t.Fatalf("ethtool -l %s failed: %s %v", iface.Name, out, err)
+	}
+	maximum, current, err := parseEthtoolChannels(string(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxRx, maxTx := maximum.queues()
+	if maxRx <= 1 && maxTx <= 1 {
+		t.Skipf("%s NIC %s doesn't support multiqueue", nicType, iface.Name)
+	}
+	// Drivers default to a queue per vCPU, up to the maximum of the device.
+	rx, tx := current.queues()
+	if want := min(cpus, maxRx); rx != want {
+		t.Errorf("%s NIC %s has %d RX queues, want %d for %d vCPUs and a maximum of %d", nicType, iface.Name, rx, want, cpus, maxRx)
+	}
+	if want := min(cpus, maxTx); tx != want {
+		t.Errorf("%s NIC %s has %d TX queues, want %d for %d vCPUs and a maximum of %d", nicType, iface.Name, tx, want, cpus, maxTx)
+	}
+}
@@ -16,6 +16,7 @@
 package network
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -37,6 +38,31 @@ type InstanceConfig struct {
 var vm1Config = InstanceConfig{name: "ping1", ip: "192.168.0.2"}
 var vm2Config = InstanceConfig{name: "ping2", ip: "192.168.0.3"}
 
+// The client of the IP forwarding test reaches the target through a tunnel to
+// the router, which forwards the packets of the client with their source
+// address unchanged.
+var (
+	forwardClientConfig = InstanceConfig{name: "fwdclient", ip: "10.132.0.2"}
+	forwardRouterConfig = InstanceConfig{name: "fwdrouter", ip: "10.132.0.3"}
+	forwardTargetConfig = InstanceConfig{name: "fwdtarget", ip: "10.132.0.4"}
+)
+
+// forwardPort is the UDP port the target of the IP forwarding test echoes on.
+const forwardPort = 8081
+
+const mtuRebootVMName = "mtureboot"
+
+const dualStackVMName = "dualstack"
+
+const multiqueueVMName = "multiqueue"
+
+// Metadata keys of the multiqueue VM. The metadata server doesn't report the
+// NIC type, and the guest can't tell offline vCPUs from missing ones.
+const (
+	nicTypeKey      = "nic-type"
+	expectedCPUsKey = "expected-vcpus"
+)
+
 // TestSetup sets up the test workflow.
 func TestSetup(t *imagetest.TestWorkflow) error {
 	network1, err := t.CreateNetwork("network-1", false)
@@ -77,7 +103,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	if err := vm1.SetPrivateIP(network2, vm1Config.ip); err != nil {
 		return err
 	}
-	vm1.RunTests("TestSendPing|TestDHCP|TestDefaultMTU")
+	vm1.RunTests("TestSendPing|TestDHCP|TestDefaultMTU|TestMTUMatchesMetadata")
 
 	multinictests := "TestStaticIP|TestWaitForPing"
 	if !utils.HasFeature(t.Image, "WINDOWS") && !strings.Contains(t.Image.Name, "sles-15") && !strings.Contains(t.Image.Name, "opensuse-leap") && !strings.Contains(t.Image.Name, "ubuntu-1604") && !strings.Contains(t.Image.Name, "ubuntu-pro-1604") && !strings.Contains(t.Image.Name, "cos") {
@@ -104,6 +130,9 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	if err := vm2.AddAliasIPRanges("10.14.8.0/24", "secondary-range"); err != nil {
 		return err
 	}
+	if err := vm2.AddAliasIPRanges("10.14.16.8/29", "secondary-range"); err != nil {
+		return err
+	}
 	if err := vm2.Reboot(); err != nil {
 		return err
 	}
@@ -114,6 +143,24 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	}
 	vm2.RunTests(multinictests)
 
+	// The MTU of a custom network must still be applied by the guest after a
+	// reboot, not only on the first boot.
+	if err := addMTURebootVM(t); err != nil {
+		return err
+	}
+
+	if err := addDualStackVM(t); err != nil {
+		return err
+	}
+
+	if err := addMultiqueueVM(t); err != nil {
+		return err
+	}
+
+	if err := addIPForwardingVMs(t); err != nil {
+		return err
+	}
+
 	if el7Re.MatchString(t.Image.Family) {
 		vm3, err := t.CreateTestVM("testGVNICEl7")
 		if err != nil {
@@ -125,3 +172,128 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 
 	return nil
 }
+
+func addMTURebootVM(t *imagetest.TestWorkflow) error {
+	jumboNetwork, err := t.CreateNetwork("network-jumbo", false)
+	if err != nil {
+		return err
+	}
+	if err := jumboNetwork.SetMTU(imagetest.JumboFramesMTU); err != nil {
+		return err
+	}
+	jumboSubnetwork, err := jumboNetwork.CreateSubnetwork("subnetwork-jumbo", "10.130.0.0/20")
+	if err != nil {
+		return err
+	}
+	mtuRebootInst := &daisy.Instance{}
+	mtuRebootInst.Metadata = map[string]string{imagetest.ShouldRebootDuringTest: "true"}
+	vm, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: mtuRebootVMName}}, mtuRebootInst)
+	if err != nil {
+		return err
+	}
+	vm.AddMetadata("enable-guest-attributes", "TRUE")
+	if err := vm.AddCustomNetwork(jumboNetwork, jumboSubnetwork); err != nil {
+		return err
+	}
+	if err := vm.Reboot(); err != nil {
+		return err
+	}
+	vm.RunTests("TestMTUAfterReboot")
+	return nil
+}
+
+func addDualStackVM(t *imagetest.TestWorkflow) error {
+	ipv6Network, err := t.CreateNetwork("network-ipv6", false)
+	if err != nil {
+		return err
+	}
+	ipv6Subnetwork, err := ipv6Network.CreateSubnetwork("subnetwork-ipv6", "10.131.0.0/20")
+	if err != nil {
+		return err
+	}
+	vm, err := t.CreateTestVM(dualStackVMName)
+	if err != nil {
+		return err
+	}
+	if err := vm.AddCustomNetwork(ipv6Network, ipv6Subnetwork); err != nil {
+		return err
+	}
+	if err := vm.SetStackType("IPV4_IPV6"); err != nil {
+		return err
+	}
+	vm.RunTests("TestIPv6Address")
+	return nil
+}
+
+// addMultiqueueVM adds a VM checking that the NIC gets as many queues as the
+// machine type has vCPUs, on gVNIC when the image supports it.
+func addMultiqueueVM(t *imagetest.TestWorkflow) error {
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		return nil
+	}
+	// Single vCPU and shared core machine types only get one queue.
+	if t.MachineType == nil || t.MachineType.GuestCpus < 2 || t.MachineType.IsSharedCpu {
+		return nil
+	}
+	vm, err := t.CreateTestVM(multiqueueVMName)
+	if err != nil {
+		return err
+	}
+	nicType := "VIRTIO_NET"
+	if utils.HasFeature(t.Image, "GVNIC") {
+		vm.UseGVNIC()
+		nicType = "GVNIC"
+	}
+	vm.AddMetadata(nicTypeKey, nicType)
+	vm.AddMetadata(expectedCPUsKey, fmt.Sprintf("%d", t.MachineType.GuestCpus))
+	vm.RunTests("TestNICQueues")
+	return nil
+}
+
+// addIPForwardingVMs adds a router VM with IP forwarding enabled, and a client
+// and a target VM exchanging packets through it.
+func addIPForwardingVMs(t *imagetest.TestWorkflow) error {
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		return nil
+	}
+	forwardNetwork, err := t.CreateNetwork("network-forwarding", false)
+	if err != nil {
+		return err
+	}
+	forwardSubnetwork, err := forwardNetwork.CreateSubnetwork("subnetwork-forwarding", "10.132.0.0/20")
+	if err != nil {
+		return err
+	}
+	if err := forwardNetwork.CreateFirewallRule("allow-ipip-forwarding", "ipip", nil, []string{"10.132.0.0/20"}); err != nil {
+		return err
+	}
+	if err := forwardNetwork.CreateFirewallRule("allow-udp-forwarding", "udp", []string{fmt.Sprintf("%d", forwardPort)}, []string{"10.132.0.0/20"}); err != nil {
+		return err
+	}
+
+	vms := []struct {
+		config InstanceConfig
+		test   string
+	}{
+		{forwardRouterConfig, "TestIPForwarding"},
+		{forwardClientConfig, "TestForwardedTraffic"},
+		{forwardTargetConfig, "TestForwardedTrafficTarget"},
+	}
+	for _, v := range vms {
+		vm, err := t.CreateTestVM(v.config.name)
+		if err != nil {
+			return err
+		}
+		if err := vm.AddCustomNetwork(forwardNetwork, forwardSubnetwork); err != nil {
+			return err
+		}
+		if err := vm.SetPrivateIP(forwardNetwork, v.config.ip); err != nil {
+			return err
+		}
+		if v.config == forwardRouterConfig {
+			vm.EnableIPForwarding()
+		}
+		vm.RunTests(v.test)
+	}
+	return nil
+}
@@ -75,6 +75,8 @@ func TestNetworkPerformance(t *testing.T) {
 		t.Fatalf("Error: Wrong unit of measurement on machine type %s with network %s. Expected: %v Gbits/s, Actual: %v %s", machineTypeName, network, expected, resultPerf, units)
 	}
 
+	utils.ReportMetric(t, "throughput", resultPerf, "Gbits/s")
+
 	// Check if it matches the target.
 	if resultPerf < expected {
 		t.Fatalf("Error: Did not meet performance expectation on machine type %s with network %s. Expected: %v Gbits/s, Actual: %v Gbits/s", machineTypeName, network, expected, resultPerf)
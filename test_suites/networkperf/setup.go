@@ -259,7 +259,9 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		if err := jfNetwork.CreateFirewallRule("jf-allow-tcp-"+tc.machineType, "tcp", []string{"5001"}, []string{"192.168.1.0/24"}); err != nil {
 			return err
 		}
-		jfNetwork.SetMTU(imagetest.JumboFramesMTU)
+		if err := jfNetwork.SetMTU(imagetest.JumboFramesMTU); err != nil {
+			return err
+		}
 
 		// Read startup scripts
 		var serverStartup string
@@ -0,0 +1,276 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ntp
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// metadataServers are the names the metadata server NTP server is configured
+// with.
+var metadataServers = []string{"metadata.google.internal", "metadata", "169.254.169.254"}
+
+var (
+	w32tmServerRgx = regexp.MustCompile(`(?m)^NtpServer:\s*(.+?)\s*\(`)
+	w32tmSourceRgx = regexp.MustCompile(`(?m)^Source:\s*(.+?)\s*$`)
+	w32tmLeapRgx   = regexp.MustCompile(`(?m)^Leap Indicator:\s*(\d)`)
+)
+
+// ntpSource is a time source of the NTP service.
+type ntpSource struct {
+	name string
+	// selected is whether the service currently syncs the clock against the
+	// source.
+	selected bool
+}
+
+// timeService is a Linux NTP service.
+type timeService struct {
+	// units are the systemd units the service is packaged as by distros.
+	units []string
+	// sources returns the time sources of the service.
+	sources func(ctx context.Context) ([]ntpSource, error)
+}
+
+var linuxTimeServices = []timeService{
+	{units: []string{"chronyd", "chrony"}, sources: chronySources},
+	{units: []string{"ntpd", "ntp", "ntpsec"}, sources: ntpqSources},
+	{units: []string{"systemd-timesyncd"}, sources: timesyncdSources},
+}
+
+// isMetadataServer reports whether an NTP server name or address is the
+// metadata server.
+func isMetadataServer(name string) bool {
+	// w32tm appends flags such as ",0x1" to server names.
+	name, _, _ = strings.Cut(name, ",")
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	for _, s := range metadataServers {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// activeTimeService returns the Linux NTP service which is active and the
+// name of its unit.
+func activeTimeService(ctx context.Context) (timeService, string, error) {
+	for _, s := range linuxTimeServices {
+		for _, unit := range s.units {
+			if err := exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", unit).Run(); err == nil {
+				return s, unit, nil
+			}
+		}
+	}
+	return timeService{}, "", fmt.Errorf("none of chronyd, ntpd or systemd-timesyncd is active")
+}
+
+// chronySources parses the sources of chronyd from the CSV output of chronyc,
+// where the fields of a source are its mode, state and name followed by its
+// statistics.
+func chronySources(ctx context.Context) ([]ntpSource, error) {
+	out, err := exec.CommandContext(ctx, "chronyc", "-c", "sources").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("chronyc sources failed: %s %v", out, err)
+	}
+	var sources []ntpSource
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) < 3 {
+			continue
+		}
+		sources = append(sources, ntpSource{name: fields[2], selected: fields[1] == "*"})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("chronyd has no sources: %q", out)
+	}
+	return sources, nil
+}
+
+// ntpqSources parses the peers of ntpd from the output of ntpq, where the
+// first character of a peer line is its tally code, "*" for the system peer.
+func ntpqSources(ctx context.Context) ([]ntpSource, error) {
+	out, err := exec.CommandContext(ctx, "ntpq", "-pn").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ntpq -pn failed: %s %v", out, err)
+	}
+	var sources []ntpSource
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// The first two lines are the column names and a separator.
+	for i := 2; i < len(lines); i++ {
+		line := lines[i]
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 {
+			continue
+		}
+		sources = append(sources, ntpSource{name: fields[0], selected: line[0] == '*'})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("ntpd has no peers: %q", out)
+	}
+	return sources, nil
+}
+
+// timesyncdSources returns the server systemd-timesyncd uses, which is
+// selected once timedatectl reports the clock as synchronized.
+func timesyncdSources(ctx context.Context) ([]ntpSource, error) {
+	timedatectl := func(args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, "timedatectl", args...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("timedatectl %s failed: %s %v", strings.Join(args, " "), out, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	server, err := timedatectl("show-timesync", "--property=ServerName", "--value")
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		return nil, fmt.Errorf("systemd-timesyncd has no server")
+	}
+	synced, err := timedatectl("show", "--property=NTPSynchronized", "--value")
+	if err != nil {
+		return nil, err
+	}
+	return []ntpSource{{name: server, selected: synced == "yes"}}, nil
+}
+
+// w32tmQuery runs w32tm /query with the given option.
+func w32tmQuery(option string) (string, error) {
+	out, err := utils.RunPowershellCmd("w32tm /query /" + option)
+	if err != nil {
+		return "", fmt.Errorf("w32tm /query /%s failed: %s %s %v", option, out.Stdout, out.Stderr, err)
+	}
+	return out.Stdout, nil
+}
+
+func TestNTPService(t *testing.T) {
+	ctx := utils.Context(t)
+	if utils.IsWindows() {
+		out, err := utils.RunPowershellCmd("(Get-Service -Name w32time).Status")
+		if err != nil {
+			t.Fatalf("could not get w32time status: %s %s %v", out.Stdout, out.Stderr, err)
+		}
+		if status := strings.TrimSpace(out.Stdout); status != "Running" {
+			t.Fatalf("w32time status is %q, want Running", status)
+		}
+		return
+	}
+	_, unit, err := activeTimeService(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("NTP service %s is active", unit)
+}
+
+func TestNTPServer(t *testing.T) {
+	ctx := utils.Context(t)
+	var servers []string
+	if utils.IsWindows() {
+		out, err := w32tmQuery("configuration")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := w32tmServerRgx.FindStringSubmatch(out)
+		if m == nil {
+			t.Fatalf("no NtpServer in w32tm configuration: %s", out)
+		}
+		servers = strings.Fields(m[1])
+	} else {
+		s, unit, err := activeTimeService(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sources []ntpSource
+		// The service may not have resolved its servers right after boot.
+		err = utils.RetryUntil(ctx, 2*time.Minute, 10*time.Second, func() error {
+			var err error
+			sources, err = s.sources(ctx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("could not get the sources of %s: %v", unit, err)
+		}
+		for _, src := range sources {
+			servers = append(servers, src.name)
+		}
+	}
+	if len(servers) == 0 {
+		t.Fatal("no NTP server is configured")
+	}
+	for _, server := range servers {
+		if !isMetadataServer(server) {
+			t.Errorf("NTP server %s is not the metadata server", server)
+		}
+	}
+}
+
+func TestNTPSynchronized(t *testing.T) {
+	ctx := utils.Context(t)
+	var sync func() error
+	if utils.IsWindows() {
+		sync = func() error {
+			out, err := w32tmQuery("status")
+			if err != nil {
+				return err
+			}
+			// Leap indicator 3 means the clock is not synchronized.
+			if m := w32tmLeapRgx.FindStringSubmatch(out); m == nil || m[1] == "3" {
+				return fmt.Errorf("clock is not synchronized: %s", out)
+			}
+			m := w32tmSourceRgx.FindStringSubmatch(out)
+			if m == nil {
+				return fmt.Errorf("no source in w32tm status: %s", out)
+			}
+			if !isMetadataServer(m[1]) {
+				return fmt.Errorf("clock is synchronized against %s, not the metadata server", m[1])
+			}
+			return nil
+		}
+	} else {
+		s, unit, err := activeTimeService(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sync = func() error {
+			sources, err := s.sources(ctx)
+			if err != nil {
+				return err
+			}
+			for _, src := range sources {
+				if !src.selected {
+					continue
+				}
+				if !isMetadataServer(src.name) {
+					return fmt.Errorf("%s synchronizes against %s, not the metadata server", unit, src.name)
+				}
+				return nil
+			}
+			return fmt.Errorf("%s is not synchronized to any of its sources %v", unit, sources)
+		}
+	}
+	// The first sync can take a few polls after boot.
+	if err := utils.RetryUntil(ctx, 5*time.Minute, 10*time.Second, sync); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -15,10 +15,11 @@
 package oslogin
 
 import (
-	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 )
@@ -30,37 +31,11 @@ func TestOsLoginEnabled(t *testing.T) {
 }
 
 func TestOsLoginDisabled(t *testing.T) {
-	// Check OS Login not enabled in /etc/nsswitch.conf
-	data, err := os.ReadFile("/etc/nsswitch.conf")
-	if err != nil {
-		t.Fatalf("cannot read /etc/nsswitch.conf")
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-		if strings.Contains(line, "passwd:") && strings.Contains(line, "oslogin") {
-			t.Errorf("OS Login NSS module wrongly included in /etc/nsswitch.conf when disabled.")
-		}
-	}
-
-	// Check AuthorizedKeys Command
-	data, err = os.ReadFile("/etc/ssh/sshd_config")
-	if err != nil {
-		t.Fatalf("cannot read /etc/ssh/sshd_config")
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-		if strings.Contains(line, "AuthorizedKeysCommand") && strings.Contains(line, "/usr/bin/google_authorized_keys") {
-			t.Errorf("OS Login AuthorizedKeysCommand directive wrongly exists when disabled.")
-		}
+	if err := isOsLoginDisabled(); err != nil {
+		t.Error(err)
 	}
 
-	if err = testSSHDPamConfig(utils.Context(t)); err != nil {
+	if err := testSSHDPamConfig(utils.Context(t)); err != nil {
 		t.Fatalf("error checking pam config: %v", err)
 	}
 }
@@ -137,3 +112,72 @@ func TestGetentPasswdInvalidUser(t *testing.T) {
 		t.Errorf("getent passwd did not give error on invalid user")
 	}
 }
+
+// TestOsLoginHomeDirectory checks that the home directory of an OS Login user
+// can be provisioned the way pam_mkhomedir does on their first login.
+func TestOsLoginHomeDirectory(t *testing.T) {
+	ctx := utils.Context(t)
+	if !isOsLoginInstalled() {
+		t.Skip("OS Login package is not installed")
+	}
+	helper, err := exec.LookPath("mkhomedir_helper")
+	if err != nil {
+		t.Skipf("mkhomedir_helper not found: %v", err)
+	}
+	testUsername, testUUID, _, err := getTestUserEntry(ctx)
+	if err != nil {
+		t.Fatalf("failed to get test user entry: %v", err)
+	}
+
+	// mkhomedir_helper looks the user up through NSS, so this fails if the
+	// OS Login NSS module doesn't resolve the user.
+	if out, err := exec.CommandContext(ctx, helper, testUsername).CombinedOutput(); err != nil {
+		t.Fatalf("mkhomedir_helper %s failed: %s %v", testUsername, out, err)
+	}
+	home := path.Join("/home", testUsername)
+	out, err := exec.CommandContext(ctx, "stat", "-c", "%u", home).Output()
+	if err != nil {
+		t.Fatalf("home directory %s was not created: %v", home, err)
+	}
+	if owner := strings.TrimSpace(string(out)); owner != testUUID {
+		t.Errorf("home directory %s is owned by uid %s, want %s", home, owner, testUUID)
+	}
+}
+
+// TestOsLoginToggle checks that the guest agent disables OS Login when
+// enable-oslogin is set to false while the VM runs, and that local users
+// still resolve afterwards.
+func TestOsLoginToggle(t *testing.T) {
+	// Setup turns OS Login off once this is signalled.
+	signal := utils.SignalWorkflow(t, osLoginCheckedKey)
+	ctx := utils.Context(t)
+	if !isOsLoginInstalled() {
+		t.Skip("OS Login package is not installed")
+	}
+	if err := isOsLoginEnabled(ctx); err != nil {
+		t.Fatalf("OSLogin disabled when it should be enabled: %v", err)
+	}
+	testUsername, _, _, err := getTestUserEntry(ctx)
+	if err != nil {
+		t.Fatalf("failed to get test user entry: %v", err)
+	}
+	if err := exec.CommandContext(ctx, "getent", "passwd", testUsername).Run(); err != nil {
+		t.Fatalf("getent passwd %s failed with OS Login enabled: %v", testUsername, err)
+	}
+
+	if err := signal(); err != nil {
+		t.Fatalf("could not signal that OS Login was checked: %v", err)
+	}
+	if err := utils.RetryUntil(ctx, 5*time.Minute, 5*time.Second, isOsLoginDisabled); err != nil {
+		t.Fatalf("OS Login was not disabled after enable-oslogin was set to false: %v", err)
+	}
+
+	for _, user := range []string{"root", "nobody"} {
+		if out, err := exec.CommandContext(ctx, "getent", "passwd", user).Output(); err != nil || !strings.HasPrefix(string(out), user+":") {
+			t.Errorf("local user %s does not resolve with OS Login disabled: %s %v", user, out, err)
+		}
+	}
+	if err := exec.CommandContext(ctx, "getent", "passwd", testUsername).Run(); err == nil {
+		t.Errorf("OS Login user %s still resolves with OS Login disabled", testUsername)
+	}
+}
@@ -123,6 +123,34 @@ func isOsLoginEnabled(ctx context.Context) error {
 	return nil
 }
 
+// Checks if OSLogin is disabled. Returns an error if the OSLogin NSS module or
+// AuthorizedKeysCommand is still configured, or there is trouble reading a file.
+func isOsLoginDisabled() error {
+	data, err := os.ReadFile("/etc/nsswitch.conf")
+	if err != nil {
+		return fmt.Errorf("cannot read /etc/nsswitch.conf: %v", err)
+	}
+	if err = fileContainsLine(string(data), "passwd:", "oslogin"); err == nil {
+		return fmt.Errorf("OS Login NSS module wrongly included in /etc/nsswitch.conf when disabled")
+	}
+
+	data, err = os.ReadFile("/etc/ssh/sshd_config")
+	if err != nil {
+		return fmt.Errorf("cannot read /etc/ssh/sshd_config: %v", err)
+	}
+	if err = fileContainsLine(string(data), "AuthorizedKeysCommand", "/usr/bin/google_authorized_keys"); err == nil {
+		return fmt.Errorf("OS Login AuthorizedKeysCommand directive wrongly exists when disabled")
+	}
+	return nil
+}
+
+// Checks if the OSLogin package is installed, by looking for the
+// AuthorizedKeysCommand it provides.
+func isOsLoginInstalled() bool {
+	_, err := os.Stat("/usr/bin/google_authorized_keys")
+	return err == nil
+}
+
 func testSSHDPamConfig(ctx context.Context) error {
 	twoFactorAuthEnabled, err := isTwoFactorAuthEnabled(ctx)
 	if err != nil {
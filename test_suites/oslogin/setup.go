@@ -47,6 +47,10 @@ const (
 	admin2FAUser    = "admin-2fa-user"
 	admin2FAKey     = "admin-2fa-key"
 	admin2FASSHKey  = "admin-2fa-ssh-key"
+
+	// osLoginCheckedKey is the guest attribute the toggle VM sets once it
+	// checked OS Login is enabled, to have it turned off.
+	osLoginCheckedKey = "oslogin-enabled-checked"
 )
 
 var (
@@ -126,7 +130,19 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	}
 	defaultVM.AddScope(computeScope)
 	defaultVM.AddMetadata("enable-oslogin", "true")
-	defaultVM.RunTests("TestOsLoginEnabled|TestGetentPasswd|TestAgent")
+	defaultVM.RunTests("TestOsLoginEnabled|TestGetentPasswd|TestOsLoginHomeDirectory|TestAgent")
+
+	toggle, err := t.CreateTestVM("toggle")
+	if err != nil {
+		return err
+	}
+	toggle.AddScope(computeScope)
+	toggle.AddMetadata("enable-oslogin", "true")
+	toggle.AddMetadata("enable-guest-attributes", "TRUE")
+	if err := toggle.SetMetadataOnSignal(osLoginCheckedKey, "enable-oslogin", "false"); err != nil {
+		return err
+	}
+	toggle.RunTests("TestOsLoginToggle")
 
 	normalUser := twoFATestUsers[counter%len(twoFATestUsers)]
 	adminUser := twoFAAdminTestUsers[counter%len(twoFAAdminTestUsers)]
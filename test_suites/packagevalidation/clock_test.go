@@ -17,7 +17,6 @@ package packagevalidation
 import (
 	"os/exec"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -36,7 +35,7 @@ const (
 )
 
 func TestNTP(t *testing.T) {
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		testNTPWindows(t)
 	} else {
 		testNTPServiceLinux(t)
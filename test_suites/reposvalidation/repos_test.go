@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reposvalidation
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// gcpRepoHost serves the GCP package repositories, such as the guest
+// environment and Cloud SDK repositories.
+const gcpRepoHost = "packages.cloud.google.com"
+
+// repoConfigGlobs match the files configuring the repositories of each
+// package manager.
+var repoConfigGlobs = []string{
+	"/etc/apt/sources.list",
+	"/etc/apt/sources.list.d/*",
+	"/etc/yum.repos.d/*.repo",
+	"/etc/zypp/repos.d/*.repo",
+}
+
+// aptFailureRgx matches the output of apt-get update when it failed to fetch
+// a repository, which it doesn't reflect in its exit status.
+var aptFailureRgx = regexp.MustCompile(`(?m)^(W: Failed to fetch|W: Some index files failed|E: )`)
+
+// refreshCommand returns the command refreshing the metadata of all
+// repositories with the package manager of the image.
+func refreshCommand() ([]string, error) {
+	switch {
+	case utils.CheckLinuxCmdExists("apt-get"):
+		return []string{"apt-get", "update"}, nil
+	case utils.CheckLinuxCmdExists("dnf"):
+		return []string{"dnf", "-y", "makecache"}, nil
+	case utils.CheckLinuxCmdExists("yum"):
+		return []string{"yum", "-y", "makecache"}, nil
+	case utils.CheckLinuxCmdExists("zypper"):
+		return []string{"zypper", "--non-interactive", "refresh"}, nil
+	}
+	return nil, fmt.Errorf("no known package manager found")
+}
+
+func TestRepositoriesReachable(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	cmd, err := refreshCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	// Retry to tell broken repositories from transient errors.
+	err = utils.Retry(ctx, 3, 10*time.Second, func() error {
+		out, err = exec.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", strings.Join(cmd, " "), err)
+		}
+		if cmd[0] == "apt-get" && aptFailureRgx.Match(out) {
+			return fmt.Errorf("%s failed to fetch repositories", strings.Join(cmd, " "))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v, output:\n%s", err, out)
+	}
+}
+
+func TestGCPRepositoriesConfigured(t *testing.T) {
+	utils.LinuxOnly(t)
+	for _, glob := range repoConfigGlobs {
+		files, err := filepath.Glob(glob)
+		if err != nil {
+			t.Fatalf("invalid glob %s: %v", glob, err)
+		}
+		for _, f := range files {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			if bytes.Contains(b, []byte(gcpRepoHost)) {
+				t.Logf("%s configures repositories of %s", f, gcpRepoHost)
+				return
+			}
+		}
+	}
+	t.Errorf("none of %v configures repositories of %s", repoConfigGlobs, gcpRepoHost)
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reposvalidation is a CIT suite for testing that the package
+// repositories of Linux images are configured and reachable.
+package reposvalidation
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// Name is the name of the test package. It must match the directory name.
+var Name = "reposvalidation"
+
+// gcpRepoImageRe matches the images which ship with the GCP package
+// repositories, as opposed to distros packaging the guest environment in
+// their own repositories.
+var gcpRepoImageRe = regexp.MustCompile(`debian|rhel|centos|rocky-linux|almalinux`)
+
+// TestSetup sets up the test workflow.
+func TestSetup(t *imagetest.TestWorkflow) error {
+	if utils.HasFeature(t.Image, "WINDOWS") {
+		t.Skip("Package repositories are only tested on Linux images.")
+		return nil
+	}
+	if strings.Contains(t.Image.Name, "cos") {
+		t.Skip("Container-Optimized OS has no package manager.")
+		return nil
+	}
+	if strings.Contains(t.Image.Name, "byos") {
+		t.Skip("The OS repositories of BYOS images need a subscription.")
+		return nil
+	}
+	vm, err := t.CreateTestVM("repos")
+	if err != nil {
+		return err
+	}
+	tests := "TestRepositoriesReachable"
+	if gcpRepoImageRe.MatchString(t.Image.Name) {
+		tests += "|TestGCPRepositoriesConfigured"
+	}
+	vm.RunTests(tests)
+	return nil
+}
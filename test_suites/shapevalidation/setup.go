@@ -20,6 +20,8 @@ import (
 	"flag"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/cloud-image-tests"
 	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
@@ -145,14 +147,59 @@ var armshapes = map[string]*shape{
 	},
 }
 
+// noSMTSeries are the machine series which have one thread per core.
+var noSMTSeries = []string{"t2d", "t2a", "c4a", "h3"}
+
 // TestSetup sets up the test workflow.
 func TestSetup(t *imagetest.TestWorkflow) error {
+	if err := testMachineType(t); err != nil {
+		return err
+	}
 	if t.Image.Architecture == "ARM64" {
 		return testFamily(t, armshapes)
 	}
 	return testFamily(t, x86shapes)
 }
 
+// expectedThreadsPerCore returns the number of threads per core the guest
+// should see on the machine type, or 0 if it depends on the host, as on
+// shared core machine types.
+func expectedThreadsPerCore(mt *compute.MachineType) int {
+	if mt.IsSharedCpu {
+		return 0
+	}
+	series, _, _ := strings.Cut(mt.Name, "-")
+	if mt.GuestCpus == 1 || slices.Contains(noSMTSeries, series) {
+		return 1
+	}
+	return 2
+}
+
+// testMachineType checks the CPUs and memory of a VM of the machine type of the
+// workflow, which is already known so no API call is needed.
+func testMachineType(t *imagetest.TestWorkflow) error {
+	filter, err := regexp.Compile(*testFilter)
+	if err != nil {
+		return fmt.Errorf("invalid shapevalidation test filter: %v", err)
+	}
+	if t.MachineType == nil || !filter.MatchString("DEFAULT") {
+		return nil
+	}
+	vm, err := t.CreateTestVM("machinetype")
+	if err != nil {
+		return err
+	}
+	vm.AddMetadata("expected_cpu", fmt.Sprintf("%d", t.MachineType.GuestCpus))
+	vm.AddMetadata("expected_memory_mb", fmt.Sprintf("%d", t.MachineType.MemoryMb))
+	tests := "TestCpu|TestMemorySize"
+	if threads := expectedThreadsPerCore(t.MachineType); threads > 0 {
+		vm.AddMetadata("expected_threads_per_core", fmt.Sprintf("%d", threads))
+		tests += "|TestCPUTopology"
+	}
+	vm.RunTests(tests)
+	return nil
+}
+
 func testFamily(t *imagetest.TestWorkflow, families map[string]*shape) error {
 	filter, err := regexp.Compile(*testFilter)
 	if err != nil {
@@ -39,6 +39,28 @@ func TestMem(t *testing.T) {
 	}
 }
 
+// memorySlack is the fraction of the memory of the machine type the firmware
+// and kernel may reserve, e.g. for a crash kernel.
+const memorySlack = 0.1
+
+func TestMemorySize(t *testing.T) {
+	expectedMemory, err := utils.GetMetadata(utils.Context(t), "instance", "attributes", "expected_memory_mb")
+	if err != nil {
+		t.Fatalf("could not get expected memory from metadata: %v", err)
+	}
+	emem, err := strconv.ParseUint(expectedMemory, 10, 64)
+	if err != nil {
+		t.Fatalf("could not parse uint64 from %s", expectedMemory)
+	}
+	mem, err := memTotalMB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lower := uint64(float64(emem) * (1 - memorySlack)); mem < lower || mem > emem {
+		t.Errorf("got %d MB memory, want between %d MB and %d MB", mem, lower, emem)
+	}
+}
+
 func TestCpu(t *testing.T) {
 	expectedCPU, err := utils.GetMetadata(utils.Context(t), "instance", "attributes", "expected_cpu")
 	if err != nil {
@@ -57,6 +79,24 @@ func TestCpu(t *testing.T) {
 	}
 }
 
+func TestCPUTopology(t *testing.T) {
+	expected, err := utils.GetMetadata(utils.Context(t), "instance", "attributes", "expected_threads_per_core")
+	if err != nil {
+		t.Fatalf("could not get expected threads per core from metadata: %v", err)
+	}
+	ethreads, err := strconv.Atoi(expected)
+	if err != nil {
+		t.Fatalf("could not parse int from %s", expected)
+	}
+	threads, err := threadsPerCore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threads != ethreads {
+		t.Errorf("got %d threads per core want %d", threads, ethreads)
+	}
+}
+
 func TestNuma(t *testing.T) {
 	expectedNuma, err := utils.GetMetadata(utils.Context(t), "instance", "attributes", "expected_numa")
 	if err != nil {
@@ -35,6 +35,26 @@ func memTotal() (uint64, error) {
 	return (info.Totalram / 1_000_000_000), nil
 }
 
+// memTotalMB returns the MemTotal of /proc/meminfo in MB, which is the memory
+// of the VM less what the firmware and kernel reserve.
+func memTotalMB() (uint64, error) {
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed MemTotal %q", line)
+			}
+			return kb / 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+}
+
 func numCpus() (int, error) {
 	cpus, err := os.ReadFile("/sys/devices/system/cpu/online")
 	if err != nil {
@@ -43,6 +63,16 @@ func numCpus() (int, error) {
 	return countKernelList(string(cpus))
 }
 
+// threadsPerCore returns the number of hardware threads of the core of the
+// first CPU, which is the same for all cores.
+func threadsPerCore() (int, error) {
+	siblings, err := os.ReadFile("/sys/devices/system/cpu/cpu0/topology/thread_siblings_list")
+	if err != nil {
+		return 0, err
+	}
+	return countKernelList(string(siblings))
+}
+
 func numNumaNodes() (uint8, error) {
 	nodes, err := os.ReadFile("/sys/devices/system/node/online")
 	if err != nil {
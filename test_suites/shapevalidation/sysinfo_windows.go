@@ -15,6 +15,7 @@
 package shapevalidation
 
 import (
+	"fmt"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -86,6 +87,19 @@ func memTotal() (uint64, error) {
 	return (msx.ullTotalPhys / 1_000_000_000), nil
 }
 
+// memTotalMB returns the TotalPhysicalMemory of Win32_ComputerSystem in MB.
+func memTotalMB() (uint64, error) {
+	out, err := exec.Command("powershell.exe", "-NonInteractive", "-NoProfile", "(Get-CimInstance Win32_ComputerSystem).TotalPhysicalMemory").Output()
+	if err != nil {
+		return 0, err
+	}
+	b, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse total physical memory %q: %v", out, err)
+	}
+	return b / (1024 * 1024), nil
+}
+
 func numCpus() (int, error) {
 	getActiveProcessorCount, err := k32Proc("GetActiveProcessorCount")
 	if err != nil {
@@ -101,6 +115,23 @@ func numCpus() (int, error) {
 	return int(r), err
 }
 
+// threadsPerCore returns the number of logical processors per core of all
+// processors reported by Win32_Processor.
+func threadsPerCore() (int, error) {
+	out, err := exec.Command("powershell.exe", "-NonInteractive", "-NoProfile", "$p = Get-CimInstance Win32_Processor; \"$(($p | Measure-Object NumberOfLogicalProcessors -Sum).Sum) $(($p | Measure-Object NumberOfCores -Sum).Sum)\"").Output()
+	if err != nil {
+		return 0, err
+	}
+	var logical, cores int
+	if _, err := fmt.Sscan(string(out), &logical, &cores); err != nil {
+		return 0, fmt.Errorf("could not parse processor counts %q: %v", out, err)
+	}
+	if cores == 0 {
+		return 0, fmt.Errorf("no processor cores reported")
+	}
+	return logical / cores, nil
+}
+
 func numNumaNodes() (uint8, error) {
 	// There is no function to list the number of nodes on a system,
 	// and they are not guaranteed to be a sequential list, so we are
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// metadataKeyOf returns the key of user in the ssh-keys metadata value.
+func metadataKeyOf(user, keys string) (string, bool) {
+	for _, line := range strings.Split(keys, "\n") {
+		u, key, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && u == user {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// TestBlockProjectSSHKeys tests that the guest agent only adds instance ssh
+// keys to authorized_keys when the instance blocks project keys.
+func TestBlockProjectSSHKeys(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	instanceKeys, err := utils.GetMetadata(ctx, "instance", "attributes", "ssh-keys")
+	if err != nil {
+		t.Fatalf("couldn't get instance ssh keys from metadata: %v", err)
+	}
+	instanceKey, ok := metadataKeyOf(instanceKeyUser, instanceKeys)
+	if !ok {
+		t.Fatalf("no key of %s in instance ssh keys", instanceKeyUser)
+	}
+	projectKeys, err := utils.GetMetadata(ctx, "project", "attributes", "ssh-keys")
+	if err != nil {
+		t.Fatalf("couldn't get project ssh keys from metadata: %v", err)
+	}
+	projectKey, ok := metadataKeyOf(projectKeyUser, projectKeys)
+	if !ok {
+		t.Fatalf("no key of %s in project ssh keys, the test can't check they are blocked", projectKeyUser)
+	}
+
+	// The guest agent creates the user and its keys asynchronously.
+	err = utils.RetryUntil(ctx, 2*time.Minute, 5*time.Second, func() error {
+		keys, err := utils.ReadAuthorizedKeys(instanceKeyUser)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if k == strings.TrimSpace(instanceKey) {
+				return nil
+			}
+		}
+		return fmt.Errorf("instance key of %s is not in authorized_keys %v", instanceKeyUser, keys)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The instance key being authorized means the guest agent has applied
+	// the metadata, project keys included if it doesn't block them.
+	keys, err := utils.ReadAuthorizedKeys(projectKeyUser)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("couldn't read authorized_keys of %s: %v", projectKeyUser, err)
+	}
+	for _, k := range keys {
+		if k == strings.TrimSpace(projectKey) {
+			t.Fatalf("project key of %s is authorized on an instance blocking project keys", projectKeyUser)
+		}
+	}
+}
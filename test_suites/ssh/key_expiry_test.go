@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// TestSSHKeyExpiry tests that the guest agent adds unexpired metadata ssh keys
+// to authorized_keys and leaves out expired ones.
+func TestSSHKeyExpiry(t *testing.T) {
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	keys, err := utils.GetMetadata(ctx, "instance", "attributes", "ssh-keys")
+	if err != nil {
+		t.Fatalf("couldn't get ssh keys from metadata: %v", err)
+	}
+	// The guest agent creates the user and its keys asynchronously.
+	err = utils.RetryUntil(ctx, 2*time.Minute, 5*time.Second, func() error {
+		authorizedKeys, err := utils.ReadAuthorizedKeys(expiryUser)
+		if err != nil {
+			return err
+		}
+		return utils.CheckSSHKeyExpiry(expiryUser, keys, authorizedKeys, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSSHKeyExpiryAfterBoot tests that the guest agent handles the expiry of
+// ssh keys added to metadata after boot, like TestSSHKeyExpiry does for keys
+// present at boot.
+func TestSSHKeyExpiryAfterBoot(t *testing.T) {
+	signal := utils.SignalWorkflow(t, hotExpiryReadyKey)
+	utils.LinuxOnly(t)
+	ctx := utils.Context(t)
+	if err := signal(); err != nil {
+		t.Fatalf("couldn't signal the workflow to add the ssh keys: %v", err)
+	}
+	var keys string
+	err := utils.RetryUntil(ctx, 5*time.Minute, 5*time.Second, func() error {
+		var err error
+		keys, err = utils.GetMetadata(ctx, "instance", "attributes", "ssh-keys")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(keys, hotExpiryUser+":") {
+			return fmt.Errorf("no keys of %s in metadata", hotExpiryUser)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ssh keys were not added to metadata: %v", err)
+	}
+	err = utils.RetryUntil(ctx, 2*time.Minute, 5*time.Second, func() error {
+		authorizedKeys, err := utils.ReadAuthorizedKeys(hotExpiryUser)
+		if err != nil {
+			return err
+		}
+		return utils.CheckSSHKeyExpiry(hotExpiryUser, keys, authorizedKeys, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
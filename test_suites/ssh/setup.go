@@ -16,13 +16,30 @@
 package ssh
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 )
 
 // Name is the name of the test package. It must match the directory name.
 var Name = "ssh"
 
-const user = "test-user"
+const (
+	user = "test-user"
+	// expiryUser has one expired and one unexpired key.
+	expiryUser = "expiry-user"
+	// instanceKeyUser has an instance key, and projectKeyUser a project key,
+	// on a VM blocking project keys.
+	instanceKeyUser = "instance-key-user"
+	projectKeyUser  = "project-key-user"
+	// hotExpiryUser has one expired and one unexpired key, which are added
+	// after boot once the guest sets the hotExpiryReadyKey guest attribute.
+	hotExpiryUser     = "hot-expiry-user"
+	hotExpiryReadyKey = "ready-for-ssh-keys"
+)
 
 // TestSetup sets up the test workflow.
 func TestSetup(t *imagetest.TestWorkflow) error {
@@ -57,5 +74,85 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		return err
 	}
 	vm3.RunTests("TestHostKeysNotOverrideAfterAgentRestart")
+
+	// The guest agent on windows doesn't manage an authorized_keys file.
+	if !utils.HasFeature(t.Image, "WINDOWS") {
+		expiredKey, err := t.AddSSHKey(expiryUser + "-expired")
+		if err != nil {
+			return err
+		}
+		validKey, err := t.AddSSHKey(expiryUser + "-valid")
+		if err != nil {
+			return err
+		}
+		vm4, err := t.CreateTestVM("keyexpiry")
+		if err != nil {
+			return err
+		}
+		if err := vm4.AddUserWithExpiry(expiryUser, expiredKey, time.Now().Add(-24*time.Hour)); err != nil {
+			return err
+		}
+		// Valid for longer than the test can run.
+		if err := vm4.AddUserWithExpiry(expiryUser, validKey, time.Now().Add(7*24*time.Hour)); err != nil {
+			return err
+		}
+		vm4.AddMetadata("enable-oslogin", "false")
+		vm4.RunTests("TestSSHKeyExpiry")
+
+		instanceKey, err := t.AddSSHKey(instanceKeyUser)
+		if err != nil {
+			return err
+		}
+		projectKey, err := t.AddSSHKey(projectKeyUser)
+		if err != nil {
+			return err
+		}
+		t.AddProjectMetadata("ssh-keys", fmt.Sprintf("%s:%s", projectKeyUser, strings.TrimSpace(projectKey)))
+		if err := addHotKeyExpiryVM(t); err != nil {
+			return err
+		}
+
+		vm5, err := t.CreateTestVM("blockprojectkeys")
+		if err != nil {
+			return err
+		}
+		vm5.AddUser(instanceKeyUser, instanceKey)
+		vm5.AddMetadata("block-project-ssh-keys", "true")
+		vm5.AddMetadata("enable-oslogin", "false")
+		vm5.RunTests("TestBlockProjectSSHKeys")
+	}
+	return nil
+}
+
+// addHotKeyExpiryVM adds a VM whose expiring ssh keys are added to its metadata
+// while its tests run, rather than when it is created.
+func addHotKeyExpiryVM(t *imagetest.TestWorkflow) error {
+	expiredKey, err := t.AddSSHKey(hotExpiryUser + "-expired")
+	if err != nil {
+		return err
+	}
+	validKey, err := t.AddSSHKey(hotExpiryUser + "-valid")
+	if err != nil {
+		return err
+	}
+	expired, err := utils.SSHKeyWithExpiry(expiredKey, hotExpiryUser, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	// Valid for longer than the test can run.
+	valid, err := utils.SSHKeyWithExpiry(validKey, hotExpiryUser, time.Now().Add(7*24*time.Hour))
+	if err != nil {
+		return err
+	}
+	vm, err := t.CreateTestVM("hotkeyexpiry")
+	if err != nil {
+		return err
+	}
+	vm.AddMetadata("enable-guest-attributes", "true")
+	vm.AddMetadata("enable-oslogin", "false")
+	if err := vm.SetMetadataOnSignal(hotExpiryReadyKey, "ssh-keys", fmt.Sprintf("%s:%s\n%s:%s", hotExpiryUser, expired, hotExpiryUser, valid)); err != nil {
+		return err
+	}
+	vm.RunTests("TestSSHKeyExpiryAfterBoot")
 	return nil
 }
@@ -17,7 +17,6 @@ package storageperf
 import (
 	"encoding/json"
 	"fmt"
-	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -29,7 +28,7 @@ import (
 func TestRandomReadIOPS(t *testing.T) {
 	var randReadIOPSJson []byte
 	var err error
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		if randReadIOPSJson, err = runFIOWindows(t, randRead); err != nil {
 			t.Fatalf("windows fio rand read failed with error: %v. If testing locally, check the guidance at storageperf/startupscripts/install_fio.ps1", err)
 		}
@@ -62,6 +61,7 @@ func TestRandomReadIOPS(t *testing.T) {
 		t.Fatalf("benchmark iops string %s was not a float: err %v", expectedRandReadIOPSString, err)
 	}
 
+	utils.ReportMetric(t, "iops", finalIOPSValue, "IOPS")
 	machineName, _ := utils.GetInstanceName(utils.Context(t))
 	if finalIOPSValue < iopsErrorMargin*expectedRandReadIOPS {
 		t.Fatalf("iops average for vm %s was too low: expected at least %f of target %s, got %s", machineName, iopsErrorMargin, expectedRandReadIOPSString, finalIOPSValueString)
@@ -74,7 +74,7 @@ func TestRandomReadIOPS(t *testing.T) {
 func TestSequentialReadIOPS(t *testing.T) {
 	var seqReadIOPSJson []byte
 	var err error
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		if seqReadIOPSJson, err = runFIOWindows(t, seqRead); err != nil {
 			t.Fatalf("windows fio seq read failed with error: %v", err)
 		}
@@ -115,6 +115,7 @@ func TestSequentialReadIOPS(t *testing.T) {
 		t.Fatalf("benchmark iops string %s  was not a float: err %v", expectedSeqReadIOPSString, err)
 	}
 
+	utils.ReportMetric(t, "bandwidth", finalBandwidthMBps, "MB/s")
 	// suppress the error because the vm name is only for printing out test results, and does not affect test behavior
 	machineName, _ := utils.GetInstanceName(utils.Context(t))
 	if finalBandwidthMBps < iopsErrorMargin*expectedSeqReadIOPS {
@@ -17,7 +17,6 @@ package storageperf
 import (
 	"encoding/json"
 	"fmt"
-	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -29,7 +28,7 @@ import (
 func TestRandomWriteIOPS(t *testing.T) {
 	var randWriteIOPSJson []byte
 	var err error
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		if randWriteIOPSJson, err = runFIOWindows(t, randWrite); err != nil {
 			t.Fatalf("windows fio rand write failed with error: %v. If testing locally, check the guidance at storageperf/startupscripts/install_fio.ps1", err)
 		}
@@ -63,6 +62,7 @@ func TestRandomWriteIOPS(t *testing.T) {
 	}
 
 	// suppress the error because the vm name is only for printing out test results, and does not affect test behavior
+	utils.ReportMetric(t, "iops", finalIOPSValue, "IOPS")
 	machineName, _ := utils.GetInstanceName(utils.Context(t))
 	if finalIOPSValue < iopsErrorMargin*expectedRandWriteIOPS {
 		t.Fatalf("iops average for vm %s was too low: expected at least %f of target %s, got %s", machineName, iopsErrorMargin, expectedRandWriteIOPSString, finalIOPSValueString)
@@ -75,7 +75,7 @@ func TestRandomWriteIOPS(t *testing.T) {
 func TestSequentialWriteIOPS(t *testing.T) {
 	var seqWriteIOPSJson []byte
 	var err error
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		if seqWriteIOPSJson, err = runFIOWindows(t, seqWrite); err != nil {
 			t.Fatalf("windows fio seq write failed with error: %v", err)
 		}
@@ -114,6 +114,7 @@ func TestSequentialWriteIOPS(t *testing.T) {
 		t.Fatalf("benchmark iops string %s was not a float: err %v", expectedSeqWriteIOPSString, err)
 	}
 
+	utils.ReportMetric(t, "bandwidth", finalBandwidthMBps, "MB/s")
 	machineName, _ := utils.GetInstanceName(utils.Context(t))
 	if finalBandwidthMBps < iopsErrorMargin*expectedSeqWriteIOPS {
 		t.Fatalf("iops average for vm %s was too low: expected at least %f of target %s, got %s", machineName, iopsErrorMargin, expectedSeqWriteIOPSString, finalBandwidthMBpsString)
@@ -46,6 +46,8 @@ type storagePerfTest struct {
 	minCPUPlatform   string
 	zone             string
 	requiredFeatures []string
+	// provisionedIOPS is the IOPS provisioned on hyperdisk mount disks, if set.
+	provisionedIOPS int64
 }
 
 const (
@@ -152,12 +154,13 @@ var storagePerfTestConfig = []storagePerfTest{
 		zone:             "us-east4-b",
 	},
 	{
-		name:         "n2-hde",
-		bootDiskType: imagetest.PdBalanced,
-		arch:         "X86_64",
-		machineType:  "n2-standard-80",
-		diskType:     imagetest.HyperdiskExtreme,
-		cpuMetric:    "N2_CPUS",
+		name:            "n2-hde",
+		bootDiskType:    imagetest.PdBalanced,
+		arch:            "X86_64",
+		machineType:     "n2-standard-80",
+		diskType:        imagetest.HyperdiskExtreme,
+		cpuMetric:       "N2_CPUS",
+		provisionedIOPS: 160000,
 	},
 	{
 		name:         "n2d-pd",
@@ -223,7 +226,7 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 				}
 			}
 
-			mountDisk := &compute.Disk{Name: mountDiskName + tc.machineType + tc.diskType, Type: tc.diskType, SizeGb: mountdiskSizeGB, Zone: tc.zone}
+			mountDisk := &compute.Disk{Name: mountDiskName + tc.machineType + tc.diskType, Type: tc.diskType, SizeGb: mountdiskSizeGB, Zone: tc.zone, ProvisionedIops: tc.provisionedIOPS}
 			disks = append(disks, mountDisk)
 		}
 
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -220,9 +219,9 @@ type FIOStatistics struct {
 }
 
 // installFioWindows copies the fio.exe file onto the VM instance.
-func installFioWindows() error {
-	if procStatus, err := utils.RunPowershellCmd("gsutil cp " + fioWindowsGCS + " " + fioWindowsLocalPath); err != nil {
-		return fmt.Errorf("gsutil failed with error: %v %s %s", err, procStatus.Stdout, procStatus.Stderr)
+func installFioWindows(ctx context.Context) error {
+	if err := utils.DownloadGCSObjectWithDefaultClient(ctx, fioWindowsGCS, fioWindowsLocalPath); err != nil {
+		return fmt.Errorf("failed to download fio: %v", err)
 	}
 	return nil
 }
@@ -395,7 +394,7 @@ func getDiskClass(ctx context.Context) string {
 // function to get num numa nodes
 // TODO: implement this for windows hyperdisk
 func getNumNumaNodes() (int, error) {
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		return 0, fmt.Errorf("getNumaNodes not yet implemented on windows")
 	}
 	lscpuOut, err := exec.Command("lscpu").CombinedOutput()
@@ -427,7 +426,7 @@ func getNumNumaNodes() (int, error) {
 // returned format is queue_1_cpus, queue_2_cpus, error
 // TODO: implement this for windows hyperdisk
 func getCPUNvmeMapping(symlinkRealPath string) (string, string, error) {
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		return "", "", fmt.Errorf("get cpu to nvme mapping not yet implemented on windows")
 	}
 	cpuListCmd := exec.Command("cat", "/sys/class/block/"+symlinkRealPath+"/mq/*/cpu_list")
@@ -448,7 +447,7 @@ func getCPUNvmeMapping(symlinkRealPath string) (string, string, error) {
 // fill the disk before testing to reach the maximum read iops and bandwidth
 // TODO: implement this for windows by passing in the \\\\.\\PhysicalDrive1 parameter
 func fillDisk(symlinkRealPath string, t *testing.T) error {
-	if runtime.GOOS == "windows" {
+	if utils.IsWindows() {
 		t.Logf("fill disk preliminary step not yet implemented for windows: performance may be lower than the target values")
 	} else {
 		// hard coding the filesize to 500G to save time on the fill disk step, as it
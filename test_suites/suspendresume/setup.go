@@ -16,8 +16,6 @@
 package suspendresume
 
 import (
-	"strings"
-
 	"github.com/GoogleCloudPlatform/cloud-image-tests"
 	"github.com/GoogleCloudPlatform/compute-daisy"
 	"google.golang.org/api/compute/v1"
@@ -28,15 +26,16 @@ var Name = "suspendresume"
 
 // TestSetup sets up the test workflow.
 func TestSetup(t *imagetest.TestWorkflow) error {
-	if !strings.Contains(t.Image.Name, "rhel-8-2-sap") && !strings.Contains(t.Image.Name, "rhel-8-1-sap") && !strings.Contains(t.Image.Name, "debian-10") && !strings.Contains(t.Image.Family, "ubuntu-pro-1804-lts-arm64") {
-		suspend := &daisy.Instance{}
-		suspend.Scopes = append(suspend.Scopes, "https://www.googleapis.com/auth/cloud-platform")
-		suspendvm, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "suspend"}}, suspend)
-		if err != nil {
-			return err
-		}
-		suspendvm.RunTests("TestSuspend")
-		suspendvm.Resume()
+	if skipped, err := t.SkipImage("rhel-8-2-sap|rhel-8-1-sap|debian-10|ubuntu-pro-1804-lts-arm64", "suspend and resume is not supported on this image"); err != nil || skipped {
+		return err
+	}
+	suspend := &daisy.Instance{}
+	suspend.Scopes = append(suspend.Scopes, "https://www.googleapis.com/auth/cloud-platform")
+	suspendvm, err := t.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "suspend"}}, suspend)
+	if err != nil {
+		return err
 	}
+	suspendvm.RunTests("TestSuspend")
+	suspendvm.Resume()
 	return nil
 }
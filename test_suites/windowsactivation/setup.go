@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package windowsactivation is a CIT suite for testing that Windows Server
+// images activate against the GCE KMS server.
+package windowsactivation
+
+import (
+	"github.com/GoogleCloudPlatform/cloud-image-tests"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+// Name is the name of the test package. It must match the directory name.
+var Name = "windowsactivation"
+
+// TestSetup sets up the test workflow.
+func TestSetup(t *imagetest.TestWorkflow) error {
+	if !utils.HasFeature(t.Image, "WINDOWS") {
+		t.Skip("Windows activation is only tested on Windows images.")
+		return nil
+	}
+	if utils.IsWindowsClient(t.Image.Name) {
+		t.Skip("Windows activation is only tested on Windows Server images.")
+		return nil
+	}
+	vm, err := t.CreateTestVM("activation")
+	if err != nil {
+		return err
+	}
+	vm.RunTests("TestWindowsActivation")
+	return nil
+}
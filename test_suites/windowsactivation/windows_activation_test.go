@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package windowsactivation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+var licenseStatusRgx = regexp.MustCompile(`License Status: *(.+)`)
+
+// TestWindowsActivation checks that Windows is activated. Activation runs
+// after boot, so the status is checked until it is licensed or the timeout
+// elapses.
+func TestWindowsActivation(t *testing.T) {
+	utils.WindowsOnly(t)
+	var output string
+	err := utils.RetryUntil(utils.Context(t), 5*time.Minute, 30*time.Second, func() error {
+		res, err := utils.RunPowershellCmd(`cscript C:\Windows\system32\slmgr.vbs /dlv`)
+		output = res.Stdout
+		if err != nil {
+			return fmt.Errorf("failed to get license status: %v", err)
+		}
+		m := licenseStatusRgx.FindStringSubmatch(output)
+		if m == nil {
+			return fmt.Errorf("license status not found")
+		}
+		if status := strings.TrimSpace(m[1]); status != "Licensed" {
+			return fmt.Errorf("license status is %q, want Licensed", status)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Windows is not activated: %v, slmgr output:\n%s", err, output)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package winrm
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
+)
+
+const rdpPort = 3389
+
+// allowsTCPPort reports whether an enabled ingress firewall rule allows TCP
+// connections to port.
+func allowsTCPPort(fw *computepb.Firewall, port int) bool {
+	if fw.GetDisabled() || fw.GetDirection() == "EGRESS" {
+		return false
+	}
+	for _, a := range fw.GetAllowed() {
+		if a.GetIPProtocol() != "tcp" && a.GetIPProtocol() != "all" {
+			continue
+		}
+		if len(a.GetPorts()) == 0 {
+			return true
+		}
+		for _, p := range a.GetPorts() {
+			first, last, isRange := strings.Cut(p, "-")
+			if !isRange {
+				last = first
+			}
+			from, err1 := strconv.Atoi(first)
+			to, err2 := strconv.Atoi(last)
+			if err1 == nil && err2 == nil && from <= port && port <= to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestRDP(t *testing.T) {
+	utils.WindowsOnly(t)
+	ctx := utils.Context(t)
+	if err := utils.WaitForPort(ctx, "localhost", rdpPort, 5*time.Minute); err != nil {
+		t.Fatalf("RDP is not listening: %v", err)
+	}
+	out, err := utils.RunPowershellCmd("(Get-Service -Name TermService).Status")
+	if err != nil {
+		t.Fatalf("could not get the status of TermService: %s %s %v", out.Stdout, out.Stderr, err)
+	}
+	if status := strings.TrimSpace(out.Stdout); status != "Running" {
+		t.Errorf("TermService status is %q, want Running", status)
+	}
+
+	project, _, err := utils.GetProjectZone(ctx)
+	if err != nil {
+		t.Fatalf("could not get project: %v", err)
+	}
+	network, err := utils.GetMetadata(ctx, "instance", "network-interfaces", "0", "network")
+	if err != nil {
+		t.Fatalf("could not get network: %v", err)
+	}
+	name, err := utils.GetRealVMName(rdpFirewallRule)
+	if err != nil {
+		t.Fatalf("could not get firewall rule name: %v", err)
+	}
+	name, _, _ = strings.Cut(name, ".")
+	client, err := compute.NewFirewallsRESTClient(ctx)
+	if err != nil {
+		t.Fatalf("could not create firewalls client: %v", err)
+	}
+	defer client.Close()
+	fw, err := client.Get(ctx, &computepb.GetFirewallRequest{Project: project, Firewall: name})
+	if err != nil {
+		t.Fatalf("could not get firewall rule %s: %v", name, err)
+	}
+	if path.Base(fw.GetNetwork()) != path.Base(strings.TrimSpace(network)) {
+		t.Errorf("firewall rule %s is on network %s, want %s", name, fw.GetNetwork(), network)
+	}
+	if !allowsTCPPort(fw, rdpPort) {
+		t.Errorf("firewall rule %s does not allow tcp:%d, allows %v", name, rdpPort, fw.GetAllowed())
+	}
+}
@@ -25,7 +25,13 @@ import (
 // Name is the name of the test package. It must match the directory name.
 var Name = "winrm"
 
-const user = "test-user"
+const (
+	user = "test-user"
+	// rdpFirewallRule is the name of the firewall rule allowing RDP, which
+	// TestRDP checks exists on the network of the rdp VM.
+	rdpFirewallRule      = "allow-rdp"
+	computeReadOnlyScope = "https://www.googleapis.com/auth/compute.readonly"
+)
 
 // TestSetup sets up the test workflow.
 func TestSetup(t *imagetest.TestWorkflow) error {
@@ -33,6 +39,9 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 		return nil
 	}
 	passwd := genPw(14)
+	if err := t.AddFirewallRule(rdpFirewallRule, "tcp", []string{"3389"}, nil); err != nil {
+		return err
+	}
 
 	vm, err := t.CreateTestVM("client")
 	if err != nil {
@@ -48,6 +57,13 @@ func TestSetup(t *imagetest.TestWorkflow) error {
 	vm2.AddMetadata("winrm-passwd", passwd)
 	vm2.RunTests("TestWaitForWinrmConnection")
 
+	vm3, err := t.CreateTestVM("rdp")
+	if err != nil {
+		return err
+	}
+	vm3.AddScope(computeReadOnlyScope)
+	vm3.RunTests("TestRDP")
+
 	return nil
 }
 
@@ -19,10 +19,14 @@ package imagetest
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,10 +41,17 @@ import (
 	computeBeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 var (
 	client *storage.Client
+
+	// serialPortsToLog are the serial ports of test VMs which daisy streams to
+	// the logs directory of the workflow while the VMs run. Daisy deletes the
+	// VMs before a failed workflow returns, so the output can't be fetched
+	// afterwards.
+	serialPortsToLog = []int64{1, 2, 3, 4}
 )
 
 const (
@@ -58,9 +69,22 @@ const (
 	HyperdiskThroughput = "hyperdisk-throughput"
 	// HyperdiskBalanced disktype string
 	HyperdiskBalanced = "hyperdisk-balanced"
+	// RegionalPd disktype string. Regional disks are not supported yet, as
+	// daisy can only create and delete zonal disks.
+	RegionalPd = "regional-pd"
 
 	testWrapperPath        = "/wrapper"
 	testWrapperPathWindows = "/wrapp"
+
+	defaultResultsCallbackTimeout = 30 * time.Second
+
+	// zoneExhaustedErrorCode is the error code of creating a VM in a zone
+	// which is out of capacity for its machine type.
+	zoneExhaustedErrorCode = "ZONE_RESOURCE_POOL_EXHAUSTED"
+
+	// cleanupConcurrency is the number of resources of a test workflow
+	// deleted at once when cleaning up after it.
+	cleanupConcurrency = 10
 )
 
 // TestWorkflow defines a test workflow which creates at least one test VM.
@@ -77,7 +101,10 @@ type TestWorkflow struct {
 	Project     *compute.Project
 	Zone        *compute.Zone
 	// GCSPath is the destination for workflow outputs in gs://[...] form.
-	GCSPath        string
+	GCSPath string
+	// NodeGroup is the name of a pre-existing sole-tenant node group which
+	// test VMs can be scheduled on, if any.
+	NodeGroup      string
 	skipped        bool
 	skippedMessage string
 	wf             *daisy.Workflow
@@ -85,9 +112,205 @@ type TestWorkflow struct {
 	counter int
 	// Does this test require exclusive project
 	lockProject bool
+	// Names of snapshots created by the workflow.
+	snapshots map[string]bool
+	// Disks attached to running VMs, by disk name.
+	hotplugDisks map[string]*hotplugDisk
+	// Called with the results of the workflow after cleanup.
+	resultsCallback        ResultsCallback
+	resultsCallbackTimeout time.Duration
+	// Summary of the results, set once the workflow has run.
+	summary *WorkflowSummary
+	// Whether each VM is created in its own create-disks and create-vms steps.
+	parallelVMCreation bool
+	// Whether leftover resources are only listed rather than deleted.
+	cleanupDryRun bool
+	// Labels added to the VMs and disks created by the workflow.
+	resourceLabels map[string]string
+	// The machine type of the workflow when it is one of several running the
+	// suite on different machine types, see NewTestWorkflowMatrix.
+	matrixMachineType string
+	// Reasons of the tests excluded from running in the guest, by test name.
+	excludedTests map[string]string
+	// Images other than Image which VMs of the workflow boot from, see
+	// NewMultiImageTestWorkflow.
+	extraImages []*testImage
+	// MTU of the networks created by the workflow, DefaultMTU if zero.
+	networkMTU int
+	// IP ranges of the subnetworks created for the network interfaces of VMs,
+	// see SetSubnetCIDR.
+	subnetCIDR            string
+	subnetSecondaryRanges map[string]string
+	// Names of the firewall rules added with AddFirewallRule.
+	firewallRules []string
+	// Resource policies attached to disks with AttachResourcePolicy.
+	resourcePolicies []string
+	// Names of the VMs which measure their boot time with MeasureBootTime.
+	bootTimeVMs []string
+	// Customer-supplied encryption keys of disks, by disk name. They are only
+	// added to the workflow when it runs, so they are not printed with it.
+	diskKeys map[string]*compute.CustomerEncryptionKey
+	// Zones the workflow is set up again in, in order, when the zone it runs
+	// in is out of capacity for its VMs, see SetFallbackZones.
+	fallbackZones []string
+	setupFunc     func(*TestWorkflow) error
+	// Project metadata set while the workflow runs, see AddProjectMetadata.
+	projectMetadata map[string]string
+}
+
+// testImage is an additional image of a workflow, with the default machine
+// type for its architecture.
+type testImage struct {
+	url         string
+	image       *compute.Image
+	machineType *compute.MachineType
 }
 
-func (t *TestWorkflow) appendCreateVMStep(disks []*compute.Disk, instanceParams *daisy.Instance) (*daisy.Step, *daisy.Instance, error) {
+// hotplugDisk is a disk attached to a VM after the VM is created.
+type hotplugDisk struct {
+	vmname string
+	// The step waiting for the guest to see the disk.
+	attachedStep *daisy.Step
+	detached     bool
+}
+
+// ResultsCallback is a function which receives the results of a test workflow
+// once it has finished running and its resources have been cleaned up. The
+// context is cancelled when the callback timeout expires.
+type ResultsCallback func(ctx context.Context, suite junit.Testsuite) error
+
+// appendCreateVMStep adds the VM to the create-vms step. Any accelerators are
+// attached to the VM, which must have a machine type supporting them.
+func (t *TestWorkflow) appendCreateVMStep(disks []*compute.Disk, instanceParams *daisy.Instance, accels ...*compute.AcceleratorConfig) (*daisy.Step, *daisy.Instance, error) {
+	stepName := createVMsStepName
+	if len(disks) > 0 {
+		stepName = t.createVMsStepNameFor(disks[0].Name)
+	}
+	return t.appendCreateVMStepNamed(stepName, disks, instanceParams, accels...)
+}
+
+// SetParallelVMCreation sets whether each VM and its disks are created in
+// their own create-vms-<vm> and create-disks-<vm> steps, rather than in the
+// create-vms and create-disks steps shared by all VMs. The steps of different
+// VMs don't depend on each other, so daisy creates the VMs in parallel. It
+// applies to the VMs created after it is called.
+func (t *TestWorkflow) SetParallelVMCreation(parallel bool) {
+	t.parallelVMCreation = parallel
+}
+
+// SetFallbackZones sets the zones to run the workflow in, in order, when its
+// VMs can't be created because the zone is out of capacity. The workflow is
+// cleaned up, and a new workflow of the suite is set up with setup in the next
+// zone which has its machine type and run instead. Daisy resolves resources in
+// the zone of the workflow, so the steps can't be moved to another zone. VMs
+// and disks with a zone set explicitly stay in that zone.
+func (t *TestWorkflow) SetFallbackZones(zones []string, setup func(*TestWorkflow) error) {
+	t.fallbackZones = zones
+	t.setupFunc = setup
+}
+
+// createVMsStepNameFor returns the name of the step creating the VM.
+func (t *TestWorkflow) createVMsStepNameFor(vmname string) string {
+	if t.parallelVMCreation {
+		return createVMsStepName + "-" + vmname
+	}
+	return createVMsStepName
+}
+
+// createDisksStepNameFor returns the name of the step creating the disks of
+// the VM.
+func (t *TestWorkflow) createDisksStepNameFor(vmname string) string {
+	if t.parallelVMCreation {
+		return createDisksStepName + "-" + vmname
+	}
+	return createDisksStepName
+}
+
+// getCreateStepNames returns the names of the shared step with the given
+// name, if it exists, and of the per VM steps whose name starts with it,
+// sorted.
+func (t *TestWorkflow) getCreateStepNames(stepName string) []string {
+	var names []string
+	for name := range t.wf.Steps {
+		if name == stepName || strings.HasPrefix(name, stepName+"-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelResource adds the labels identifying the test run, and any labels set
+// with SetResourceLabels, to the labels of a resource. Labels already set on
+// the resource are kept. It returns a new map, leaving the given one as is.
+func (t *TestWorkflow) labelResource(resourceLabels map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range resourceLabels {
+		labels[k] = v
+	}
+	add := map[string]string{
+		"test-run-id": normalizeLabel(t.wf.ID()),
+		"test-suite":  normalizeLabel(t.Name),
+	}
+	for k, v := range t.resourceLabels {
+		add[k] = v
+	}
+	for k, v := range add {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// resourcesLabeled returns true if the workflow creates instances or disks,
+// and all of them have the test-run-id label.
+func (t *TestWorkflow) resourcesLabeled() bool {
+	runID := normalizeLabel(t.wf.ID())
+	var count int
+	for _, step := range t.wf.Steps {
+		var labels []map[string]string
+		if step.CreateInstances != nil {
+			for _, instance := range step.CreateInstances.Instances {
+				labels = append(labels, instance.Labels)
+			}
+			for _, instance := range step.CreateInstances.InstancesBeta {
+				labels = append(labels, instance.Labels)
+			}
+		}
+		if step.CreateDisks != nil {
+			for _, disk := range *step.CreateDisks {
+				labels = append(labels, disk.Labels)
+			}
+		}
+		for _, l := range labels {
+			if l["test-run-id"] != runID {
+				return false
+			}
+			count++
+		}
+	}
+	return count > 0
+}
+
+// normalizeLabel converts a string to a valid label key or value, which may
+// only contain up to 63 lowercase letters, digits, underscores and dashes.
+func normalizeLabel(s string) string {
+	label := []rune(strings.ToLower(s))
+	for i, r := range label {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '_' && r != '-' {
+			label[i] = '-'
+		}
+	}
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return string(label)
+}
+
+// appendCreateVMStepNamed adds the VM to the create instances step with the
+// given name, creating the step if it doesn't exist yet.
+func (t *TestWorkflow) appendCreateVMStepNamed(stepName string, disks []*compute.Disk, instanceParams *daisy.Instance, accels ...*compute.AcceleratorConfig) (*daisy.Step, *daisy.Instance, error) {
 	if len(disks) == 0 || disks[0].Name == "" {
 		return nil, nil, fmt.Errorf("failed to create VM from empty boot disk")
 	}
@@ -107,9 +330,29 @@ func (t *TestWorkflow) appendCreateVMStep(disks []*compute.Disk, instanceParams
 		instance = &daisy.Instance{}
 	}
 
+	// Accelerators may also be set on the instance parameters.
+	instance.GuestAccelerators = append(instance.GuestAccelerators, accels...)
+	if len(instance.GuestAccelerators) > 0 {
+		if instance.MachineType == "" {
+			instance.MachineType = t.MachineType.Name
+		}
+		if err := validateAccelerators(instance.MachineType, instance.GuestAccelerators); err != nil {
+			return nil, nil, fmt.Errorf("failed to create VM %s: %v", name, err)
+		}
+		if instance.Scheduling == nil {
+			instance.Scheduling = &compute.Scheduling{}
+		}
+		// VMs with GPUs can't live migrate.
+		instance.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
 	instance.StartupScript = fmt.Sprintf("wrapper%s", suffix)
 	instance.Name = name
+	instance.Labels = t.labelResource(instance.Labels)
 	instance.Scopes = append(instance.Scopes, "https://www.googleapis.com/auth/devstorage.read_write")
+	if instance.SerialPortsToLog == nil {
+		instance.SerialPortsToLog = slices.Clone(serialPortsToLog)
+	}
 
 	for _, disk := range disks {
 		currentDisk := &compute.AttachedDisk{Source: disk.Name, AutoDelete: true}
@@ -129,13 +372,13 @@ func (t *TestWorkflow) appendCreateVMStep(disks []*compute.Disk, instanceParams
 	createInstances := &daisy.CreateInstances{}
 	createInstances.Instances = append(createInstances.Instances, instance)
 
-	createVMStep, ok := t.wf.Steps[createVMsStepName]
+	createVMStep, ok := t.wf.Steps[stepName]
 	if ok {
 		// append to existing step.
 		createVMStep.CreateInstances.Instances = append(createVMStep.CreateInstances.Instances, instance)
 	} else {
 		var err error
-		createVMStep, err = t.wf.NewStep(createVMsStepName)
+		createVMStep, err = t.wf.NewStep(stepName)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -146,7 +389,10 @@ func (t *TestWorkflow) appendCreateVMStep(disks []*compute.Disk, instanceParams
 	return createVMStep, instance, nil
 }
 
-func (t *TestWorkflow) appendCreateVMStepBeta(disks []*compute.Disk, instance *daisy.InstanceBeta) (*daisy.Step, *daisy.InstanceBeta, error) {
+// appendCreateVMStepBeta adds the VM to the create-vms step using the beta
+// API. Any accelerators are attached to the VM, which must have a machine type
+// supporting them.
+func (t *TestWorkflow) appendCreateVMStepBeta(disks []*compute.Disk, instance *daisy.InstanceBeta, accels ...*compute.AcceleratorConfig) (*daisy.Step, *daisy.InstanceBeta, error) {
 	if len(disks) == 0 || disks[0].Name == "" {
 		return nil, nil, fmt.Errorf("failed to create VM from empty boot disk")
 	}
@@ -162,9 +408,41 @@ func (t *TestWorkflow) appendCreateVMStepBeta(disks []*compute.Disk, instance *d
 		instance = &daisy.InstanceBeta{}
 	}
 
+	// Accelerators may also be set on the instance parameters.
+	for _, accel := range accels {
+		if accel == nil {
+			return nil, nil, fmt.Errorf("failed to create VM %s with empty accelerator", name)
+		}
+		instance.GuestAccelerators = append(instance.GuestAccelerators, &computeBeta.AcceleratorConfig{AcceleratorType: accel.AcceleratorType, AcceleratorCount: accel.AcceleratorCount})
+	}
+	if len(instance.GuestAccelerators) > 0 {
+		if instance.MachineType == "" {
+			instance.MachineType = t.MachineType.Name
+		}
+		var allAccels []*compute.AcceleratorConfig
+		for _, accel := range instance.GuestAccelerators {
+			if accel == nil {
+				return nil, nil, fmt.Errorf("failed to create VM %s with empty accelerator", name)
+			}
+			allAccels = append(allAccels, &compute.AcceleratorConfig{AcceleratorType: accel.AcceleratorType, AcceleratorCount: accel.AcceleratorCount})
+		}
+		if err := validateAccelerators(instance.MachineType, allAccels); err != nil {
+			return nil, nil, fmt.Errorf("failed to create VM %s: %v", name, err)
+		}
+		if instance.Scheduling == nil {
+			instance.Scheduling = &computeBeta.Scheduling{}
+		}
+		// VMs with GPUs can't live migrate.
+		instance.Scheduling.OnHostMaintenance = "TERMINATE"
+	}
+
 	instance.StartupScript = fmt.Sprintf("wrapper%s", suffix)
 	instance.Name = name
+	instance.Labels = t.labelResource(instance.Labels)
 	instance.Scopes = append(instance.Scopes, "https://www.googleapis.com/auth/devstorage.read_write")
+	if instance.SerialPortsToLog == nil {
+		instance.SerialPortsToLog = slices.Clone(serialPortsToLog)
+	}
 
 	for _, disk := range disks {
 		instance.Disks = append(instance.Disks, &computeBeta.AttachedDisk{Source: disk.Name, AutoDelete: true})
@@ -182,13 +460,14 @@ func (t *TestWorkflow) appendCreateVMStepBeta(disks []*compute.Disk, instance *d
 	createInstances := &daisy.CreateInstances{}
 	createInstances.InstancesBeta = append(createInstances.InstancesBeta, instance)
 
-	createVMStep, ok := t.wf.Steps[createVMsStepName]
+	stepName := t.createVMsStepNameFor(name)
+	createVMStep, ok := t.wf.Steps[stepName]
 	if ok {
 		// append to existing step.
 		createVMStep.CreateInstances.InstancesBeta = append(createVMStep.CreateInstances.InstancesBeta, instance)
 	} else {
 		var err error
-		createVMStep, err = t.wf.NewStep(createVMsStepName)
+		createVMStep, err = t.wf.NewStep(stepName)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -199,26 +478,287 @@ func (t *TestWorkflow) appendCreateVMStepBeta(disks []*compute.Disk, instance *d
 	return createVMStep, instance, nil
 }
 
+// acceleratorMachineFamilies maps accelerator types to the machine families
+// they can be attached to.
+var acceleratorMachineFamilies = map[string][]string{
+	"nvidia-tesla-t4":   {"n1"},
+	"nvidia-tesla-p4":   {"n1"},
+	"nvidia-tesla-p100": {"n1"},
+	"nvidia-tesla-v100": {"n1"},
+	"nvidia-tesla-a100": {"a2"},
+	"nvidia-a100-80gb":  {"a2"},
+	"nvidia-l4":         {"g2"},
+	"nvidia-h100-80gb":  {"a3"},
+}
+
+// validateAccelerators checks the accelerators can be attached to a VM with
+// the given machine type.
+func validateAccelerators(machineType string, accels []*compute.AcceleratorConfig) error {
+	if machineType == "" {
+		return fmt.Errorf("a machine type is required to attach accelerators")
+	}
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	for _, accel := range accels {
+		if accel == nil || accel.AcceleratorType == "" || accel.AcceleratorCount < 1 {
+			return fmt.Errorf("accelerators need a type and a positive count, got %+v", accel)
+		}
+		accelType := path.Base(accel.AcceleratorType)
+		families, ok := acceleratorMachineFamilies[accelType]
+		if !ok {
+			return fmt.Errorf("unknown accelerator type %s", accelType)
+		}
+		if !slices.Contains(families, family) {
+			return fmt.Errorf("accelerator %s is not supported on machine type %s, use one of the machine families %v", accelType, machineType, families)
+		}
+	}
+	return nil
+}
+
+// nestedVirtualizationFamilies are the machine families of Intel shapes, which
+// support nested virtualization.
+var nestedVirtualizationFamilies = []string{"n1", "n2", "n4", "c2", "c3", "c4", "m1", "m2", "m3"}
+
+// SupportsNestedVirtualization reports whether VMs of the machine type can
+// enable nested virtualization.
+func SupportsNestedVirtualization(machineType string) bool {
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	return slices.Contains(nestedVirtualizationFamilies, family)
+}
+
+// gvnicOnlyMachineFamilies are the machine families whose VMs only support
+// gVNIC network interfaces.
+var gvnicOnlyMachineFamilies = []string{"a3", "c3", "c3d", "c4", "c4a", "c4d", "h3", "n4", "t2a", "x4", "z3"}
+
+// SupportsVirtioNet reports whether VMs of the machine type can use VirtIO
+// network interfaces.
+func SupportsVirtioNet(machineType string) bool {
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	return !slices.Contains(gvnicOnlyMachineFamilies, family)
+}
+
+// localSSDLimits maps machine families to the maximum number of local SSDs
+// which can be attached to a VM. Families with a limit of zero don't support
+// local SSDs. Families which aren't listed are not checked.
+var localSSDLimits = map[string]int{
+	"n1":  24,
+	"n2":  24,
+	"n2d": 24,
+	"c2":  8,
+	"c2d": 8,
+	"a2":  8,
+	"e2":  0,
+	"t2d": 0,
+	"t2a": 0,
+	"f1":  0,
+	"g1":  0,
+}
+
+// validateLocalSSDs checks that count local SSDs with the given interface can
+// be attached to a VM with the given machine type.
+func validateLocalSSDs(machineType, iface string, count int) error {
+	if iface != "NVME" && iface != "SCSI" {
+		return fmt.Errorf("local SSD interface must be NVME or SCSI, got %q", iface)
+	}
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	limit, ok := localSSDLimits[family]
+	if !ok {
+		return nil
+	}
+	if limit == 0 {
+		return fmt.Errorf("machine type %s does not support local SSDs", machineType)
+	}
+	if count > limit {
+		return fmt.Errorf("machine type %s supports at most %d local SSDs, got %d", machineType, limit, count)
+	}
+	return nil
+}
+
+// nvmeOnlyMachineFamilies are the machine families which only attach
+// persistent disks with the NVME interface.
+var nvmeOnlyMachineFamilies = []string{"c3", "c3d", "c4", "c4a", "n4", "h3", "m3", "t2a", "x4", "z3"}
+
+// validateDiskInterface checks that persistent disks can be attached with the
+// given interface to a VM with the given machine type.
+func validateDiskInterface(machineType, iface string) error {
+	if iface != "NVME" && iface != "SCSI" {
+		return fmt.Errorf("disk interface must be NVME or SCSI, got %q", iface)
+	}
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	if iface == "SCSI" && slices.Contains(nvmeOnlyMachineFamilies, family) {
+		return fmt.Errorf("machine type %s only supports NVME disks", machineType)
+	}
+	return nil
+}
+
+// confidentialMachineFamilies maps confidential instance types to the machine
+// families which support them.
+var confidentialMachineFamilies = map[string][]string{
+	"SEV":     {"n2d", "c2d", "c3d"},
+	"SEV_SNP": {"n2d"},
+	"TDX":     {"c3"},
+}
+
+// validateConfidentialInstanceType checks the confidential instance type is
+// supported by the given machine type.
+func validateConfidentialInstanceType(machineType, confidentialInstanceType string) error {
+	families, ok := confidentialMachineFamilies[confidentialInstanceType]
+	if !ok {
+		return fmt.Errorf("unknown confidential instance type %q", confidentialInstanceType)
+	}
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	if !slices.Contains(families, family) {
+		return fmt.Errorf("confidential instance type %s is not supported on machine type %s, use one of the machine families %v", confidentialInstanceType, machineType, families)
+	}
+	return nil
+}
+
+// convertInstanceToBeta replaces the GA instance in the create step with an
+// equivalent beta instance, for features only available in the beta API.
+func (t *TestWorkflow) convertInstanceToBeta(instance *daisy.Instance) (*daisy.InstanceBeta, error) {
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		idx := slices.Index(step.CreateInstances.Instances, instance)
+		if idx < 0 {
+			continue
+		}
+		b, err := json.Marshal(&instance.Instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert instance %s to beta: %v", instance.Name, err)
+		}
+		beta := &daisy.InstanceBeta{InstanceBase: instance.InstanceBase, Metadata: instance.Metadata}
+		if err := json.Unmarshal(b, &beta.Instance); err != nil {
+			return nil, fmt.Errorf("failed to convert instance %s to beta: %v", instance.Name, err)
+		}
+		step.CreateInstances.Instances = slices.Delete(step.CreateInstances.Instances, idx, idx+1)
+		step.CreateInstances.InstancesBeta = append(step.CreateInstances.InstancesBeta, beta)
+		return beta, nil
+	}
+	return nil, fmt.Errorf("no create step found for instance %s", instance.Name)
+}
+
+// customMachineFamily describes the custom machine types of a machine family.
+type customMachineFamily struct {
+	maxCPUs int
+	// Memory limits per vCPU, in MB.
+	minMemPerCPU float64
+	maxMemPerCPU float64
+	// Whether custom machine types with a single vCPU are allowed.
+	allowSingleCPU bool
+}
+
+// customMachineFamilies maps machine families to the limits of their custom
+// machine types. The n1 family is used for custom machine types without a
+// family prefix.
+var customMachineFamilies = map[string]customMachineFamily{
+	"n1":  {maxCPUs: 96, minMemPerCPU: 921.6, maxMemPerCPU: 6656, allowSingleCPU: true},
+	"n2":  {maxCPUs: 80, minMemPerCPU: 512, maxMemPerCPU: 8192},
+	"n2d": {maxCPUs: 96, minMemPerCPU: 512, maxMemPerCPU: 8192},
+	"e2":  {maxCPUs: 32, minMemPerCPU: 512, maxMemPerCPU: 8192},
+}
+
+// customMachineType builds the name of a custom machine type, returning an
+// error if the combination of vCPUs and memory is not supported.
+func customMachineType(family string, cpus, memMB int) (string, error) {
+	if family == "" {
+		family = "n1"
+	}
+	limits, ok := customMachineFamilies[family]
+	if !ok {
+		return "", fmt.Errorf("custom machine types are not supported for machine family %q", family)
+	}
+	if cpus < 1 || cpus > limits.maxCPUs {
+		return "", fmt.Errorf("%s custom machine types need between 1 and %d vCPUs, got %d", family, limits.maxCPUs, cpus)
+	}
+	if cpus == 1 && !limits.allowSingleCPU {
+		return "", fmt.Errorf("%s custom machine types need at least 2 vCPUs", family)
+	}
+	if cpus > 1 && cpus%2 != 0 {
+		return "", fmt.Errorf("custom machine types with more than 1 vCPU need an even number of vCPUs, got %d", cpus)
+	}
+	if memMB <= 0 || memMB%256 != 0 {
+		return "", fmt.Errorf("custom machine type memory must be a positive multiple of 256MB, got %dMB", memMB)
+	}
+	memPerCPU := float64(memMB) / float64(cpus)
+	if memPerCPU < limits.minMemPerCPU || memPerCPU > limits.maxMemPerCPU {
+		return "", fmt.Errorf("%s custom machine types need between %gMB and %gMB of memory per vCPU, got %gMB", family, limits.minMemPerCPU, limits.maxMemPerCPU, memPerCPU)
+	}
+	if family == "n1" {
+		return fmt.Sprintf("custom-%d-%d", cpus, memMB), nil
+	}
+	return fmt.Sprintf("%s-custom-%d-%d", family, cpus, memMB), nil
+}
+
+// maxNetworkInterfaces returns the number of network interfaces supported by
+// a machine type, which is the number of vCPUs between 2 and 8. The number of
+// vCPUs of the default machine type is known, other machine types are parsed
+// from their name and are assumed to support 8 interfaces if that fails.
+func maxNetworkInterfaces(machineType string, defaultMachineType *compute.MachineType) int {
+	var cpus int64
+	if machineType == "" || (defaultMachineType != nil && path.Base(machineType) == defaultMachineType.Name) {
+		if defaultMachineType != nil {
+			cpus = defaultMachineType.GuestCpus
+		}
+	} else {
+		// Machine types are named like n2-standard-8 or n2-custom-8-16384.
+		parts := strings.Split(path.Base(machineType), "-")
+		cpuPart := parts[len(parts)-1]
+		if i := slices.Index(parts, "custom"); i >= 0 && i+1 < len(parts) {
+			cpuPart = parts[i+1]
+		}
+		var err error
+		cpus, err = strconv.ParseInt(cpuPart, 10, 64)
+		if err != nil {
+			cpus = 8
+		}
+	}
+	return int(min(max(cpus, 2), 8))
+}
+
+// acceleratorTypeURL expands an accelerator type name to the partial URL the
+// compute API expects, using the project and zone of the VM if set. Without a
+// project the URL is relative to the zone, as the workflow project is not yet
+// known when workflows are finalized.
+func (t *TestWorkflow) acceleratorTypeURL(accelType, project, zone string) string {
+	if strings.Contains(accelType, "/") {
+		return accelType
+	}
+	if zone == "" {
+		zone = t.wf.Zone
+	}
+	if project == "" {
+		return fmt.Sprintf("zones/%s/acceleratorTypes/%s", zone, accelType)
+	}
+	return fmt.Sprintf("projects/%s/zones/%s/acceleratorTypes/%s", project, zone, accelType)
+}
+
 // appendCreateDisksStep should be called for creating the boot disk, or first disk in a VM.
 func (t *TestWorkflow) appendCreateDisksStep(diskParams *compute.Disk) (*daisy.Step, error) {
 	if diskParams == nil || diskParams.Name == "" {
 		return nil, fmt.Errorf("failed to create disk with empty parameters")
 	}
+	if err := checkDiskType(diskParams); err != nil {
+		return nil, err
+	}
 	bootdisk := &daisy.Disk{}
 	bootdisk.Name = diskParams.Name
 	bootdisk.SourceImage = t.ImageURL
 	bootdisk.Type = diskParams.Type
 	bootdisk.Zone = diskParams.Zone
+	bootdisk.Labels = t.labelResource(diskParams.Labels)
 
 	createDisks := &daisy.CreateDisks{bootdisk}
 
-	createDisksStep, ok := t.wf.Steps[createDisksStepName]
+	// The boot disk is named after the VM.
+	stepName := t.createDisksStepNameFor(diskParams.Name)
+	createDisksStep, ok := t.wf.Steps[stepName]
 	if ok {
 		// append to existing step.
 		*createDisksStep.CreateDisks = append(*createDisksStep.CreateDisks, bootdisk)
 	} else {
 		var err error
-		createDisksStep, err = t.wf.NewStep(createDisksStepName)
+		createDisksStep, err = t.wf.NewStep(stepName)
 		if err != nil {
 			return nil, err
 		}
@@ -228,15 +768,82 @@ func (t *TestWorkflow) appendCreateDisksStep(diskParams *compute.Disk) (*daisy.S
 	return createDisksStep, nil
 }
 
+// checkDiskType returns an error for disks which the workflow can't create.
+// Regional disks need the regionDisks API, which daisy's CreateDisks step and
+// compute client don't support, so they would fail when the workflow runs.
+func checkDiskType(diskParams *compute.Disk) error {
+	if path.Base(diskParams.Type) == RegionalPd || len(diskParams.ReplicaZones) > 0 {
+		return fmt.Errorf("failed to create disk %s: regional disks are not supported by daisy", diskParams.Name)
+	}
+	return nil
+}
+
+// provisionedRange is the range of provisioned IOPS or throughput in MiB/s
+// accepted for a disk type.
+type provisionedRange struct {
+	min, max int64
+}
+
+// provisionedIopsRanges and provisionedThroughputRanges are the disk types
+// which can be created with provisioned IOPS and throughput. The maximum of a
+// disk also depends on its size, which is left to the API to check.
+var (
+	provisionedIopsRanges = map[string]provisionedRange{
+		PdExtreme:         {10000, 120000},
+		HyperdiskExtreme:  {2500, 350000},
+		HyperdiskBalanced: {3000, 160000},
+	}
+	provisionedThroughputRanges = map[string]provisionedRange{
+		HyperdiskThroughput: {10, 2400},
+		HyperdiskBalanced:   {140, 2400},
+	}
+)
+
+// checkProvisionedPerformance returns an error if the provisioned IOPS or
+// throughput of the disk are not supported by its type.
+func checkProvisionedPerformance(diskParams *compute.Disk) error {
+	diskType := path.Base(diskParams.Type)
+	for _, p := range []struct {
+		name   string
+		value  int64
+		ranges map[string]provisionedRange
+	}{
+		{"IOPS", diskParams.ProvisionedIops, provisionedIopsRanges},
+		{"throughput", diskParams.ProvisionedThroughput, provisionedThroughputRanges},
+	} {
+		if p.value == 0 {
+			continue
+		}
+		r, ok := p.ranges[diskType]
+		if !ok {
+			return fmt.Errorf("failed to create disk %s: disk type %q does not support provisioned %s", diskParams.Name, diskParams.Type, p.name)
+		}
+		if p.value < r.min || p.value > r.max {
+			return fmt.Errorf("failed to create disk %s: provisioned %s of %s disks must be between %d and %d, got %d", diskParams.Name, p.name, diskType, r.min, r.max, p.value)
+		}
+	}
+	return nil
+}
+
 // appendCreateMountDisksStep should be called for any disk which is not the vm boot disk.
-func (t *TestWorkflow) appendCreateMountDisksStep(diskParams *compute.Disk) (*daisy.Step, error) {
+// The disk is created in the create disks step of the named VM.
+func (t *TestWorkflow) appendCreateMountDisksStep(vmname string, diskParams *compute.Disk) (*daisy.Step, error) {
 	if diskParams == nil || diskParams.Name == "" {
 		return nil, fmt.Errorf("failed to create disk with empty parameters")
 	}
+	if err := checkDiskType(diskParams); err != nil {
+		return nil, err
+	}
+	if err := checkProvisionedPerformance(diskParams); err != nil {
+		return nil, err
+	}
 	mountdisk := &daisy.Disk{}
 	mountdisk.Name = diskParams.Name
 	mountdisk.Type = diskParams.Type
 	mountdisk.Zone = diskParams.Zone
+	mountdisk.ProvisionedIops = diskParams.ProvisionedIops
+	mountdisk.ProvisionedThroughput = diskParams.ProvisionedThroughput
+	mountdisk.Labels = t.labelResource(diskParams.Labels)
 	if diskParams.SizeGb == 0 {
 		return nil, fmt.Errorf("failed to create mount disk with no SizeGb parameter")
 	}
@@ -244,13 +851,14 @@ func (t *TestWorkflow) appendCreateMountDisksStep(diskParams *compute.Disk) (*da
 
 	createDisks := &daisy.CreateDisks{mountdisk}
 
-	createDisksStep, ok := t.wf.Steps[createDisksStepName]
+	stepName := t.createDisksStepNameFor(vmname)
+	createDisksStep, ok := t.wf.Steps[stepName]
 	if ok {
 		// append to existing step.
 		*createDisksStep.CreateDisks = append(*createDisksStep.CreateDisks, mountdisk)
 	} else {
 		var err error
-		createDisksStep, err = t.wf.NewStep(createDisksStepName)
+		createDisksStep, err = t.wf.NewStep(stepName)
 		if err != nil {
 			return nil, err
 		}
@@ -260,41 +868,289 @@ func (t *TestWorkflow) appendCreateMountDisksStep(diskParams *compute.Disk) (*da
 	return createDisksStep, nil
 }
 
-func (t *TestWorkflow) addWaitStoppedStep(stepname, vmname string) (*daisy.Step, error) {
-	instanceSignal := &daisy.InstanceSignal{}
-	instanceSignal.Name = vmname
-	instanceSignal.Stopped = true
+// appendCreateDiskFromSnapshotStep adds a step which creates a boot disk from
+// a snapshot. The disk gets its own step rather than joining the create-disks
+// step, as it must wait for the snapshot which is taken after the VMs in
+// create-vms are running.
+func (t *TestWorkflow) appendCreateDiskFromSnapshotStep(diskParams *compute.Disk, snapshotURL string) (*daisy.Step, error) {
+	if diskParams == nil || diskParams.Name == "" {
+		return nil, fmt.Errorf("failed to create disk with empty parameters")
+	}
+	if snapshotURL == "" {
+		return nil, fmt.Errorf("failed to create disk %s from empty snapshot", diskParams.Name)
+	}
+	disk := &daisy.Disk{}
+	disk.Name = diskParams.Name
+	disk.SourceSnapshot = snapshotURL
+	disk.Type = diskParams.Type
+	disk.Zone = diskParams.Zone
+	disk.Architecture = t.Image.Architecture
+	disk.Labels = t.labelResource(diskParams.Labels)
+
+	// Snapshots created by this workflow are referenced by name, and the disk
+	// can only be created once the snapshot step has finished.
+	var createSnapshotStep *daisy.Step
+	snapshotName := path.Base(snapshotURL)
+	if t.snapshots[snapshotName] {
+		var ok bool
+		createSnapshotStep, ok = t.wf.Steps["create-snapshot-"+snapshotName]
+		if !ok {
+			return nil, fmt.Errorf("could not find step creating snapshot %s", snapshotName)
+		}
+	} else if !strings.Contains(snapshotURL, "/") {
+		return nil, fmt.Errorf("snapshot %s is not created by the workflow, use a full snapshot URL for existing snapshots", snapshotURL)
+	}
 
-	waitForInstances := &daisy.WaitForInstancesSignal{instanceSignal}
-	waitStep, err := t.wf.NewStep("wait-stopped-" + stepname)
+	createDiskStep, err := t.wf.NewStep("create-disk-from-snapshot-" + diskParams.Name)
 	if err != nil {
 		return nil, err
 	}
-	waitStep.WaitForInstancesSignal = waitForInstances
+	createDiskStep.CreateDisks = &daisy.CreateDisks{disk}
+	if createSnapshotStep != nil {
+		if err := t.wf.AddDependency(createDiskStep, createSnapshotStep); err != nil {
+			return nil, err
+		}
+	}
 
-	return waitStep, nil
+	return createDiskStep, nil
 }
 
-func (t *TestWorkflow) addWaitStep(stepname, vmname string) (*daisy.Step, error) {
-	serialOutput := &daisy.SerialOutput{}
-	serialOutput.Port = 1
-	serialOutput.SuccessMatch = successMatch
+// appendCreateSnapshotStep adds a step which snapshots the given disk after
+// the last wait step of the VM the disk is attached to.
+func (t *TestWorkflow) appendCreateSnapshotStep(disk *compute.Disk, snapshotName string) (*daisy.Step, *daisy.Snapshot, error) {
+	if disk == nil || disk.Name == "" {
+		return nil, nil, fmt.Errorf("failed to create snapshot of empty disk")
+	}
+	if snapshotName == "" {
+		return nil, nil, fmt.Errorf("failed to create snapshot of disk %s with empty name", disk.Name)
+	}
+	if _, ok := t.snapshots[snapshotName]; ok {
+		return nil, nil, fmt.Errorf("snapshot %s already exists in workflow", snapshotName)
+	}
+	vmname, err := t.getVMForDisk(disk.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Snapshot once the VM has signaled, so the filesystem is quiesced. If the
+	// VM ends with anything else, e.g. a stop or start step, the guest may
+	// still be booting when the snapshot is taken.
+	lastStep, err := t.getLastStepForVM(vmname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve last step for vm %s: %v", vmname, err)
+	}
+	if lastStep.WaitForInstancesSignal == nil {
+		return nil, nil, fmt.Errorf("last step for vm %s is not a wait step, cannot snapshot disk %s", vmname, disk.Name)
+	}
+
+	snapshot := &daisy.Snapshot{
+		Snapshot: compute.Snapshot{
+			Name:       snapshotName,
+			SourceDisk: disk.Name,
+		},
+	}
+	createSnapshotStep, err := t.wf.NewStep("create-snapshot-" + snapshotName)
+	if err != nil {
+		return nil, nil, err
+	}
+	createSnapshotStep.CreateSnapshots = &daisy.CreateSnapshots{snapshot}
+	if err := t.wf.AddDependency(createSnapshotStep, lastStep); err != nil {
+		return nil, nil, err
+	}
+
+	if t.snapshots == nil {
+		t.snapshots = make(map[string]bool)
+	}
+	t.snapshots[snapshotName] = true
+
+	return createSnapshotStep, snapshot, nil
+}
+
+// getVMForDisk returns the name of the VM the disk is attached to at creation.
+func (t *TestWorkflow) getVMForDisk(diskName string) (string, error) {
+	for _, createVMsStep := range t.wf.Steps {
+		if createVMsStep.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range createVMsStep.CreateInstances.Instances {
+			for _, attachedDisk := range vm.Disks {
+				if attachedDisk.Source == diskName {
+					return vm.Name, nil
+				}
+			}
+		}
+		for _, vm := range createVMsStep.CreateInstances.InstancesBeta {
+			for _, attachedDisk := range vm.Disks {
+				if attachedDisk.Source == diskName {
+					return vm.Name, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("disk %s is not attached to any vm in the workflow", diskName)
+}
+
+// getCreateStepForVM returns the step which creates the VM.
+func (t *TestWorkflow) getCreateStepForVM(vmname string) (*daisy.Step, error) {
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range step.CreateInstances.Instances {
+			if vm.Name == vmname {
+				return step, nil
+			}
+		}
+		for _, vm := range step.CreateInstances.InstancesBeta {
+			if vm.Name == vmname {
+				return step, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not find step creating vm %s", vmname)
+}
+
+// findDependencyCycle returns the names of the steps of a dependency cycle in
+// the workflow, starting and ending with the same step, or nil if there is
+// none.
+func (t *TestWorkflow) findDependencyCycle() []string {
+	// Steps are unvisited, on the current path, or done.
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case onPath:
+			start := slices.Index(stack, name)
+			return append(slices.Clone(stack[start:]), name)
+		case done:
+			return nil
+		}
+		state[name] = onPath
+		stack = append(stack, name)
+		deps := slices.Clone(t.wf.Dependencies[name])
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return nil
+	}
+	var names []string
+	for name := range t.wf.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// dependsOnAny reports whether the step is one of the target steps, or
+// depends on one of them directly or indirectly.
+func (t *TestWorkflow) dependsOnAny(name string, targets []string) bool {
+	seen := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		if slices.Contains(targets, name) {
+			return true
+		}
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		for _, dep := range t.wf.Dependencies[name] {
+			if visit(dep) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(name)
+}
+
+// getDiskSizeGb returns the size the disk is created with. It returns false if
+// the disk has no explicit size, e.g. a boot disk sized by its image.
+func (t *TestWorkflow) getDiskSizeGb(diskName string) (int64, bool) {
+	for _, step := range t.wf.Steps {
+		if step.CreateDisks == nil {
+			continue
+		}
+		for _, disk := range *step.CreateDisks {
+			if disk.Name != diskName || disk.SizeGb == "" {
+				continue
+			}
+			sizeGb, err := strconv.ParseInt(disk.SizeGb, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return sizeGb, true
+		}
+	}
+	return 0, false
+}
+
+func (t *TestWorkflow) addAttachDiskStep(stepname, vmname, diskName string) (*daisy.Step, error) {
+	attachDisk := &daisy.AttachDisk{Instance: vmname}
+	attachDisk.Source = diskName
+	// Delete the disk with the VM, even if the test aborts before detaching it.
+	attachDisk.AutoDelete = true
+
+	attachDiskStep, err := t.wf.NewStep("attach-disk-" + stepname)
+	if err != nil {
+		return nil, err
+	}
+	attachDiskStep.AttachDisks = &daisy.AttachDisks{attachDisk}
+
+	return attachDiskStep, nil
+}
+
+func (t *TestWorkflow) addDetachDiskStep(stepname, vmname, diskName string) (*daisy.Step, error) {
+	detachDisk := &daisy.DetachDisk{Instance: vmname, DeviceName: diskName}
 
+	detachDiskStep, err := t.wf.NewStep("detach-disk-" + stepname)
+	if err != nil {
+		return nil, err
+	}
+	detachDiskStep.DetachDisks = &daisy.DetachDisks{detachDisk}
+
+	return detachDiskStep, nil
+}
+
+// addWaitGuestAttributeStep adds a step waiting for the test on the VM to set
+// the given guest attribute key in the CIT namespace.
+func (t *TestWorkflow) addWaitGuestAttributeStep(stepname, vmname, key string) (*daisy.Step, error) {
 	instanceSignal := &daisy.InstanceSignal{}
 	instanceSignal.Name = vmname
-	instanceSignal.Stopped = false
+	instanceSignal.GuestAttribute = &daisy.GuestAttribute{Namespace: utils.GuestAttributeTestNamespace, KeyName: key}
+	instanceSignal.Interval = "8s"
 
-	guestAttribute := &daisy.GuestAttribute{}
-	guestAttribute.Namespace = utils.GuestAttributeTestNamespace
-	guestAttribute.KeyName = utils.GuestAttributeTestKey
+	waitStep, err := t.wf.NewStep("wait-" + stepname)
+	if err != nil {
+		return nil, err
+	}
+	waitStep.WaitForInstancesSignal = &daisy.WaitForInstancesSignal{instanceSignal}
 
-	instanceSignal.SerialOutput = serialOutput
-	instanceSignal.GuestAttribute = guestAttribute
-	instanceSignal.Interval = "8s"
+	return waitStep, nil
+}
 
-	waitForInstances := &daisy.WaitForInstancesSignal{instanceSignal}
+func (t *TestWorkflow) addWaitStoppedStep(stepname, vmname string) (*daisy.Step, error) {
+	instanceSignal := &daisy.InstanceSignal{}
+	instanceSignal.Name = vmname
+	instanceSignal.Stopped = true
 
-	waitStep, err := t.wf.NewStep("wait-" + stepname)
+	waitForInstances := &daisy.WaitForInstancesSignal{instanceSignal}
+	waitStep, err := t.wf.NewStep("wait-stopped-" + stepname)
 	if err != nil {
 		return nil, err
 	}
@@ -303,8 +1159,25 @@ func (t *TestWorkflow) addWaitStep(stepname, vmname string) (*daisy.Step, error)
 	return waitStep, nil
 }
 
-// after guest attributes for instance wait step matching are implemented, this step will wait for a different guest attribute key than addWaitStep
-func (t *TestWorkflow) addWaitRebootGAStep(stepname, vmname string) (*daisy.Step, error) {
+func (t *TestWorkflow) addWaitStep(stepname, vmname string) (*daisy.Step, error) {
+	return t.addWaitStepWithTimeout(stepname, vmname, "")
+}
+
+// addWaitStepWithTimeout adds a wait step like addWaitStep, which times out
+// after the given duration instead of the workflow default timeout if it is
+// not empty.
+func (t *TestWorkflow) addWaitStepWithTimeout(stepname, vmname, timeout string) (*daisy.Step, error) {
+	return t.addWaitSignalStep(stepname, vmname, utils.GuestAttributeTestNamespace, utils.GuestAttributeTestKey, timeout)
+}
+
+// addWaitSignalStep adds a wait step like addWaitStepWithTimeout, which waits
+// for the given guest attribute instead of the one set with the test results.
+func (t *TestWorkflow) addWaitSignalStep(stepname, vmname, namespace, key, timeout string) (*daisy.Step, error) {
+	if timeout != "" {
+		if _, err := time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout %q for wait step %s: %v", timeout, stepname, err)
+		}
+	}
 	serialOutput := &daisy.SerialOutput{}
 	serialOutput.Port = 1
 	serialOutput.SuccessMatch = successMatch
@@ -314,10 +1187,8 @@ func (t *TestWorkflow) addWaitRebootGAStep(stepname, vmname string) (*daisy.Step
 	instanceSignal.Stopped = false
 
 	guestAttribute := &daisy.GuestAttribute{}
-	guestAttribute.Namespace = utils.GuestAttributeTestNamespace
-	// specifically wait for a different guest attribute if this is the
-	// first boot before a reboot, and we want test results from a reboot.
-	guestAttribute.KeyName = utils.FirstBootGAKey
+	guestAttribute.Namespace = namespace
+	guestAttribute.KeyName = key
 
 	instanceSignal.SerialOutput = serialOutput
 	instanceSignal.GuestAttribute = guestAttribute
@@ -330,10 +1201,17 @@ func (t *TestWorkflow) addWaitRebootGAStep(stepname, vmname string) (*daisy.Step
 		return nil, err
 	}
 	waitStep.WaitForInstancesSignal = waitForInstances
+	waitStep.Timeout = timeout
 
 	return waitStep, nil
 }
 
+// addWaitRebootGAStep adds a wait step for the guest attribute set on the
+// first boot before a reboot, when test results are wanted from a reboot.
+func (t *TestWorkflow) addWaitRebootGAStep(stepname, vmname string) (*daisy.Step, error) {
+	return t.addWaitSignalStep(stepname, vmname, utils.GuestAttributeTestNamespace, utils.FirstBootGAKey, "")
+}
+
 func (t *TestWorkflow) addStopStep(stepname, vmname string) (*daisy.Step, error) {
 	stopInstances := &daisy.StopInstances{}
 	stopInstances.Instances = append(stopInstances.Instances, vmname)
@@ -347,10 +1225,10 @@ func (t *TestWorkflow) addStopStep(stepname, vmname string) (*daisy.Step, error)
 	return stopInstancesStep, nil
 }
 
-func (t *TestWorkflow) addDiskResizeStep(stepname, vmname string, diskSize int) (*daisy.Step, error) {
+func (t *TestWorkflow) addDiskResizeStep(stepname, diskName string, diskSize int) (*daisy.Step, error) {
 	resizeDisk := &daisy.ResizeDisk{}
 	resizeDisk.DisksResizeRequest.SizeGb = int64(diskSize)
-	resizeDisk.Name = vmname
+	resizeDisk.Name = diskName
 	resizeDiskStepName := "resize-disk-" + stepname
 	resizeDiskStep, err := t.wf.NewStep(resizeDiskStepName)
 	if err != nil {
@@ -457,6 +1335,9 @@ func finalizeWorkflows(ctx context.Context, tests []*TestWorkflow, zone, gcsPref
 
 		// $GCS_PATH/2021-04-20T11:44:08-07:00/image_validation/debian-10
 		twf.GCSPath = fmt.Sprintf("%s/%s/%s", gcsPrefix, twf.Name, twf.Image.Name)
+		if twf.matrixMachineType != "" {
+			twf.GCSPath += "/" + twf.matrixMachineType
+		}
 		twf.wf.GCSPath = twf.GCSPath
 
 		twf.wf.Zone = zone
@@ -476,34 +1357,48 @@ func finalizeWorkflows(ctx context.Context, tests []*TestWorkflow, zone, gcsPref
 					q.Region = twf.wf.Zone[:len(twf.wf.Zone)-2]
 				}
 			}
-			createStep, ok := twf.wf.Steps[createStepName]
-			if !ok {
-				continue
-			}
 			// Fix dependencies. Create steps should depend on the quota step, and quota steps should inherit all other dependencies.
-			for _, dep := range twf.wf.Dependencies[createStepName] {
-				dStep, ok := twf.wf.Steps[dep]
-				if ok {
-					if err := twf.wf.AddDependency(quotaStep, dStep); err != nil {
-						return err
+			// Dependencies which run after one of the create steps, such as
+			// waiting for a VM another VM depends on, are left out, as the
+			// quota step would otherwise depend on itself.
+			createStepNames := twf.getCreateStepNames(createStepName)
+			for _, name := range createStepNames {
+				createStep := twf.wf.Steps[name]
+				for _, dep := range twf.wf.Dependencies[name] {
+					if twf.dependsOnAny(dep, append(slices.Clone(createStepNames), quotaStepName)) {
+						continue
+					}
+					dStep, ok := twf.wf.Steps[dep]
+					if ok {
+						if err := twf.wf.AddDependency(quotaStep, dStep); err != nil {
+							return err
+						}
 					}
 				}
-			}
-			if err := twf.wf.AddDependency(createStep, quotaStep); err != nil {
-				return err
+				if err := twf.wf.AddDependency(createStep, quotaStep); err != nil {
+					return err
+				}
 			}
 		}
-
-		// Assume amd64 when arch is not set.
-		arch := "amd64"
-		if twf.Image.Architecture == "ARM64" {
-			arch = "arm64"
+		if cycle := twf.findDependencyCycle(); cycle != nil {
+			return fmt.Errorf("workflow %s has the dependency cycle %s", twf.Name, strings.Join(cycle, " -> "))
 		}
 
-		createDisksStep, createDisksOk := twf.wf.Steps[createDisksStepName]
-		createVMsStep, ok := twf.wf.Steps[createVMsStepName]
-		if ok {
+		arch := guestArch(twf.Image)
+
+		var createdDisks []*daisy.Disk
+		for _, name := range twf.getCreateStepNames(createDisksStepName) {
+			createdDisks = append(createdDisks, *twf.wf.Steps[name].CreateDisks...)
+		}
+		// VMs created from snapshots are in their own create step.
+		for _, createVMsStep := range twf.wf.Steps {
+			if createVMsStep.CreateInstances == nil {
+				continue
+			}
 			for _, vm := range createVMsStep.CreateInstances.Instances {
+				if skip := twf.testSkipPattern(); skip != "" {
+					vm.Metadata["_test_skip"] = skip
+				}
 				if vm.MachineType != "" {
 					log.Printf("VM %s machine type set to %s for test %s\n", vm.Name, vm.MachineType, twf.Name)
 				} else {
@@ -512,9 +1407,12 @@ func finalizeWorkflows(ctx context.Context, tests []*TestWorkflow, zone, gcsPref
 				if vm.Zone != "" && vm.Zone != twf.wf.Zone {
 					log.Printf("VM %s zone is set to %s, differing from workflow zone %s for test %s, not overriding\n", vm.Name, vm.Zone, twf.wf.Zone, twf.Name)
 				}
-				if createDisksOk && (strings.HasPrefix(vm.MachineType, "c4-") || strings.HasPrefix(vm.MachineType, "n4-")) {
+				for _, accel := range vm.GuestAccelerators {
+					accel.AcceleratorType = twf.acceleratorTypeURL(accel.AcceleratorType, vm.Project, vm.Zone)
+				}
+				if strings.HasPrefix(vm.MachineType, "c4-") || strings.HasPrefix(vm.MachineType, "n4-") {
 					for _, attachedDisk := range vm.Disks {
-						for _, disk := range *createDisksStep.CreateDisks {
+						for _, disk := range createdDisks {
 							if attachedDisk.Source == disk.Name && disk.Type == "" {
 								disk.Type = HyperdiskBalanced
 							}
@@ -522,6 +1420,14 @@ func finalizeWorkflows(ctx context.Context, tests []*TestWorkflow, zone, gcsPref
 					}
 				}
 			}
+			for _, vm := range createVMsStep.CreateInstances.InstancesBeta {
+				if skip := twf.testSkipPattern(); skip != "" {
+					vm.Metadata["_test_skip"] = skip
+				}
+				for _, accel := range vm.GuestAccelerators {
+					accel.AcceleratorType = twf.acceleratorTypeURL(accel.AcceleratorType, vm.Project, vm.Zone)
+				}
+			}
 		}
 
 		if utils.HasFeature(twf.Image, "WINDOWS") {
@@ -534,6 +1440,14 @@ func finalizeWorkflows(ctx context.Context, tests []*TestWorkflow, zone, gcsPref
 		} else {
 			twf.wf.Sources["testpackage"] = fmt.Sprintf("%s/%s.%s.test", localPath, twf.Name, arch)
 			twf.wf.Sources["wrapper"] = fmt.Sprintf("%s%s.%s", localPath, testWrapperPath, arch)
+			// VMs booting additional images of another architecture run the
+			// binaries built for it.
+			for _, ti := range twf.extraImages {
+				if extraArch := guestArch(ti.image); extraArch != arch {
+					twf.wf.Sources["testpackage-"+extraArch] = fmt.Sprintf("%s/%s.%s.test", localPath, twf.Name, extraArch)
+					twf.wf.Sources["wrapper-"+extraArch] = fmt.Sprintf("%s%s.%s", localPath, testWrapperPath, extraArch)
+				}
+			}
 		}
 
 		// add a final copy-objects step which copies the daisy-outs-path directory to twf.gcsPath + /outs
@@ -567,12 +1481,22 @@ type testResult struct {
 	workflowSuccess bool
 	err             error
 	results         []string
+	duration        time.Duration
 }
 
 func getTestResults(ctx context.Context, ts *TestWorkflow) ([]string, error) {
 	results := []string{}
-	createVMsStep, ok := ts.wf.Steps[createVMsStepName]
-	if ok {
+	// VMs restored from snapshots are created in their own steps. Sort the
+	// steps to keep the order of the results stable.
+	var createStepNames []string
+	for name, step := range ts.wf.Steps {
+		if step.CreateInstances != nil {
+			createStepNames = append(createStepNames, name)
+		}
+	}
+	sort.Strings(createStepNames)
+	for _, name := range createStepNames {
+		createVMsStep := ts.wf.Steps[name]
 		for _, vm := range createVMsStep.CreateInstances.Instances {
 			out, err := utils.DownloadGCSObject(ctx, client, vm.Metadata["_test_results_url"])
 			if err != nil {
@@ -592,13 +1516,203 @@ func getTestResults(ctx context.Context, ts *TestWorkflow) ([]string, error) {
 	return results, nil
 }
 
+// parseImageURL returns the project and name of an image partial URL of the
+// form projects/<project>/global/images/<image>, or the project and family
+// name if it is of the form projects/<project>/global/images/family/<family>.
+func parseImageURL(image string) (project, name string, isFamily bool, err error) {
+	if i := strings.Index(image, "projects/"); i > 0 {
+		// Strip the API prefix of full URLs.
+		image = image[i:]
+	}
+	split := strings.Split(image, "/")
+	if len(split) < 2 || split[0] != "projects" || split[1] == "" {
+		return "", "", false, fmt.Errorf("invalid image %q, want projects/<project>/global/images/<image> or projects/<project>/global/images/family/<family>", image)
+	}
+	if split[len(split)-2] == "family" {
+		if split[len(split)-1] == "" {
+			return "", "", false, fmt.Errorf("image %q has an empty family", image)
+		}
+		return split[1], split[len(split)-1], true, nil
+	}
+	if split[len(split)-1] == "" || split[len(split)-1] == "family" {
+		return "", "", false, fmt.Errorf("image %q has an empty image or family name", image)
+	}
+	return split[1], split[len(split)-1], false, nil
+}
+
+// arm64MachineFamilies are the machine families with ARM64 CPUs. Other
+// families are assumed to be X86_64.
+var arm64MachineFamilies = map[string]bool{
+	"t2a": true,
+	"c4a": true,
+}
+
+// machineTypeArchitecture returns the CPU architecture of a machine type, in
+// the same form as the architecture of an image.
+func machineTypeArchitecture(machineType string) string {
+	family, _, _ := strings.Cut(path.Base(machineType), "-")
+	if arm64MachineFamilies[family] {
+		return "ARM64"
+	}
+	return "X86_64"
+}
+
+// NewTestWorkflowMatrix returns a TestWorkflow running the test suite on each
+// of the machine types. Machine types whose architecture doesn't match the
+// image are skipped. The machine type is part of the name of each daisy
+// workflow, its GCS path and the classname of its test results, so that the
+// results of different machine types can be told apart.
+func NewTestWorkflowMatrix(client daisycompute.Client, computeEndpointOverride, name, image, timeout, project, zone string, machineTypes []string, nodeGroup string) ([]*TestWorkflow, error) {
+	var tests []*TestWorkflow
+	for _, machineType := range machineTypes {
+		t, err := NewTestWorkflow(client, computeEndpointOverride, name, image, timeout, project, zone, machineType, machineType, nodeGroup)
+		if err != nil {
+			return nil, err
+		}
+		imageArch := t.Image.Architecture
+		if imageArch == "" {
+			// Assume x86 when arch is not set.
+			imageArch = "X86_64"
+		}
+		if arch := machineTypeArchitecture(machineType); arch != imageArch {
+			log.Printf("Skipping machine type %s for test %s: it is %s, image %s is %s", machineType, name, arch, image, imageArch)
+			continue
+		}
+		t.matrixMachineType = machineType
+		t.wf.Name = fmt.Sprintf("%s-%s", t.wf.Name, machineType)
+		tests = append(tests, t)
+	}
+	return tests, nil
+}
+
+// MatrixMachineType returns the machine type of a workflow created by
+// NewTestWorkflowMatrix, or an empty string for other workflows.
+func (t *TestWorkflow) MatrixMachineType() string {
+	return t.matrixMachineType
+}
+
+// ParseSuiteTimeouts parses a comma separated list of suite=timeout pairs,
+// e.g. "networkperf=20m,storageperf=2h", into a map of timeouts by suite name.
+func ParseSuiteTimeouts(s string) (map[string]string, error) {
+	timeouts := make(map[string]string)
+	if s == "" {
+		return timeouts, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		suite, timeout, ok := strings.Cut(pair, "=")
+		if !ok || suite == "" {
+			return nil, fmt.Errorf("invalid suite timeout %q, want suite=timeout", pair)
+		}
+		if _, ok := timeouts[suite]; ok {
+			return nil, fmt.Errorf("timeout for suite %s set more than once", suite)
+		}
+		if err := validateTimeout(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout for suite %s: %v", suite, err)
+		}
+		timeouts[suite] = timeout
+	}
+	return timeouts, nil
+}
+
+// validateTimeout returns an error if the timeout is not a positive duration.
+func validateTimeout(timeout string) error {
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("timeout %s is not positive", timeout)
+	}
+	return nil
+}
+
+// guestArch returns the architecture of the test binaries for the image.
+func guestArch(image *compute.Image) string {
+	if image.Architecture == "ARM64" {
+		return "arm64"
+	}
+	// Assume amd64 when arch is not set.
+	return "amd64"
+}
+
+// NewMultiImageTestWorkflow returns a new TestWorkflow whose VMs may boot from
+// any of the images, e.g. to test SSH between two versions of an OS. The first
+// image is the image of the workflow, which CreateTestVM uses, and VMs booting
+// other images are created with CreateTestVMFromImage. The default machine type
+// of each image is resolved from its own architecture. Windows and Linux
+// images can't be mixed, as the workflow runs one kind of test binaries.
+func NewMultiImageTestWorkflow(client daisycompute.Client, computeEndpointOverride, name string, images []string, timeout, project, zone, x86Shape, arm64Shape, nodeGroup string) (*TestWorkflow, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images for test %s", name)
+	}
+	t, err := NewTestWorkflow(client, computeEndpointOverride, name, images[0], timeout, project, zone, x86Shape, arm64Shape, nodeGroup)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{images[0]: true}
+	windows := utils.HasFeature(t.Image, "WINDOWS")
+	for _, url := range images[1:] {
+		if seen[url] {
+			return nil, fmt.Errorf("image %s is listed more than once for test %s", url, name)
+		}
+		seen[url] = true
+		image, err := resolveImage(client, url)
+		if err != nil {
+			return nil, err
+		}
+		if utils.HasFeature(image, "WINDOWS") != windows {
+			return nil, fmt.Errorf("can't mix windows and linux images in test %s: %s and %s", name, images[0], url)
+		}
+		if windows && guestArch(image) != guestArch(t.Image) {
+			return nil, fmt.Errorf("can't mix windows images of different architectures in test %s: %s and %s", name, images[0], url)
+		}
+		machineType, err := client.GetMachineType(t.Project.Name, t.Zone.Name, shapeForImage(image, x86Shape, arm64Shape))
+		if err != nil {
+			return nil, err
+		}
+		t.extraImages = append(t.extraImages, &testImage{url: url, image: image, machineType: machineType})
+	}
+	return t, nil
+}
+
+// resolveImage returns the image with the given partial URL. Image families
+// are resolved to their latest non-deprecated image, so the guest OS features
+// and architecture of the image are known.
+func resolveImage(client daisycompute.Client, image string) (*compute.Image, error) {
+	imageProject, imageName, isFamily, err := parseImageURL(image)
+	if err != nil {
+		return nil, err
+	}
+	if isFamily {
+		img, err := client.GetImageFromFamily(imageProject, imageName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image family %s: %v", image, err)
+		}
+		return img, nil
+	}
+	return client.GetImage(imageProject, imageName)
+}
+
+// shapeForImage returns the default machine type for the architecture of the
+// image.
+func shapeForImage(image *compute.Image, x86Shape, arm64Shape string) string {
+	if image.Architecture == "ARM64" {
+		return arm64Shape
+	}
+	return x86Shape
+}
+
 // NewTestWorkflow returns a new TestWorkflow.
-func NewTestWorkflow(client daisycompute.Client, computeEndpointOverride, name, image, timeout, project, zone, x86Shape string, arm64Shape string) (*TestWorkflow, error) {
+func NewTestWorkflow(client daisycompute.Client, computeEndpointOverride, name, image, timeout, project, zone, x86Shape string, arm64Shape string, nodeGroup string) (*TestWorkflow, error) {
+	if err := validateTimeout(timeout); err != nil {
+		return nil, fmt.Errorf("invalid timeout for test %s: %v", name, err)
+	}
 	t := &TestWorkflow{}
 	t.counter = 0
 	t.Name = name
 	t.ImageURL = image
 	t.Client = client
+	t.NodeGroup = nodeGroup
 
 	var err error
 	t.Project, err = t.Client.GetProject(project)
@@ -609,20 +1723,11 @@ func NewTestWorkflow(client daisycompute.Client, computeEndpointOverride, name,
 	if err != nil {
 		return nil, err
 	}
-	split := strings.Split(image, "/")
-	if strings.Contains(image, "family") {
-		t.Image, err = t.Client.GetImageFromFamily(split[1], split[len(split)-1])
-	} else {
-		t.Image, err = t.Client.GetImage(split[1], split[len(split)-1])
-	}
+	t.Image, err = resolveImage(t.Client, image)
 	if err != nil {
 		return nil, err
 	}
-	if t.Image.Architecture == "ARM64" {
-		t.MachineType, err = t.Client.GetMachineType(t.Project.Name, t.Zone.Name, arm64Shape)
-	} else {
-		t.MachineType, err = t.Client.GetMachineType(t.Project.Name, t.Zone.Name, x86Shape)
-	}
+	t.MachineType, err = t.Client.GetMachineType(t.Project.Name, t.Zone.Name, shapeForImage(t.Image, x86Shape, arm64Shape))
 	if err != nil {
 		return nil, err
 	}
@@ -713,7 +1818,7 @@ func RunTests(ctx context.Context, storageClient *storage.Client, testWorkflows
 
 	finalizeWorkflows(ctx, testWorkflows, zone, gcsPrefix, localPath)
 
-	testResults := make(chan testResult, len(testWorkflows))
+	testResults := make(chan junit.Testsuite, len(testWorkflows))
 	testchan := make(chan *TestWorkflow, len(testWorkflows))
 
 	// Whenever we select a test project, we want to do so in a semi-random order
@@ -762,7 +1867,14 @@ func RunTests(ctx context.Context, storageClient *storage.Client, testWorkflows
 				} else {
 					test.wf.Project = <-projects
 				}
-				testResults <- runTestWorkflow(ctx, test)
+				res := runTestWorkflow(ctx, test, gcsPrefix, localPath)
+				suite := parseResult(res, localPath)
+				summary := newWorkflowSummary(res, suite)
+				test.summary = &summary
+				if err := test.notifyResults(ctx, suite); err != nil {
+					log.Printf("results callback for test %s/%s failed: %v", test.Name, test.Image.Name, err)
+				}
+				testResults <- suite
 				if test.lockProject {
 					// "unlock" the project.
 					exclusiveProjects <- test.wf.Project
@@ -778,7 +1890,7 @@ func RunTests(ctx context.Context, storageClient *storage.Client, testWorkflows
 
 	var suites junit.Testsuites
 	for i := 0; i < len(testWorkflows); i++ {
-		suites.Suites = append(suites.Suites, parseResult(<-testResults, localPath))
+		suites.Suites = append(suites.Suites, <-testResults)
 	}
 	for _, suite := range suites.Suites {
 		suites.Errors += suite.Errors
@@ -797,7 +1909,90 @@ func formatTimeDelta(format string, t time.Duration) string {
 	return z.Add(time.Duration(t)).Format(format)
 }
 
-func runTestWorkflow(ctx context.Context, test *TestWorkflow) testResult {
+// setProjectMetadata sets the metadata added with AddProjectMetadata on the
+// project of the workflow. It returns a function restoring the previous values,
+// which removes the keys the project didn't have. Project ssh keys are added to
+// the keys of the project, and only the added keys are removed again, so the
+// keys of the project are kept even if restoring fails.
+func (t *TestWorkflow) setProjectMetadata() (func() error, error) {
+	previous := make(map[string]*string)
+	err := t.updateProjectMetadata(func(items map[string]*string) {
+		for k, v := range t.projectMetadata {
+			v := v
+			previous[k] = items[k]
+			if k == "ssh-keys" && items[k] != nil && *items[k] != "" {
+				v = fmt.Sprintf("%s\n%s", strings.TrimRight(*items[k], "\n"), v)
+			}
+			items[k] = &v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return t.updateProjectMetadata(func(items map[string]*string) {
+			for k, v := range previous {
+				if k == "ssh-keys" && items[k] != nil {
+					keys := removeLines(*items[k], t.projectMetadata[k])
+					if keys != "" || v != nil {
+						items[k] = &keys
+						continue
+					}
+				}
+				if v == nil {
+					delete(items, k)
+				} else {
+					items[k] = v
+				}
+			}
+		})
+	}, nil
+}
+
+// removeLines returns value without the lines which are also lines of remove.
+func removeLines(value, remove string) string {
+	removed := strings.Split(remove, "\n")
+	var kept []string
+	for _, line := range strings.Split(value, "\n") {
+		if !slices.Contains(removed, line) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// updateProjectMetadata applies update to the metadata items of the project of
+// the workflow, by key.
+func (t *TestWorkflow) updateProjectMetadata(update func(items map[string]*string)) error {
+	project, err := t.Client.GetProject(t.wf.Project)
+	if err != nil {
+		return fmt.Errorf("failed to get project %s: %v", t.wf.Project, err)
+	}
+	md := project.CommonInstanceMetadata
+	if md == nil {
+		md = &compute.Metadata{}
+	}
+	items := make(map[string]*string)
+	for _, item := range md.Items {
+		items[item.Key] = item.Value
+	}
+	update(items)
+	var keys []string
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	updated := &compute.Metadata{Fingerprint: md.Fingerprint}
+	for _, k := range keys {
+		updated.Items = append(updated.Items, &compute.MetadataItems{Key: k, Value: items[k]})
+	}
+	if err := t.Client.SetCommonInstanceMetadata(t.wf.Project, updated); err != nil {
+		return fmt.Errorf("failed to set metadata of project %s: %v", t.wf.Project, err)
+	}
+	return nil
+}
+
+func runTestWorkflow(ctx context.Context, test *TestWorkflow, gcsPrefix, localPath string) testResult {
 	var res testResult
 	res.testWorkflow = test
 	if test.skipped {
@@ -808,26 +2003,62 @@ func runTestWorkflow(ctx context.Context, test *TestWorkflow) testResult {
 
 	clean := func() {
 		log.Printf("cleaning up after test %s/%s (ID %s) in project %s\n", test.Name, test.Image.Name, test.wf.ID(), test.wf.Project)
-		cleaned, errs := cleanTestWorkflow(test)
+		cleaned, errs := cleanTestWorkflow(test, cleanupConcurrency, test.cleanupDryRun)
 		for _, err := range errs {
 			log.Printf("error cleaning test %s/%s: %v\n", test.Name, test.Image.Name, err)
 		}
 		if len(cleaned) > 0 {
 			log.Printf("test %s/%s had %d leftover resources\n", test.Name, test.Image.Name, len(cleaned))
 		}
+		if test.cleanupDryRun {
+			for _, c := range cleaned {
+				log.Printf("would delete resource %s from test %s/%s", c, test.Name, test.Image.Name)
+			}
+			return
+		}
 		for _, c := range cleaned {
 			log.Printf("deleted resource %s from test %s/%s", c, test.Name, test.Image.Name)
 		}
+		leaked, unexpected, errs := auditCleanup(test, cleaned)
+		for _, err := range errs {
+			log.Printf("error auditing cleanup of test %s/%s: %v\n", test.Name, test.Image.Name, err)
+		}
+		for _, r := range leaked {
+			log.Printf("resource %s created by test %s/%s was not cleaned up", r, test.Name, test.Image.Name)
+		}
+		for _, r := range unexpected {
+			log.Printf("resource %s cleaned up for test %s/%s was not created by the test workflow", r, test.Name, test.Image.Name)
+		}
 	}
 	defer clean()
 
+	if len(test.projectMetadata) > 0 {
+		restore, err := test.setProjectMetadata()
+		if err != nil {
+			res.err = err
+			return res
+		}
+		defer func() {
+			if err := restore(); err != nil {
+				log.Printf("error restoring project metadata after test %s/%s: %v\n", test.Name, test.Image.Name, err)
+			}
+		}()
+	}
+
 	start := time.Now()
 	log.Printf("running test %s/%s (ID %s) in project %s\n", test.Name, test.Image.Name, test.wf.ID(), test.wf.Project)
-	if err := test.wf.Run(ctx); err != nil {
-		res.err = err
+	runErr := test.runInZones(ctx, clean, gcsPrefix, localPath)
+	res.duration = time.Since(start)
+	if runErr != nil {
+		err := explainKMSError(runErr, test.diskEncryptionKeys())
+		if logsPath := test.serialLogsPath(); logsPath != "" {
+			res.err = fmt.Errorf("%v; serial port output of the test VMs is in %s", err, logsPath)
+		} else {
+			res.err = err
+		}
 		return res
 	}
-	delta := formatTimeDelta("04m 05s", time.Now().Sub(start))
+	delta := formatTimeDelta("04m 05s", res.duration)
 	log.Printf("finished test %s/%s (ID %s) in project %s, time spent: %s\n", test.Name, test.Image.Name, test.wf.ID(), test.wf.Project, delta)
 
 	results, err := getTestResults(ctx, test)
@@ -841,29 +2072,498 @@ func runTestWorkflow(ctx context.Context, test *TestWorkflow) testResult {
 	return res
 }
 
-func cleanTestWorkflow(test *TestWorkflow) (totalCleaned []string, totalErrs []error) {
-	c := cleanerupper.Clients{Daisy: test.Client}
-	policy := cleanerupper.WorkflowPolicy(test.wf.ID())
+// runInZones runs the workflow. While its VMs can't be created because the
+// zone is out of capacity, it is cleaned up and replaced by the workflow set
+// up in the next fallback zone, which is run instead.
+func (t *TestWorkflow) runInZones(ctx context.Context, clean func(), gcsPrefix, localPath string) error {
+	for {
+		t.applyDiskKeys()
+		runErr := t.wf.Run(ctx)
+		if runErr == nil {
+			return nil
+		}
+		if len(t.fallbackZones) == 0 || !strings.Contains(runErr.Error(), zoneExhaustedErrorCode) {
+			return runErr
+		}
+		clean()
+		var next *TestWorkflow
+		for next == nil && len(t.fallbackZones) > 0 {
+			zone := t.fallbackZones[0]
+			t.fallbackZones = t.fallbackZones[1:]
+			n, err := t.inZone(zone)
+			if err != nil {
+				log.Printf("test %s/%s can't fall back to zone %s: %v", t.Name, t.Image.Name, zone, err)
+				continue
+			}
+			if err := finalizeWorkflows(ctx, []*TestWorkflow{n}, zone, gcsPrefix, localPath); err != nil {
+				log.Printf("test %s/%s can't fall back to zone %s: %v", t.Name, t.Image.Name, zone, err)
+				continue
+			}
+			next = n
+		}
+		if next == nil {
+			return fmt.Errorf("%v; no fallback zone left", runErr)
+		}
+		log.Printf("zone %s is out of capacity for test %s/%s, retrying in zone %s", t.wf.Zone, t.Name, t.Image.Name, next.wf.Zone)
+		*t = *next
+	}
+}
+
+// inZone returns a new workflow of the suite in the given zone, set up with
+// the setup function of SetFallbackZones, with the remaining fallback zones.
+func (t *TestWorkflow) inZone(zone string) (*TestWorkflow, error) {
+	n := &TestWorkflow{
+		Name:                   t.Name,
+		Client:                 t.Client,
+		Image:                  t.Image,
+		ImageURL:               t.ImageURL,
+		Project:                t.Project,
+		NodeGroup:              t.NodeGroup,
+		resultsCallback:        t.resultsCallback,
+		resultsCallbackTimeout: t.resultsCallbackTimeout,
+		cleanupDryRun:          t.cleanupDryRun,
+		matrixMachineType:      t.matrixMachineType,
+		excludedTests:          t.excludedTests,
+		fallbackZones:          t.fallbackZones,
+		setupFunc:              t.setupFunc,
+	}
+	var err error
+	if n.Zone, err = t.Client.GetZone(t.Project.Name, zone); err != nil {
+		return nil, err
+	}
+	if n.MachineType, err = t.Client.GetMachineType(t.Project.Name, zone, t.MachineType.Name); err != nil {
+		return nil, err
+	}
+	for _, ti := range t.extraImages {
+		machineType, err := t.Client.GetMachineType(t.Project.Name, zone, ti.machineType.Name)
+		if err != nil {
+			return nil, err
+		}
+		n.extraImages = append(n.extraImages, &testImage{url: ti.url, image: ti.image, machineType: machineType})
+	}
+
+	n.wf = daisy.New()
+	n.wf.ComputeEndpoint = t.wf.ComputeEndpoint
+	n.wf.Name = t.wf.Name
+	n.wf.DefaultTimeout = t.wf.DefaultTimeout
+	n.wf.Project = t.wf.Project
+	n.wf.Zone = zone
+	n.wf.DisableCloudLogging()
+	n.wf.DisableStdoutLogging()
+	if err := t.setupFunc(n); err != nil {
+		return nil, fmt.Errorf("failed to set up test workflow: %v", err)
+	}
+	return n, nil
+}
+
+// notifyResults calls the results callback of the workflow, if one is set. It
+// returns once the callback returns or the callback timeout expires, whichever
+// comes first, so a misbehaving callback can't block the run.
+func (t *TestWorkflow) notifyResults(ctx context.Context, suite junit.Testsuite) error {
+	if t.resultsCallback == nil {
+		return nil
+	}
+	timeout := t.resultsCallbackTimeout
+	if timeout <= 0 {
+		timeout = defaultResultsCallbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Buffered so the callback goroutine can exit even after a timeout.
+	done := make(chan error, 1)
+	go func() {
+		done <- t.resultsCallback(ctx, suite)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("results callback did not return within %s: %v", timeout, ctx.Err())
+	}
+}
+
+// cleanTestWorkflow deletes the resources left behind by the test workflow,
+// making at most maxConcurrency delete calls at once. Zero means no limit. On
+// dry run, it makes no delete calls and returns what would have been deleted.
+func cleanTestWorkflow(test *TestWorkflow, maxConcurrency int, dryRun bool) (totalCleaned []string, totalErrs []error) {
+	return cleanWorkflowResources(test, maxConcurrency, dryRun)
+}
 
-	cleaned, errs := cleanerupper.CleanInstances(c, test.wf.Project, policy, false)
+// cleanWorkflowResources deletes the resources of the test workflow, or only
+// lists them if dryRun is set. Resources of one kind are deleted
+// concurrently, but instances are deleted before the disks attached to them
+// and those before the networks. The returned resources are sorted.
+func cleanWorkflowResources(test *TestWorkflow, maxConcurrency int, dryRun bool) (totalCleaned []string, totalErrs []error) {
+	c := cleanerupper.Clients{Daisy: test.Client, MaxConcurrency: maxConcurrency}
+	policy := cleanerupper.WorkflowPolicy(test.wf.ID())
+	// The daisy client can't clear the deletion protection of instances, nor
+	// list resource policies, instance groups, instance templates, addresses,
+	// routers or routes.
+	_, createsNetworks := test.wf.Steps[createNetworkStepName]
+	if (!dryRun && test.deletionProtected()) || len(test.resourcePolicies) > 0 || createsNetworks {
+		var opts []option.ClientOption
+		if test.wf.ComputeEndpoint != "" {
+			opts = append(opts, option.WithEndpoint(test.wf.ComputeEndpoint))
+		}
+		svc, err := compute.NewService(context.Background(), opts...)
+		if err != nil {
+			totalErrs = append(totalErrs, fmt.Errorf("failed to create compute client: %v", err))
+		}
+		c.Compute = svc
+	}
+
+	// When every instance and disk of the workflow is labeled with the run ID,
+	// only those are listed, rather than every instance and disk in the
+	// project. Networks have no labels and are always matched by name.
+	labeled := c
+	if test.resourcesLabeled() {
+		labeled.ListFilter = fmt.Sprintf("labels.test-run-id=%s", normalizeLabel(test.wf.ID()))
+	}
+	var cleaned []string
+	var errs []error
+	// Managed instance groups and instance templates, such as those created by
+	// guest tests of rollouts, are cleaned whenever there is a compute client
+	// to list them. Deleting a managed instance group waits for its instances
+	// to be deleted, and its template can't be deleted until then.
+	if c.Compute != nil {
+		cleaned, errs = cleanerupper.CleanInstanceGroupManagers(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+		cleaned, errs = cleanerupper.CleanInstanceTemplates(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+	}
+	cleaned, errs = cleanerupper.CleanInstances(labeled, test.wf.Project, policy, dryRun)
+	totalCleaned = append(totalCleaned, cleaned...)
+	totalErrs = append(totalErrs, errs...)
+	// Disks are cleaned after instances, so disks which were still attached
+	// when a test aborted, such as hotplugged disks, can be deleted.
+	cleaned, errs = cleanerupper.CleanDisks(labeled, test.wf.Project, policy, dryRun)
+	totalCleaned = append(totalCleaned, cleaned...)
+	totalErrs = append(totalErrs, errs...)
+	// Images are matched like snapshots, so images created from disks by
+	// workflow steps or guest tests don't leak.
+	cleaned, errs = cleanerupper.CleanImages(c, test.wf.Project, policy, dryRun)
 	totalCleaned = append(totalCleaned, cleaned...)
 	totalErrs = append(totalErrs, errs...)
-	cleaned, errs = cleanerupper.CleanDisks(c, test.wf.Project, policy, false)
+	// Snapshots are cleaned even if the workflow has no snapshot steps, as
+	// guest tests may take snapshots through the API, named after their VM.
+	cleaned, errs = cleanerupper.CleanSnapshots(c, test.wf.Project, policy, dryRun)
 	totalCleaned = append(totalCleaned, cleaned...)
 	totalErrs = append(totalErrs, errs...)
-	cleaned, errs = cleanerupper.CleanNetworks(c, test.wf.Project, policy, false)
+	// Resource policies can't be deleted while they are attached to disks.
+	if len(test.resourcePolicies) > 0 {
+		cleaned, errs = cleanerupper.CleanResourcePolicies(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+	}
+	// Firewall rules added to a network the workflow didn't create, such as
+	// the default network, are not deleted along with the network.
+	if len(test.firewallRules) > 0 {
+		cleaned, errs = cleanerupper.CleanFirewallRules(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+	}
+	// Static addresses and routers, such as those of Cloud NAT, are cleaned
+	// whenever there is a compute client to list them. Addresses are released
+	// once the instances using them are deleted, and both internal addresses
+	// and routers keep their network from being deleted.
+	if c.Compute != nil {
+		cleaned, errs = cleanerupper.CleanAddresses(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+		cleaned, errs = cleanerupper.CleanRouters(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+	}
+	// Custom routes, such as those to VMs forwarding IP packets, keep the
+	// networks of the workflow from being deleted. Routes on those networks
+	// are cleaned even if they aren't named after the workflow.
+	if createsNetworks {
+		cleaned, errs = cleanerupper.CleanRoutes(c, test.wf.Project, policy, dryRun)
+		totalCleaned = append(totalCleaned, cleaned...)
+		totalErrs = append(totalErrs, errs...)
+	}
+	cleaned, errs = cleanerupper.CleanNetworks(c, test.wf.Project, policy, dryRun)
 	totalCleaned = append(totalCleaned, cleaned...)
 	totalErrs = append(totalErrs, errs...)
 
+	// On dry run, rules of networks created by the workflow are listed twice.
+	sort.Strings(totalCleaned)
+	totalCleaned = slices.Compact(totalCleaned)
 	return
 }
 
+// deletionProtected reports whether any VM of the workflow is created with
+// deletion protection.
+func (t *TestWorkflow) deletionProtected() bool {
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, i := range step.CreateInstances.Instances {
+			if i.DeletionProtection {
+				return true
+			}
+		}
+		for _, i := range step.CreateInstances.InstancesBeta {
+			if i.DeletionProtection {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// auditCleanup compares the resources created by the test workflow with the
+// resources removed by cleanTestWorkflow and the resources which still exist
+// afterwards. It returns the created resources which were not cleaned up, and
+// the cleaned up or remaining resources which the workflow did not create.
+func auditCleanup(test *TestWorkflow, cleaned []string) (leaked, unexpected []string, errs []error) {
+	remaining, errs := cleanWorkflowResources(test, 0, true)
+	leaked, unexpected = reconcileCleanup(test.createdResources(), cleaned, remaining)
+	return leaked, unexpected, errs
+}
+
+// reconcileCleanup returns the created resources which are still remaining,
+// and the cleaned or remaining resources which are not in created. All
+// resources are partial URLs in the format used by cleanerupper.
+func reconcileCleanup(created, cleaned, remaining []string) (leaked, unexpected []string) {
+	createdSet := make(map[string]bool)
+	for _, r := range created {
+		createdSet[r] = true
+	}
+	seen := make(map[string]bool)
+	for _, r := range remaining {
+		if createdSet[r] {
+			leaked = append(leaked, r)
+		}
+	}
+	for _, resources := range [][]string{cleaned, remaining} {
+		for _, r := range resources {
+			if !createdSet[r] && !seen[r] {
+				unexpected = append(unexpected, r)
+			}
+			seen[r] = true
+		}
+	}
+	sort.Strings(leaked)
+	sort.Strings(unexpected)
+	return leaked, unexpected
+}
+
+// createdResources returns the partial URLs of the resources created by the
+// steps of the workflow. Resource names are generated by daisy when the
+// workflow is populated, so this is only accurate once the workflow has run.
+func (t *TestWorkflow) createdResources() []string {
+	project := func(r daisy.Resource) string {
+		if r.Project != "" {
+			return r.Project
+		}
+		return t.wf.Project
+	}
+	name := func(r daisy.Resource, name string) string {
+		if r.RealName != "" {
+			return r.RealName
+		}
+		return name
+	}
+	zone := func(zone string) string {
+		if zone != "" {
+			return path.Base(zone)
+		}
+		return t.wf.Zone
+	}
+	region := func(region string) string {
+		if region != "" {
+			return path.Base(region)
+		}
+		z := zone("")
+		if i := strings.LastIndex(z, "-"); i > 0 {
+			return z[:i]
+		}
+		return z
+	}
+
+	var created []string
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances != nil {
+			for _, i := range step.CreateInstances.Instances {
+				created = append(created, fmt.Sprintf("projects/%s/zones/%s/instances/%s", project(i.Resource), zone(i.Zone), name(i.Resource, i.Name)))
+			}
+			for _, i := range step.CreateInstances.InstancesBeta {
+				created = append(created, fmt.Sprintf("projects/%s/zones/%s/instances/%s", project(i.Resource), zone(i.Zone), name(i.Resource, i.Name)))
+			}
+		}
+		if step.CreateDisks != nil {
+			for _, d := range *step.CreateDisks {
+				created = append(created, fmt.Sprintf("projects/%s/zones/%s/disks/%s", project(d.Resource), zone(d.Zone), name(d.Resource, d.Name)))
+			}
+		}
+		if step.CreateImages != nil {
+			for _, i := range step.CreateImages.Images {
+				created = append(created, fmt.Sprintf("projects/%s/global/images/%s", project(i.Resource), name(i.Resource, i.Name)))
+			}
+			for _, i := range step.CreateImages.ImagesBeta {
+				created = append(created, fmt.Sprintf("projects/%s/global/images/%s", project(i.Resource), name(i.Resource, i.Name)))
+			}
+		}
+		if step.CreateSnapshots != nil {
+			for _, s := range *step.CreateSnapshots {
+				created = append(created, fmt.Sprintf("projects/%s/global/snapshots/%s", project(s.Resource), name(s.Resource, s.Name)))
+			}
+		}
+		if step.CreateNetworks != nil {
+			for _, n := range *step.CreateNetworks {
+				created = append(created, fmt.Sprintf("projects/%s/global/networks/%s", project(n.Resource), name(n.Resource, n.Name)))
+			}
+		}
+		if step.CreateSubnetworks != nil {
+			for _, sn := range *step.CreateSubnetworks {
+				created = append(created, fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", project(sn.Resource), region(sn.Region), name(sn.Resource, sn.Name)))
+			}
+		}
+		if step.CreateFirewallRules != nil {
+			for _, f := range *step.CreateFirewallRules {
+				created = append(created, fmt.Sprintf("projects/%s/global/firewalls/%s", project(f.Resource), name(f.Resource, f.Name)))
+			}
+		}
+	}
+	sort.Strings(created)
+	return created
+}
+
+// applyDiskKeys adds the customer-supplied encryption keys of disks to the
+// steps creating the disks, the instances they are attached to and the
+// snapshots taken of them, which all need the key.
+func (t *TestWorkflow) applyDiskKeys() {
+	if len(t.diskKeys) == 0 {
+		return
+	}
+	for _, step := range t.wf.Steps {
+		if step.CreateDisks != nil {
+			for _, disk := range *step.CreateDisks {
+				if key, ok := t.diskKeys[disk.Name]; ok {
+					disk.DiskEncryptionKey = key
+				}
+			}
+		}
+		if step.CreateSnapshots != nil {
+			for _, snapshot := range *step.CreateSnapshots {
+				if key, ok := t.diskKeys[snapshot.SourceDisk]; ok {
+					snapshot.SourceDiskEncryptionKey = key
+				}
+			}
+		}
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range step.CreateInstances.Instances {
+			for _, d := range vm.Disks {
+				if key, ok := t.diskKeys[d.Source]; ok {
+					d.DiskEncryptionKey = key
+				}
+			}
+		}
+		for _, vm := range step.CreateInstances.InstancesBeta {
+			for _, d := range vm.Disks {
+				if key, ok := t.diskKeys[d.Source]; ok {
+					d.DiskEncryptionKey = &computeBeta.CustomerEncryptionKey{RawKey: key.RawKey, RsaEncryptedKey: key.RsaEncryptedKey}
+				}
+			}
+		}
+	}
+}
+
+// diskEncryptionKeys returns the KMS keys which disks created by the workflow
+// are encrypted with, sorted.
+func (t *TestWorkflow) diskEncryptionKeys() []string {
+	var keys []string
+	for _, step := range t.wf.Steps {
+		if step.CreateDisks == nil {
+			continue
+		}
+		for _, disk := range *step.CreateDisks {
+			if disk.DiskEncryptionKey != nil && disk.DiskEncryptionKey.KmsKeyName != "" && !slices.Contains(keys, disk.DiskEncryptionKey.KmsKeyName) {
+				keys = append(keys, disk.DiskEncryptionKey.KmsKeyName)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// explainKMSError adds the likely cause to a permission error of a workflow
+// creating disks encrypted with the given KMS keys.
+func explainKMSError(err error, keys []string) error {
+	if len(keys) == 0 {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	if !strings.Contains(msg, "permission") && !strings.Contains(msg, "403") {
+		return err
+	}
+	return fmt.Errorf("%v; disks are encrypted with KMS keys %s, check that the Compute Engine service agent of the project has the roles/cloudkms.cryptoKeyEncrypterDecrypter role on them", err, strings.Join(keys, ", "))
+}
+
+// serialLogsPath returns the GCS path daisy streams the serial port output of
+// the test VMs to, as <vm>-serial-port<N>.log. It is only known once the
+// workflow has been populated, and is empty before.
+func (t *TestWorkflow) serialLogsPath() string {
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range step.CreateInstances.Instances {
+			if logsPath := vm.Metadata["daisy-logs-path"]; logsPath != "" {
+				return logsPath
+			}
+		}
+		for _, vm := range step.CreateInstances.InstancesBeta {
+			if logsPath := vm.Metadata["daisy-logs-path"]; logsPath != "" {
+				return logsPath
+			}
+		}
+	}
+	return ""
+}
+
+// failureLogPaths returns the GCS paths the guest agent and system logs of the
+// VMs which collect them on failure are uploaded to.
+func (t *TestWorkflow) failureLogPaths() []string {
+	var paths []string
+	add := func(metadata map[string]string) {
+		for _, key := range []string{"_test_agent_log_url", "_test_system_log_url"} {
+			if url := metadata[key]; url != "" {
+				paths = append(paths, strings.Replace(url, "${OUTSPATH}", t.GCSPath+"/outs", 1))
+			}
+		}
+	}
+	for _, step := range t.wf.Steps {
+		if step.CreateInstances == nil {
+			continue
+		}
+		for _, vm := range step.CreateInstances.Instances {
+			add(vm.Metadata)
+		}
+		for _, vm := range step.CreateInstances.InstancesBeta {
+			add(vm.Metadata)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
 // gets result struct and converts to a jUnit TestSuite
 func parseResult(res testResult, localPath string) junit.Testsuite {
 	ret := junit.Testsuite{}
 	// Use ImageURL instead of the name or family to display results the same way
 	// as the user entered them.
 	name := fmt.Sprintf("%s-%s", res.testWorkflow.Name, strings.Split(res.testWorkflow.ImageURL, "/")[len(strings.Split(res.testWorkflow.ImageURL, "/"))-1])
+	if res.testWorkflow.matrixMachineType != "" {
+		name = fmt.Sprintf("%s-%s", name, res.testWorkflow.matrixMachineType)
+	}
 
 	switch {
 	case res.skipped:
@@ -880,6 +2580,13 @@ func parseResult(res testResult, localPath string) junit.Testsuite {
 	case res.workflowSuccess:
 		// Workflow completed without error. Only in this case do we try to parse the result.
 		ret = convertToTestSuite(res.results, name)
+		if logPaths := res.testWorkflow.failureLogPaths(); len(logPaths) > 0 {
+			for i := range ret.Testcases {
+				if failure := ret.Testcases[i].Failure; failure != nil {
+					failure.Data += fmt.Sprintf("\nguest logs collected on failure, if any: %s", strings.Join(logPaths, ", "))
+				}
+			}
+		}
 		// Tests handled by a suite but not executed or skipped should be marked disabled
 		for _, test := range getTestsBySuiteName(res.testWorkflow.Name, localPath) {
 			hasResult := false
@@ -895,7 +2602,11 @@ func parseResult(res testResult, localPath string) junit.Testsuite {
 			newTc := junit.Testcase{}
 			newTc.Classname = name
 			newTc.Name = test
-			newTc.Skipped = &junit.Result{Data: fmt.Sprintf("%s disabled on %s", test, res.testWorkflow.ImageURL)}
+			if reason, ok := res.testWorkflow.excludedTests[test]; ok {
+				newTc.Skipped = &junit.Result{Data: fmt.Sprintf("%s excluded on %s: %s", test, res.testWorkflow.ImageURL, reason)}
+			} else {
+				newTc.Skipped = &junit.Result{Data: fmt.Sprintf("%s disabled on %s", test, res.testWorkflow.ImageURL)}
+			}
 			ret.Testcases = append(ret.Testcases, newTc)
 			ret.Tests++
 			ret.Skipped++
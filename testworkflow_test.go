@@ -15,14 +15,23 @@
 package imagetest
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"path"
+	"slices"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-image-tests/utils"
 	daisy "github.com/GoogleCloudPlatform/compute-daisy"
 	daisycompute "github.com/GoogleCloudPlatform/compute-daisy/compute"
+	"github.com/jstemmer/go-junit-report/v2/junit"
+	computeBeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 )
 
@@ -122,6 +131,10 @@ func TestCleanTestWorkflow(t *testing.T) {
 			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/regions/testRegion/backendServices/test-backend-service", "Name": "test-backend-service", "Network": "projects/test-project/global/networks/test-network-`+twf.wf.ID()+`"}]}`)
 		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/backendServices/test-backend-service?alt=json&prettyPrint=false", "test-project") {
 			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/%s/healthChecks?alt=json&pageToken=&prettyPrint=false", "test-project", "test-region") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/regions/test-region/healthChecks/test-health-check", "Name": "test-health-check"}, {"SelfLink": "projects/test-project/regions/test-region/healthChecks/test-hc-`+twf.wf.ID()+`", "Name": "test-hc-`+twf.wf.ID()+`"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/healthChecks/test-hc-"+twf.wf.ID()+"?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
 		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/networks/test-network-"+twf.wf.ID()+"?alt=json&prettyPrint=false", "test-project") {
 			fmt.Fprint(w, `{"Status":"DONE"}`)
 		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/subnetworks/test-subnetwork?alt=json&prettyPrint=false", "test-project") {
@@ -130,6 +143,14 @@ func TestCleanTestWorkflow(t *testing.T) {
 			fmt.Fprint(w, `{"Status":"DONE"}`)
 		} else if r.Method == "POST" && r.URL.String() == fmt.Sprintf("/projects/%s/regions/test-region/operations//wait?alt=json&prettyPrint=false", "test-project") {
 			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/global/images?alt=json&pageToken=&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/global/images/test-image-`+twf.wf.ID()+`", "Name": "test-image-`+twf.wf.ID()+`", "Description": "created by Daisy in workflow \"`+twf.wf.ID()+`\""}, {"SelfLink": "projects/test-project/global/images/other-image", "Name": "other-image"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/images/test-image-"+twf.wf.ID()+"?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/global/snapshots?alt=json&pageToken=&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/global/snapshots/test-snapshot-`+twf.wf.ID()+`", "Name": "test-snapshot-`+twf.wf.ID()+`"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/snapshots/test-snapshot-"+twf.wf.ID()+"?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
 		} else {
 			w.WriteHeader(555)
 			fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
@@ -139,8 +160,8 @@ func TestCleanTestWorkflow(t *testing.T) {
 		t.Fatal(err)
 	}
 	twf.Client = daisyFake
-	expect := []string{"projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network-" + twf.wf.ID(), "projects/test-project/regions/test-region/subnetworks/test-subnetwork", "projects/test-project/zones/test-zone/disks/test-disk-" + twf.wf.ID(), "projects/test-project/zones/test-zone/instances/test-instance-" + twf.wf.ID()}
-	cleaned, errs := cleanTestWorkflow(twf)
+	expect := []string{"projects/test-project/global/images/test-image-" + twf.wf.ID(), "projects/test-project/global/snapshots/test-snapshot-" + twf.wf.ID(), "projects/test-project/regions/test-region/backendServices/test-backend-service", "projects/test-project/regions/test-region/forwardingRules/test-forwarding-rule", "projects/test-project/regions/test-region/healthChecks/test-hc-" + twf.wf.ID(), "projects/test-project/global/firewalls/test-firewall", "projects/test-project/global/networks/test-network-" + twf.wf.ID(), "projects/test-project/regions/test-region/subnetworks/test-subnetwork", "projects/test-project/zones/test-zone/disks/test-disk-" + twf.wf.ID(), "projects/test-project/zones/test-zone/instances/test-instance-" + twf.wf.ID()}
+	cleaned, errs := cleanTestWorkflow(twf, 2, false)
 	for _, err := range errs {
 		t.Errorf("got error from cleanTestWorkflow: %v", err)
 	}
@@ -294,7 +315,7 @@ func TestAppendCreateDisksStep(t *testing.T) {
 	if !ok || step != stepFromWF {
 		t.Error("step was not correctly added to workflow")
 	}
-	step2, err := twf.appendCreateMountDisksStep(&compute.Disk{Name: "diskname2", Type: HyperdiskExtreme, SizeGb: 100})
+	step2, err := twf.appendCreateMountDisksStep("diskname", &compute.Disk{Name: "diskname2", Type: HyperdiskExtreme, SizeGb: 100})
 	if err != nil {
 		t.Fatalf("failed to add wait step to test workflow: %v", err)
 	}
@@ -310,6 +331,358 @@ func TestAppendCreateDisksStep(t *testing.T) {
 	}
 }
 
+func TestAppendCreateSnapshotStep(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	step, snapshot, err := twf.appendCreateSnapshotStep(&compute.Disk{Name: "vm"}, "snap")
+	if err != nil {
+		t.Fatalf("failed to add create snapshot step to test workflow: %v", err)
+	}
+	if step.CreateSnapshots == nil || len(*step.CreateSnapshots) != 1 {
+		t.Fatal("CreateSnapshots step is malformed")
+	}
+	if (*step.CreateSnapshots)[0] != snapshot {
+		t.Error("returned snapshot is not part of CreateSnapshots step")
+	}
+	if snapshot.Name != "snap" || snapshot.SourceDisk != "vm" {
+		t.Errorf("unexpected snapshot, got name %q source disk %q", snapshot.Name, snapshot.SourceDisk)
+	}
+	if stepFromWF, ok := twf.wf.Steps["create-snapshot-snap"]; !ok || step != stepFromWF {
+		t.Error("step was not correctly added to workflow")
+	}
+	if deps := twf.wf.Dependencies["create-snapshot-snap"]; !slices.Contains(deps, "wait-vm") {
+		t.Errorf("create snapshot step has deps %v, want a dependency on wait-vm", deps)
+	}
+	if _, ok := twf.snapshots["snap"]; !ok {
+		t.Error("snapshot was not recorded in workflow")
+	}
+	if _, _, err := twf.appendCreateSnapshotStep(&compute.Disk{Name: "vm"}, "snap"); err == nil {
+		t.Error("expected error creating duplicate snapshot")
+	}
+	if _, _, err := twf.appendCreateSnapshotStep(&compute.Disk{Name: "unattached"}, "snap2"); err == nil {
+		t.Error("expected error creating snapshot of unattached disk")
+	}
+}
+
+func TestAppendCreateSnapshotStepAfterReboot(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	tvm, err := twf.CreateTestVM("vm")
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if err := tvm.Reboot(); err != nil {
+		t.Fatalf("failed to reboot: %v", err)
+	}
+	if _, _, err := twf.appendCreateSnapshotStep(&compute.Disk{Name: "vm"}, "snap"); err != nil {
+		t.Fatalf("failed to add create snapshot step to test workflow: %v", err)
+	}
+	if deps := twf.wf.Dependencies["create-snapshot-snap"]; !slices.Contains(deps, "wait-started-vm-1") {
+		t.Errorf("create snapshot step has deps %v, want a dependency on wait-started-vm-1", deps)
+	}
+}
+
+func TestAppendCreateSnapshotStepAfterStop(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	stopStep, err := twf.addStopStep("vm", "vm")
+	if err != nil {
+		t.Fatalf("failed to add stop step: %v", err)
+	}
+	if err := twf.wf.AddDependency(stopStep, twf.wf.Steps["wait-vm"]); err != nil {
+		t.Fatalf("failed to add dependency: %v", err)
+	}
+	if _, _, err := twf.appendCreateSnapshotStep(&compute.Disk{Name: "vm"}, "snap"); err == nil {
+		t.Error("expected error creating snapshot when last step for vm is not a wait step")
+	}
+	if _, ok := twf.wf.Steps["create-snapshot-snap"]; ok {
+		t.Error("create snapshot step was added to workflow")
+	}
+}
+
+func TestSetProjectMetadata(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "test-project"
+	twf.AddProjectMetadata("ssh-keys", "user:key")
+	twf.AddProjectMetadata("new-key", "value")
+	if !twf.lockProject {
+		t.Error("adding project metadata didn't lock the project")
+	}
+	_, daisyFake, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(555)
+		fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := "other:key"
+	md := &compute.Metadata{Fingerprint: "fp", Items: []*compute.MetadataItems{{Key: "ssh-keys", Value: &old}}}
+	daisyFake.GetProjectFn = func(project string) (*compute.Project, error) {
+		if project != "test-project" {
+			t.Errorf("got project %s, want test-project", project)
+		}
+		return &compute.Project{CommonInstanceMetadata: md}, nil
+	}
+	daisyFake.SetCommonInstanceMetadataFn = func(project string, m *compute.Metadata) error {
+		if m.Fingerprint != md.Fingerprint {
+			t.Errorf("set metadata with fingerprint %q, want %q", m.Fingerprint, md.Fingerprint)
+		}
+		md = m
+		return nil
+	}
+	twf.Client = daisyFake
+	items := func() map[string]string {
+		m := make(map[string]string)
+		for _, item := range md.Items {
+			m[item.Key] = *item.Value
+		}
+		return m
+	}
+
+	restore, err := twf.setProjectMetadata()
+	if err != nil {
+		t.Fatalf("failed to set project metadata: %v", err)
+	}
+	if got, want := items(), map[string]string{"ssh-keys": "other:key\nuser:key", "new-key": "value"}; !maps.Equal(got, want) {
+		t.Errorf("project metadata is %v, want %v", got, want)
+	}
+	// Keys added to the project while the workflow runs are kept.
+	for _, item := range md.Items {
+		if item.Key == "ssh-keys" {
+			added := *item.Value + "\nanother:key"
+			item.Value = &added
+		}
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("failed to restore project metadata: %v", err)
+	}
+	if got, want := items(), map[string]string{"ssh-keys": "other:key\nanother:key"}; !maps.Equal(got, want) {
+		t.Errorf("restored project metadata is %v, want %v", got, want)
+	}
+
+	md = &compute.Metadata{Fingerprint: "fp"}
+	restore, err = twf.setProjectMetadata()
+	if err != nil {
+		t.Fatalf("failed to set project metadata: %v", err)
+	}
+	if got, want := items(), map[string]string{"ssh-keys": "user:key", "new-key": "value"}; !maps.Equal(got, want) {
+		t.Errorf("project metadata without ssh keys is %v, want %v", got, want)
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("failed to restore project metadata: %v", err)
+	}
+	if got := items(); len(got) != 0 {
+		t.Errorf("restored project metadata is %v, want no metadata", got)
+	}
+}
+
+func TestCleanTestWorkflowSnapshots(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "test-project"
+	// The workflow has no snapshot step, the snapshot is taken by a guest
+	// test through the API.
+	var deleted []string
+	_, daisyFake, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.String() == fmt.Sprintf("/projects/%s/global/snapshots?alt=json&pageToken=&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"items":[{"SelfLink": "projects/test-project/global/snapshots/snap-`+twf.wf.ID()+`", "Name": "snap-`+twf.wf.ID()+`", "Description": "Snapshot created by Daisy in workflow \"`+twf.wf.ID()+`\""}, {"SelfLink": "projects/test-project/global/snapshots/other-snapshot", "Name": "other-snapshot"}]}`)
+		} else if r.Method == "DELETE" && r.URL.String() == fmt.Sprintf("/projects/%s/global/snapshots/snap-"+twf.wf.ID()+"?alt=json&prettyPrint=false", "test-project") {
+			deleted = append(deleted, r.URL.Path)
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "POST" && r.URL.String() == fmt.Sprintf("/projects/%s/global/operations//wait?alt=json&prettyPrint=false", "test-project") {
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		} else if r.Method == "GET" {
+			// Every other resource list is empty.
+			fmt.Fprint(w, `{}`)
+		} else {
+			w.WriteHeader(555)
+			fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twf.Client = daisyFake
+	cleaned, errs := cleanTestWorkflow(twf, 2, false)
+	for _, err := range errs {
+		t.Errorf("got error from cleanTestWorkflow: %v", err)
+	}
+	expect := []string{"projects/test-project/global/snapshots/snap-" + twf.wf.ID()}
+	if !slices.Equal(cleaned, expect) {
+		t.Errorf("unexpected cleaned resources, want %v but got %v", expect, cleaned)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("unexpected number of snapshot delete calls, want 1 but got %d", len(deleted))
+	}
+}
+
+func TestCleanTestWorkflowPagination(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "test-project"
+	id := twf.wf.ID()
+	// Every list returns its resources over two pages.
+	pages := map[string][2]string{
+		"/projects/test-project/aggregated/instances": {
+			`{"nextPageToken":"page2","items":{"zones/test-zone":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/vm1-` + id + `", "Zone":"test-zone", "Name": "vm1-` + id + `"}]}}}`,
+			`{"items":{"zones/test-zone":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/vm2-` + id + `", "Zone":"test-zone", "Name": "vm2-` + id + `"}]}}}`,
+		},
+		"/projects/test-project/aggregated/disks": {
+			`{"nextPageToken":"page2","items":{"zones/test-zone":{"disks":[{"SelfLink": "projects/test-project/zones/test-zone/disks/vm1-` + id + `", "Zone":"test-zone", "Name": "vm1-` + id + `"}]}}}`,
+			`{"items":{"zones/test-zone":{"disks":[{"SelfLink": "projects/test-project/zones/test-zone/disks/vm2-` + id + `", "Zone":"test-zone", "Name": "vm2-` + id + `"}]}}}`,
+		},
+		"/projects/test-project/global/networks": {
+			`{"nextPageToken":"page2","items":[{"SelfLink": "projects/test-project/global/networks/net1-` + id + `", "Name": "net1-` + id + `"}]}`,
+			`{"items":[{"SelfLink": "projects/test-project/global/networks/net2-` + id + `", "Name": "net2-` + id + `"}]}`,
+		},
+		"/projects/test-project/global/firewalls": {
+			`{"nextPageToken":"page2","items":[{"SelfLink": "projects/test-project/global/firewalls/fw1", "Name": "fw1", "Network": "projects/test-project/global/networks/net1-` + id + `"}]}`,
+			`{"items":[{"SelfLink": "projects/test-project/global/firewalls/fw2", "Name": "fw2", "Network": "projects/test-project/global/networks/net2-` + id + `"}]}`,
+		},
+	}
+	_, daisyFake, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET":
+			page, ok := pages[r.URL.Path]
+			if !ok {
+				// Every other resource list is empty.
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			switch r.URL.Query().Get("pageToken") {
+			case "":
+				fmt.Fprint(w, page[0])
+			case "page2":
+				fmt.Fprint(w, page[1])
+			default:
+				w.WriteHeader(555)
+				fmt.Fprint(w, "unexpected page token:", r.URL)
+			}
+		case r.Method == "DELETE", r.Method == "POST":
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twf.Client = daisyFake
+	cleaned, errs := cleanTestWorkflow(twf, 0, false)
+	for _, err := range errs {
+		t.Errorf("got error from cleanTestWorkflow: %v", err)
+	}
+	expect := []string{
+		"projects/test-project/global/firewalls/fw1",
+		"projects/test-project/global/firewalls/fw2",
+		"projects/test-project/global/networks/net1-" + id,
+		"projects/test-project/global/networks/net2-" + id,
+		"projects/test-project/zones/test-zone/disks/vm1-" + id,
+		"projects/test-project/zones/test-zone/disks/vm2-" + id,
+		"projects/test-project/zones/test-zone/instances/vm1-" + id,
+		"projects/test-project/zones/test-zone/instances/vm2-" + id,
+	}
+	if !slices.Equal(cleaned, expect) {
+		t.Errorf("unexpected cleaned resources over several list pages, want %v but got %v", expect, cleaned)
+	}
+}
+
+func TestCleanTestWorkflowDryRun(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "test-project"
+	var deleteCalls int
+	_, daisyFake, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/instances?alt=json&pageToken=&prettyPrint=false":
+			fmt.Fprint(w, `{"items":{"zones/test-zone":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/vm-`+twf.wf.ID()+`", "Zone":"test-zone", "Name": "vm-`+twf.wf.ID()+`"}, {"SelfLink": "projects/test-project/zones/test-zone/instances/other-vm", "Zone":"test-zone", "Name": "other-vm"}]}}}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/disks?alt=json&pageToken=&prettyPrint=false":
+			fmt.Fprint(w, `{"items":{"zones/test-zone":{"disks":[{"SelfLink": "projects/test-project/zones/test-zone/disks/vm-`+twf.wf.ID()+`", "Zone":"test-zone", "Name": "vm-`+twf.wf.ID()+`"}]}}}`)
+		case r.Method == "DELETE":
+			deleteCalls++
+			fmt.Fprint(w, `{"Status":"DONE"}`)
+		case r.Method == "GET":
+			// Every other resource list is empty.
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twf.Client = daisyFake
+	cleaned, errs := cleanTestWorkflow(twf, 0, true)
+	for _, err := range errs {
+		t.Errorf("got error from cleanTestWorkflow: %v", err)
+	}
+	expect := []string{"projects/test-project/zones/test-zone/disks/vm-" + twf.wf.ID(), "projects/test-project/zones/test-zone/instances/vm-" + twf.wf.ID()}
+	if !slices.Equal(cleaned, expect) {
+		t.Errorf("unexpected cleaned resources on dry run, want %v but got %v", expect, cleaned)
+	}
+	if deleteCalls != 0 {
+		t.Errorf("dry run made %d delete calls, want none", deleteCalls)
+	}
+}
+
+func TestCleanTestWorkflowLabels(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "test-project"
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	filter := "alt=json&filter=labels.test-run-id%3D" + twf.wf.ID() + "&pageToken=&prettyPrint=false"
+	_, daisyFake, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/instances?"+filter:
+			fmt.Fprint(w, `{"items":{"zones/test-zone":{"instances":[{"SelfLink": "projects/test-project/zones/test-zone/instances/vm-`+twf.wf.ID()+`", "Zone":"test-zone", "Name": "vm-`+twf.wf.ID()+`"}]}}}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/test-project/aggregated/disks?"+filter:
+			fmt.Fprint(w, `{}`)
+		case r.Method == "GET" && strings.Contains(r.URL.Path, "/aggregated/instances"), r.Method == "GET" && strings.Contains(r.URL.Path, "/aggregated/disks"):
+			w.WriteHeader(555)
+			fmt.Fprint(w, "unfiltered list of labeled resources:", r.URL)
+		case r.Method == "GET":
+			// Every other resource list is empty.
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(555)
+			fmt.Fprint(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twf.Client = daisyFake
+	cleaned, errs := cleanTestWorkflow(twf, 0, true)
+	for _, err := range errs {
+		t.Errorf("got error from cleanTestWorkflow: %v", err)
+	}
+	expect := []string{"projects/test-project/zones/test-zone/instances/vm-" + twf.wf.ID()}
+	if !slices.Equal(cleaned, expect) {
+		t.Errorf("unexpected cleaned resources, want %v but got %v", expect, cleaned)
+	}
+}
+
+func TestResourcesLabeled(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if twf.resourcesLabeled() {
+		t.Errorf("resourcesLabeled() = true for a workflow without resources")
+	}
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	if !twf.resourcesLabeled() {
+		t.Errorf("resourcesLabeled() = false for a workflow with labeled resources")
+	}
+	disks := *twf.wf.Steps[createDisksStepName].CreateDisks
+	delete(disks[0].Labels, "test-run-id")
+	if twf.resourcesLabeled() {
+		t.Errorf("resourcesLabeled() = true for a workflow with an unlabeled disk")
+	}
+}
+
 func TestAppendCreateVMStep(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	if twf.wf == nil {
@@ -356,6 +729,72 @@ func TestAppendCreateVMStep(t *testing.T) {
 	}
 }
 
+func TestAppendCreateVMStepAccelerators(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	accels := []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-l4", AcceleratorCount: 1}}
+	_, inst, err := twf.appendCreateVMStep([]*compute.Disk{{Name: "vm"}}, &daisy.Instance{Instance: compute.Instance{MachineType: "g2-standard-4"}}, accels...)
+	if err != nil {
+		t.Fatalf("failed to add create vm step with accelerators: %v", err)
+	}
+	if len(inst.GuestAccelerators) != 1 || inst.GuestAccelerators[0].AcceleratorType != "nvidia-l4" {
+		t.Errorf("instance has accelerators %v, want %v", inst.GuestAccelerators, accels)
+	}
+	if inst.Scheduling == nil || inst.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("instance has scheduling %+v, want OnHostMaintenance TERMINATE", inst.Scheduling)
+	}
+	_, instBeta, err := twf.appendCreateVMStepBeta([]*compute.Disk{{Name: "vmbeta"}}, &daisy.InstanceBeta{Instance: computeBeta.Instance{MachineType: "a2-highgpu-1g"}}, &compute.AcceleratorConfig{AcceleratorType: "nvidia-tesla-a100", AcceleratorCount: 1})
+	if err != nil {
+		t.Fatalf("failed to add beta create vm step with accelerators: %v", err)
+	}
+	if len(instBeta.GuestAccelerators) != 1 || instBeta.Scheduling == nil || instBeta.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("beta instance has accelerators %v and scheduling %+v, want one accelerator and OnHostMaintenance TERMINATE", instBeta.GuestAccelerators, instBeta.Scheduling)
+	}
+}
+
+func TestValidateAccelerators(t *testing.T) {
+	testcases := []struct {
+		name        string
+		machineType string
+		accels      []*compute.AcceleratorConfig
+		wantErr     bool
+	}{
+		{name: "T4 on N1", machineType: "n1-standard-4", accels: []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-tesla-t4", AcceleratorCount: 1}}},
+		{name: "A100 URL on A2", machineType: "zones/us-central1-a/machineTypes/a2-highgpu-1g", accels: []*compute.AcceleratorConfig{{AcceleratorType: "projects/p/zones/us-central1-a/acceleratorTypes/nvidia-tesla-a100", AcceleratorCount: 1}}},
+		{name: "L4 on N1", machineType: "n1-standard-4", accels: []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-l4", AcceleratorCount: 1}}, wantErr: true},
+		{name: "Unknown accelerator", machineType: "n1-standard-4", accels: []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-unknown", AcceleratorCount: 1}}, wantErr: true},
+		{name: "No count", machineType: "n1-standard-4", accels: []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-tesla-t4"}}, wantErr: true},
+		{name: "No machine type", accels: []*compute.AcceleratorConfig{{AcceleratorType: "nvidia-tesla-t4", AcceleratorCount: 1}}, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateAccelerators(tc.machineType, tc.accels); (err != nil) != tc.wantErr {
+				t.Errorf("validateAccelerators(%q, %v) = %v, want error: %v", tc.machineType, tc.accels, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFinalizeWorkflowsAcceleratorURL(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	_, inst, err := twf.appendCreateVMStep([]*compute.Disk{{Name: "vm"}}, &daisy.Instance{Instance: compute.Instance{MachineType: "g2-standard-4"}}, &compute.AcceleratorConfig{AcceleratorType: "nvidia-l4", AcceleratorCount: 1})
+	if err != nil {
+		t.Fatalf("failed to add create vm step with accelerators: %v", err)
+	}
+	_, instBeta, err := twf.appendCreateVMStepBeta([]*compute.Disk{{Name: "vmbeta"}}, &daisy.InstanceBeta{Instance: computeBeta.Instance{MachineType: "a2-highgpu-1g"}}, &compute.AcceleratorConfig{AcceleratorType: "nvidia-tesla-a100", AcceleratorCount: 1})
+	if err != nil {
+		t.Fatalf("failed to add beta create vm step with accelerators: %v", err)
+	}
+	if err := finalizeWorkflows(context.Background(), []*TestWorkflow{twf}, "us-central1-a", "gs://bucket", "/tmp"); err != nil {
+		t.Fatalf("finalizeWorkflows() failed: %v", err)
+	}
+	if got, want := inst.GuestAccelerators[0].AcceleratorType, "zones/us-central1-a/acceleratorTypes/nvidia-l4"; got != want {
+		t.Errorf("instance has accelerator type %q, want %q", got, want)
+	}
+	if got, want := instBeta.GuestAccelerators[0].AcceleratorType, "zones/us-central1-a/acceleratorTypes/nvidia-tesla-a100"; got != want {
+		t.Errorf("beta instance has accelerator type %q, want %q", got, want)
+	}
+}
+
 func TestAppendCreateVMStepBeta(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	if twf.wf == nil {
@@ -538,7 +977,7 @@ func TestNewTestWorkflow(t *testing.T) {
 				t.Fatal(err)
 			}
 			defer srv.Close()
-			twf, err := NewTestWorkflow(client, "", tc.name, tc.image, tc.timeout, tc.project, tc.zone, tc.x86Shape, tc.arm64Shape)
+			twf, err := NewTestWorkflow(client, "", tc.name, tc.image, tc.timeout, tc.project, tc.zone, tc.x86Shape, tc.arm64Shape, "")
 			if err != nil {
 				t.Fatalf("failed to create test workflow: %v", err)
 			}
@@ -570,6 +1009,130 @@ func TestNewTestWorkflow(t *testing.T) {
 	}
 }
 
+func TestNewTestWorkflowMatrix(t *testing.T) {
+	srv, client, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/gcp-guest?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"gcp-guest"}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/gcp-guest/zones/us-central1-a?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"us-central1-a"}`)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/projects/gcp-guest/zones/us-central1-a/machineTypes/"):
+			fmt.Fprintf(w, `{"Name":"%s"}`, path.Base(r.URL.Path))
+		case r.Method == "GET" && r.URL.String() == "/projects/fake-cloud/global/images/fakeos-v1?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"fakeos-v1", "Architecture":"X86_64"}`)
+		default:
+			w.WriteHeader(500)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	tests, err := NewTestWorkflowMatrix(client, "", "suite", "projects/fake-cloud/global/images/fakeos-v1", "30m", "gcp-guest", "us-central1-a", []string{"n2-standard-2", "t2a-standard-1", "c3-standard-4"}, "")
+	if err != nil {
+		t.Fatalf("failed to create test workflows: %v", err)
+	}
+	var got []string
+	for _, twf := range tests {
+		if twf.Name != "suite" {
+			t.Errorf("unexpected workflow name, want suite got %s", twf.Name)
+		}
+		if twf.MachineType.Name != twf.MatrixMachineType() {
+			t.Errorf("workflow for machine type %s has default machine type %s", twf.MatrixMachineType(), twf.MachineType.Name)
+		}
+		if want := "suite-" + twf.MatrixMachineType(); twf.wf.Name != want {
+			t.Errorf("unexpected daisy workflow name, want %s got %s", want, twf.wf.Name)
+		}
+		got = append(got, twf.MatrixMachineType())
+	}
+	if want := []string{"n2-standard-2", "c3-standard-4"}; !slices.Equal(got, want) {
+		t.Errorf("created workflows for machine types %v, want %v", got, want)
+	}
+}
+
+func TestNewMultiImageTestWorkflow(t *testing.T) {
+	srv, client, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/gcp-guest?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"gcp-guest"}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/gcp-guest/zones/us-central1-a?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"us-central1-a"}`)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/projects/gcp-guest/zones/us-central1-a/machineTypes/"):
+			fmt.Fprintf(w, `{"Name":"%s"}`, path.Base(r.URL.Path))
+		case r.Method == "GET" && r.URL.String() == "/projects/fake-cloud/global/images/fakeos-v1?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"fakeos-v1", "Architecture":"X86_64"}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/fake-cloud/global/images/fakeos-arm64-v2?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"fakeos-arm64-v2", "Architecture":"ARM64"}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/fake-cloud/global/images/fakewin-v1?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"fakewin-v1", "GuestOsFeatures":[{"Type":"WINDOWS"}]}`)
+		default:
+			w.WriteHeader(500)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	x86Image := "projects/fake-cloud/global/images/fakeos-v1"
+	armImage := "projects/fake-cloud/global/images/fakeos-arm64-v2"
+	twf, err := NewMultiImageTestWorkflow(client, "", "suite", []string{x86Image, armImage}, "30m", "gcp-guest", "us-central1-a", "n1-standard-1", "t2a-standard-1", "")
+	if err != nil {
+		t.Fatalf("failed to create multi image test workflow: %v", err)
+	}
+	twf.SetParallelVMCreation(true)
+	if twf.ImageURL != x86Image || twf.MachineType.Name != "n1-standard-1" {
+		t.Errorf("workflow has image %s and machine type %s, want %s and n1-standard-1", twf.ImageURL, twf.MachineType.Name, x86Image)
+	}
+	old, err := twf.CreateTestVMFromImage("old", x86Image)
+	if err != nil {
+		t.Fatalf("failed to create vm from %s: %v", x86Image, err)
+	}
+	arm, err := twf.CreateTestVMFromImage("arm", armImage)
+	if err != nil {
+		t.Fatalf("failed to create vm from %s: %v", armImage, err)
+	}
+	if disk := (*twf.wf.Steps["create-disks-arm"].CreateDisks)[0]; disk.SourceImage != armImage {
+		t.Errorf("arm boot disk has source image %s, want %s", disk.SourceImage, armImage)
+	}
+	if disk := (*twf.wf.Steps["create-disks-old"].CreateDisks)[0]; disk.SourceImage != x86Image {
+		t.Errorf("old boot disk has source image %s, want %s", disk.SourceImage, x86Image)
+	}
+	if arm.instance.MachineType != "t2a-standard-1" || arm.instance.StartupScript != "wrapper-arm64" || arm.instance.Metadata["_test_package_url"] != "${SOURCESPATH}/testpackage-arm64" {
+		t.Errorf("arm vm has machine type %s, startup script %s and test package %s, want the t2a-standard-1 machine type and the arm64 binaries", arm.instance.MachineType, arm.instance.StartupScript, arm.instance.Metadata["_test_package_url"])
+	}
+	if old.instance.StartupScript != "wrapper" {
+		t.Errorf("old vm has startup script %s, want wrapper", old.instance.StartupScript)
+	}
+	if deps := twf.wf.Dependencies["wait-arm"]; !slices.Equal(deps, []string{"create-vms-arm"}) {
+		t.Errorf("wait-arm depends on %v, want only create-vms-arm", deps)
+	}
+	if _, err := twf.CreateTestVMFromImage("other", "projects/fake-cloud/global/images/other"); err == nil {
+		t.Errorf("CreateTestVMFromImage succeeded for an image which is not part of the workflow")
+	}
+
+	if _, err := NewMultiImageTestWorkflow(client, "", "suite", []string{x86Image, "projects/fake-cloud/global/images/fakewin-v1"}, "30m", "gcp-guest", "us-central1-a", "n1-standard-1", "t2a-standard-1", ""); err == nil {
+		t.Errorf("NewMultiImageTestWorkflow succeeded with windows and linux images")
+	}
+	if _, err := NewMultiImageTestWorkflow(client, "", "suite", []string{x86Image, x86Image}, "30m", "gcp-guest", "us-central1-a", "n1-standard-1", "t2a-standard-1", ""); err == nil {
+		t.Errorf("NewMultiImageTestWorkflow succeeded with a duplicate image")
+	}
+}
+
+func TestMachineTypeArchitecture(t *testing.T) {
+	for machineType, want := range map[string]string{
+		"n1-standard-1":  "X86_64",
+		"t2a-standard-1": "ARM64",
+		"projects/p/zones/z/machineTypes/c4a-standard-4": "ARM64",
+		"e2-micro": "X86_64",
+	} {
+		if got := machineTypeArchitecture(machineType); got != want {
+			t.Errorf("machineTypeArchitecture(%s) = %s, want %s", machineType, got, want)
+		}
+	}
+}
+
 func TestGetLastStepForVM(t *testing.T) {
 	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
 	if _, err := twf.CreateTestVM("vm"); err != nil {
@@ -631,3 +1194,477 @@ func TestGetLastStepForVMWhenMultipleReboot(t *testing.T) {
 		t.Error("not wait-started-vm-2 step")
 	}
 }
+
+func TestNotifyResults(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	var got junit.Testsuite
+	twf.SetResultsCallback(func(ctx context.Context, suite junit.Testsuite) error {
+		got = suite
+		return nil
+	}, time.Second)
+	want := junit.Testsuite{Name: "name-image", Tests: 2, Failures: 1}
+	if err := twf.notifyResults(context.Background(), want); err != nil {
+		t.Fatalf("notifyResults() failed: %v", err)
+	}
+	if got.Name != want.Name || got.Tests != want.Tests || got.Failures != want.Failures {
+		t.Errorf("callback received %+v, want %+v", got, want)
+	}
+}
+
+func TestNotifyResultsTimeout(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	block := make(chan struct{})
+	defer close(block)
+	twf.SetResultsCallback(func(ctx context.Context, suite junit.Testsuite) error {
+		<-block
+		return nil
+	}, 50*time.Millisecond)
+	start := time.Now()
+	if err := twf.notifyResults(context.Background(), junit.Testsuite{}); err == nil {
+		t.Error("notifyResults() did not return an error for a blocked callback")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("notifyResults() took %s, should have returned after the timeout", elapsed)
+	}
+}
+
+func TestNotifyResultsNoCallback(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if err := twf.notifyResults(context.Background(), junit.Testsuite{}); err != nil {
+		t.Errorf("notifyResults() without a callback failed: %v", err)
+	}
+}
+
+func TestCreatedResources(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.wf.Project = "project"
+	twf.wf.Zone = "us-central1-a"
+	if _, err := twf.CreateTestVM("vm"); err != nil {
+		t.Fatalf("CreateTestVM: %v", err)
+	}
+	network, err := twf.CreateNetwork("net", false)
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	if _, err := network.CreateSubnetwork("subnet", "10.0.0.0/24"); err != nil {
+		t.Fatalf("CreateSubnetwork: %v", err)
+	}
+	// Simulate the names generated by daisy when the workflow is populated.
+	for _, step := range twf.wf.Steps {
+		if step.CreateInstances != nil {
+			for _, i := range step.CreateInstances.Instances {
+				i.RealName = i.Name + "-name-id"
+			}
+		}
+		if step.CreateDisks != nil {
+			for _, d := range *step.CreateDisks {
+				d.RealName = d.Name + "-name-id"
+			}
+		}
+	}
+
+	imageStep, err := twf.wf.NewStep("create-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageStep.CreateImages = &daisy.CreateImages{Images: []*daisy.Image{{Image: compute.Image{Name: "image"}, ImageBase: daisy.ImageBase{Resource: daisy.Resource{RealName: "image-name-id"}}}}}
+
+	want := []string{
+		"projects/project/global/images/image-name-id",
+		"projects/project/global/networks/net",
+		"projects/project/regions/us-central1/subnetworks/subnet",
+		"projects/project/zones/us-central1-a/disks/vm-name-id",
+		"projects/project/zones/us-central1-a/instances/vm-name-id",
+	}
+	got := twf.createdResources()
+	if !slices.Equal(got, want) {
+		t.Errorf("createdResources() = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileCleanup(t *testing.T) {
+	created := []string{
+		"projects/p/zones/z/instances/vm",
+		"projects/p/zones/z/disks/vm",
+		"projects/p/zones/z/disks/leaked",
+	}
+	cleaned := []string{
+		"projects/p/zones/z/instances/vm",
+		"projects/p/zones/z/disks/vm",
+		"projects/p/zones/z/disks/other",
+	}
+	remaining := []string{
+		"projects/p/zones/z/disks/leaked",
+	}
+	leaked, unexpected := reconcileCleanup(created, cleaned, remaining)
+	if want := []string{"projects/p/zones/z/disks/leaked"}; !slices.Equal(leaked, want) {
+		t.Errorf("reconcileCleanup() leaked = %v, want %v", leaked, want)
+	}
+	if want := []string{"projects/p/zones/z/disks/other"}; !slices.Equal(unexpected, want) {
+		t.Errorf("reconcileCleanup() unexpected = %v, want %v", unexpected, want)
+	}
+}
+
+func TestReconcileCleanupClean(t *testing.T) {
+	created := []string{"projects/p/zones/z/instances/vm"}
+	leaked, unexpected := reconcileCleanup(created, created, nil)
+	if len(leaked) != 0 || len(unexpected) != 0 {
+		t.Errorf("reconcileCleanup() = %v, %v, want no discrepancies", leaked, unexpected)
+	}
+}
+
+func TestCustomMachineType(t *testing.T) {
+	testcases := []struct {
+		family  string
+		cpus    int
+		memMB   int
+		want    string
+		wantErr bool
+	}{
+		{family: "", cpus: 4, memMB: 8192, want: "custom-4-8192"},
+		{family: "n1", cpus: 1, memMB: 1024, want: "custom-1-1024"},
+		{family: "n2", cpus: 8, memMB: 16384, want: "n2-custom-8-16384"},
+		{family: "n2", cpus: 1, memMB: 1024, wantErr: true},
+		{family: "n1", cpus: 3, memMB: 6144, wantErr: true},
+		{family: "n1", cpus: 4, memMB: 8000, wantErr: true},
+		{family: "n1", cpus: 4, memMB: 2048, wantErr: true},
+		{family: "e2", cpus: 64, memMB: 65536, wantErr: true},
+		{family: "c2", cpus: 4, memMB: 8192, wantErr: true},
+	}
+	for _, tc := range testcases {
+		got, err := customMachineType(tc.family, tc.cpus, tc.memMB)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("customMachineType(%q, %d, %d) = %q, want error", tc.family, tc.cpus, tc.memMB, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("customMachineType(%q, %d, %d) = %q, %v, want %q", tc.family, tc.cpus, tc.memMB, got, err, tc.want)
+		}
+	}
+}
+
+func TestMaxNetworkInterfaces(t *testing.T) {
+	defaultType := &compute.MachineType{Name: "n1-standard-4", GuestCpus: 4}
+	testcases := []struct {
+		machineType string
+		want        int
+	}{
+		{machineType: "", want: 4},
+		{machineType: "n1-standard-4", want: 4},
+		{machineType: "e2-micro", want: 8},
+		{machineType: "n2-standard-1", want: 2},
+		{machineType: "n2-standard-32", want: 8},
+		{machineType: "zones/us-central1-a/machineTypes/n2-custom-6-8192", want: 6},
+	}
+	for _, tc := range testcases {
+		if got := maxNetworkInterfaces(tc.machineType, defaultType); got != tc.want {
+			t.Errorf("maxNetworkInterfaces(%q) = %d, want %d", tc.machineType, got, tc.want)
+		}
+	}
+}
+
+func TestAppendCreateDisksStepRegionalPd(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	if _, err := twf.appendCreateDisksStep(&compute.Disk{Name: "boot", Type: RegionalPd}); err == nil {
+		t.Error("created regional boot disk")
+	}
+	if _, err := twf.appendCreateMountDisksStep("boot", &compute.Disk{Name: "mount", SizeGb: 10, ReplicaZones: []string{"us-central1-a", "us-central1-b"}}); err == nil {
+		t.Error("created regional mount disk")
+	}
+	if _, ok := twf.wf.Steps[createDisksStepName]; ok {
+		t.Error("create-disks step added for rejected regional disks")
+	}
+}
+
+func TestParseImageURL(t *testing.T) {
+	testcases := []struct {
+		image       string
+		wantProject string
+		wantName    string
+		wantFamily  bool
+		wantErr     bool
+	}{
+		{image: "projects/fake-cloud/global/images/fakeos-v1", wantProject: "fake-cloud", wantName: "fakeos-v1"},
+		{image: "projects/fake-cloud/global/images/family/fakeos", wantProject: "fake-cloud", wantName: "fakeos", wantFamily: true},
+		{image: "https://www.googleapis.com/compute/v1/projects/fake-cloud/global/images/family/fakeos", wantProject: "fake-cloud", wantName: "fakeos", wantFamily: true},
+		{image: "projects/fake-cloud/global/images/myfamily-v1", wantProject: "fake-cloud", wantName: "myfamily-v1"},
+		{image: "projects/fake-cloud/global/images/family/", wantErr: true},
+		{image: "projects/fake-cloud/global/images/family", wantErr: true},
+		{image: "fakeos-v1", wantErr: true},
+	}
+	for _, tc := range testcases {
+		project, name, isFamily, err := parseImageURL(tc.image)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseImageURL(%q) = %q, %q, %v, want error", tc.image, project, name, isFamily)
+			}
+			continue
+		}
+		if err != nil || project != tc.wantProject || name != tc.wantName || isFamily != tc.wantFamily {
+			t.Errorf("parseImageURL(%q) = %q, %q, %v, %v, want %q, %q, %v", tc.image, project, name, isFamily, err, tc.wantProject, tc.wantName, tc.wantFamily)
+		}
+	}
+}
+
+func TestAddWaitStepWithTimeout(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	step, err := twf.addWaitStepWithTimeout("stepname", "vmname", "90m")
+	if err != nil {
+		t.Fatalf("failed to add wait step: %v", err)
+	}
+	if step.Timeout != "90m" {
+		t.Errorf("wait step has timeout %q, want 90m", step.Timeout)
+	}
+	if _, err := twf.addWaitStepWithTimeout("other", "vmname", "90"); err == nil {
+		t.Error("added wait step with an invalid timeout")
+	}
+}
+
+func TestSerialLogsPath(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	step, vm, err := twf.appendCreateVMStep([]*compute.Disk{{Name: "vm"}}, nil)
+	if err != nil {
+		t.Fatalf("failed to append create vm step: %v", err)
+	}
+	if !slices.Equal(vm.SerialPortsToLog, []int64{1, 2, 3, 4}) {
+		t.Errorf("vm logs serial ports %v, want 1-4", vm.SerialPortsToLog)
+	}
+	if logsPath := twf.serialLogsPath(); logsPath != "" {
+		t.Errorf("serialLogsPath() = %q before the workflow is populated, want empty", logsPath)
+	}
+	// Daisy sets the logs path when it populates the instance.
+	step.CreateInstances.Instances[0].Metadata["daisy-logs-path"] = "gs://bucket/daisy/logs"
+	if logsPath := twf.serialLogsPath(); logsPath != "gs://bucket/daisy/logs" {
+		t.Errorf("serialLogsPath() = %q, want gs://bucket/daisy/logs", logsPath)
+	}
+}
+
+func TestSetParallelVMCreation(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.SetParallelVMCreation(true)
+	for _, name := range []string{"vm1", "vm2"} {
+		if _, err := twf.CreateTestVM(name); err != nil {
+			t.Fatalf("failed to create test vm %s: %v", name, err)
+		}
+	}
+	vm3, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm3"}, {Name: "mount", SizeGb: 10}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create test vm3: %v", err)
+	}
+	if _, err := twf.CreateNetwork("network", true); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	for _, name := range []string{createVMsStepName, createDisksStepName} {
+		if _, ok := twf.wf.Steps[name]; ok {
+			t.Errorf("workflow has shared step %s with parallel VM creation", name)
+		}
+	}
+	for _, name := range []string{"vm1", "vm2", "vm3"} {
+		deps := twf.wf.Dependencies["create-vms-"+name]
+		if !slices.Contains(deps, "create-disks-"+name) || !slices.Contains(deps, createNetworkStepName) || len(deps) != 2 {
+			t.Errorf("create-vms-%s depends on %v, want create-disks-%s and %s", name, deps, name, createNetworkStepName)
+		}
+		if deps := twf.wf.Dependencies["wait-"+name]; !slices.Equal(deps, []string{"create-vms-" + name}) {
+			t.Errorf("wait-%s depends on %v, want create-vms-%s", name, deps, name)
+		}
+	}
+	if disks := *twf.wf.Steps["create-disks-vm3"].CreateDisks; len(disks) != 2 || disks[1].Name != "mount" {
+		t.Errorf("create-disks-vm3 creates %d disks, want the boot and mount disks of vm3", len(disks))
+	}
+	if got := twf.getCreateStepNames(createVMsStepName); !slices.Equal(got, []string{"create-vms-vm1", "create-vms-vm2", "create-vms-vm3"}) {
+		t.Errorf("getCreateStepNames(%s) = %v, want the create steps of vm1, vm2 and vm3", createVMsStepName, got)
+	}
+	if step, err := twf.getCreateStepForVM(vm3.name); err != nil || step != twf.wf.Steps["create-vms-vm3"] {
+		t.Errorf("getCreateStepForVM(vm3) = %v, %v, want create-vms-vm3", step, err)
+	}
+
+	twf = NewTestWorkflowForUnitTest("name", "image", "30m")
+	for _, name := range []string{"vm1", "vm2"} {
+		if _, err := twf.CreateTestVM(name); err != nil {
+			t.Fatalf("failed to create test vm %s: %v", name, err)
+		}
+	}
+	if step, ok := twf.wf.Steps[createVMsStepName]; !ok || len(step.CreateInstances.Instances) != 2 {
+		t.Errorf("VMs are not created in the shared %s step by default", createVMsStepName)
+	}
+}
+
+func TestSetResourceLabels(t *testing.T) {
+	twf := NewTestWorkflowForUnitTest("Image_Suite", "image", "30m")
+	twf.SetResourceLabels(map[string]string{"Team": "Guest OS", "cost-center": "123"})
+	vm, err := twf.CreateTestVMMultipleDisks([]*compute.Disk{{Name: "vm", Labels: map[string]string{"test-suite": "custom"}}, {Name: "mount", SizeGb: 10}}, &daisy.Instance{Instance: compute.Instance{Labels: map[string]string{"owner": "me"}}})
+	if err != nil {
+		t.Fatalf("failed to create test vm: %v", err)
+	}
+	want := map[string]string{
+		"test-run-id": twf.wf.ID(),
+		"test-suite":  "image_suite",
+		"team":        "guest-os",
+		"cost-center": "123",
+	}
+	wantInstance := maps.Clone(want)
+	wantInstance["owner"] = "me"
+	instance := twf.wf.Steps[createVMsStepName].CreateInstances.Instances[0]
+	if got := instance.Labels; !maps.Equal(got, wantInstance) {
+		t.Errorf("instance %s has labels %v, want %v", vm.name, got, wantInstance)
+	}
+	disks := *twf.wf.Steps[createDisksStepName].CreateDisks
+	wantBoot := maps.Clone(want)
+	wantBoot["test-suite"] = "custom"
+	if got := disks[0].Labels; !maps.Equal(got, wantBoot) {
+		t.Errorf("boot disk has labels %v, want %v", got, wantBoot)
+	}
+	if got := disks[1].Labels; !maps.Equal(got, want) {
+		t.Errorf("mount disk has labels %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeLabel(t *testing.T) {
+	testcases := []struct {
+		input string
+		want  string
+	}{
+		{input: "abc-123_x", want: "abc-123_x"},
+		{input: "Image_Suite", want: "image_suite"},
+		{input: "a b.c/d", want: "a-b-c-d"},
+		{input: strings.Repeat("a", 70), want: strings.Repeat("a", 63)},
+	}
+	for _, tc := range testcases {
+		if got := normalizeLabel(tc.input); got != tc.want {
+			t.Errorf("normalizeLabel(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestParseSuiteTimeouts(t *testing.T) {
+	testcases := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{input: "", want: map[string]string{}},
+		{input: "networkperf=20m", want: map[string]string{"networkperf": "20m"}},
+		{input: "networkperf=20m,storageperf=2h", want: map[string]string{"networkperf": "20m", "storageperf": "2h"}},
+		{input: "networkperf", wantErr: true},
+		{input: "=20m", wantErr: true},
+		{input: "networkperf=20", wantErr: true},
+		{input: "networkperf=-5m", wantErr: true},
+		{input: "networkperf=20m,networkperf=30m", wantErr: true},
+	}
+	for _, tc := range testcases {
+		got, err := ParseSuiteTimeouts(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseSuiteTimeouts(%q) err = %v, want error: %v", tc.input, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !maps.Equal(got, tc.want) {
+			t.Errorf("ParseSuiteTimeouts(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestExplainKMSError(t *testing.T) {
+	err := errors.New("googleapi: Error 403: Permission denied on resource, forbidden")
+	keys := []string{"projects/p/locations/l/keyRings/r/cryptoKeys/k"}
+	if got := explainKMSError(err, nil); got != err {
+		t.Errorf("explainKMSError changed the error of a workflow without encrypted disks: %v", got)
+	}
+	other := errors.New("instance vm: timed out")
+	if got := explainKMSError(other, keys); got != other {
+		t.Errorf("explainKMSError changed an error which is not a permission error: %v", got)
+	}
+	if got := explainKMSError(err, keys); !strings.Contains(got.Error(), err.Error()) || !strings.Contains(got.Error(), keys[0]) || !strings.Contains(got.Error(), "cryptoKeyEncrypterDecrypter") {
+		t.Errorf("explainKMSError(%v) = %v, want the error with the keys and the role they need", err, got)
+	}
+}
+
+func TestAppendCreateMountDisksStepProvisionedPerformance(t *testing.T) {
+	tests := []struct {
+		name    string
+		disk    *compute.Disk
+		wantErr bool
+	}{
+		{"extreme iops", &compute.Disk{Type: HyperdiskExtreme, ProvisionedIops: 10000}, false},
+		{"balanced iops and throughput", &compute.Disk{Type: HyperdiskBalanced, ProvisionedIops: 3000, ProvisionedThroughput: 140}, false},
+		{"throughput url", &compute.Disk{Type: "zones/us-central1-a/diskTypes/" + HyperdiskThroughput, ProvisionedThroughput: 200}, false},
+		{"pd extreme iops", &compute.Disk{Type: PdExtreme, ProvisionedIops: 10000}, false},
+		{"extreme iops too low", &compute.Disk{Type: HyperdiskExtreme, ProvisionedIops: 100}, true},
+		{"balanced throughput too high", &compute.Disk{Type: HyperdiskBalanced, ProvisionedThroughput: 5000}, true},
+		{"extreme throughput", &compute.Disk{Type: HyperdiskExtreme, ProvisionedThroughput: 200}, true},
+		{"throughput iops", &compute.Disk{Type: HyperdiskThroughput, ProvisionedIops: 3000}, true},
+		{"pd-ssd iops", &compute.Disk{Type: PdSsd, ProvisionedIops: 3000}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+			tc.disk.Name = "mount"
+			tc.disk.SizeGb = 100
+			step, err := twf.appendCreateMountDisksStep("vm", tc.disk)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("appendCreateMountDisksStep(%+v) err = %v, want error: %v", tc.disk, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			d := (*step.CreateDisks)[0]
+			if d.ProvisionedIops != tc.disk.ProvisionedIops || d.ProvisionedThroughput != tc.disk.ProvisionedThroughput {
+				t.Errorf("created disk with provisioned IOPS %d and throughput %d, want %d and %d", d.ProvisionedIops, d.ProvisionedThroughput, tc.disk.ProvisionedIops, tc.disk.ProvisionedThroughput)
+			}
+		})
+	}
+}
+
+func TestInZone(t *testing.T) {
+	_, client, err := daisycompute.NewTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.String() == "/projects/project/zones/us-east1-b?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"us-east1-b"}`)
+		case r.Method == "GET" && r.URL.String() == "/projects/project/zones/us-east1-b/machineTypes/n2-standard-2?alt=json&prettyPrint=false":
+			fmt.Fprint(w, `{"Name":"n2-standard-2"}`)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintln(w, "URL and Method not recognized:", r.Method, r.URL)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twf := NewTestWorkflowForUnitTest("name", "image", "30m")
+	twf.Client = client
+	twf.Project.Name = "project"
+	twf.MachineType.Name = "n2-standard-2"
+	twf.wf.Project = "test-project"
+	twf.wf.Zone = "us-central1-a"
+	twf.SetCleanupDryRun(true)
+	var setupCalls int
+	twf.SetFallbackZones([]string{"us-west1-a", "us-east1-b"}, func(t *TestWorkflow) error {
+		setupCalls++
+		_, err := t.CreateTestVM("vm")
+		return err
+	})
+
+	if _, err := twf.inZone("us-west1-a"); err == nil {
+		t.Errorf("inZone(us-west1-a) succeeded for a zone without the machine type")
+	}
+	n, err := twf.inZone("us-east1-b")
+	if err != nil {
+		t.Fatalf("inZone(us-east1-b) failed: %v", err)
+	}
+	if setupCalls != 1 {
+		t.Errorf("setup was called %d times, want 1", setupCalls)
+	}
+	if n.wf.Zone != "us-east1-b" || n.Zone.Name != "us-east1-b" || n.wf.Project != "test-project" {
+		t.Errorf("new workflow is in zone %s (%s) of project %s, want us-east1-b of test-project", n.wf.Zone, n.Zone.Name, n.wf.Project)
+	}
+	if n.wf.ID() == twf.wf.ID() {
+		t.Errorf("new workflow has the ID of the original workflow")
+	}
+	if !n.cleanupDryRun || n.wf.DefaultTimeout != "30m" {
+		t.Errorf("new workflow did not keep the settings of the original workflow")
+	}
+	if _, ok := n.wf.Steps[createVMsStepName]; !ok {
+		t.Errorf("new workflow was not set up")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// AgentLogCommand returns the command and arguments which print the guest
+// agent log on the given OS, as named by runtime.GOOS. On windows the agent
+// logs to the event log, and on linux to the journal of its systemd units.
+func AgentLogCommand(goos string) []string {
+	if goos == "windows" {
+		return []string{"powershell.exe", "-NonInteractive", "-NoLogo", "-NoProfile", "Get-WinEvent -ProviderName GCEGuestAgent | Format-List TimeCreated,LevelDisplayName,Message"}
+	}
+	return []string{"journalctl", "--no-pager", "-o", "short-precise", "-u", "google-guest-agent", "-u", "google-guest-agent-manager"}
+}
+
+// GetAgentLog returns the guest agent log on the given OS.
+func GetAgentLog(goos string) ([]byte, error) {
+	cmd := AgentLogCommand(goos)
+	out, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return out, fmt.Errorf("%q failed: %v", cmd, err)
+	}
+	return out, nil
+}
+
+// SystemLogCommand returns the command and arguments which print the system
+// log of the current boot on the given OS, as named by runtime.GOOS. On
+// windows this is the most recent entries of the System event log.
+func SystemLogCommand(goos string) []string {
+	if goos == "windows" {
+		return []string{"powershell.exe", "-NonInteractive", "-NoLogo", "-NoProfile", "Get-WinEvent -LogName System -MaxEvents 2000 | Format-List TimeCreated,ProviderName,LevelDisplayName,Message"}
+	}
+	return []string{"journalctl", "--no-pager", "-o", "short-precise", "-b"}
+}
+
+// GetSystemLog returns the system log on the given OS.
+func GetSystemLog(goos string) ([]byte, error) {
+	cmd := SystemLogCommand(goos)
+	out, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return out, fmt.Errorf("%q failed: %v", cmd, err)
+	}
+	return out, nil
+}
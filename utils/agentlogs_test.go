@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAgentLogCommand(t *testing.T) {
+	testcases := []struct {
+		goos     string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{goos: "linux", wantCmd: "journalctl", wantArgs: []string{"-u", "google-guest-agent"}},
+		{goos: "windows", wantCmd: "powershell.exe", wantArgs: []string{"GCEGuestAgent"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.goos, func(t *testing.T) {
+			cmd := AgentLogCommand(tc.goos)
+			if cmd[0] != tc.wantCmd {
+				t.Errorf("AgentLogCommand(%q) runs %q, want %q", tc.goos, cmd[0], tc.wantCmd)
+			}
+			args := strings.Join(cmd[1:], " ")
+			for _, want := range tc.wantArgs {
+				if !strings.Contains(args, want) {
+					t.Errorf("AgentLogCommand(%q) has args %q, want them to contain %q", tc.goos, args, want)
+				}
+			}
+			if tc.goos != "windows" && slices.Contains(cmd, "powershell.exe") {
+				t.Errorf("AgentLogCommand(%q) = %q, uses powershell on linux", tc.goos, cmd)
+			}
+		})
+	}
+}
+
+func TestSystemLogCommand(t *testing.T) {
+	testcases := []struct {
+		goos     string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{goos: "linux", wantCmd: "journalctl", wantArgs: []string{"-b"}},
+		{goos: "windows", wantCmd: "powershell.exe", wantArgs: []string{"-LogName System"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.goos, func(t *testing.T) {
+			cmd := SystemLogCommand(tc.goos)
+			if cmd[0] != tc.wantCmd {
+				t.Errorf("SystemLogCommand(%q) runs %q, want %q", tc.goos, cmd[0], tc.wantCmd)
+			}
+			args := strings.Join(cmd[1:], " ")
+			for _, want := range tc.wantArgs {
+				if !strings.Contains(args, want) {
+					t.Errorf("SystemLogCommand(%q) has args %q, want them to contain %q", tc.goos, args, want)
+				}
+			}
+			if slices.Contains(cmd, "-u") {
+				t.Errorf("SystemLogCommand(%q) = %q, is limited to a unit", tc.goos, cmd)
+			}
+		})
+	}
+}
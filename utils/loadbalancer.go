@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/protobuf/proto"
+)
+
+// InternalLoadBalancer is a minimal internal passthrough TCP load balancer in
+// front of test VMs in the zone of the VM creating it. Daisy can't create
+// backend services or health checks, so it is created from inside a test VM,
+// which needs the cloud-platform scope.
+type InternalLoadBalancer struct {
+	// Name prefixes the names of the load balancer resources, which are
+	// suffixed like the names of the test VMs, so that the cleanup of the test
+	// workflow matches them.
+	Name string
+	// Network and Subnetwork are the URLs of the network and subnetwork of the
+	// backends, which the forwarding rule and backend service are created in.
+	Network    string
+	Subnetwork string
+	// IP is the internal IP address of the forwarding rule.
+	IP string
+	// Port is the TCP port the load balancer forwards, and health checks the
+	// backends on.
+	Port int
+	// Backends are the names of the test VMs to balance, as passed to
+	// CreateTestVM.
+	Backends []string
+}
+
+// lbResourceName returns the name of a load balancer resource, with the
+// suffix of the names of the test VMs.
+func lbResourceName(name string) (string, error) {
+	name, err := GetRealVMName(name)
+	if err != nil {
+		return "", err
+	}
+	name, _, _ = strings.Cut(name, ".")
+	if len(name) > 63 {
+		return "", fmt.Errorf("load balancer resource name %s is longer than 63 characters", name)
+	}
+	return name, nil
+}
+
+// CreateInternalLoadBalancer creates the network endpoint group of the
+// backends, a TCP health check, a regional backend service and a forwarding
+// rule of an internal load balancer. It returns a function which deletes
+// them, which should be called once the load balancer is no longer used. The
+// backend service and forwarding rule are also deleted along with the network
+// when the test workflow is cleaned up, as well as the health check.
+func CreateInternalLoadBalancer(ctx context.Context, lb InternalLoadBalancer) (func(context.Context), error) {
+	project, zone, err := GetProjectZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	region := zone[:strings.LastIndex(zone, "-")]
+	var names [4]string
+	for i, kind := range []string{"neg", "hc", "backend", "fr"} {
+		if names[i], err = lbResourceName(lb.Name + "-" + kind); err != nil {
+			return nil, err
+		}
+	}
+	negName, hcName, backendName, frName := names[0], names[1], names[2], names[3]
+	var endpoints []*computepb.NetworkEndpoint
+	for _, b := range lb.Backends {
+		name, err := GetRealVMName(b)
+		if err != nil {
+			return nil, err
+		}
+		name, _, _ = strings.Cut(name, ".")
+		endpoints = append(endpoints, &computepb.NetworkEndpoint{Instance: proto.String(fmt.Sprintf("projects/%s/zones/%s/instances/%s", project, zone, name))})
+	}
+
+	negClient, err := compute.NewNetworkEndpointGroupsRESTClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	healthCheckClient, err := compute.NewRegionHealthChecksRESTClient(ctx)
+	if err != nil {
+		negClient.Close()
+		return nil, err
+	}
+	backendServiceClient, err := compute.NewRegionBackendServicesRESTClient(ctx)
+	if err != nil {
+		healthCheckClient.Close()
+		negClient.Close()
+		return nil, err
+	}
+	forwardingRuleClient, err := compute.NewForwardingRulesRESTClient(ctx)
+	if err != nil {
+		backendServiceClient.Close()
+		healthCheckClient.Close()
+		negClient.Close()
+		return nil, err
+	}
+	cleanup := func(ctx context.Context) {
+		tryWait := func(op *compute.Operation, err error) {
+			if err == nil {
+				op.Wait(ctx)
+			}
+		}
+		tryWait(forwardingRuleClient.Delete(ctx, &computepb.DeleteForwardingRuleRequest{Project: project, Region: region, ForwardingRule: frName}))
+		tryWait(backendServiceClient.Delete(ctx, &computepb.DeleteRegionBackendServiceRequest{Project: project, Region: region, BackendService: backendName}))
+		tryWait(healthCheckClient.Delete(ctx, &computepb.DeleteRegionHealthCheckRequest{Project: project, Region: region, HealthCheck: hcName}))
+		tryWait(negClient.Delete(ctx, &computepb.DeleteNetworkEndpointGroupRequest{Project: project, Zone: zone, NetworkEndpointGroup: negName}))
+		forwardingRuleClient.Close()
+		backendServiceClient.Close()
+		healthCheckClient.Close()
+		negClient.Close()
+	}
+	wait := func(op *compute.Operation, err error) error {
+		if err != nil {
+			return err
+		}
+		return op.Wait(ctx)
+	}
+	create := func() error {
+		neg := &computepb.NetworkEndpointGroup{
+			Name:                &negName,
+			NetworkEndpointType: proto.String("GCE_VM_IP"),
+			Network:             &lb.Network,
+			Subnetwork:          &lb.Subnetwork,
+		}
+		if err := wait(negClient.Insert(ctx, &computepb.InsertNetworkEndpointGroupRequest{Project: project, Zone: zone, NetworkEndpointGroupResource: neg})); err != nil {
+			return fmt.Errorf("failed to create network endpoint group %s: %v", negName, err)
+		}
+		attach := &computepb.AttachNetworkEndpointsNetworkEndpointGroupRequest{
+			Project:              project,
+			Zone:                 zone,
+			NetworkEndpointGroup: negName,
+			NetworkEndpointGroupsAttachEndpointsRequestResource: &computepb.NetworkEndpointGroupsAttachEndpointsRequest{NetworkEndpoints: endpoints},
+		}
+		if err := wait(negClient.AttachNetworkEndpoints(ctx, attach)); err != nil {
+			return fmt.Errorf("failed to add backends to network endpoint group %s: %v", negName, err)
+		}
+		hc := &computepb.HealthCheck{
+			Name:             &hcName,
+			Type:             proto.String("TCP"),
+			CheckIntervalSec: proto.Int32(1),
+			TimeoutSec:       proto.Int32(1),
+			TcpHealthCheck: &computepb.TCPHealthCheck{
+				PortSpecification: proto.String("USE_FIXED_PORT"),
+				Port:              proto.Int32(int32(lb.Port)),
+			},
+		}
+		if err := wait(healthCheckClient.Insert(ctx, &computepb.InsertRegionHealthCheckRequest{Project: project, Region: region, HealthCheckResource: hc})); err != nil {
+			return fmt.Errorf("failed to create health check %s: %v", hcName, err)
+		}
+		backendService := &computepb.BackendService{
+			Name:                &backendName,
+			LoadBalancingScheme: proto.String("INTERNAL"),
+			Protocol:            proto.String("TCP"),
+			Network:             &lb.Network,
+			HealthChecks:        []string{fmt.Sprintf("projects/%s/regions/%s/healthChecks/%s", project, region, hcName)},
+			Backends: []*computepb.Backend{
+				{Group: proto.String(fmt.Sprintf("projects/%s/zones/%s/networkEndpointGroups/%s", project, zone, negName))},
+			},
+		}
+		if err := wait(backendServiceClient.Insert(ctx, &computepb.InsertRegionBackendServiceRequest{Project: project, Region: region, BackendServiceResource: backendService})); err != nil {
+			return fmt.Errorf("failed to create backend service %s: %v", backendName, err)
+		}
+		forwardingRule := &computepb.ForwardingRule{
+			Name:                &frName,
+			LoadBalancingScheme: proto.String("INTERNAL"),
+			Network:             &lb.Network,
+			Subnetwork:          &lb.Subnetwork,
+			BackendService:      proto.String(fmt.Sprintf("projects/%s/regions/%s/backendServices/%s", project, region, backendName)),
+			IPAddress:           &lb.IP,
+			IPProtocol:          proto.String("TCP"),
+			Ports:               []string{fmt.Sprint(lb.Port)},
+		}
+		if err := wait(forwardingRuleClient.Insert(ctx, &computepb.InsertForwardingRuleRequest{Project: project, Region: region, ForwardingRuleResource: forwardingRule})); err != nil {
+			return fmt.Errorf("failed to create forwarding rule %s: %v", frName, err)
+		}
+		return nil
+	}
+	if err := create(); err != nil {
+		cleanup(context.Background())
+		return nil, err
+	}
+	return cleanup, nil
+}
@@ -16,16 +16,37 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
 )
 
-const (
+var (
 	metadataURLPrefix = "http://metadata.google.internal/computeMetadata/v1/"
+
+	// metadataClient is shared by all metadata requests so that concurrent
+	// callers reuse connections. It has no overall timeout, requests are
+	// bounded by the deadline of their context.
+	metadataClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
 )
 
 var (
@@ -33,6 +54,20 @@ var (
 	ErrMDSEntryNotFound = errors.New("No metadata entry found: 404 error")
 )
 
+// MetadataNotFoundError is returned by GetMetadataJSON when the requested
+// metadata path does not exist. It matches ErrMDSEntryNotFound with errors.Is.
+type MetadataNotFoundError struct {
+	Path string
+}
+
+func (e *MetadataNotFoundError) Error() string {
+	return fmt.Sprintf("metadata entry %q not found", e.Path)
+}
+
+func (e *MetadataNotFoundError) Unwrap() error {
+	return ErrMDSEntryNotFound
+}
+
 // GetMetadata does a HTTP Get request to the metadata server, the metadata entry of
 // interest is provided by elem as the elements of the entry path, the following example
 // does a Get request to the entry "instance/guest-attributes":
@@ -49,6 +84,51 @@ func GetMetadata(ctx context.Context, elem ...string) (string, error) {
 	return body, err
 }
 
+// GetMetadataJSON does a recursive HTTP Get request to the metadata server and
+// returns the whole subtree under the metadata entry given by elem, parsed from
+// JSON. The following example returns all network interfaces with their
+// addresses:
+//
+// resp, err := GetMetadataJSON(context.Background(), "instance", "network-interfaces")
+// ...
+//
+// Directories holding a list, such as network-interfaces, are returned as a
+// map keyed by index. A *MetadataNotFoundError is returned if the entry does
+// not exist.
+func GetMetadataJSON(ctx context.Context, elem ...string) (map[string]any, error) {
+	path, err := url.JoinPath(metadataURLPrefix, elem...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata url: %+v", err)
+	}
+	// A trailing slash makes the metadata server return the directory rather
+	// than redirecting to it.
+	path = strings.TrimSuffix(path, "/") + "/?recursive=true&alt=json"
+
+	body, _, err := doHTTPGet(ctx, path)
+	if errors.Is(err, ErrMDSEntryNotFound) {
+		return nil, &MetadataNotFoundError{Path: strings.Join(elem, "/")}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var v any
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata entry %q: %v", strings.Join(elem, "/"), err)
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		return v, nil
+	case []any:
+		m := make(map[string]any, len(v))
+		for i, item := range v {
+			m[fmt.Sprintf("%d", i)] = item
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("metadata entry %q is not a directory", strings.Join(elem, "/"))
+}
+
 // GetMetadataWithHeaders is similar to GetMetadata it only differs on the return where GetMetadata
 // returns only the response's body as a string and an error GetMetadataWithHeaders returns the
 // response's body as a string, the headers and an error.
@@ -61,6 +141,92 @@ func GetMetadataWithHeaders(ctx context.Context, elem ...string) (string, http.H
 	return doHTTPGet(ctx, path)
 }
 
+// WaitForMetadataChange waits for the metadata entry given by keys to change
+// using the metadata server's wait_for_change long polling, and returns its
+// new value and ETag. The metadata server ends a long poll after a while even
+// if nothing changed, in which case the request is repeated until the entry
+// changes or ctx is done. If lastETag is empty, the current value and ETag are
+// returned without waiting, for use as the lastETag of the next call:
+//
+// value, etag, err := WaitForMetadataChange(ctx, "", "instance", "attributes", "ssh-keys")
+// ...
+// value, etag, err = WaitForMetadataChange(ctx, etag, "instance", "attributes", "ssh-keys")
+// ...
+func WaitForMetadataChange(ctx context.Context, lastETag string, keys ...string) (value, newETag string, err error) {
+	path, err := url.JoinPath(metadataURLPrefix, keys...)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse metadata url: %+v", err)
+	}
+	if lastETag == "" {
+		body, headers, err := doHTTPGet(ctx, path)
+		if err != nil {
+			return "", "", err
+		}
+		return body, headers.Get("ETag"), nil
+	}
+
+	path += "?" + url.Values{"wait_for_change": {"true"}, "last_etag": {lastETag}}.Encode()
+	for {
+		body, headers, err := doHTTPGet(ctx, path)
+		if err != nil {
+			return "", "", err
+		}
+		if etag := headers.Get("ETag"); etag != lastETag {
+			return body, etag, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return "", "", fmt.Errorf("metadata entry %q did not change: %v", strings.Join(keys, "/"), err)
+		}
+	}
+}
+
+// GetInstanceMetadata returns the metadata entry given by keys of another
+// instance, read through the compute API as the metadata server only serves
+// the local instance. The keys are the elements of the entry path under
+// instance/, as for GetMetadata; the following example gets the internal IP
+// of the primary network interface of the instance server:
+//
+// ip, err := GetInstanceMetadata(ctx, client, project, zone, "server", "network-interfaces", "0", "ip")
+// ...
+//
+// Only the entries available from the instance resource are supported:
+// attributes/<key>, id, name and network-interfaces/<n>/ip.
+// A *MetadataNotFoundError is returned if the entry is not set.
+func GetInstanceMetadata(ctx context.Context, client *compute.Service, project, zone, instance string, keys ...string) (string, error) {
+	inst, err := client.Instances.Get(project, zone, instance).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get instance %s: %v", instance, err)
+	}
+	if len(keys) > 0 && keys[0] == "instance" {
+		keys = keys[1:]
+	}
+	key := strings.Join(keys, "/")
+	notFound := &MetadataNotFoundError{Path: path.Join(instance, key)}
+
+	switch {
+	case len(keys) == 2 && keys[0] == "attributes":
+		if inst.Metadata != nil {
+			for _, item := range inst.Metadata.Items {
+				if item.Key == keys[1] && item.Value != nil {
+					return *item.Value, nil
+				}
+			}
+		}
+		return "", notFound
+	case key == "id":
+		return strconv.FormatUint(inst.Id, 10), nil
+	case key == "name":
+		return inst.Name, nil
+	case len(keys) == 3 && keys[0] == "network-interfaces" && keys[2] == "ip":
+		i, err := strconv.Atoi(keys[1])
+		if err != nil || i < 0 || i >= len(inst.NetworkInterfaces) {
+			return "", notFound
+		}
+		return inst.NetworkInterfaces[i].NetworkIP, nil
+	}
+	return "", fmt.Errorf("metadata entry %q of other instances is not supported", key)
+}
+
 // PutMetadata does a HTTP Put request to the metadata server, the metadata entry of
 // interest is provided by path as the section of the path after the metadata server,
 // with the data string as the post data. The following example sets the key
@@ -82,20 +248,51 @@ func PutMetadata(ctx context.Context, path string, data string) error {
 	return nil
 }
 
+// PutGuestAttribute sets the guest attribute key in namespace to value. The
+// metadata server creates the namespace on the first write to it, so callers
+// need not create it first. Guest attributes must be enabled on the instance
+// with the enable-guest-attributes metadata key.
+func PutGuestAttribute(ctx context.Context, namespace, key, value string) error {
+	if err := validateGuestAttribute(namespace, key); err != nil {
+		return err
+	}
+	return PutMetadata(ctx, path.Join("instance", "guest-attributes", namespace, key), value)
+}
+
+// GetGuestAttribute returns the value of the guest attribute key in namespace.
+// ErrMDSEntryNotFound is returned if the namespace or key does not exist.
+func GetGuestAttribute(ctx context.Context, namespace, key string) (string, error) {
+	if err := validateGuestAttribute(namespace, key); err != nil {
+		return "", err
+	}
+	return GetMetadata(ctx, "instance", "guest-attributes", namespace, key)
+}
+
+func validateGuestAttribute(namespace, key string) error {
+	if namespace == "" || strings.Contains(namespace, "/") {
+		return fmt.Errorf("invalid guest attribute namespace %q", namespace)
+	}
+	if key == "" || strings.Contains(key, "/") {
+		return fmt.Errorf("invalid guest attribute key %q", key)
+	}
+	return nil
+}
+
 func doHTTPRequest(req *http.Request) (*http.Response, error) {
 	req.Header.Add("Metadata-Flavor", "Google")
-	client := &http.Client{}
 
-	resp, err := client.Do(req)
+	resp, err := metadataClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to do the http request: %+v", err)
 	}
 
 	if resp.StatusCode == 404 {
+		resp.Body.Close()
 		return nil, ErrMDSEntryNotFound
 	}
 
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("http response code is %v", resp.StatusCode)
 	}
 
@@ -112,6 +309,7 @@ func doHTTPGet(ctx context.Context, path string) (string, http.Header, error) {
 	if err != nil {
 		return "", nil, err
 	}
+	defer resp.Body.Close()
 
 	val, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -127,6 +325,9 @@ func doHTTPPut(ctx context.Context, path string, data string) error {
 		return fmt.Errorf("failed to create a http request with context: %+v", err)
 	}
 
-	_, err = doHTTPRequest(req)
-	return err
+	resp, err := doHTTPRequest(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
 }
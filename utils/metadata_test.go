@@ -0,0 +1,356 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGetMetadataJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("request is missing the Metadata-Flavor header")
+		}
+		if r.URL.Query().Get("recursive") != "true" || r.URL.Query().Get("alt") != "json" {
+			t.Errorf("request query = %q, want recursive=true&alt=json", r.URL.RawQuery)
+		}
+		switch r.URL.Path {
+		case "/instance/":
+			w.Write([]byte(`{"hostname":"vm.c.project.internal","network-interfaces":[{"ip":"10.0.0.2"}]}`))
+		case "/instance/network-interfaces/":
+			w.Write([]byte(`[{"ip":"10.0.0.2"},{"ip":"10.0.1.2"}]`))
+		case "/instance/hostname/":
+			w.Write([]byte(`"vm.c.project.internal"`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx := context.Background()
+
+	instance, err := GetMetadataJSON(ctx, "instance")
+	if err != nil {
+		t.Fatalf("GetMetadataJSON(instance) failed: %v", err)
+	}
+	if instance["hostname"] != "vm.c.project.internal" {
+		t.Errorf("hostname = %v, want vm.c.project.internal", instance["hostname"])
+	}
+	nics, err := GetMetadataJSON(ctx, "instance", "network-interfaces")
+	if err != nil {
+		t.Fatalf("GetMetadataJSON(network-interfaces) failed: %v", err)
+	}
+	if nic, ok := nics["1"].(map[string]any); !ok || nic["ip"] != "10.0.1.2" {
+		t.Errorf("network-interfaces[1] = %v, want ip 10.0.1.2", nics["1"])
+	}
+	if _, err := GetMetadataJSON(ctx, "instance", "hostname"); err == nil {
+		t.Error("GetMetadataJSON(hostname) succeeded for a value which is not a directory")
+	}
+	_, err = GetMetadataJSON(ctx, "instance", "missing")
+	var notFound *MetadataNotFoundError
+	if !errors.As(err, &notFound) || notFound.Path != "instance/missing" {
+		t.Errorf("GetMetadataJSON(missing) = %v, want a MetadataNotFoundError for instance/missing", err)
+	}
+	if !errors.Is(err, ErrMDSEntryNotFound) {
+		t.Errorf("GetMetadataJSON(missing) = %v, want it to match ErrMDSEntryNotFound", err)
+	}
+}
+
+func TestGuestAttributes(t *testing.T) {
+	var mu sync.Mutex
+	attributes := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key, ok := strings.CutPrefix(r.URL.Path, "/instance/guest-attributes/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			attributes[key] = string(body)
+		case http.MethodGet:
+			value, ok := attributes[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(value))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx := context.Background()
+
+	if _, err := GetGuestAttribute(ctx, "newNamespace", "stage"); !errors.Is(err, ErrMDSEntryNotFound) {
+		t.Errorf("GetGuestAttribute() before PutGuestAttribute() = %v, want %v", err, ErrMDSEntryNotFound)
+	}
+	if err := PutGuestAttribute(ctx, "newNamespace", "stage", `{"boot":2}`); err != nil {
+		t.Fatalf("PutGuestAttribute() failed: %v", err)
+	}
+	got, err := GetGuestAttribute(ctx, "newNamespace", "stage")
+	if err != nil || got != `{"boot":2}` {
+		t.Errorf("GetGuestAttribute() = %q, %v, want %q, nil", got, err, `{"boot":2}`)
+	}
+	if err := PutGuestAttribute(ctx, "a/b", "stage", ""); err == nil {
+		t.Error("PutGuestAttribute() succeeded for a namespace containing a slash")
+	}
+	if _, err := GetGuestAttribute(ctx, "newNamespace", ""); err == nil {
+		t.Error("GetGuestAttribute() succeeded for an empty key")
+	}
+}
+
+func TestSignalWorkflow(t *testing.T) {
+	var mu sync.Mutex
+	puts := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		puts[r.URL.Path]++
+	}))
+	defer srv.Close()
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+
+	t.Run("skipped", func(t *testing.T) {
+		SignalWorkflow(t, "skipped")
+		t.Skip("skipped before signalling")
+	})
+	t.Run("signalled", func(t *testing.T) {
+		signal := SignalWorkflow(t, "signalled")
+		for i := 0; i < 2; i++ {
+			if err := signal(); err != nil {
+				t.Errorf("signal() failed: %v", err)
+			}
+		}
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range []string{"skipped", "signalled"} {
+		if got := puts["/instance/guest-attributes/"+GuestAttributeTestNamespace+"/"+key]; got != 1 {
+			t.Errorf("guest attribute %s was set %d times, want once", key, got)
+		}
+	}
+}
+
+func TestGetMetadataConcurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := GetMetadata(ctx, "instance", "id")
+			if err != nil {
+				errs <- err
+			} else if got != "/instance/id" {
+				errs <- errors.New("unexpected response " + got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent GetMetadata() failed: %v", err)
+	}
+}
+
+func TestGetMetadataContextDeadline(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := GetMetadata(ctx, "instance", "id"); err == nil {
+		t.Error("GetMetadata() on a stalled server succeeded, want a deadline error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetMetadata() on a stalled server returned after %v, want it to return at the context deadline", elapsed)
+	}
+}
+
+func TestWaitForMetadataChange(t *testing.T) {
+	var mu sync.Mutex
+	etag, value := "etag-1", "old"
+	changed := make(chan struct{})
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/instance/attributes/key" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("wait_for_change") == "true" {
+			mu.Lock()
+			polls++
+			first := polls == 1
+			mu.Unlock()
+			if r.URL.Query().Get("last_etag") != "etag-1" {
+				t.Errorf("request last_etag = %q, want etag-1", r.URL.Query().Get("last_etag"))
+			}
+			// End the first long poll without a change, as the metadata
+			// server does on its own timeout.
+			if !first {
+				select {
+				case <-changed:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(value))
+	}))
+	defer srv.Close()
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx := context.Background()
+
+	got, gotETag, err := WaitForMetadataChange(ctx, "", "instance", "attributes", "key")
+	if err != nil || got != "old" || gotETag != "etag-1" {
+		t.Fatalf("WaitForMetadataChange() without etag = %q, %q, %v, want old, etag-1, nil", got, gotETag, err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		etag, value = "etag-2", "new"
+		mu.Unlock()
+		close(changed)
+	}()
+	got, gotETag, err = WaitForMetadataChange(ctx, "etag-1", "instance", "attributes", "key")
+	if err != nil || got != "new" || gotETag != "etag-2" {
+		t.Errorf("WaitForMetadataChange(etag-1) = %q, %q, %v, want new, etag-2, nil", got, gotETag, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if polls < 2 {
+		t.Errorf("WaitForMetadataChange(etag-1) made %d long polls, want it to poll again after an unchanged response", polls)
+	}
+}
+
+func TestWaitForMetadataChangeCancel(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+	oldPrefix := metadataURLPrefix
+	metadataURLPrefix = srv.URL + "/"
+	defer func() { metadataURLPrefix = oldPrefix }()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, _, err := WaitForMetadataChange(ctx, "etag-1", "instance", "id"); err == nil {
+		t.Error("WaitForMetadataChange() succeeded after the context was canceled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WaitForMetadataChange() returned %v after the context was canceled, want it to return promptly", elapsed)
+	}
+}
+
+func TestGetInstanceMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/p/zones/z/instances/server" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id":"1234","name":"server","metadata":{"items":[{"key":"role","value":"iperf"}]},"networkInterfaces":[{"networkIP":"10.0.0.2"}]}`))
+	}))
+	defer srv.Close()
+	client, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{keys: []string{"attributes", "role"}, want: "iperf"},
+		{keys: []string{"instance", "attributes", "role"}, want: "iperf"},
+		{keys: []string{"id"}, want: "1234"},
+		{keys: []string{"name"}, want: "server"},
+		{keys: []string{"network-interfaces", "0", "ip"}, want: "10.0.0.2"},
+	}
+	for _, tc := range tests {
+		got, err := GetInstanceMetadata(ctx, client, "p", "z", "server", tc.keys...)
+		if err != nil || got != tc.want {
+			t.Errorf("GetInstanceMetadata(%v) = %q, %v, want %q, nil", tc.keys, got, err, tc.want)
+		}
+	}
+	for _, keys := range [][]string{{"attributes", "missing"}, {"network-interfaces", "1", "ip"}} {
+		if _, err := GetInstanceMetadata(ctx, client, "p", "z", "server", keys...); !errors.Is(err, ErrMDSEntryNotFound) {
+			t.Errorf("GetInstanceMetadata(%v) = %v, want it to match ErrMDSEntryNotFound", keys, err)
+		}
+	}
+	if _, err := GetInstanceMetadata(ctx, client, "p", "z", "server", "scheduling"); err == nil || errors.Is(err, ErrMDSEntryNotFound) {
+		t.Errorf("GetInstanceMetadata(scheduling) = %v, want an unsupported entry error", err)
+	}
+	if _, err := GetInstanceMetadata(ctx, client, "p", "z", "missing", "id"); err == nil {
+		t.Error("GetInstanceMetadata() succeeded for a missing instance")
+	}
+}
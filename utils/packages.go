@@ -0,0 +1,287 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// OutdatedPackage describes an installed package whose version is lower than
+// the expected minimum version.
+type OutdatedPackage struct {
+	Name       string
+	Installed  string
+	MinVersion string
+}
+
+// PackageReport is the result of checking installed packages against a set
+// of expected minimum versions.
+type PackageReport struct {
+	// Missing are the expected packages which are not installed.
+	Missing []string
+	// Outdated are the expected packages installed at a version lower than
+	// the minimum version.
+	Outdated []OutdatedPackage
+}
+
+// OK returns true if no package is missing or outdated.
+func (r PackageReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Outdated) == 0
+}
+
+// String returns a human readable summary of the report.
+func (r PackageReport) String() string {
+	var lines []string
+	for _, name := range r.Missing {
+		lines = append(lines, fmt.Sprintf("%s: not installed", name))
+	}
+	for _, pkg := range r.Outdated {
+		lines = append(lines, fmt.Sprintf("%s: installed version %s is lower than %s", pkg.Name, pkg.Installed, pkg.MinVersion))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ListInstalledPackages returns a map of installed package names to versions,
+// using the package manager available on the image.
+func ListInstalledPackages() (map[string]string, error) {
+	var out []byte
+	var err error
+	switch {
+	case IsWindows():
+		out, err = exec.Command("googet", "installed").Output()
+		if err != nil {
+			return nil, fmt.Errorf("googet installed failed: %v", err)
+		}
+		return parseGooGetInstalled(string(out)), nil
+	case CheckLinuxCmdExists("rpm"):
+		out, err = exec.Command("rpm", "-qa", "--queryformat", "%{NAME} %{VERSION}-%{RELEASE}\n").Output()
+	case CheckLinuxCmdExists("dpkg-query"):
+		out, err = exec.Command("dpkg-query", "-W", "--showformat", "${db:Status-Abbrev} ${Package} ${Version}\n").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list installed packages: %v", err)
+		}
+		return parseDpkgQueryLines(string(out)), nil
+	default:
+		return nil, fmt.Errorf("could not determine how to list installed packages")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list installed packages: %v", err)
+	}
+	return parseNameVersionLines(string(out)), nil
+}
+
+// parseNameVersionLines parses lines of "name version" pairs. When a name is
+// listed more than once, as with multiple installed kernels, the highest
+// version is kept.
+func parseNameVersionLines(out string) map[string]string {
+	pkgs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		addPackageVersion(pkgs, fields[0], fields[1])
+	}
+	return pkgs
+}
+
+// parseDpkgQueryLines parses lines of "status name version" triples, keeping
+// only packages in the installed ("ii") state. Removed packages whose config
+// files remain are listed by dpkg-query with an "rc" status.
+func parseDpkgQueryLines(out string) map[string]string {
+	pkgs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "ii" {
+			continue
+		}
+		addPackageVersion(pkgs, fields[1], fields[2])
+	}
+	return pkgs
+}
+
+func addPackageVersion(pkgs map[string]string, name, version string) {
+	if current, ok := pkgs[name]; ok && CompareVersions(current, version) >= 0 {
+		return
+	}
+	pkgs[name] = version
+}
+
+// parseGooGetInstalled parses the output of `googet installed`, which lists
+// packages as "name.arch version" below a header line.
+func parseGooGetInstalled(out string) map[string]string {
+	pkgs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasSuffix(fields[1], ":") {
+			continue
+		}
+		name := fields[0]
+		if i := strings.LastIndex(name, "."); i > 0 {
+			name = name[:i]
+		}
+		pkgs[name] = fields[1]
+	}
+	return pkgs
+}
+
+// CompareVersions compares two package version strings, returning -1 if a is
+// lower than b, 0 if they are equal and 1 if a is greater than b. Versions are
+// split into numeric and non-numeric segments which are compared in order, and
+// an optional "epoch:" prefix takes precedence over the rest of the version. As
+// with dpkg and rpm, a "~" sorts lower than anything else, including the end
+// of the version, so "1.0~rc1" is lower than "1.0".
+func CompareVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+	segsA := versionSegments(restA)
+	segsB := versionSegments(restB)
+	for i := 0; i < len(segsA) || i < len(segsB); i++ {
+		switch {
+		case i >= len(segsA):
+			// a ended, it is only greater if b continues with a tilde.
+			if segsB[i] == "~" {
+				return 1
+			}
+			return -1
+		case i >= len(segsB):
+			if segsA[i] == "~" {
+				return -1
+			}
+			return 1
+		}
+		if c := compareSegment(segsA[i], segsB[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func splitEpoch(v string) (int, string) {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return 0, v
+	}
+	epoch, err := strconv.Atoi(v[:i])
+	if err != nil {
+		return 0, v
+	}
+	return epoch, v[i+1:]
+}
+
+// versionSegments splits a version into runs of digits, runs of letters and
+// individual tildes, dropping other separators.
+func versionSegments(v string) []string {
+	var segs []string
+	var cur []rune
+	var curIsDigit bool
+	for _, r := range v {
+		if r == '~' {
+			if len(cur) > 0 {
+				segs = append(segs, string(cur))
+				cur = nil
+			}
+			segs = append(segs, "~")
+			continue
+		}
+		isDigit := unicode.IsDigit(r)
+		if !isDigit && !unicode.IsLetter(r) {
+			if len(cur) > 0 {
+				segs = append(segs, string(cur))
+				cur = nil
+			}
+			continue
+		}
+		if len(cur) > 0 && isDigit != curIsDigit {
+			segs = append(segs, string(cur))
+			cur = nil
+		}
+		cur = append(cur, r)
+		curIsDigit = isDigit
+	}
+	if len(cur) > 0 {
+		segs = append(segs, string(cur))
+	}
+	return segs
+}
+
+func compareSegment(a, b string) int {
+	switch {
+	case a == "~" && b == "~":
+		return 0
+	case a == "~":
+		return -1
+	case b == "~":
+		return 1
+	}
+	numA, errA := strconv.ParseUint(a, 10, 64)
+	numB, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if numA < numB {
+			return -1
+		} else if numA > numB {
+			return 1
+		}
+		return 0
+	case errA == nil:
+		// Numeric segments are newer than alphabetic ones.
+		return 1
+	case errB == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// CheckPackageVersions compares the installed packages against a map of
+// package names to minimum versions. An empty minimum version only checks
+// that the package is installed.
+func CheckPackageVersions(installed, minVersions map[string]string) PackageReport {
+	var report PackageReport
+	for name, minVersion := range minVersions {
+		version, ok := installed[name]
+		if !ok {
+			report.Missing = append(report.Missing, name)
+			continue
+		}
+		if minVersion != "" && CompareVersions(version, minVersion) < 0 {
+			report.Outdated = append(report.Outdated, OutdatedPackage{Name: name, Installed: version, MinVersion: minVersion})
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Slice(report.Outdated, func(i, j int) bool { return report.Outdated[i].Name < report.Outdated[j].Name })
+	return report
+}
+
+// CheckInstalledPackageVersions lists the installed packages and checks them
+// against a map of package names to minimum versions.
+func CheckInstalledPackageVersions(minVersions map[string]string) (PackageReport, error) {
+	installed, err := ListInstalledPackages()
+	if err != nil {
+		return PackageReport{}, err
+	}
+	return CheckPackageVersions(installed, minVersions), nil
+}
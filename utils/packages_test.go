@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	testcases := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"20240314.00-g1", "20240213.00-g1", 1},
+		{"1:1.0", "2.0", 1},
+		{"1.0", "1.0.1", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.0.1", "1.0a", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0~rc1", 1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~rc1", "1.0~rc1", 0},
+		{"1.0.1~beta", "1.0", 1},
+	}
+	for _, tc := range testcases {
+		if got := CompareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPackageVersions(t *testing.T) {
+	minVersions := map[string]string{
+		"google-guest-agent":    "20240213.00",
+		"google-osconfig-agent": "20240320.00",
+		"google-compute-engine": "",
+	}
+	testcases := []struct {
+		name      string
+		installed map[string]string
+		want      PackageReport
+	}{
+		{
+			name: "All installed and up to date",
+			installed: map[string]string{
+				"google-guest-agent":    "1:20240314.00-g1",
+				"google-osconfig-agent": "20240320.00-g1",
+				"google-compute-engine": "20240307.00-g1",
+				"bash":                  "5.2.15-2",
+			},
+			want: PackageReport{},
+		},
+		{
+			name: "Missing package",
+			installed: map[string]string{
+				"google-guest-agent":    "20240314.00-g1",
+				"google-osconfig-agent": "20240320.00-g1",
+			},
+			want: PackageReport{Missing: []string{"google-compute-engine"}},
+		},
+		{
+			name: "Outdated package",
+			installed: map[string]string{
+				"google-guest-agent":    "20231004.02-g1",
+				"google-osconfig-agent": "20240320.00-g1",
+				"google-compute-engine": "20240307.00-g1",
+			},
+			want: PackageReport{Outdated: []OutdatedPackage{{Name: "google-guest-agent", Installed: "20231004.02-g1", MinVersion: "20240213.00"}}},
+		},
+		{
+			name:      "Nothing installed",
+			installed: map[string]string{},
+			want:      PackageReport{Missing: []string{"google-compute-engine", "google-guest-agent", "google-osconfig-agent"}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CheckPackageVersions(tc.installed, minVersions)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("CheckPackageVersions(%v) = %+v, want %+v", tc.installed, got, tc.want)
+			}
+			if got.OK() != (len(tc.want.Missing) == 0 && len(tc.want.Outdated) == 0) {
+				t.Errorf("CheckPackageVersions(%v).OK() = %v, unexpected", tc.installed, got.OK())
+			}
+		})
+	}
+}
+
+func TestParseGooGetInstalled(t *testing.T) {
+	out := "Installed packages:\n  googet.x86_64 2.18.3@1\n  google-compute-engine-windows.x86_64 20240109.00@1\n"
+	want := map[string]string{
+		"googet":                        "2.18.3@1",
+		"google-compute-engine-windows": "20240109.00@1",
+	}
+	if got := parseGooGetInstalled(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGooGetInstalled(%q) = %v, want %v", out, got, want)
+	}
+}
+
+func TestParseNameVersionLines(t *testing.T) {
+	testcases := []struct {
+		name string
+		out  string
+		want map[string]string
+	}{
+		{
+			name: "Single versions",
+			out:  "bash 5.1.8-6.el9\ngoogle-guest-agent 20240314.00-g1.el9\n",
+			want: map[string]string{"bash": "5.1.8-6.el9", "google-guest-agent": "20240314.00-g1.el9"},
+		},
+		{
+			name: "Duplicate names keep highest version",
+			out:  "kernel 5.14.0-362.24.1.el9_3\nkernel 5.14.0-427.13.1.el9_4\nkernel 5.14.0-284.11.1.el9_2\n",
+			want: map[string]string{"kernel": "5.14.0-427.13.1.el9_4"},
+		},
+		{
+			name: "Malformed lines",
+			out:  "\nbash\nbash 5.1.8-6.el9 extra\nbash 5.1.8-6.el9\n",
+			want: map[string]string{"bash": "5.1.8-6.el9"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseNameVersionLines(tc.out); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseNameVersionLines(%q) = %v, want %v", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDpkgQueryLines(t *testing.T) {
+	out := "ii bash 5.2.15-2+b2\nrc google-compute-engine 1:20240307.00-g1\nii google-guest-agent 1:20240314.00-g1\nbroken\n"
+	want := map[string]string{
+		"bash":               "5.2.15-2+b2",
+		"google-guest-agent": "1:20240314.00-g1",
+	}
+	if got := parseDpkgQueryLines(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDpkgQueryLines(%q) = %v, want %v", out, got, want)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Retry calls fn until it succeeds, up to the given number of attempts. The
+// delay between attempts starts at baseDelay and doubles after each attempt,
+// with up to half of it randomly subtracted so that VMs polling the same
+// service do not hit it in lockstep. If every attempt fails, or ctx is done
+// before fn succeeds, the last error from fn is returned wrapped with the
+// number of attempts made.
+func Retry(ctx context.Context, attempts int, baseDelay time.Duration, fn func() error) error {
+	if attempts < 1 {
+		return fmt.Errorf("invalid number of attempts %d, want at least 1", attempts)
+	}
+	var err error
+	delay := baseDelay
+	for i := 1; ; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i == attempts {
+			return fmt.Errorf("failed after %d attempts: %w", i, err)
+		}
+		wait := delay
+		if half := int64(delay / 2); half > 0 {
+			wait -= time.Duration(rand.Int63n(half))
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v after %d attempts: %w", ctx.Err(), i, err)
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// RetryUntil calls fn every interval until it succeeds or the timeout has
+// elapsed. If fn never succeeds, or ctx is done first, the last error from fn
+// is returned wrapped with the number of attempts made.
+func RetryUntil(ctx context.Context, timeout, interval time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("failed after %d attempts in %s: %w", i, timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v after %d attempts: %w", ctx.Err(), i, err)
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	errFailed := errors.New("failed")
+	calls := 0
+	err := Retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want nil after 3 calls", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) || !strings.Contains(err.Error(), "3 attempts") || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want %v after 3 attempts", err, calls, errFailed)
+	}
+
+	if err := Retry(context.Background(), 0, time.Millisecond, func() error { return nil }); err == nil {
+		t.Error("Retry() succeeded with 0 attempts")
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	errFailed := errors.New("failed")
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Retry(ctx, 10, time.Hour, func() error {
+		calls++
+		cancel()
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) || !strings.Contains(err.Error(), context.Canceled.Error()) || calls != 1 {
+		t.Errorf("Retry() = %v after %d calls, want a cancellation after 1 call", err, calls)
+	}
+}
+
+func TestRetryUntil(t *testing.T) {
+	errFailed := errors.New("failed")
+	calls := 0
+	err := RetryUntil(context.Background(), time.Second, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("RetryUntil() = %v after %d calls, want nil after 3 calls", err, calls)
+	}
+
+	err = RetryUntil(context.Background(), 20*time.Millisecond, 5*time.Millisecond, func() error { return errFailed })
+	if !errors.Is(err, errFailed) {
+		t.Errorf("RetryUntil() = %v, want %v", err, errFailed)
+	}
+}
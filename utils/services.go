@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// initSystem is the service manager used to restart services.
+type initSystem int
+
+const (
+	initSystemd initSystem = iota
+	initUpstart
+	initSysV
+	initWindows
+)
+
+// detectInitSystem returns the service manager running on this VM.
+func detectInitSystem() initSystem {
+	if IsWindows() {
+		return initWindows
+	}
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		return initSystemd
+	}
+	if CheckLinuxCmdExists("initctl") {
+		return initUpstart
+	}
+	return initSysV
+}
+
+// restartServiceCommand returns the command line restarting the named service
+// with the given service manager.
+func restartServiceCommand(init initSystem, name string) []string {
+	switch init {
+	case initWindows:
+		return []string{"powershell.exe", "-NoLogo", "-NoProfile", "-NonInteractive", "Restart-Service", name}
+	case initUpstart:
+		return []string{"initctl", "restart", name}
+	case initSysV:
+		return []string{"service", name, "restart"}
+	default:
+		return []string{"systemctl", "restart", name}
+	}
+}
+
+// RestartService restarts the named service using the service manager
+// detected at runtime: systemd when /run/systemd/system exists, otherwise
+// initctl or the service command, and Restart-Service on Windows. The error
+// includes the stderr of the command on failure.
+func RestartService(ctx context.Context, name string) error {
+	args := restartServiceCommand(detectInitSystem(), name)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%q failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// RestartAgent restarts the guest agent, which is the GCEAgent service on
+// Windows and google-guest-agent elsewhere.
+func RestartAgent(ctx context.Context) error {
+	if IsWindows() {
+		return RestartService(ctx, "GCEAgent")
+	}
+	return RestartService(ctx, "google-guest-agent")
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRestartServiceCommand(t *testing.T) {
+	tests := []struct {
+		init initSystem
+		want []string
+	}{
+		{init: initSystemd, want: []string{"systemctl", "restart", "google-guest-agent"}},
+		{init: initUpstart, want: []string{"initctl", "restart", "google-guest-agent"}},
+		{init: initSysV, want: []string{"service", "google-guest-agent", "restart"}},
+		{init: initWindows, want: []string{"powershell.exe", "-NoLogo", "-NoProfile", "-NonInteractive", "Restart-Service", "google-guest-agent"}},
+	}
+	for _, tc := range tests {
+		if got := restartServiceCommand(tc.init, "google-guest-agent"); !slices.Equal(got, tc.want) {
+			t.Errorf("restartServiceCommand(%v) = %q, want %q", tc.init, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sshKeyExpiry is the json object the guest agent reads from a key with a
+// google-ssh comment.
+type sshKeyExpiry struct {
+	UserName string `json:"userName"`
+	ExpireOn string `json:"expireOn"`
+}
+
+// SSHKeyWithExpiry formats a public key with the google-ssh comment that the
+// guest agent uses to expire keys, e.g.
+// `ssh-rsa AAAA... google-ssh {"userName":"user","expireOn":"2024-01-02T15:04:05Z"}`.
+// Any comment on the public key is dropped.
+func SSHKeyWithExpiry(publicKey, userName string, expireOn time.Time) (string, error) {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("invalid public key %q", publicKey)
+	}
+	expiry, err := json.Marshal(sshKeyExpiry{UserName: userName, ExpireOn: expireOn.UTC().Format(time.RFC3339)})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal key expiry: %v", err)
+	}
+	return fmt.Sprintf("%s %s google-ssh %s", fields[0], fields[1], expiry), nil
+}
+
+// SSHKeyExpiry returns the expiry time of a public key. It returns false if
+// the key doesn't have a google-ssh expiry comment.
+func SSHKeyExpiry(publicKey string) (time.Time, bool, error) {
+	fields := strings.SplitN(strings.TrimSpace(publicKey), " ", 4)
+	if len(fields) < 3 || fields[2] != "google-ssh" {
+		return time.Time{}, false, nil
+	}
+	if len(fields) != 4 {
+		return time.Time{}, false, fmt.Errorf("google-ssh key is missing its expiry: %q", publicKey)
+	}
+	var expiry sshKeyExpiry
+	if err := json.Unmarshal([]byte(fields[3]), &expiry); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to parse google-ssh key expiry %q: %v", fields[3], err)
+	}
+	expireOn, err := time.Parse(time.RFC3339, expiry.ExpireOn)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to parse expireOn %q: %v", expiry.ExpireOn, err)
+	}
+	return expireOn, true, nil
+}
+
+// CheckSSHKeyExpiry checks the keys for user in the ssh-keys metadata value
+// against the keys in the user's authorized_keys file. Keys which are expired
+// at now must be absent, and all other keys must be present.
+func CheckSSHKeyExpiry(user, metadataKeys string, authorizedKeys []string, now time.Time) error {
+	authorized := make(map[string]bool)
+	for _, key := range authorizedKeys {
+		if fields := strings.Fields(key); len(fields) >= 2 {
+			authorized[fields[1]] = true
+		}
+	}
+	var errs []string
+	for _, line := range strings.Split(metadataKeys, "\n") {
+		keyUser, key, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || keyUser != user {
+			continue
+		}
+		fields := strings.Fields(key)
+		if len(fields) < 2 {
+			continue
+		}
+		expireOn, hasExpiry, err := SSHKeyExpiry(key)
+		if err != nil {
+			return err
+		}
+		expired := hasExpiry && expireOn.Before(now)
+		switch {
+		case expired && authorized[fields[1]]:
+			errs = append(errs, fmt.Sprintf("key expired on %s is in authorized_keys", expireOn.Format(time.RFC3339)))
+		case !expired && !authorized[fields[1]]:
+			errs = append(errs, fmt.Sprintf("unexpired key %s... is not in authorized_keys", fields[1][:min(len(fields[1]), 16)]))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ssh keys of user %s are not handled correctly: %s", user, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ReadAuthorizedKeys returns the keys in the authorized_keys file of a local
+// linux user, skipping comments and empty lines.
+func ReadAuthorizedKeys(user string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join("/home", user, ".ssh", "authorized_keys"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
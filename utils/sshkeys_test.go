@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSHKeyWithExpiry(t *testing.T) {
+	expireOn := time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("PST", -8*60*60))
+	got, err := SSHKeyWithExpiry("ssh-rsa AAAAB3Nza user@host\n", "user", expireOn)
+	if err != nil {
+		t.Fatalf("SSHKeyWithExpiry() failed: %v", err)
+	}
+	want := `ssh-rsa AAAAB3Nza google-ssh {"userName":"user","expireOn":"2024-01-02T23:04:05Z"}`
+	if got != want {
+		t.Errorf("SSHKeyWithExpiry() = %q, want %q", got, want)
+	}
+	gotExpiry, ok, err := SSHKeyExpiry(got)
+	if err != nil || !ok || !gotExpiry.Equal(expireOn) {
+		t.Errorf("SSHKeyExpiry(%q) = %v, %v, %v, want %v, true, nil", got, gotExpiry, ok, err, expireOn)
+	}
+	if _, err := SSHKeyWithExpiry("ssh-rsa", "user", expireOn); err == nil {
+		t.Error("SSHKeyWithExpiry() succeeded for a key without key data")
+	}
+}
+
+func TestCheckSSHKeyExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	metadataKeys := `user:ssh-rsa EXPIRED google-ssh {"userName":"user","expireOn":"2024-05-31T00:00:00Z"}
+user:ssh-rsa VALID google-ssh {"userName":"user","expireOn":"2024-06-02T00:00:00Z"}
+user:ssh-ed25519 NOEXPIRY user@host
+other:ssh-rsa OTHER other@host`
+	testcases := []struct {
+		name           string
+		authorizedKeys []string
+		wantErr        bool
+	}{
+		{
+			name:           "Expired key absent",
+			authorizedKeys: []string{`ssh-rsa VALID google-ssh {"userName":"user","expireOn":"2024-06-02T00:00:00Z"}`, "ssh-ed25519 NOEXPIRY user@host"},
+		},
+		{
+			name:           "Expired key present",
+			authorizedKeys: []string{"ssh-rsa EXPIRED", "ssh-rsa VALID", "ssh-ed25519 NOEXPIRY"},
+			wantErr:        true,
+		},
+		{
+			name:           "Valid key absent",
+			authorizedKeys: []string{"ssh-ed25519 NOEXPIRY"},
+			wantErr:        true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckSSHKeyExpiry("user", metadataKeys, tc.authorizedKeys, now)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("CheckSSHKeyExpiry(%v) = %v, want error: %v", tc.authorizedKeys, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -22,9 +22,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -32,6 +33,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -40,6 +42,7 @@ import (
 	"cloud.google.com/go/storage"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
 const (
@@ -50,6 +53,16 @@ const (
 	GuestAttributeTestKey = "test-complete"
 	// FirstBootGAKey is the key for guest attribute in the daisy "wait for instance" step in the case where it is the first boot, and we still want to wait for results from a subsequent reboot.
 	FirstBootGAKey = "first-boot-key"
+	// HotplugAttachedGAKeyPrefix is the prefix of the guest attribute key a test sets once a disk attached while the VM is running has appeared.
+	HotplugAttachedGAKeyPrefix = "hotplug-attached-"
+	// HotplugDetachedGAKeyPrefix is the prefix of the guest attribute key a test sets once a disk detached while the VM is running has disappeared.
+	HotplugDetachedGAKeyPrefix = "hotplug-detached-"
+	// BootCountGAKey is the key of the guest attribute the test wrapper sets to the number of times the VM booted, on VMs which count their boots.
+	BootCountGAKey = "boot-count"
+	// BootedGAKey is the key of the guest attribute the test wrapper sets when it starts on the first boot, on VMs which measure their boot time.
+	BootedGAKey = "booted"
+	// MetricLogPrefix prefixes the log lines of the metrics reported with ReportMetric, which the test workflow collects into its results summary.
+	MetricLogPrefix = "cit-metric"
 )
 
 var windowsClientImagePatterns = []string{
@@ -88,14 +101,43 @@ func GetRealVMName(name string) (string, error) {
 	return strings.Join([]string{name, parts[1], parts[2]}, "-"), nil
 }
 
-// DownloadGCSObject downloads a GCS object.
-func DownloadGCSObject(ctx context.Context, client *storage.Client, gcsPath string) ([]byte, error) {
+// ParseGCSPath splits a gs://bucket/object path into the bucket and object
+// names.
+func ParseGCSPath(gcsPath string) (string, string, error) {
 	u, err := url.Parse(gcsPath)
 	if err != nil {
-		log.Fatalf("Failed to parse GCS url: %v\n", err)
+		return "", "", fmt.Errorf("failed to parse GCS path %q: %v", gcsPath, err)
 	}
 	object := strings.TrimPrefix(u.Path, "/")
-	rc, err := client.Bucket(u.Host).Object(object).NewReader(ctx)
+	if u.Scheme != "gs" || u.Host == "" || object == "" {
+		return "", "", fmt.Errorf("malformed GCS path %q, want gs://bucket/object", gcsPath)
+	}
+	return u.Host, object, nil
+}
+
+// openGCSObject opens a reader on a GCS object, turning a missing object or
+// missing permissions into an error naming the object.
+func openGCSObject(ctx context.Context, client *storage.Client, gcsPath string) (*storage.Reader, error) {
+	bucket, object, err := ParseGCSPath(gcsPath)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return nil, fmt.Errorf("GCS object %s does not exist", gcsPath)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		return nil, fmt.Errorf("permission denied reading GCS object %s, check the scopes and roles of the VM service account: %v", gcsPath, err)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read GCS object %s: %v", gcsPath, err)
+	}
+	return rc, nil
+}
+
+// DownloadGCSObject downloads a GCS object.
+func DownloadGCSObject(ctx context.Context, client *storage.Client, gcsPath string) ([]byte, error) {
+	rc, err := openGCSObject(ctx, client, gcsPath)
 	if err != nil {
 		return nil, err
 	}
@@ -110,15 +152,36 @@ func DownloadGCSObject(ctx context.Context, client *storage.Client, gcsPath stri
 }
 
 // DownloadGCSObjectToFile downloads a GCS object, writing it to the specified file.
+// The object is streamed to the file, so large fixtures such as ISOs are not
+// held in memory.
 func DownloadGCSObjectToFile(ctx context.Context, client *storage.Client, gcsPath, file string) error {
-	data, err := DownloadGCSObject(ctx, client, gcsPath)
+	rc, err := openGCSObject(ctx, client, gcsPath)
 	if err != nil {
 		return err
 	}
-	if err = ioutil.WriteFile(file, data, 0755); err != nil {
+	defer rc.Close()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
 		return err
 	}
-	return nil
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to download GCS object %s to %s: %v", gcsPath, file, err)
+	}
+	return f.Close()
+}
+
+// DownloadGCSObjectWithDefaultClient downloads a GCS object to the specified
+// file using a storage client authenticated as the VM service account, for
+// suites staging fixtures on images which have no gsutil.
+func DownloadGCSObjectWithDefaultClient(ctx context.Context, gcsPath, file string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+	return DownloadGCSObjectToFile(ctx, client, gcsPath, file)
 }
 
 // ExtractBaseImageName extract the base image name from full image resource.
@@ -255,6 +318,29 @@ func GetInstanceName(ctx context.Context) (string, error) {
 	return name, nil
 }
 
+// ReadSerialOutput returns the output of a serial port of the current instance,
+// read through the compute API. The service account of the instance needs a
+// compute scope to read it.
+func ReadSerialOutput(ctx context.Context, port int) (string, error) {
+	project, zone, err := GetProjectZone(ctx)
+	if err != nil {
+		return "", err
+	}
+	name, err := GetInstanceName(ctx)
+	if err != nil {
+		return "", err
+	}
+	service, err := compute.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create compute service: %v", err)
+	}
+	out, err := service.Instances.GetSerialPortOutput(project, zone, name).Port(int64(port)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get output of serial port %d: %v", port, err)
+	}
+	return out.Contents, nil
+}
+
 // AccessSecret accesses the given secret.
 func AccessSecret(ctx context.Context, client *secretmanager.Client, secretName string) (string, error) {
 	// Get project
@@ -295,6 +381,31 @@ func CreateClient(user, host string, pembytes []byte) (*ssh.Client, error) {
 	return client, nil
 }
 
+// WaitForPort dials the TCP port on host until it accepts a connection, the
+// timeout passes or ctx is done, whichever comes first. Pass the context from
+// Context(t) so the wait also ends before the test deadline. The last dial
+// error is returned if the port never accepted a connection.
+func WaitForPort(ctx context.Context, host string, port int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var d net.Dialer
+	for {
+		dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := d.DialContext(dialCtx, "tcp", addr)
+		dialCancel()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("port %s did not accept connections: %v", addr, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 // GetInterfaceByMAC returns the interface with the specified MAC address.
 func GetInterfaceByMAC(mac string) (net.Interface, error) {
 	hwaddr, err := net.ParseMAC(mac)
@@ -325,6 +436,16 @@ func GetInterface(ctx context.Context, index int) (net.Interface, error) {
 	return GetInterfaceByMAC(mac)
 }
 
+// InterfaceMTU returns the MTU configured in the guest on the interface
+// corresponding to the metadata interface array at the specified index.
+func InterfaceMTU(ctx context.Context, index int) (int, error) {
+	iface, err := GetInterface(ctx, index)
+	if err != nil {
+		return 0, err
+	}
+	return iface.MTU, nil
+}
+
 // CheckLinuxCmdExists checks that a command exists on the linux image, and is executable.
 func CheckLinuxCmdExists(cmd string) bool {
 	cmdPath, err := exec.LookPath(cmd)
@@ -379,6 +500,38 @@ func IsWindows() bool {
 	return false
 }
 
+// IsLinux returns true if the detected runtime environment is Linux.
+func IsLinux() bool {
+	return runtime.GOOS == "linux"
+}
+
+// GetArchitecture returns the architecture of the running guest as used for
+// compute image architectures, either X86_64 or ARM64. It is read from
+// uname -m on Linux and from PROCESSOR_ARCHITECTURE on Windows, rather than
+// runtime.GOARCH, so a binary running under emulation reports the machine.
+func GetArchitecture(ctx context.Context) (string, error) {
+	if IsWindows() {
+		return NormalizeArchitecture(os.Getenv("PROCESSOR_ARCHITECTURE"))
+	}
+	out, err := exec.CommandContext(ctx, "uname", "-m").Output()
+	if err != nil {
+		return "", fmt.Errorf("uname -m failed: %v", err)
+	}
+	return NormalizeArchitecture(string(out))
+}
+
+// NormalizeArchitecture maps the spellings of CPU architectures used by
+// uname, Windows and Go to X86_64 or ARM64.
+func NormalizeArchitecture(arch string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(arch)) {
+	case "x86_64", "amd64", "x64":
+		return "X86_64", nil
+	case "aarch64", "arm64":
+		return "ARM64", nil
+	}
+	return "", fmt.Errorf("unknown architecture %q", arch)
+}
+
 // IsWindowsClient returns true if the image is a client (non-server) Windows image.
 func IsWindowsClient(image string) bool {
 	for _, pattern := range windowsClientImagePatterns {
@@ -539,6 +692,14 @@ func HasFeature(img *compute.Image, feature string) bool {
 	return false
 }
 
+// ReportMetric logs a measurement made by the test, such as a throughput in
+// Gbits/s, so that it is part of the results summary of the test workflow.
+// The name and unit must not contain spaces.
+func ReportMetric(t *testing.T, name string, value float64, unit string) {
+	t.Helper()
+	t.Logf("%s %s %s=%g %s", MetricLogPrefix, t.Name(), name, value, unit)
+}
+
 // Context returns a context to be used by test implementations, it handles
 // the context cancellation based on the test's timeout(deadline), if no timeout
 // is defined (or the deadline can't be assessed) then a plain background context
@@ -560,3 +721,25 @@ func Context(t *testing.T) context.Context {
 	// plain background context as we won't need to cancel it.
 	return context.Background()
 }
+
+// SignalWorkflow returns a function setting the guest attribute key in the test
+// namespace, which TestVM.SetMetadataOnSignal waits for. The workflow waits for
+// the signal until the tests of the VM time out, so if the test ends without
+// calling the function, e.g. because it was skipped or failed first, the
+// attribute is set once the test ends. Only the first call sets the attribute.
+func SignalWorkflow(t *testing.T, key string) func() error {
+	var once sync.Once
+	var err error
+	signal := func() error {
+		once.Do(func() {
+			err = PutGuestAttribute(Context(t), GuestAttributeTestNamespace, key, "true")
+		})
+		return err
+	}
+	t.Cleanup(func() {
+		if err := signal(); err != nil {
+			t.Logf("could not signal the workflow with %s: %v", key, err)
+		}
+	})
+	return signal
+}
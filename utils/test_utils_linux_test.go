@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package utils
+
+import "testing"
+
+func TestIsOS(t *testing.T) {
+	if !IsLinux() {
+		t.Errorf("IsLinux() = false, want true")
+	}
+	if IsWindows() {
+		t.Errorf("IsWindows() = true, want false")
+	}
+}
+
+func TestOSOnly(t *testing.T) {
+	var ranLinux, ranWindows bool
+	t.Run("LinuxOnly", func(t *testing.T) {
+		LinuxOnly(t)
+		ranLinux = true
+	})
+	t.Run("WindowsOnly", func(t *testing.T) {
+		WindowsOnly(t)
+		ranWindows = true
+	})
+	if !ranLinux {
+		t.Errorf("LinuxOnly skipped the test on linux")
+	}
+	if ranWindows {
+		t.Errorf("WindowsOnly did not skip the test on linux")
+	}
+}
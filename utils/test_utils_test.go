@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGCSPath(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantBucket string
+		wantObject string
+		wantErr    bool
+	}{
+		{path: "gs://bucket/object", wantBucket: "bucket", wantObject: "object"},
+		{path: "gs://bucket/dir/fio.exe", wantBucket: "bucket", wantObject: "dir/fio.exe"},
+		{path: "gs://bucket", wantErr: true},
+		{path: "gs://bucket/", wantErr: true},
+		{path: "https://bucket/object", wantErr: true},
+		{path: "bucket/object", wantErr: true},
+		{path: "gs:///object", wantErr: true},
+	}
+	for _, tc := range tests {
+		bucket, object, err := ParseGCSPath(tc.path)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseGCSPath(%q) succeeded, want error", tc.path)
+			}
+			continue
+		}
+		if err != nil || bucket != tc.wantBucket || object != tc.wantObject {
+			t.Errorf("ParseGCSPath(%q) = %q, %q, %v, want %q, %q, nil", tc.path, bucket, object, err, tc.wantBucket, tc.wantObject)
+		}
+	}
+}
+
+func TestNormalizeArchitecture(t *testing.T) {
+	tests := []struct {
+		arch    string
+		want    string
+		wantErr bool
+	}{
+		{arch: "x86_64\n", want: "X86_64"},
+		{arch: "amd64", want: "X86_64"},
+		{arch: "AMD64", want: "X86_64"},
+		{arch: "aarch64\n", want: "ARM64"},
+		{arch: "arm64", want: "ARM64"},
+		{arch: "ARM64", want: "ARM64"},
+		{arch: "armv7l", wantErr: true},
+		{arch: "i686", wantErr: true},
+		{arch: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := NormalizeArchitecture(tc.arch)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("NormalizeArchitecture(%q) = %q, %v, want %q, error %v", tc.arch, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestWaitForPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	if err := WaitForPort(context.Background(), "127.0.0.1", port, time.Second); err != nil {
+		t.Errorf("WaitForPort() on a listening port failed: %v", err)
+	}
+
+	l.Close()
+	err = WaitForPort(context.Background(), "127.0.0.1", port, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("WaitForPort() on a closed port = %v, want the connection refused error", err)
+	}
+}
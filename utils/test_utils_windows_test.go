@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package utils
+
+import "testing"
+
+func TestIsOS(t *testing.T) {
+	if !IsWindows() {
+		t.Errorf("IsWindows() = false, want true")
+	}
+	if IsLinux() {
+		t.Errorf("IsLinux() = true, want false")
+	}
+}
+
+func TestOSOnly(t *testing.T) {
+	var ranWindows, ranLinux bool
+	t.Run("WindowsOnly", func(t *testing.T) {
+		WindowsOnly(t)
+		ranWindows = true
+	})
+	t.Run("LinuxOnly", func(t *testing.T) {
+		LinuxOnly(t)
+		ranLinux = true
+	})
+	if !ranWindows {
+		t.Errorf("WindowsOnly skipped the test on windows")
+	}
+	if ranLinux {
+		t.Errorf("LinuxOnly did not skip the test on windows")
+	}
+}